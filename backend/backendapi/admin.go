@@ -0,0 +1,32 @@
+// admin API, used to manage the backend rather than by devices
+
+package backendapi
+
+import (
+	"crypto/subtle"
+	"log"
+	"net/http"
+	"strings"
+)
+
+func requireAdmin(next http.Handler) http.Handler {
+	// only let requests through if they carry the admin token from the credentials file as a bearer token
+	// the admin API is disabled when no token is configured
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		adminToken, _ := pCreds["admin_token"].(string)
+		if adminToken == "" {
+			http.Error(w, `{"error": "admin API disabled, no admin_token configured"}`, http.StatusForbidden)
+			return
+		}
+
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+			log.Printf("Rejected admin request from %s\n", r.RemoteAddr)
+			http.Error(w, `{"error": "unauthorized"}`, http.StatusUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
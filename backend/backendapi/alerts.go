@@ -0,0 +1,539 @@
+// alert rules, evaluated every alert_eval_interval over the status of devices or over metrics
+// a status rule gives one alert per device in the given status, e.g. offline, or flapping
+// a query rule gives one alert per sample the PromQL query returns, e.g. load1 > 4
+// an alert is pending while its condition holds for less than the "for" duration of its rule, then firing,
+// and resolved once the condition stops holding; pending alerts whose condition stops holding are dropped
+// rules come from alert_rules in the credentials file, which cannot be changed through the API, or from the admin API
+// alert states are kept in the database so a restart does not fire every alert again
+// alerts about a device in a maintenance window keep the state they had when it started until it ends
+
+package backendapi
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	AlertPending  = "pending"
+	AlertFiring   = "firing"
+	AlertResolved = "resolved"
+)
+
+// AlertRule is a condition over device status or metrics, which raises alerts while it holds
+type AlertRule struct {
+	Name     string            `json:"name"`
+	Status   string            `json:"status,omitempty"`  // online, late, offline or flapping, for a status rule
+	Tag      string            `json:"tag,omitempty"`     // only devices with this tag, for a status rule
+	Query    string            `json:"query,omitempty"`   // PromQL, for a query rule
+	For      string            `json:"for,omitempty"`     // how long the condition must hold before alerts fire, e.g. "5m"
+	Severity string            `json:"severity"`          // e.g. warning or critical, warning by default
+	Labels   map[string]string `json:"labels,omitempty"`  // added to the labels of every alert of the rule
+	Summary  string            `json:"summary,omitempty"` // human readable description of the problem
+	Source   string            `json:"source"`            // config or api
+}
+
+// Alert is the state of one alert of a rule, e.g. for one device
+type Alert struct {
+	Rule        string            `json:"rule"`
+	Labels      map[string]string `json:"labels"` // alertname, severity, the labels of the rule and device or the labels of the sample
+	Summary     string            `json:"summary,omitempty"`
+	State       string            `json:"state"` // pending, firing or resolved
+	Value       float64           `json:"value"` // value of the sample, for query rules
+	ActiveSince time.Time         `json:"active_since"`
+	FiredAt     time.Time         `json:"fired_at"`
+	ResolvedAt  time.Time         `json:"resolved_at"`
+}
+
+// alertKey identifies an alert, by rule and labels
+type alertKey struct {
+	rule   string
+	labels string
+}
+
+// activeAlert is an alert whose condition holds at evaluation time
+type activeAlert struct {
+	labels map[string]string
+	value  float64
+	since  time.Time
+}
+
+var alertRules = make(map[string]AlertRule) // rules by name
+var alerts = make(map[alertKey]*Alert)      // pending, firing and recently resolved alerts
+var alertsMutex sync.Mutex                  // protects alertRules and alerts
+var alertEvalInterval = 15 * time.Second    // how often rules are evaluated
+var resolvedAlertRetention = time.Hour      // how long resolved alerts are still listed
+var alertListeners []func(Alert)            // told when alerts fire and resolve, e.g. to send notifications
+var alertStatuses = []string{StatusOnline, StatusLate, StatusOffline, "flapping"}
+
+func validateAlertRule(rule AlertRule) error {
+	// a rule needs a name and exactly one condition
+	if rule.Name == "" {
+		return fmt.Errorf("every rule needs a name")
+	}
+	if (rule.Status == "") == (rule.Query == "") {
+		return fmt.Errorf("rule %s needs either a status or a query", rule.Name)
+	}
+	if rule.Status != "" && !containsString(alertStatuses, rule.Status) {
+		return fmt.Errorf("rule %s has an unknown status %s", rule.Name, rule.Status)
+	}
+	if rule.Query != "" {
+		if _, err := parsePromQL(rule.Query); err != nil {
+			return fmt.Errorf("rule %s has a bad query, %v", rule.Name, err)
+		}
+	}
+	if rule.For != "" {
+		d, err := time.ParseDuration(rule.For)
+		if err != nil || d < 0 {
+			return fmt.Errorf("rule %s needs a positive for duration", rule.Name)
+		}
+	}
+	return nil
+}
+
+func (rule AlertRule) forDuration() time.Duration {
+	d, _ := time.ParseDuration(rule.For)
+	return d
+}
+
+func loadAlerting(creds map[string]interface{}, dbObj *sql.DB) error {
+	// rules from the credentials file, then rules and alert states from the database
+	if value, ok := creds["alert_eval_interval"].(string); ok {
+		if interval, err := time.ParseDuration(value); err == nil && interval > 0 {
+			alertEvalInterval = interval
+		}
+	}
+
+	if configRules, ok := creds["alert_rules"]; ok {
+		jsonData, err := json.Marshal(configRules)
+		if err != nil {
+			return err
+		}
+		var rules []AlertRule
+		err = json.Unmarshal(jsonData, &rules)
+		if err != nil {
+			return fmt.Errorf("alert_rules must be a list of rules, %v", err)
+		}
+		for _, rule := range rules {
+			rule = normalizeAlertRule(rule, "config")
+			if err = validateAlertRule(rule); err != nil {
+				return err
+			}
+			alertRules[rule.Name] = rule
+		}
+	}
+
+	err := loadAlertRules(dbObj)
+	if err != nil {
+		return err
+	}
+	return loadAlertStates(dbObj)
+}
+
+func runAlertEvaluator() {
+	// evaluate every rule periodically
+	ticker := time.NewTicker(alertEvalInterval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		evaluateAlerts(now)
+	}
+}
+
+func evaluateAlerts(now time.Time) {
+	// update the state of the alerts of every rule, store the changes and tell listeners about alerts firing and resolving
+	alertsMutex.Lock()
+	rules := make(map[string]AlertRule, len(alertRules))
+	for name, rule := range alertRules {
+		rules[name] = rule
+	}
+	alertsMutex.Unlock()
+
+	// conditions are evaluated without holding the lock, queries can take a while
+	// rules that fail to evaluate leave their alerts as they are
+	active := make(map[string]map[string]activeAlert)
+	knownDevices := make(map[string]bool)
+	deviceListMutex.Lock()
+	for _, dev := range deviceList {
+		knownDevices[dev.Name] = true
+	}
+	deviceListMutex.Unlock()
+	maintained := devicesInMaintenance(now)
+	for name, rule := range rules {
+		instances, err := activeAlerts(rule, now)
+		if err != nil {
+			log.Printf("Failed to evaluate alert rule %s, %v\n", name, err)
+			continue
+		}
+		active[name] = instances
+	}
+
+	var changed []*Alert
+	var removed []alertKey
+	var notifications []Alert
+	alertsMutex.Lock()
+	for name, instances := range active {
+		rule := rules[name]
+		for labels, instance := range instances {
+			if maintained[instance.labels["device"]] {
+				continue
+			}
+			key := alertKey{name, labels}
+			alert, ok := alerts[key]
+			created := !ok || alert.State == AlertResolved
+			if created {
+				alert = &Alert{Rule: name, Labels: instance.labels, Summary: rule.Summary, State: AlertPending, ActiveSince: instance.since}
+				alerts[key] = alert
+				changed = append(changed, alert)
+			}
+			alert.Value = instance.value
+			if alert.State == AlertPending && now.Sub(alert.ActiveSince) >= rule.forDuration() {
+				alert.State = AlertFiring
+				alert.FiredAt = now
+				if !created {
+					changed = append(changed, alert)
+				}
+				notifications = append(notifications, *alert)
+			}
+		}
+	}
+
+	for key, alert := range alerts {
+		instances, evaluated := active[key.rule]
+		_, ruleExists := rules[key.rule]
+		if (!evaluated && ruleExists) || instances[key.labels].labels != nil {
+			continue
+		}
+		// devices the backend does not know yet, e.g. after a restart, keep their alerts until they register
+		if device, ok := alert.Labels["device"]; ok && rules[key.rule].Status != "" && !knownDevices[device] {
+			continue
+		}
+		if maintained[alert.Labels["device"]] {
+			continue
+		}
+
+		switch alert.State {
+		case AlertPending:
+			delete(alerts, key)
+			removed = append(removed, key)
+		case AlertFiring:
+			alert.State = AlertResolved
+			alert.ResolvedAt = now
+			changed = append(changed, alert)
+			notifications = append(notifications, *alert)
+		case AlertResolved:
+			if now.Sub(alert.ResolvedAt) > resolvedAlertRetention {
+				delete(alerts, key)
+				removed = append(removed, key)
+			}
+		}
+	}
+
+	var saved []Alert
+	for _, alert := range changed {
+		saved = append(saved, *alert)
+	}
+	alertsMutex.Unlock()
+
+	// store and notify without holding the lock
+	if dbObj != nil {
+		for _, alert := range saved {
+			if err := saveAlertState(alert, dbObj); err != nil {
+				log.Println(err)
+			}
+		}
+		for _, key := range removed {
+			if err := deleteAlertState(key, dbObj); err != nil {
+				log.Println(err)
+			}
+		}
+	}
+	for _, alert := range notifications {
+		log.Printf("Alert %s %s %v\n", alert.Rule, alert.State, alert.Labels)
+		for _, listener := range alertListeners {
+			listener(alert)
+		}
+	}
+}
+
+func activeAlerts(rule AlertRule, now time.Time) (map[string]activeAlert, error) {
+	// alerts whose condition holds now, keyed by their encoded labels
+	instances := make(map[string]activeAlert)
+	add := func(labels map[string]string, value float64, since time.Time) {
+		labels = alertLabels(rule, labels)
+		instances[encodeLabels(labels)] = activeAlert{labels: labels, value: value, since: since}
+	}
+
+	if rule.Status != "" {
+		deviceListMutex.Lock()
+		defer deviceListMutex.Unlock()
+		for _, dev := range deviceList {
+			if rule.Tag != "" && !dev.HasTag(rule.Tag) {
+				continue
+			}
+			if rule.Status == "flapping" && dev.Flapping {
+				add(map[string]string{"device": dev.Name}, dev.FlapScore, now)
+			} else if dev.Status == rule.Status {
+				add(map[string]string{"device": dev.Name}, 0, dev.StatusSince)
+			}
+		}
+		return instances, nil
+	}
+
+	if metricsStore == nil {
+		return nil, fmt.Errorf("metrics are not stored")
+	}
+	value, err := evalPromInstant(metricsStore, rule.Query, now, now)
+	if err != nil {
+		return nil, err
+	}
+	switch value := value.(type) {
+	case float64:
+		// a number makes a single alert, unless it is 0, e.g. count(load1 > 4) > 0 holds as long as it returns something
+		if value != 0 {
+			add(map[string]string{}, value, now)
+		}
+	case []promSample:
+		for _, sample := range value {
+			add(withoutLabels(sample.Labels, "__name__"), sample.Value, now)
+		}
+	default:
+		return nil, fmt.Errorf("query must return a number or an instant vector")
+	}
+	return instances, nil
+}
+
+func alertLabels(rule AlertRule, labels map[string]string) map[string]string {
+	// labels of an alert: those of the condition, then those of the rule, alertname and severity
+	output := make(map[string]string)
+	for key, value := range labels {
+		output[key] = value
+	}
+	for key, value := range rule.Labels {
+		output[key] = value
+	}
+	output["alertname"] = rule.Name
+	output["severity"] = rule.Severity
+	return output
+}
+
+func normalizeAlertRule(rule AlertRule, source string) AlertRule {
+	// fill the defaults of a rule
+	if rule.Severity == "" {
+		rule.Severity = "warning"
+	}
+	rule.Source = source
+	return rule
+}
+
+func listAlerts(states ...string) []Alert {
+	// copy of the alerts in the given states, or in any state, oldest first
+	alertsMutex.Lock()
+	defer alertsMutex.Unlock()
+	output := []Alert{}
+	for _, alert := range alerts {
+		if len(states) == 0 || containsString(states, alert.State) {
+			output = append(output, *alert)
+		}
+	}
+	sort.Slice(output, func(i, j int) bool {
+		if !output[i].ActiveSince.Equal(output[j].ActiveSince) {
+			return output[i].ActiveSince.Before(output[j].ActiveSince)
+		}
+		return encodeLabels(output[i].Labels) < encodeLabels(output[j].Labels)
+	})
+	return output
+}
+
+////////////
+// respond to HTTP calls from client
+func getAlerts(w http.ResponseWriter, r *http.Request) {
+	// list alerts, state=pending, firing or resolved can be given several times to filter them
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(listAlerts(r.URL.Query()["state"]...))
+}
+
+/////////////
+// admin API
+func getAlertRules(w http.ResponseWriter, r *http.Request) {
+	// list every rule, by name
+	w.Header().Set("Content-Type", "application/json")
+	alertsMutex.Lock()
+	rules := []AlertRule{}
+	for _, rule := range alertRules {
+		rules = append(rules, rule)
+	}
+	alertsMutex.Unlock()
+	sort.Slice(rules, func(i, j int) bool { return rules[i].Name < rules[j].Name })
+	json.NewEncoder(w).Encode(rules)
+}
+
+func putAlertRule(w http.ResponseWriter, r *http.Request) {
+	// add or replace a rule, rules from the credentials file cannot be changed
+	w.Header().Set("Content-Type", "application/json")
+	name := mux.Vars(r)["name"]
+
+	var rule AlertRule
+	err := json.NewDecoder(r.Body).Decode(&rule)
+	if err == nil {
+		rule.Name = name
+		rule = normalizeAlertRule(rule, "api")
+		err = validateAlertRule(rule)
+	}
+	if err != nil {
+		jsonData, _ := json.Marshal(map[string]string{"error": err.Error()})
+		http.Error(w, string(jsonData), http.StatusBadRequest)
+		return
+	}
+
+	alertsMutex.Lock()
+	existing, ok := alertRules[name]
+	alertsMutex.Unlock()
+	if ok && existing.Source == "config" {
+		http.Error(w, `{"error": "rule is set in the credentials file"}`, http.StatusConflict)
+		return
+	}
+
+	err = saveAlertRule(rule, dbObj)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, `{"error": "failed to store rule"}`, http.StatusInternalServerError)
+		return
+	}
+	alertsMutex.Lock()
+	alertRules[name] = rule
+	alertsMutex.Unlock()
+	log.Printf("Alert rule %s updated\n", name)
+	json.NewEncoder(w).Encode(rule)
+}
+
+func deleteAlertRule(w http.ResponseWriter, r *http.Request) {
+	// remove a rule, its firing alerts resolve at the next evaluation
+	name := mux.Vars(r)["name"]
+	alertsMutex.Lock()
+	existing, ok := alertRules[name]
+	alertsMutex.Unlock()
+	if !ok {
+		http.Error(w, `{"error": "rule not found"}`, http.StatusNotFound)
+		return
+	} else if existing.Source == "config" {
+		http.Error(w, `{"error": "rule is set in the credentials file"}`, http.StatusConflict)
+		return
+	}
+
+	err := deleteAlertRuleFromDB(name, dbObj)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, `{"error": "failed to delete rule"}`, http.StatusInternalServerError)
+		return
+	}
+	alertsMutex.Lock()
+	delete(alertRules, name)
+	alertsMutex.Unlock()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+/////////////
+// database
+func loadAlertRules(dbObj *sql.DB) error {
+	// load the rules set through the API
+	rows, err := dbObj.Query(`SELECT name, rule FROM alert_rules`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name string
+		var jsonData []byte
+		err = rows.Scan(&name, &jsonData)
+		if err != nil {
+			return err
+		}
+
+		var rule AlertRule
+		err = json.Unmarshal(jsonData, &rule)
+		if err == nil {
+			err = validateAlertRule(rule)
+		}
+		if err != nil {
+			log.Printf("Ignoring invalid alert rule %s, %v\n", name, err)
+			continue
+		}
+		if existing, ok := alertRules[name]; ok && existing.Source == "config" {
+			log.Printf("Ignoring alert rule %s from the database, it is set in the credentials file\n", name)
+			continue
+		}
+		alertRules[name] = rule
+	}
+
+	return rows.Err()
+}
+
+func saveAlertRule(rule AlertRule, dbObj *sql.DB) error {
+	jsonData, err := json.Marshal(rule)
+	if err != nil {
+		return err
+	}
+
+	sqlStatement := `INSERT INTO alert_rules (name, rule, updated_ts) VALUES ($1, $2, $3)
+ON CONFLICT (name) DO UPDATE SET rule = EXCLUDED.rule, updated_ts = EXCLUDED.updated_ts`
+	_, err = dbObj.Exec(sqlStatement, rule.Name, string(jsonData), time.Now())
+	return err
+}
+
+func deleteAlertRuleFromDB(name string, dbObj *sql.DB) error {
+	_, err := dbObj.Exec(`DELETE FROM alert_rules WHERE name = $1`, name)
+	return err
+}
+
+func loadAlertStates(dbObj *sql.DB) error {
+	// load the alerts that were pending, firing or resolved when the backend stopped
+	rows, err := dbObj.Query(`SELECT alert FROM alert_state`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var jsonData []byte
+		err = rows.Scan(&jsonData)
+		if err != nil {
+			return err
+		}
+
+		var alert Alert
+		err = json.Unmarshal(jsonData, &alert)
+		if err != nil {
+			log.Printf("Ignoring invalid alert state, %v\n", err)
+			continue
+		}
+		alerts[alertKey{alert.Rule, encodeLabels(alert.Labels)}] = &alert
+	}
+
+	return rows.Err()
+}
+
+func saveAlertState(alert Alert, dbObj *sql.DB) error {
+	jsonData, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+
+	sqlStatement := `INSERT INTO alert_state (rule, labels, alert, updated_ts) VALUES ($1, $2, $3, $4)
+ON CONFLICT (rule, labels) DO UPDATE SET alert = EXCLUDED.alert, updated_ts = EXCLUDED.updated_ts`
+	_, err = dbObj.Exec(sqlStatement, alert.Rule, encodeLabels(alert.Labels), string(jsonData), time.Now())
+	return err
+}
+
+func deleteAlertState(key alertKey, dbObj *sql.DB) error {
+	_, err := dbObj.Exec(`DELETE FROM alert_state WHERE rule = $1 AND labels = $2`, key.rule, key.labels)
+	return err
+}
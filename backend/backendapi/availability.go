@@ -0,0 +1,359 @@
+// availability reports, computed from the status transitions of devices
+// online and late count as available, offline after missed check-ins is an outage,
+// offline after a check-out is planned downtime and counts neither for nor against a device
+// GET /devices/{name}/availability            report for one device
+// GET /devices/{name}/availability/intervals  online / late / offline intervals of one device
+// GET /availability?tag=...                   report for every device with the tag, or every device without one
+// all of them accept from and to (RFC 3339 or unix seconds, the last 30 days by default) and format=csv
+
+package backendapi
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+var defaultReportRange = 30 * 24 * time.Hour // range of reports when from is not given
+
+// StatusInterval is a period a device spent with the same status
+type StatusInterval struct {
+	Start  time.Time `json:"start"`
+	End    time.Time `json:"end"`
+	Status string    `json:"status"`
+	Reason string    `json:"reason"` // reason of the transition that started the interval
+}
+
+// AvailabilityReport sums up the intervals of one device, or of a group of devices, over a window
+type AvailabilityReport struct {
+	Device        string    `json:"device,omitempty"`
+	From          time.Time `json:"from"`
+	To            time.Time `json:"to"`
+	Monitored     float64   `json:"monitored_seconds"` // time with a known status, planned downtime excluded
+	Uptime        float64   `json:"uptime_seconds"`
+	Downtime      float64   `json:"downtime_seconds"`
+	Planned       float64   `json:"planned_downtime_seconds"`
+	Availability  *float64  `json:"availability_percent"` // null without monitored time
+	Outages       int       `json:"outages"`
+	LongestOutage float64   `json:"longest_outage_seconds"`
+	MTTR          *float64  `json:"mttr_seconds"` // mean time to recover, null without outages
+	MTBF          *float64  `json:"mtbf_seconds"` // mean time between failures, null without outages
+}
+
+// GroupAvailabilityReport is the report of every device of a group, and of the group as a whole
+type GroupAvailabilityReport struct {
+	Tag     string               `json:"tag,omitempty"`
+	Total   AvailabilityReport   `json:"total"`
+	Devices []AvailabilityReport `json:"devices"`
+}
+
+var reportCSVHeader = []string{"device", "from", "to", "availability_percent", "monitored_seconds", "uptime_seconds", "downtime_seconds",
+	"planned_downtime_seconds", "outages", "longest_outage_seconds", "mttr_seconds", "mtbf_seconds"}
+
+////////////
+// respond to HTTP calls from client
+func getDeviceAvailability(w http.ResponseWriter, r *http.Request) {
+	// availability report of a single device
+	dev, from, to, ok := readReportRequest(w, r)
+	if !ok {
+		return
+	}
+	intervals, err := deviceIntervals(dev, from, to)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, `{"error": "failed to read status history"}`, http.StatusInternalServerError)
+		return
+	}
+
+	report := computeAvailability(intervals, from, to)
+	report.Device = dev.Name
+	if r.URL.Query().Get("format") == "csv" {
+		writeReportCSV(w, []AvailabilityReport{report}, dev.Name+"-availability.csv")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+func getDeviceIntervals(w http.ResponseWriter, r *http.Request) {
+	// online / late / offline intervals of a single device
+	dev, from, to, ok := readReportRequest(w, r)
+	if !ok {
+		return
+	}
+	intervals, err := deviceIntervals(dev, from, to)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, `{"error": "failed to read status history"}`, http.StatusInternalServerError)
+		return
+	}
+
+	if r.URL.Query().Get("format") == "csv" {
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", dev.Name+"-intervals.csv"))
+		writer := csv.NewWriter(w)
+		writer.Write([]string{"start", "end", "status", "reason", "duration_seconds"})
+		for _, interval := range intervals {
+			writer.Write([]string{interval.Start.Format(time.RFC3339), interval.End.Format(time.RFC3339), interval.Status, interval.Reason,
+				formatSeconds(interval.End.Sub(interval.Start).Seconds())})
+		}
+		writer.Flush()
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(intervals)
+}
+
+func getGroupAvailability(w http.ResponseWriter, r *http.Request) {
+	// availability report of every device with a tag, and of all of them together
+	from, to, err := readReportRange(r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, err.Error()), http.StatusBadRequest)
+		return
+	}
+	tag := r.URL.Query().Get("tag")
+
+	var devices []Device
+	deviceListMutex.Lock()
+	for _, dev := range deviceList {
+		if tag == "" || dev.HasTag(tag) {
+			devices = append(devices, dev)
+		}
+	}
+	deviceListMutex.Unlock()
+
+	group := GroupAvailabilityReport{Tag: tag, Devices: []AvailabilityReport{}}
+	for _, dev := range devices {
+		intervals, err := deviceIntervals(dev, from, to)
+		if err != nil {
+			log.Println(err)
+			http.Error(w, `{"error": "failed to read status history"}`, http.StatusInternalServerError)
+			return
+		}
+		report := computeAvailability(intervals, from, to)
+		report.Device = dev.Name
+		group.Devices = append(group.Devices, report)
+	}
+	group.Total = sumAvailability(group.Devices, from, to)
+
+	if r.URL.Query().Get("format") == "csv" {
+		total := group.Total
+		total.Device = "total"
+		filename := "availability.csv"
+		if tag != "" {
+			filename = tag + "-availability.csv"
+		}
+		writeReportCSV(w, append(group.Devices, total), filename)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(group)
+}
+
+/////////////
+// helpful functions for API calls
+func readReportRequest(w http.ResponseWriter, r *http.Request) (Device, time.Time, time.Time, bool) {
+	// the device named in the path and the window of the report, answer with an error if either is bad
+	dev, found := deviceByName(mux.Vars(r)["name"])
+	if !found {
+		http.Error(w, `{"error": "device not found"}`, http.StatusNotFound)
+		return Device{}, time.Time{}, time.Time{}, false
+	}
+	from, to, err := readReportRange(r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, err.Error()), http.StatusBadRequest)
+		return Device{}, time.Time{}, time.Time{}, false
+	}
+	return dev, from, to, true
+}
+
+func readReportRange(r *http.Request) (time.Time, time.Time, error) {
+	// from and to query parameters, a window ending in the future ends now
+	now := time.Now()
+	to := now
+	from := to.Add(-defaultReportRange)
+	var err error
+	if value := r.URL.Query().Get("to"); value != "" {
+		if to, err = parseQueryTime(value); err != nil {
+			return from, to, fmt.Errorf("bad to %q", value)
+		}
+	}
+	if value := r.URL.Query().Get("from"); value != "" {
+		if from, err = parseQueryTime(value); err != nil {
+			return from, to, fmt.Errorf("bad from %q", value)
+		}
+	}
+	if to.After(now) {
+		to = now
+	}
+	if !from.Before(to) {
+		return from, to, fmt.Errorf("from must be before to, and in the past")
+	}
+	return from, to, nil
+}
+
+func deviceIntervals(dev Device, from, to time.Time) ([]StatusInterval, error) {
+	// intervals of the device within the window, from the transitions stored in the database
+	initial, err := readStatusBefore(dev.Key, from, dbObj)
+	if err != nil {
+		return nil, err
+	}
+	changes, err := readStatusChanges(dev.Key, from, to, dbObj)
+	if err != nil {
+		return nil, err
+	}
+	return statusIntervals(initial, changes, from, to), nil
+}
+
+func statusIntervals(initial *StatusChange, changes []StatusChange, from, to time.Time) []StatusInterval {
+	// turn transitions into intervals clipped to the window
+	// initial is the last transition before from, nil if the status of the device at from is not known
+	// only the first status of a device has no previous one, later ones are left from restarts of versions that did not keep statuses
+	intervals := []StatusInterval{}
+	var current *StatusInterval
+	if initial != nil {
+		current = &StatusInterval{Start: from, Status: initial.Status, Reason: initial.Reason}
+	}
+
+	for _, change := range changes {
+		if change.Timestamp.Before(from) || change.Timestamp.After(to) || (current != nil && change.Previous == "") {
+			continue
+		}
+		if current != nil {
+			current.End = change.Timestamp
+			if current.End.After(current.Start) {
+				intervals = append(intervals, *current)
+			}
+		}
+		current = &StatusInterval{Start: change.Timestamp, Status: change.Status, Reason: change.Reason}
+	}
+	if current != nil {
+		current.End = to
+		if current.End.After(current.Start) {
+			intervals = append(intervals, *current)
+		}
+	}
+	return intervals
+}
+
+func computeAvailability(intervals []StatusInterval, from, to time.Time) AvailabilityReport {
+	// sum up the intervals of one device, consecutive unplanned offline intervals are a single outage
+	report := AvailabilityReport{From: from, To: to}
+	inOutage := false
+	outage := 0.0
+	for _, interval := range intervals {
+		duration := interval.End.Sub(interval.Start).Seconds()
+		switch {
+		case interval.Status != StatusOffline:
+			report.Uptime += duration
+			inOutage = false
+		case interval.Reason == "checkout":
+			report.Planned += duration
+			inOutage = false
+		default:
+			if !inOutage {
+				report.Outages++
+				outage = 0
+			}
+			inOutage = true
+			outage += duration
+			report.Downtime += duration
+			if outage > report.LongestOutage {
+				report.LongestOutage = outage
+			}
+		}
+	}
+	finishAvailability(&report)
+	return report
+}
+
+func sumAvailability(reports []AvailabilityReport, from, to time.Time) AvailabilityReport {
+	// report of a group, availability is weighted by how long each device was monitored
+	total := AvailabilityReport{From: from, To: to}
+	for _, report := range reports {
+		total.Uptime += report.Uptime
+		total.Downtime += report.Downtime
+		total.Planned += report.Planned
+		total.Outages += report.Outages
+		if report.LongestOutage > total.LongestOutage {
+			total.LongestOutage = report.LongestOutage
+		}
+	}
+	finishAvailability(&total)
+	return total
+}
+
+func finishAvailability(report *AvailabilityReport) {
+	// fill in the figures derived from uptime, downtime and outages
+	report.Monitored = report.Uptime + report.Downtime
+	if report.Monitored > 0 {
+		availability := 100 * report.Uptime / report.Monitored
+		report.Availability = &availability
+	}
+	if report.Outages > 0 {
+		mttr := report.Downtime / float64(report.Outages)
+		mtbf := report.Uptime / float64(report.Outages)
+		report.MTTR = &mttr
+		report.MTBF = &mtbf
+	}
+}
+
+func writeReportCSV(w http.ResponseWriter, reports []AvailabilityReport, filename string) {
+	// one line per report, empty cells for figures that cannot be computed
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	optional := func(value *float64) string {
+		if value == nil {
+			return ""
+		}
+		return formatSeconds(*value)
+	}
+
+	writer := csv.NewWriter(w)
+	writer.Write(reportCSVHeader)
+	for _, report := range reports {
+		writer.Write([]string{
+			report.Device,
+			report.From.Format(time.RFC3339),
+			report.To.Format(time.RFC3339),
+			optional(report.Availability),
+			formatSeconds(report.Monitored),
+			formatSeconds(report.Uptime),
+			formatSeconds(report.Downtime),
+			formatSeconds(report.Planned),
+			strconv.Itoa(report.Outages),
+			formatSeconds(report.LongestOutage),
+			optional(report.MTTR),
+			optional(report.MTBF),
+		})
+	}
+	writer.Flush()
+}
+
+func formatSeconds(value float64) string {
+	return strconv.FormatFloat(value, 'f', 3, 64)
+}
+
+/////////////
+// database
+func readStatusBefore(key string, ts time.Time, dbObj *sql.DB) (*StatusChange, error) {
+	// last transition of the device with the given key before ts, nil if there is none
+	// a first status is only used if there is nothing else, versions that did not keep statuses wrote one on every restart
+	var change StatusChange
+	err := dbObj.QueryRow(`SELECT ts, status, previous, reason FROM device_status_history
+WHERE device_key = $1 AND ts < $2 ORDER BY previous <> '' DESC, ts DESC, id DESC LIMIT 1`, key, ts).Scan(&change.Timestamp, &change.Status, &change.Previous, &change.Reason)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &change, nil
+}
@@ -3,13 +3,14 @@
 package backendapi
 
 import (
-	"crypto/sha256"
+	"crypto/rand"
 	"database/sql"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"time"
 
@@ -70,10 +71,130 @@ func SetupBackend() {
 	log.Printf("Successfully connected to Postgres at %s:%d\n", pgresHost, pgresPort)
 	log.Printf("Using database %s, table %s\n", pgresDBName, pgresTableName)
 
+	// make sure the tables have every column this version needs
+	err = migrateDatabase(pCreds["reg_table"].(string), dbObj)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	// devices registered before, with their status and the commands they did not report a result for yet
+	loadStatusSettings(pCreds)
+	err = loadDevices(pCreds["reg_table"].(string), dbObj)
+	if err != nil {
+		log.Panic(err)
+	}
+	err = loadPendingCommands(dbObj)
+	if err != nil {
+		log.Panic(err)
+	}
+	log.Printf("Loaded %d devices\n", len(deviceList))
+
+	// configurations devices fetch from the backend
+	err = loadRemoteConfigs(dbObj)
+	if err != nil {
+		log.Panic(err)
+	}
+	log.Printf("Loaded %d group and %d device configurations\n", len(groupConfigs), len(deviceConfigs))
+
+	// samples devices send are kept as time series
+	metricsStore, err = openMetricsStore(pCreds)
+	if err != nil {
+		log.Panic(err)
+	}
+	defer metricsStore.Close()
+	go runMetricsMaintenance(metricsStore)
+
+	// devices that stop checking in become late, then offline
+	startStatusMonitor()
+
+	// alerts over device status and metrics
+	// their states are loaded once the devices got their status back, alerts that were firing keep firing
+	err = loadAlerting(pCreds, dbObj)
+	if err != nil {
+		log.Panic(err)
+	}
+	log.Printf("Loaded %d alert rules\n", len(alertRules))
+
+	// silences and maintenance windows suppress notifications
+	err = loadSilences(dbObj)
+	if err != nil {
+		log.Panic(err)
+	}
+	log.Printf("Loaded %d silences and %d maintenance windows\n", len(silences), len(maintenanceWindows))
+
+	// alerts and device events reach people through notification channels
+	err = loadNotifier(pCreds)
+	if err != nil {
+		log.Panic(err)
+	}
+	log.Printf("Loaded %d notification channels and %d routes\n", len(notificationTargets), len(notificationRoutes))
+	go runAlertEvaluator()
+
 	// start HTTP server
 	router := mux.NewRouter()
+	router.Use(instrumentRequest)
+	router.Use(decompressRequest)
 	router.HandleFunc("/register", registerDevice).Methods("POST")
 	router.HandleFunc("/checkin", checkInDevice).Methods("POST")
+	router.HandleFunc("/checkout", checkOutDevice).Methods("POST")
+	router.HandleFunc("/inventory", receiveInventory).Methods("POST")
+	router.HandleFunc("/data", receiveData).Methods("POST")
+	router.HandleFunc("/events", receiveEvents).Methods("POST")
+	router.HandleFunc("/check-results", receiveCheckResults).Methods("POST")
+	router.HandleFunc("/devices", listDevices).Methods("GET")
+	router.HandleFunc("/devices/{name}", getDevice).Methods("GET")
+	router.HandleFunc("/devices/{name}/inventory/history", getDeviceInventoryHistory).Methods("GET")
+	router.HandleFunc("/devices/{name}/events", getDeviceEvents).Methods("GET")
+	router.HandleFunc("/devices/{name}/checks/{check}", getDeviceCheckHistory).Methods("GET")
+	router.HandleFunc("/config", getDeviceConfig).Methods("POST")
+	router.HandleFunc("/config/ack", ackDeviceConfig).Methods("POST")
+	router.HandleFunc("/command-result", receiveCommandResult).Methods("POST")
+	router.HandleFunc("/session", openDeviceSession).Methods("GET")
+	router.HandleFunc("/devices/{name}/commands", getDeviceCommands).Methods("GET")
+	router.HandleFunc("/devices/{name}/status/history", getDeviceStatusHistory).Methods("GET")
+	router.HandleFunc("/devices/{name}/availability", getDeviceAvailability).Methods("GET")
+	router.HandleFunc("/devices/{name}/availability/intervals", getDeviceIntervals).Methods("GET")
+	router.HandleFunc("/availability", getGroupAvailability).Methods("GET")
+	router.HandleFunc("/alerts", getAlerts).Methods("GET")
+	router.HandleFunc("/devices/{name}/metrics/{metric}", getDeviceMetric).Methods("GET")
+	router.HandleFunc("/metrics/{metric}", getMetric).Methods("GET")
+	router.HandleFunc("/api/v1/query", promQuery).Methods("GET", "POST")
+	router.HandleFunc("/api/v1/query_range", promQueryRange).Methods("GET", "POST")
+	router.Handle("/metrics", metricsHandler()).Methods("GET")
+
+	// admin API
+	admin := router.PathPrefix("/admin").Subrouter()
+	admin.Use(requireAdmin)
+	admin.HandleFunc("/config/{scope}/{name}", getRemoteConfig).Methods("GET")
+	admin.HandleFunc("/config/{scope}/{name}", putRemoteConfig).Methods("PUT")
+	admin.HandleFunc("/config/{scope}/{name}", deleteRemoteConfig).Methods("DELETE")
+	admin.HandleFunc("/devices/{name}/tags", putDeviceTags).Methods("PUT")
+	admin.HandleFunc("/devices/{name}/commands", queueDeviceCommand).Methods("POST")
+	admin.HandleFunc("/alerts/rules", getAlertRules).Methods("GET")
+	admin.HandleFunc("/alerts/rules/{name}", putAlertRule).Methods("PUT")
+	admin.HandleFunc("/alerts/rules/{name}", deleteAlertRule).Methods("DELETE")
+	admin.HandleFunc("/notifications/log", getNotificationLog).Methods("GET")
+	admin.HandleFunc("/notifications/channels/{channel}/test", testNotificationChannel).Methods("POST")
+	admin.HandleFunc("/silences", getSilences).Methods("GET")
+	admin.HandleFunc("/silences", postSilence).Methods("POST")
+	admin.HandleFunc("/silences/{id}", deleteSilence).Methods("DELETE")
+	admin.HandleFunc("/maintenance", getMaintenanceWindows).Methods("GET")
+	admin.HandleFunc("/maintenance/{name}", putMaintenanceWindow).Methods("PUT")
+	admin.HandleFunc("/maintenance/{name}", deleteMaintenanceWindow).Methods("DELETE")
+
+	// gRPC API, on its own port
+	grpcAddress := ":8001"
+	if addr, ok := pCreds["grpc_address"].(string); ok && addr != "" {
+		grpcAddress = addr
+	}
+	go serveGRPC(grpcAddress)
+
+	// MQTT bridge, only if a broker is configured
+	if broker, ok := pCreds["mqtt_broker"].(string); ok && broker != "" {
+		username, _ := pCreds["mqtt_username"].(string)
+		password, _ := pCreds["mqtt_password"].(string)
+		startMQTTBridge(broker, username, password)
+	}
 
 	err = http.ListenAndServe(":8000", router)
 	if err != nil {
@@ -137,22 +258,11 @@ func registerDevice(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// check if device is already in the list
-	index := FindDeviceByMac(deviceList, tmpDev)
-	if index != -1 {
-		log.Println(deviceList[index].Name + " (" + deviceList[index].Mac + ")" + " attempted to register again")
+	tmpDev, code = registerNewDevice(tmpDev)
+	if code == returnCodeList["AlreadyRegistered"].Code {
 		response, _ := generateErrorResponse("AlreadyRegistered")
 		http.Error(w, response, http.StatusBadRequest)
 	} else {
-		// generate a key for this device
-		// TODO: this is not very secure yet, it just takes the MD5 hash of the MAC + Name
-		tmpDev.Key = BytesToString(sha256.Sum256([]byte(tmpDev.Mac + tmpDev.Name)))
-		log.Printf("Generated key for %s: %s\n", tmpDev.Name, tmpDev.Key)
-
-		// add it to the list and send a response back with the key
-		log.Printf("Registered new device, %s (%s)\n", tmpDev.Name, tmpDev.Mac)
-		deviceList = append(deviceList, tmpDev)
-
 		// build response to send
 		resp, err := generateRegisterResponse(tmpDev)
 		if err != nil {
@@ -165,16 +275,84 @@ func registerDevice(w http.ResponseWriter, r *http.Request) {
 		if err != nil {
 			log.Println(err)
 		}
+	}
+
+	deviceListMutex.Lock()
+	Debug_dumpDeviceList(deviceList) // just for DEBUG
+	deviceListMutex.Unlock()
+}
+
+func registerNewDevice(tmpDev Device) (Device, int) {
+	// add a device that passed validation to the list and the database, generating its key
+	// shared by the HTTP and gRPC APIs
+	// the OS column is filled from the inventory, if the device sent one
+	if tmpDev.Inventory != nil && tmpDev.OS == "" {
+		tmpDev.OS = tmpDev.Inventory.OS
+	}
+	now := time.Now()
+
+	// check if device is already in the list, under any of its identifiers
+	// a device that is still up keeps its key, one that went offline, e.g. because it lost its state file, gets a new one
+	deviceListMutex.Lock()
+	index := FindDeviceByIdentity(deviceList, tmpDev)
+	if index != -1 && deviceList[index].IsUp(now) {
+		existing := deviceList[index]
+		deviceListMutex.Unlock()
+		log.Println(existing.Name + " (" + existing.Mac + ")" + " attempted to register again")
+		registrationsTotal.WithLabelValues("already_registered").Inc()
+		return existing, returnCodeList["AlreadyRegistered"].Code
+	}
+
+	oldKey := ""
+	if index != -1 {
+		// same entry, so the status, checks and configuration of the device carry over
+		existing := &deviceList[index]
+		oldKey = existing.Key
+		existing.Name, existing.Mac, existing.MachineID, existing.Interfaces = tmpDev.Name, tmpDev.Mac, tmpDev.MachineID, tmpDev.Interfaces
+		existing.OS, existing.Inventory = tmpDev.OS, tmpDev.Inventory
+		if len(tmpDev.Tags) > 0 {
+			existing.Tags = tmpDev.Tags
+		}
+		existing.LastCheckin, existing.LastCheckout = time.Time{}, time.Time{}
+		existing.Registered = now
+		existing.Key = generateDeviceKey() // the identifier stays, metrics keep following the device
+		registrationsTotal.WithLabelValues("rekeyed").Inc()
+		log.Printf("Registered %s (%s) again after it went offline, with a new key\n", existing.Name, existing.Mac)
+	} else {
+		tmpDev.Registered = now
+		tmpDev.ID = generateDeviceID()
+		tmpDev.Key = generateDeviceKey()
+		deviceList = append(deviceList, tmpDev)
+		index = len(deviceList) - 1
+		registrationsTotal.WithLabelValues("new").Inc()
+		log.Printf("Registered new device, %s (%s)\n", tmpDev.Name, tmpDev.Mac)
+	}
+	statusUpdate := updateDeviceStatus(&deviceList[index], now)
+	tmpDev = deviceList[index]
+	deviceListMutex.Unlock()
 
-		// update postgres
+	// update postgres, the caller sends a response back with the key
+	var err error
+	if oldKey != "" {
+		err = updateDeviceRegister(oldKey, tmpDev, pCreds["reg_table"].(string), dbObj)
+	} else {
 		err = newDeviceRegister(tmpDev, pCreds["reg_table"].(string), dbObj)
+	}
+	if err != nil {
+		log.Println(err)
+	}
+
+	applyStatusUpdate(statusUpdate)
+
+	// the first inventory starts the history of the device
+	if tmpDev.Inventory != nil {
+		err = newInventoryChange(tmpDev, diffInventory(nil, *tmpDev.Inventory), pCreds["reg_table"].(string), dbObj)
 		if err != nil {
 			log.Println(err)
 		}
-
 	}
 
-	Debug_dumpDeviceList(deviceList) // just for DEBUG
+	return tmpDev, returnCodeList["RegisterOK"].Code
 }
 
 func checkInDevice(w http.ResponseWriter, r *http.Request) {
@@ -182,7 +360,7 @@ func checkInDevice(w http.ResponseWriter, r *http.Request) {
 	// device has to be already registered and provide its key, for the check-in to be considered valid
 	var responseMap = make(map[string]interface{}) // map used to reply to client
 	log.Println("New check-in attempt from " + r.Host)
-	var tmpDev *Device // reference to device checking in
+	var tmpDev Device // copy of the device checking in
 	tmpDev, code := readCheckinRequestBody(r.Body)
 
 	if code != returnCodeList["CheckinOK"].Code {
@@ -201,15 +379,101 @@ func checkInDevice(w http.ResponseWriter, r *http.Request) {
 	// update last check-in status of the device
 	// reply back with the last time the device checked in as a confirmation, i.e. now
 	log.Printf("Received valid checkin from %s\n", tmpDev.Name)
-	tmpDev.LastCheckin = time.Now()
+	recordCheckin(tmpDev.Key)
 
-	// build response to send
-	responseMap["code"] = returnCodeList["CheckinOK"].Code
-	responseMap["last_checkin"] = tmpDev.LastCheckin.String()
-	json.NewEncoder(w).Encode(responseMap)
+	responseMap = checkinResponse(tmpDev.Key)
+	err := json.NewEncoder(w).Encode(responseMap)
+	if err == nil {
+		commandsDelivered(tmpDev.Key, responseMap)
+	}
 
+	deviceListMutex.Lock()
 	Debug_dumpDeviceList(deviceList) // just for DEBUG
+	deviceListMutex.Unlock()
+
+}
+
+func checkOutDevice(w http.ResponseWriter, r *http.Request) {
+	// check-out endpoint, devices call it when they stop reporting on purpose, e.g. when shutting down
+	w.Header().Set("Content-Type", "application/json")
+	tmpDev, code := readCheckinRequestBody(r.Body)
+
+	if code != returnCodeList["CheckinOK"].Code {
+		var response string
+		if code == returnCodeList["BadKey"].Code {
+			response, _ = generateErrorResponse("BadKey")
+		} else {
+			response, _ = generateErrorResponse("MalformedCheckout")
+		}
+
+		log.Printf("Received bad checkout (error %d), %s\n", code, response)
+		http.Error(w, response, http.StatusBadRequest)
+		return
+	}
+
+	json.NewEncoder(w).Encode(checkoutResponse(tmpDev))
+}
+
+func checkoutResponse(tmpDev Device) map[string]interface{} {
+	// record the check-out of the device and build the response to it
+	log.Printf("Received valid checkout from %s\n", tmpDev.Name)
+	lastCheckout := recordCheckout(tmpDev.Key)
+
+	var responseMap = make(map[string]interface{})
+	responseMap["code"] = returnCodeList["CheckoutOK"].Code
+	responseMap["code_string"] = returnCodeList["CheckoutOK"].CodeString
+	responseMap["last_checkout"] = lastCheckout.String()
+	return responseMap
+}
+
+func checkinResponse(key string) map[string]interface{} {
+	// build the response to a check-in of the device with the given key, also pushed to devices that have a session open
+	// commands due for the device are handed over with it, whoever writes the response marks them sent with commandsDelivered
+	var dev Device
+	var commands []Command
+	found := withDevice(key, func(tmpDev *Device) {
+		dev = tmpDev.clone()
+		commands = dueCommands(tmpDev, time.Now())
+	})
+
+	var responseMap = make(map[string]interface{})
+	if !found {
+		// the device registered again with a new key in the meantime
+		responseMap["code"] = returnCodeList["BadKey"].Code
+		responseMap["code_string"] = returnCodeList["BadKey"].CodeString
+		return responseMap
+	}
+	responseMap["code"] = returnCodeList["CheckinOK"].Code
+	responseMap["last_checkin"] = dev.LastCheckin.String()
+	_, responseMap["config_version"] = effectiveConfig(dev)
+	if len(commands) > 0 {
+		log.Printf("Delivering %d commands to %s\n", len(commands), dev.Name)
+		responseMap["commands"] = commands
+	}
+	return responseMap
+}
 
+func listDevices(w http.ResponseWriter, r *http.Request) {
+	// return every device known to the backend, without their keys
+	w.Header().Set("Content-Type", "application/json")
+	output := []Device{}
+	deviceListMutex.Lock()
+	for _, dev := range deviceList {
+		output = append(output, dev.Public())
+	}
+	deviceListMutex.Unlock()
+	json.NewEncoder(w).Encode(output)
+}
+
+func getDevice(w http.ResponseWriter, r *http.Request) {
+	// return a single device, identified by name
+	w.Header().Set("Content-Type", "application/json")
+	dev, found := deviceByName(mux.Vars(r)["name"])
+	if !found {
+		http.Error(w, `{"error": "device not found"}`, http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode(dev.Public())
 }
 
 /////////////
@@ -220,49 +484,73 @@ func readRegisterRequestBody(body io.ReadCloser) (Device, int) {
 	var tmpDev Device
 	var err error
 	err = json.NewDecoder(body).Decode(&tmpDev)
-	if err == nil {
-		// request not malformed, check if all the necessary parameters are there
-		if tmpDev.Name == "" {
-			return tmpDev, returnCodeList["MissingInformation"].Code
-		}
-
-		if tmpDev.Mac == "" {
-			err = fmt.Errorf("Missing device MAC")
-			return tmpDev, returnCodeList["MissingInformation"].Code
-		}
-	} else {
+	if err != nil {
 		// request malformed
 		return tmpDev, returnCodeList["BadJSON"].Code
 	}
 
-	return tmpDev, returnCodeList["RequestOK"].Code
+	return tmpDev, validateRegisterRequest(tmpDev)
 }
 
-func readCheckinRequestBody(body io.ReadCloser) (*Device, int) {
+func validateRegisterRequest(tmpDev Device) int {
+	// check if all the necessary parameters are there
+	if tmpDev.Name == "" {
+		return returnCodeList["MissingInformation"].Code
+	}
+
+	// devices without a physical interface, e.g. containers, identify themselves by their machine identifier
+	if tmpDev.Mac == "" && tmpDev.MachineID == "" {
+		return returnCodeList["MissingInformation"].Code
+	}
+
+	// every MAC address provided has to be valid, they are used to identify the device
+	for mac := range tmpDev.KnownMacs() {
+		if _, err := net.ParseMAC(mac); err != nil {
+			return returnCodeList["BadDeviceMac"].Code
+		}
+	}
+
+	return returnCodeList["RequestOK"].Code
+}
+
+func readCheckinRequestBody(body io.ReadCloser) (Device, int) {
 	// check if a check-in request body is valid
-	// if valid, return a reference to the device performing the check-in
-	var tmpDev *Device
+	// if valid, return a copy of the device performing the check-in
+	var tmpDev Device
 	var err error
 	err = json.NewDecoder(body).Decode(&tmpDev)
 	if err == nil {
 		// check if a known key is found
-		index := FindDeviceByKey(deviceList, *tmpDev)
-		if index == -1 {
+		var found bool
+		tmpDev, found = deviceByKey(tmpDev.Key)
+		if !found {
 			// not found
-			return nil, returnCodeList["BadKey"].Code
-		} else {
-			tmpDev = &deviceList[index]
+			return Device{}, returnCodeList["BadKey"].Code
 		}
 
 	} else {
 		// request malformed
-		return nil, returnCodeList["MalformedCheckin"].Code
+		return Device{}, returnCodeList["MalformedCheckin"].Code
 	}
 
 	return tmpDev, returnCodeList["CheckinOK"].Code
 
 }
 
+func generateDeviceID() string {
+	// identifier of a device, metrics are stored under it since names are not unique and keys change
+	var id [32]byte
+	rand.Read(id[:])
+	return BytesToString(id)[:32]
+}
+
+func generateDeviceKey() string {
+	// key of a device, random so that it cannot be derived from the name and MAC address the device API exposes
+	var key [32]byte
+	rand.Read(key[:])
+	return BytesToString(key)
+}
+
 func generateRegisterResponse(dev Device) (string, error) {
 	// generate a proper response message to return to a device after receiving a successful register request
 	var responseMap = make(map[string]interface{}) // map used to reply to client
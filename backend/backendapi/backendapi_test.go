@@ -3,10 +3,38 @@
 package backendapi
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
+	"context"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	"github.com/klauspost/compress/zstd"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	pb "github.com/DPinato/RemoteMonitor/proto"
 )
 
 var sampleCodeListLocation = "../../return_codes.json"
@@ -51,6 +79,15 @@ func Test_ReadRegisterRequestBody(t *testing.T) {
 		assertCorrect(t, got, want)
 	})
 
+	t.Run("Machine identifier without MAC", func(t *testing.T) {
+		testDev := Device{Name: "Sample name", MachineID: "4c4c4544004a3510804cb4c04f4b4d32"}
+		byteData, _ := json.Marshal(testDev)
+		r := ioutil.NopCloser(bytes.NewReader(byteData))
+		_, got := readRegisterRequestBody(r)
+		want := returnCodeList["RequestOK"].Code
+		assertCorrect(t, got, want)
+	})
+
 	t.Run("Malformed JSON request body", func(t *testing.T) {
 		testJson := "{\"name\":\"Sample name\", \"mac\":\"00:00:00:00:00:00}"
 		r := ioutil.NopCloser(bytes.NewReader([]byte(testJson)))
@@ -91,6 +128,16 @@ func Test_BytesToString(t *testing.T) {
 
 }
 
+func Test_generateDeviceKey(t *testing.T) {
+	first, second := generateDeviceKey(), generateDeviceKey()
+	if len(first) != 64 {
+		t.Errorf("Got %v, want a key of 64 characters", first)
+	}
+	if first == second {
+		t.Errorf("Got %v twice, want different keys", first)
+	}
+}
+
 func Test_importReturnCodes(t *testing.T) {
 	t.Run("Attempting to run function with predefined file location", func(t *testing.T) {
 		got := importReturnCodes(sampleCodeListLocation)
@@ -99,3 +146,2097 @@ func Test_importReturnCodes(t *testing.T) {
 		}
 	})
 }
+
+func Test_FindDeviceByIdentity(t *testing.T) {
+	assertCorrect := func(t *testing.T, got, want int) {
+		if got != want {
+			t.Errorf("Got %v, want %v", got, want)
+		}
+	}
+
+	list := []Device{
+		{Name: "first", Mac: "00:01:02:03:04:05", MachineID: "aaaa"},
+		{Name: "second", Mac: "00:01:02:03:04:06", Interfaces: []NetInterface{{Name: "eth1", Mac: "00:01:02:03:04:07"}}},
+		{Name: "third", Mac: "00:01:02:03:04:0a"},
+	}
+
+	t.Run("Matching machine identifier", func(t *testing.T) {
+		got := FindDeviceByIdentity(list, Device{Mac: "10:01:02:03:04:05", MachineID: "aaaa"})
+		assertCorrect(t, got, 0)
+	})
+
+	t.Run("Primary MAC now reported by a different interface", func(t *testing.T) {
+		testDev := Device{Mac: "10:01:02:03:04:05", Interfaces: []NetInterface{{Name: "eth0", Mac: "00:01:02:03:04:07"}}}
+		got := FindDeviceByIdentity(list, testDev)
+		assertCorrect(t, got, 1)
+	})
+
+	t.Run("MAC addresses compared regardless of case", func(t *testing.T) {
+		got := FindDeviceByIdentity(list, Device{Mac: "00:01:02:03:04:0A"})
+		assertCorrect(t, got, 2)
+	})
+
+	t.Run("Unknown device", func(t *testing.T) {
+		got := FindDeviceByIdentity(list, Device{Mac: "10:01:02:03:04:05", MachineID: "bbbb"})
+		assertCorrect(t, got, -1)
+	})
+}
+
+func Test_diffInventory(t *testing.T) {
+	assertCorrect := func(t *testing.T, got, want []string) {
+		if strings.Join(got, ",") != strings.Join(want, ",") {
+			t.Errorf("Got %v, want %v", got, want)
+		}
+	}
+
+	inv := Inventory{OS: "Debian GNU/Linux 12 (bookworm)", Kernel: "6.1.0-18-amd64", CPUCount: 4,
+		Interfaces: []NetInterface{{Name: "eth0", Mac: "00:01:02:03:04:05", IPs: []string{"10.0.0.2/24"}}}}
+
+	t.Run("No previous inventory", func(t *testing.T) {
+		got := diffInventory(nil, inv)
+		if len(got) != 11 {
+			t.Errorf("Got %d changed fields, want every field", len(got))
+		}
+	})
+
+	t.Run("Unchanged inventory", func(t *testing.T) {
+		got := diffInventory(&inv, inv)
+		assertCorrect(t, got, nil)
+	})
+
+	t.Run("Kernel upgrade and new address", func(t *testing.T) {
+		newInv := inv
+		newInv.Kernel = "6.1.0-20-amd64"
+		newInv.Interfaces = []NetInterface{{Name: "eth0", Mac: "00:01:02:03:04:05", IPs: []string{"10.0.0.3/24"}}}
+		got := diffInventory(&inv, newInv)
+		assertCorrect(t, got, []string{"interfaces", "kernel"})
+	})
+}
+
+func Test_partitionSamples(t *testing.T) {
+	err := importReturnCodes(sampleCodeListLocation)
+	if err != nil {
+		t.Fatalf("Failed to get return codes, %v", err)
+	}
+	now := time.Now()
+
+	// accepted samples are returned as they are, rejected ones by their index in the batch and why
+	assertPartition := func(t *testing.T, samples []Sample, maxAge time.Duration, wantAccepted int, wantRejected []RejectedSample) {
+		t.Helper()
+		accepted, rejected := partitionSamples(samples, now, maxAge)
+		if len(accepted) != wantAccepted {
+			t.Errorf("Got %v accepted, want %v", len(accepted), wantAccepted)
+		}
+		if len(rejected) != len(wantRejected) {
+			t.Fatalf("Got %v rejected, want %v", rejected, wantRejected)
+		}
+		for i := range rejected {
+			if rejected[i] != wantRejected[i] {
+				t.Errorf("Got %v rejected, want %v", rejected, wantRejected)
+			}
+		}
+	}
+
+	t.Run("Valid samples", func(t *testing.T) {
+		samples := []Sample{{Name: "load1", Value: 0.5, Timestamp: now},
+			{Name: "filesystem_used_percent", Labels: map[string]string{"mountpoint": "/"}, Value: 42, Timestamp: now.Add(-time.Minute)}}
+		assertPartition(t, samples, maxSampleAge, 2, nil)
+	})
+
+	t.Run("No samples", func(t *testing.T) {
+		assertPartition(t, nil, maxSampleAge, 0, nil)
+	})
+
+	t.Run("Sample without a name", func(t *testing.T) {
+		assertPartition(t, []Sample{{Value: 1, Timestamp: now}}, maxSampleAge, 0,
+			[]RejectedSample{{Index: 0, Code: returnCodeList["DataMalformed"].Code}})
+	})
+
+	t.Run("Sample without a usable value", func(t *testing.T) {
+		assertPartition(t, []Sample{{Name: "load1", Value: math.NaN(), Timestamp: now}}, maxSampleAge, 0,
+			[]RejectedSample{{Index: 0, Code: returnCodeList["DataMalformed"].Code}})
+	})
+
+	t.Run("Sample too old", func(t *testing.T) {
+		assertPartition(t, []Sample{{Name: "load1", Value: 1, Timestamp: now.Add(-time.Hour)}}, maxSampleAge, 0,
+			[]RejectedSample{{Index: 0, Code: returnCodeList["DataTimestampBad"].Code}})
+	})
+
+	t.Run("Sample from the future", func(t *testing.T) {
+		assertPartition(t, []Sample{{Name: "load1", Value: 1, Timestamp: now.Add(time.Hour)}}, maxSampleAge, 0,
+			[]RejectedSample{{Index: 0, Code: returnCodeList["DataTimestampBad"].Code}})
+	})
+
+	t.Run("Replayed sample", func(t *testing.T) {
+		assertPartition(t, []Sample{{Name: "load1", Value: 1, Timestamp: now.Add(-time.Hour)}}, sampleMaxAge(true), 1, nil)
+	})
+
+	t.Run("Mixed batch", func(t *testing.T) {
+		samples := []Sample{{Name: "load1", Value: 1, Timestamp: now}, {Value: 1, Timestamp: now},
+			{Name: "load5", Value: 1, Timestamp: now}, {Name: "load15", Value: 1, Timestamp: now.Add(-time.Hour)}}
+		assertPartition(t, samples, maxSampleAge, 2, []RejectedSample{
+			{Index: 1, Code: returnCodeList["DataMalformed"].Code}, {Index: 3, Code: returnCodeList["DataTimestampBad"].Code}})
+		accepted, _ := partitionSamples(samples, now, maxSampleAge)
+		if len(accepted) == 2 && (accepted[0].Name != "load1" || accepted[1].Name != "load5") {
+			t.Errorf("Got %v, want load1 and load5 in order", accepted)
+		}
+	})
+}
+
+func Test_storeSamples(t *testing.T) {
+	// devices send samples over HTTP, gRPC and MQTT at the same time, run with -race
+	oldStore := metricsStore
+	metricsStore = nil
+	defer func() { metricsStore = oldStore; latestSamples = make(map[string][]Sample) }()
+	now := time.Now()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			dev := Device{Name: fmt.Sprintf("device-%d", i%5), Key: fmt.Sprintf("key-%d", i%5), ID: fmt.Sprintf("id-%d", i%5)}
+			storeSamples(dev, []Sample{{Name: "load1", Value: float64(i), Timestamp: now.Add(time.Duration(i) * time.Second)}})
+		}(i)
+	}
+	wg.Wait()
+
+	latestSamplesMutex.Lock()
+	defer latestSamplesMutex.Unlock()
+	if len(latestSamples) != 5 {
+		t.Errorf("Got %v, want %v", len(latestSamples), 5)
+	}
+}
+
+func Test_DevicePublic(t *testing.T) {
+	// the public copy is encoded after deviceListMutex is released, it must not share anything the handlers modify
+	dev := Device{Name: "Sample name", Key: "samplekey", Tags: []string{"web"},
+		Inventory:  &Inventory{OS: "Debian GNU/Linux 12 (bookworm)", Interfaces: []NetInterface{{Name: "eth0", IPs: []string{"192.0.2.10/24"}}}},
+		Interfaces: []NetInterface{{Name: "eth0", IPs: []string{"192.0.2.10/24"}}},
+		Checks:     map[string]CheckResult{"disk_root": {Name: "disk_root", Status: 0}}}
+	public := dev.Public()
+	dev.Checks["disk_root"] = CheckResult{Name: "disk_root", Status: 2}
+	dev.Checks["load"] = CheckResult{Name: "load", Status: 0}
+	dev.Inventory.OS = "Ubuntu"
+	dev.Tags[0] = "db"
+	dev.Inventory.Interfaces[0].IPs[0] = "192.0.2.20/24"
+	dev.Interfaces[0].IPs[0] = "192.0.2.20/24"
+
+	if public.Key != "" {
+		t.Errorf("Got %v, want no key", public.Key)
+	}
+	if len(public.Checks) != 1 || public.Checks["disk_root"].Status != 0 {
+		t.Errorf("Got %v, want the checks at the time of the copy", public.Checks)
+	}
+	if public.Inventory.OS != "Debian GNU/Linux 12 (bookworm)" || public.Tags[0] != "web" {
+		t.Errorf("Got %v %v, want the inventory and tags at the time of the copy", public.Inventory.OS, public.Tags)
+	}
+	if public.Inventory.Interfaces[0].IPs[0] != "192.0.2.10/24" || public.Interfaces[0].IPs[0] != "192.0.2.10/24" {
+		t.Errorf("Got %v %v, want the addresses at the time of the copy", public.Inventory.Interfaces, public.Interfaces)
+	}
+}
+
+func Test_readEventsRequestBody(t *testing.T) {
+	assertCorrect := func(t *testing.T, got, want int) {
+		if got != want {
+			t.Errorf("Got %v, want %v", got, want)
+		}
+	}
+
+	err := importReturnCodes(sampleCodeListLocation)
+	if err != nil {
+		t.Fatalf("Failed to get return codes, %v", err)
+	}
+	deviceList = []Device{{Name: "Sample name", Key: "samplekey", Mac: "00:01:02:03:04:05"}}
+	defer func() { deviceList = nil }()
+
+	t.Run("Valid events", func(t *testing.T) {
+		testJson := `{"key": "samplekey", "events": [{"type": "process_disappeared", "labels": {"watch": "nginx"}, "message": "gone", "timestamp": "2020-01-01T00:00:00Z"}]}`
+		dev, events, got := readEventsRequestBody(ioutil.NopCloser(strings.NewReader(testJson)))
+		assertCorrect(t, got, returnCodeList["DataOK"].Code)
+		if dev.Name != "Sample name" || len(events) != 1 || events[0].Labels["watch"] != "nginx" {
+			t.Errorf("Got %v %v, want a single event from Sample name", dev, events)
+		}
+	})
+
+	t.Run("No events", func(t *testing.T) {
+		_, _, got := readEventsRequestBody(ioutil.NopCloser(strings.NewReader(`{"key": "samplekey", "events": []}`)))
+		assertCorrect(t, got, returnCodeList["DataMalformed"].Code)
+	})
+
+	t.Run("Unknown key", func(t *testing.T) {
+		testJson := `{"key": "otherkey", "events": [{"type": "process_disappeared", "timestamp": "2020-01-01T00:00:00Z"}]}`
+		_, _, got := readEventsRequestBody(ioutil.NopCloser(strings.NewReader(testJson)))
+		assertCorrect(t, got, returnCodeList["BadKey"].Code)
+	})
+
+	t.Run("Event without a type", func(t *testing.T) {
+		testJson := `{"key": "samplekey", "events": [{"message": "gone", "timestamp": "2020-01-01T00:00:00Z"}]}`
+		_, _, got := readEventsRequestBody(ioutil.NopCloser(strings.NewReader(testJson)))
+		assertCorrect(t, got, returnCodeList["DataMalformed"].Code)
+	})
+
+	t.Run("Event without a timestamp", func(t *testing.T) {
+		testJson := `{"key": "samplekey", "events": [{"type": "process_disappeared"}]}`
+		_, _, got := readEventsRequestBody(ioutil.NopCloser(strings.NewReader(testJson)))
+		assertCorrect(t, got, returnCodeList["DataMalformed"].Code)
+	})
+
+	t.Run("Rejected over HTTP", func(t *testing.T) {
+		req := httptest.NewRequest("POST", "/events", strings.NewReader(`{"key": "otherkey", "events": [{"type": "process_disappeared", "timestamp": "2020-01-01T00:00:00Z"}]}`))
+		w := httptest.NewRecorder()
+		receiveEvents(w, req)
+		if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), strconv.Itoa(returnCodeList["BadKey"].Code)) {
+			t.Errorf("Got %v %v, want %v with BadKey", w.Code, w.Body.String(), http.StatusBadRequest)
+		}
+	})
+}
+
+func Test_readCheckResultsRequestBody(t *testing.T) {
+	assertCorrect := func(t *testing.T, got, want int) {
+		if got != want {
+			t.Errorf("Got %v, want %v", got, want)
+		}
+	}
+
+	err := importReturnCodes(sampleCodeListLocation)
+	if err != nil {
+		t.Fatalf("Failed to get return codes, %v", err)
+	}
+	deviceList = []Device{{Name: "Sample name", Key: "samplekey", Mac: "00:01:02:03:04:05"}}
+	defer func() { deviceList = nil }()
+
+	t.Run("Valid check result", func(t *testing.T) {
+		testJson := `{"key": "samplekey", "results": [{"name": "disk_root", "status": 1, "output": "DISK WARNING", "timestamp": "2020-01-01T00:00:00Z"}]}`
+		_, results, got := readCheckResultsRequestBody(ioutil.NopCloser(strings.NewReader(testJson)))
+		assertCorrect(t, got, returnCodeList["DataOK"].Code)
+		if len(results) != 1 || results[0].StatusText != "WARNING" {
+			t.Errorf("Got %v, want a single WARNING result", results)
+		}
+	})
+
+	t.Run("Unknown key", func(t *testing.T) {
+		testJson := `{"key": "otherkey", "results": [{"name": "disk_root", "status": 0, "timestamp": "2020-01-01T00:00:00Z"}]}`
+		_, _, got := readCheckResultsRequestBody(ioutil.NopCloser(strings.NewReader(testJson)))
+		assertCorrect(t, got, returnCodeList["BadKey"].Code)
+	})
+
+	t.Run("Status outside of the plugin API", func(t *testing.T) {
+		testJson := `{"key": "samplekey", "results": [{"name": "disk_root", "status": 4, "timestamp": "2020-01-01T00:00:00Z"}]}`
+		_, _, got := readCheckResultsRequestBody(ioutil.NopCloser(strings.NewReader(testJson)))
+		assertCorrect(t, got, returnCodeList["DataMalformed"].Code)
+	})
+}
+
+func Test_effectiveConfig(t *testing.T) {
+	groupConfigs = map[string]RemoteConfig{
+		"web": {CheckinInterval: "30s", Collectors: []string{"cpu", "memory"},
+			Checks: []RemoteCheckDefinition{{Name: "http", Command: []string{"check_http", "-H", "localhost"}, Interval: "1m", Timeout: "10s"}}},
+		"eu": {CheckinInterval: "20s"},
+	}
+	deviceConfigs = map[string]RemoteConfig{
+		"web-1": {Checks: []RemoteCheckDefinition{{Name: "http", Command: []string{"check_http", "-H", "web-1"}, Interval: "1m", Timeout: "10s"}}},
+	}
+	defer func() {
+		groupConfigs = make(map[string]RemoteConfig)
+		deviceConfigs = make(map[string]RemoteConfig)
+	}()
+
+	t.Run("Groups applied in tag order, then the device", func(t *testing.T) {
+		rc, _ := effectiveConfig(Device{Name: "web-1", Tags: []string{"web", "eu"}})
+		if rc.CheckinInterval != "30s" {
+			t.Errorf("Got checkin interval %v, want 30s", rc.CheckinInterval)
+		}
+		if len(rc.Collectors) != 2 {
+			t.Errorf("Got collectors %v, want the ones of the web group", rc.Collectors)
+		}
+		if len(rc.Checks) != 1 || rc.Checks[0].Command[2] != "web-1" {
+			t.Errorf("Got checks %v, want the http check of the device", rc.Checks)
+		}
+	})
+
+	t.Run("Version changes with the configuration", func(t *testing.T) {
+		_, before := effectiveConfig(Device{Name: "web-2", Tags: []string{"web"}})
+		_, same := effectiveConfig(Device{Name: "web-3", Tags: []string{"web"}})
+		groupConfigs["web"] = RemoteConfig{CheckinInterval: "15s"}
+		_, after := effectiveConfig(Device{Name: "web-2", Tags: []string{"web"}})
+		if before != same || before == after {
+			t.Errorf("Got versions %s, %s and %s, want the first two equal and the last different", before, same, after)
+		}
+	})
+
+	t.Run("Invalid check timeout", func(t *testing.T) {
+		err := validateRemoteConfig(RemoteConfig{Checks: []RemoteCheckDefinition{{Name: "x", Command: []string{"true"}, Interval: "10s", Timeout: "1m"}}})
+		if err == nil {
+			t.Errorf("Got no error for a timeout longer than the interval")
+		}
+	})
+}
+
+func Test_commandLifecycle(t *testing.T) {
+	// commands stay queued until the device reports a result, they are delivered again if the result does not come
+	now := time.Now()
+	deviceList = []Device{{Name: "Sample name", Key: "samplekey", PendingCommands: []Command{
+		{ID: 1, Type: "collect_diagnostics", Timeout: 60, Status: "pending", CreatedAt: now},
+		{ID: 2, Type: "restart_service", Timeout: 60, Status: "pending", CreatedAt: now.Add(-2 * commandExpireAfter)},
+	}}}
+	defer func() { deviceList = nil }()
+	due := func(at time.Time) []int64 {
+		deviceListMutex.Lock()
+		defer deviceListMutex.Unlock()
+		var ids []int64
+		for _, cmd := range dueCommands(&deviceList[0], at) {
+			ids = append(ids, cmd.ID)
+		}
+		return ids
+	}
+
+	t.Run("Expired", func(t *testing.T) {
+		expireCommands(now)
+		if got := due(now); len(got) != 1 || got[0] != 1 {
+			t.Errorf("Got %v, want %v", got, []int64{1})
+		}
+	})
+
+	t.Run("Built but not delivered", func(t *testing.T) {
+		// a response that was built but never written, e.g. a push dropped on a full session, leaves the command pending
+		checkinResponse("samplekey")
+		if got := due(now); len(got) != 1 {
+			t.Errorf("Got %v, want the command still due", got)
+		}
+	})
+
+	t.Run("Delivered", func(t *testing.T) {
+		commandsDelivered("samplekey", map[string]interface{}{"commands": []Command{{ID: 1}}})
+		if got := due(time.Now()); len(got) != 0 {
+			t.Errorf("Got %v, want nothing due right after delivery", got)
+		}
+		if got := due(time.Now().Add(commandRedeliverAfter)); len(got) != 1 {
+			t.Errorf("Got %v, want the command delivered again without a result", got)
+		}
+	})
+
+	t.Run("Finished", func(t *testing.T) {
+		finishCommand("samplekey", 1)
+		if len(deviceList[0].PendingCommands) != 0 {
+			t.Errorf("Got %v, want an empty queue", deviceList[0].PendingCommands)
+		}
+	})
+}
+
+func Test_readCommandResultRequestBody(t *testing.T) {
+	assertCorrect := func(t *testing.T, got, want int) {
+		t.Helper()
+		if got != want {
+			t.Errorf("Got %v, want %v", got, want)
+		}
+	}
+
+	err := importReturnCodes(sampleCodeListLocation)
+	if err != nil {
+		t.Fatalf("Failed to get return codes, %v", err)
+	}
+	deviceList = []Device{{Name: "Sample name", Key: "samplekey", Mac: "00:01:02:03:04:05"}}
+	defer func() { deviceList = nil }()
+
+	t.Run("Valid command result", func(t *testing.T) {
+		testJson := `{"key": "samplekey", "id": 7, "status": "failed", "exit_code": 3, "output": "` + strings.Repeat("x", maxCommandOutput+10) + `"}`
+		req, got := readCommandResultRequestBody(ioutil.NopCloser(strings.NewReader(testJson)))
+		assertCorrect(t, got, returnCodeList["DataOK"].Code)
+		if req.ExitCode == nil || *req.ExitCode != 3 || len(req.Output) != maxCommandOutput {
+			t.Errorf("Got %v, want exit code 3 and output truncated to %d bytes", req, maxCommandOutput)
+		}
+	})
+
+	t.Run("Unknown key", func(t *testing.T) {
+		testJson := `{"key": "otherkey", "id": 7, "status": "succeeded", "exit_code": 0}`
+		_, got := readCommandResultRequestBody(ioutil.NopCloser(strings.NewReader(testJson)))
+		assertCorrect(t, got, returnCodeList["BadKey"].Code)
+	})
+
+	t.Run("Unknown status", func(t *testing.T) {
+		testJson := `{"key": "samplekey", "id": 7, "status": "pending"}`
+		_, got := readCommandResultRequestBody(ioutil.NopCloser(strings.NewReader(testJson)))
+		assertCorrect(t, got, returnCodeList["DataMalformed"].Code)
+	})
+}
+
+func Test_openDeviceSession(t *testing.T) {
+	err := importReturnCodes(sampleCodeListLocation)
+	if err != nil {
+		t.Fatalf("Failed to get return codes, %v", err)
+	}
+	deviceList = []Device{{Name: "Sample name", Key: "samplekey", Mac: "00:01:02:03:04:05"}}
+	defer func() { deviceList = nil }()
+
+	server := httptest.NewServer(http.HandlerFunc(openDeviceSession))
+	defer server.Close()
+	sessionURL := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	t.Run("Unknown key", func(t *testing.T) {
+		header := http.Header{"Authorization": []string{"Bearer otherkey"}}
+		_, resp, err := websocket.DefaultDialer.Dial(sessionURL, header)
+		if err == nil || resp == nil || resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("Got %v, want the session to be refused with %d", err, http.StatusBadRequest)
+		}
+	})
+
+	t.Run("Check-in response on open", func(t *testing.T) {
+		header := http.Header{"Authorization": []string{"Bearer samplekey"}}
+		conn, _, err := websocket.DefaultDialer.Dial(sessionURL, header)
+		if err != nil {
+			t.Fatalf("Failed to open session, %v", err)
+		}
+		defer conn.Close()
+
+		var msg map[string]interface{}
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		err = conn.ReadJSON(&msg)
+		if err != nil {
+			t.Fatalf("Failed to read from session, %v", err)
+		}
+		if got, want := int(msg["code"].(float64)), returnCodeList["CheckinOK"].Code; got != want {
+			t.Errorf("Got %v, want %v", got, want)
+		}
+		if msg["config_version"] == "" {
+			t.Errorf("Got %v, want a configuration version", msg)
+		}
+	})
+}
+
+func Test_deviceSession(t *testing.T) {
+	deviceList = []Device{{Name: "Sample name", Key: "samplekey"}, {Name: "Other name", Key: "otherkey"}}
+	remoteConfigsMutex.Lock()
+	deviceConfigs["Sample name"] = RemoteConfig{CheckinInterval: "5s"}
+	remoteConfigsMutex.Unlock()
+	defer func() {
+		deviceList = nil
+		remoteConfigsMutex.Lock()
+		delete(deviceConfigs, "Sample name")
+		remoteConfigsMutex.Unlock()
+	}()
+
+	t.Run("Ping interval", func(t *testing.T) {
+		// devices are pinged as often as they check in, at most every sessionMaxPingInterval
+		for _, tt := range []struct {
+			key  string
+			want time.Duration
+		}{
+			{"samplekey", 5 * time.Second},
+			{"otherkey", defaultCheckinInterval},
+			{"unknownkey", sessionMaxPingInterval},
+		} {
+			if got := (&deviceSession{key: tt.key}).pingInterval(); got != tt.want {
+				t.Errorf("Got %v for %s, want %v", got, tt.key, tt.want)
+			}
+		}
+	})
+
+	t.Run("Full queue", func(t *testing.T) {
+		// a device that does not keep up loses its session rather than some of the messages
+		conns := make(chan *websocket.Conn, 1)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			conn, _ := upgrader.Upgrade(w, r, nil)
+			conns <- conn
+		}))
+		defer server.Close()
+		client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+		if err != nil {
+			t.Fatalf("Failed to open session, %v", err)
+		}
+		defer client.Close()
+
+		session := &deviceSession{key: "samplekey", conn: <-conns, send: make(chan map[string]interface{}, 1), done: make(chan struct{})}
+		if !session.push(map[string]interface{}{"code": 2000}) {
+			t.Fatalf("Got false, want the first message queued")
+		}
+		if session.push(map[string]interface{}{"code": 2000}) {
+			t.Errorf("Got true, want the second message refused")
+		}
+		client.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, _, err := client.ReadMessage(); err == nil {
+			t.Errorf("Got a message, want the session closed")
+		}
+	})
+}
+
+func Test_grpcBackend(t *testing.T) {
+	err := importReturnCodes(sampleCodeListLocation)
+	if err != nil {
+		t.Fatalf("Failed to get return codes, %v", err)
+	}
+	deviceList = []Device{{Name: "Sample name", Key: "samplekey", Mac: "00:01:02:03:04:05"}}
+	defer func() { deviceList = nil }()
+
+	listener := bufconn.Listen(1024 * 1024)
+	server := grpc.NewServer()
+	pb.RegisterBackendServer(server, grpcBackend{})
+	go server.Serve(listener)
+	defer server.Stop()
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return listener.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("Failed to create client, %v", err)
+	}
+	defer conn.Close()
+	client := pb.NewBackendClient(conn)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	t.Run("Register request", func(t *testing.T) {
+		dev := deviceFromRegisterRequest(&pb.RegisterRequest{Name: "Other name", MachineId: "0123456789abcdef",
+			Inventory: &pb.Inventory{Os: "Debian GNU/Linux 12 (bookworm)", CpuCount: 4}})
+		if got, want := validateRegisterRequest(dev), returnCodeList["RequestOK"].Code; got != want {
+			t.Errorf("Got %v, want %v", got, want)
+		}
+		if dev.MachineID != "0123456789abcdef" || dev.Inventory == nil || dev.Inventory.CPUCount != 4 || !dev.Inventory.BootTime.IsZero() {
+			t.Errorf("Got %+v, want the device with its inventory", dev)
+		}
+	})
+
+	t.Run("Checkin", func(t *testing.T) {
+		resp, err := client.Checkin(ctx, &pb.KeyRequest{Key: "samplekey"})
+		if err != nil {
+			t.Fatalf("Checkin failed, %v", err)
+		}
+		if got, want := int(resp.Code), returnCodeList["CheckinOK"].Code; got != want {
+			t.Errorf("Got %v, want %v", got, want)
+		}
+	})
+
+	t.Run("Unknown key", func(t *testing.T) {
+		_, err := client.Checkin(ctx, &pb.KeyRequest{Key: "otherkey"})
+		st := status.Convert(err)
+		if st.Code() != codes.Unauthenticated {
+			t.Errorf("Got %v, want %v", st.Code(), codes.Unauthenticated)
+		}
+		want := strconv.Itoa(returnCodeList["BadKey"].Code)
+		if len(st.Details()) != 1 || st.Details()[0].(*errdetails.ErrorInfo).Metadata["code"] != want {
+			t.Errorf("Got %v, want ErrorInfo with code %s", st.Details(), want)
+		}
+	})
+
+	t.Run("SendData", func(t *testing.T) {
+		stream, err := client.SendData(ctx)
+		if err != nil {
+			t.Fatalf("Failed to open stream, %v", err)
+		}
+		stream.Send(&pb.DataRequest{Key: "samplekey", Samples: []*pb.Sample{{Name: "load1", Value: 1, Timestamp: timestamppb.Now()}}})
+		stream.Send(&pb.DataRequest{Key: "samplekey", Samples: []*pb.Sample{{Name: "load1", Value: 1, Timestamp: timestamppb.New(time.Now().Add(-time.Hour))}}})
+
+		resp, err := stream.CloseAndRecv()
+		if err != nil {
+			t.Fatalf("SendData failed, %v", err)
+		}
+		if resp.Accepted != 1 || resp.Rejected != 1 {
+			t.Errorf("Got %v, want 1 accepted and 1 rejected sample", resp)
+		}
+	})
+}
+
+func Test_handleMQTTMessage(t *testing.T) {
+	err := importReturnCodes(sampleCodeListLocation)
+	if err != nil {
+		t.Fatalf("Failed to get return codes, %v", err)
+	}
+	deviceList = []Device{{Name: "board-1", Key: "samplekey", Mac: "00:01:02:03:04:05"}}
+	defer func() { deviceList = nil }()
+
+	codeOf := func(t *testing.T, msg interface{}) int {
+		t.Helper()
+		jsonData, _ := json.Marshal(msg)
+		var m map[string]interface{}
+		json.Unmarshal(jsonData, &m)
+		return int(m["code"].(float64))
+	}
+
+	t.Run("Valid check-in", func(t *testing.T) {
+		topic, msg := handleMQTTMessage("remotemonitor/devices/board-1/checkin", []byte(`{"key": "samplekey"}`))
+		if topic != "remotemonitor/devices/board-1/commands" || codeOf(t, msg) != returnCodeList["CheckinOK"].Code {
+			t.Errorf("Got %v %v, want a check-in response on the command topic", topic, msg)
+		}
+	})
+
+	t.Run("Key of another device", func(t *testing.T) {
+		topic, msg := handleMQTTMessage("remotemonitor/devices/board-2/checkin", []byte(`{"key": "samplekey"}`))
+		if topic != "remotemonitor/devices/board-2/commands" || codeOf(t, msg) != returnCodeList["BadKey"].Code {
+			t.Errorf("Got %v %v, want BadKey on the command topic", topic, msg)
+		}
+	})
+
+	t.Run("Stale data", func(t *testing.T) {
+		payload := `{"key": "samplekey", "samples": [{"name": "load1", "value": 1, "timestamp": "2020-01-01T00:00:00Z"}]}`
+		topic, msg := handleMQTTMessage("remotemonitor/devices/board-1/data", []byte(payload))
+		if topic != "remotemonitor/devices/board-1/responses" || codeOf(t, msg) != returnCodeList["DataTimestampBad"].Code {
+			t.Errorf("Got %v %v, want DataTimestampBad on the response topic", topic, msg)
+		}
+	})
+
+	t.Run("Unknown topic", func(t *testing.T) {
+		topic, _ := handleMQTTMessage("remotemonitor/board-1/checkin", []byte(`{"key": "samplekey"}`))
+		if topic != "" {
+			t.Errorf("Got %v, want no answer", topic)
+		}
+	})
+
+	t.Run("Name that is not a topic level", func(t *testing.T) {
+		for _, name := range []string{"board+1", "board#1", ""} {
+			topic, _ := handleMQTTMessage("remotemonitor/devices/"+name+"/checkin", []byte(`{"key": "samplekey"}`))
+			if topic != "" {
+				t.Errorf("Got %v for %q, want no answer", topic, name)
+			}
+		}
+	})
+
+	t.Run("Will", func(t *testing.T) {
+		handleMQTTMessage("remotemonitor/devices/board-1/checkin", []byte(`{"key": "samplekey"}`))
+		handleMQTTMessage("remotemonitor/devices/board-1/status", []byte(`{"key": "samplekey", "status": "offline"}`))
+		mqttDevicesMutex.Lock()
+		_, known := mqttDevices["samplekey"]
+		mqttDevicesMutex.Unlock()
+		if known {
+			t.Errorf("Got the device still pushed to, want it forgotten after its will")
+		}
+	})
+}
+
+// testMQTTBroker is just enough of an MQTT 3.1.1 broker for the bridge and a device to talk through it:
+// QoS 1 publishes are acknowledged and forwarded with QoS 0, filters only support the + wildcard,
+// and the will of a client is published when the broker drops its connection
+type testMQTTBroker struct {
+	listener net.Listener
+	mutex    sync.Mutex
+	clients  map[string]net.Conn   // connections by client identifier
+	subs     map[net.Conn][]string // topic filters each connection subscribed to
+	writes   map[net.Conn]*sync.Mutex
+}
+
+func newTestMQTTBroker(t *testing.T) *testMQTTBroker {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen, %v", err)
+	}
+	b := &testMQTTBroker{listener: listener, clients: make(map[string]net.Conn), subs: make(map[net.Conn][]string), writes: make(map[net.Conn]*sync.Mutex)}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go b.serve(conn)
+		}
+	}()
+	return b
+}
+
+func (b *testMQTTBroker) serve(conn net.Conn) {
+	var will *packets.PublishPacket
+	b.mutex.Lock()
+	b.writes[conn] = &sync.Mutex{}
+	b.mutex.Unlock()
+	defer func() {
+		conn.Close()
+		b.mutex.Lock()
+		delete(b.subs, conn)
+		b.mutex.Unlock()
+		if will != nil {
+			b.route(will)
+		}
+	}()
+
+	for {
+		cp, err := packets.ReadPacket(conn)
+		if err != nil {
+			return
+		}
+		switch p := cp.(type) {
+		case *packets.ConnectPacket:
+			if p.WillFlag {
+				will = packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+				will.TopicName, will.Payload = p.WillTopic, p.WillMessage
+			}
+			b.mutex.Lock()
+			b.clients[p.ClientIdentifier] = conn
+			b.mutex.Unlock()
+			b.write(conn, packets.NewControlPacket(packets.Connack))
+		case *packets.SubscribePacket:
+			b.mutex.Lock()
+			b.subs[conn] = append(b.subs[conn], p.Topics...)
+			b.mutex.Unlock()
+			ack := packets.NewControlPacket(packets.Suback).(*packets.SubackPacket)
+			ack.MessageID, ack.ReturnCodes = p.MessageID, p.Qoss
+			b.write(conn, ack)
+		case *packets.PublishPacket:
+			if p.Qos > 0 {
+				ack := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+				ack.MessageID = p.MessageID
+				b.write(conn, ack)
+			}
+			b.route(p)
+		case *packets.PingreqPacket:
+			b.write(conn, packets.NewControlPacket(packets.Pingresp))
+		case *packets.DisconnectPacket:
+			will = nil
+			return
+		}
+	}
+}
+
+func (b *testMQTTBroker) write(conn net.Conn, p packets.ControlPacket) {
+	b.mutex.Lock()
+	lock := b.writes[conn]
+	b.mutex.Unlock()
+	lock.Lock()
+	defer lock.Unlock()
+	p.Write(conn)
+}
+
+func (b *testMQTTBroker) route(p *packets.PublishPacket) {
+	// forward a message to every connection with a matching subscription
+	b.mutex.Lock()
+	var targets []net.Conn
+	for conn, filters := range b.subs {
+		for _, filter := range filters {
+			if mqttTopicMatches(filter, p.TopicName) {
+				targets = append(targets, conn)
+				break
+			}
+		}
+	}
+	b.mutex.Unlock()
+
+	for _, conn := range targets {
+		out := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+		out.TopicName, out.Payload = p.TopicName, p.Payload
+		b.write(conn, out)
+	}
+}
+
+func (b *testMQTTBroker) subscriptions() int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	count := 0
+	for _, filters := range b.subs {
+		count += len(filters)
+	}
+	return count
+}
+
+func (b *testMQTTBroker) drop(clientID string) {
+	// close the connection of a client as if it went away, which publishes its will
+	b.mutex.Lock()
+	conn := b.clients[clientID]
+	b.mutex.Unlock()
+	conn.Close()
+}
+
+func mqttTopicMatches(filter, topic string) bool {
+	filterLevels, topicLevels := strings.Split(filter, "/"), strings.Split(topic, "/")
+	if len(filterLevels) != len(topicLevels) {
+		return false
+	}
+	for i := range filterLevels {
+		if filterLevels[i] != "+" && filterLevels[i] != topicLevels[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func Test_MQTTBridge(t *testing.T) {
+	// a device checks in through a broker, gets commands pushed to it, and stops getting them once its will is published
+	err := importReturnCodes(sampleCodeListLocation)
+	if err != nil {
+		t.Fatalf("Failed to get return codes, %v", err)
+	}
+	deviceList = []Device{{Name: "board-1", Key: "samplekey", Mac: "00:01:02:03:04:05"}}
+	broker := newTestMQTTBroker(t)
+	defer broker.listener.Close()
+	address := "tcp://" + broker.listener.Addr().String()
+
+	startMQTTBridge(address, "", "")
+	defer func() {
+		mqttClient.Disconnect(0)
+		mqttClient = nil
+		deviceList = nil
+		mqttDevices = make(map[string]time.Time)
+	}()
+	waitFor := func(t *testing.T, what string, done func() bool) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for !done() {
+			if time.Now().After(deadline) {
+				t.Fatalf("Timed out waiting for %s", what)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	waitFor(t, "the bridge to subscribe", func() bool { return broker.subscriptions() == 3 })
+
+	// the device, with a will telling the backend it is gone
+	responses := make(chan map[string]interface{}, 10)
+	opts := mqtt.NewClientOptions().AddBroker(address).SetClientID("board-1")
+	opts.SetWill("remotemonitor/devices/board-1/status", `{"key": "samplekey", "status": "offline"}`, 1, false)
+	opts.SetAutoReconnect(false)
+	device := mqtt.NewClient(opts)
+	if token := device.Connect(); !token.WaitTimeout(5*time.Second) || token.Error() != nil {
+		t.Fatalf("Device failed to connect, %v", token.Error())
+	}
+	defer device.Disconnect(0)
+	token := device.Subscribe("remotemonitor/devices/board-1/commands", 1, func(c mqtt.Client, msg mqtt.Message) {
+		var m map[string]interface{}
+		json.Unmarshal(msg.Payload(), &m)
+		responses <- m
+	})
+	if !token.WaitTimeout(5*time.Second) || token.Error() != nil {
+		t.Fatalf("Device failed to subscribe, %v", token.Error())
+	}
+	receive := func(t *testing.T) map[string]interface{} {
+		t.Helper()
+		select {
+		case m := <-responses:
+			return m
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for a check-in response")
+			return nil
+		}
+	}
+
+	t.Run("Check-in", func(t *testing.T) {
+		device.Publish("remotemonitor/devices/board-1/checkin", 1, false, `{"key": "samplekey"}`)
+		if got, want := int(receive(t)["code"].(float64)), returnCodeList["CheckinOK"].Code; got != want {
+			t.Errorf("Got %v, want %v", got, want)
+		}
+	})
+
+	t.Run("Pushed command", func(t *testing.T) {
+		deviceListMutex.Lock()
+		deviceList[0].PendingCommands = []Command{{ID: 1, Type: "collect_diagnostics", Timeout: 60, Status: "pending", CreatedAt: time.Now()}}
+		deviceListMutex.Unlock()
+		pushCheckin("samplekey")
+		commands, _ := receive(t)["commands"].([]interface{})
+		if len(commands) != 1 {
+			t.Fatalf("Got %v, want the queued command", commands)
+		}
+		waitFor(t, "the command to be marked sent", func() bool {
+			deviceListMutex.Lock()
+			defer deviceListMutex.Unlock()
+			return deviceList[0].PendingCommands[0].Status == "sent"
+		})
+	})
+
+	t.Run("Will", func(t *testing.T) {
+		broker.drop("board-1")
+		waitFor(t, "the will to be handled", func() bool {
+			mqttDevicesMutex.Lock()
+			defer mqttDevicesMutex.Unlock()
+			_, known := mqttDevices["samplekey"]
+			return !known
+		})
+		if pushMQTTCheckin("samplekey") {
+			t.Errorf("Got a check-in response pushed, want none once the device is gone")
+		}
+	})
+}
+
+func Test_readDataRequestBody(t *testing.T) {
+	assertCorrect := func(t *testing.T, got, want int) {
+		t.Helper()
+		if got != want {
+			t.Errorf("Got %v, want %v", got, want)
+		}
+	}
+
+	err := importReturnCodes(sampleCodeListLocation)
+	if err != nil {
+		t.Fatalf("Failed to get return codes, %v", err)
+	}
+	deviceList = []Device{{Name: "Sample name", Key: "samplekey", Mac: "00:01:02:03:04:05"}}
+	defer func() { deviceList = nil }()
+	now := time.Now().UTC().Format(time.RFC3339)
+
+	t.Run("Partially valid batch", func(t *testing.T) {
+		testJson := `{"key": "samplekey", "samples": [{"name": "load1", "value": 1, "timestamp": "` + now + `"},
+			{"name": "load1", "value": 1, "timestamp": "2020-01-01T00:00:00Z"}, {"value": 1, "timestamp": "` + now + `"}]}`
+		_, samples, rejected, got := readDataRequestBody(ioutil.NopCloser(strings.NewReader(testJson)))
+		assertCorrect(t, got, returnCodeList["DataOK"].Code)
+		assertCorrect(t, len(samples), 1)
+		want := []RejectedSample{{Index: 1, Code: returnCodeList["DataTimestampBad"].Code}, {Index: 2, Code: returnCodeList["DataMalformed"].Code}}
+		if len(rejected) != 2 || rejected[0] != want[0] || rejected[1] != want[1] {
+			t.Errorf("Got %v, want %v", rejected, want)
+		}
+	})
+
+	t.Run("No valid sample", func(t *testing.T) {
+		testJson := `{"key": "samplekey", "samples": [{"name": "load1", "value": 1, "timestamp": "2020-01-01T00:00:00Z"}]}`
+		_, _, _, got := readDataRequestBody(ioutil.NopCloser(strings.NewReader(testJson)))
+		assertCorrect(t, got, returnCodeList["DataTimestampBad"].Code)
+	})
+}
+
+func Test_decompressRequest(t *testing.T) {
+	err := importReturnCodes(sampleCodeListLocation)
+	if err != nil {
+		t.Fatalf("Failed to get return codes, %v", err)
+	}
+
+	var received []byte
+	handler := decompressRequest(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received, _ = ioutil.ReadAll(r.Body)
+	}))
+	send := func(body []byte, encoding string) int {
+		received = nil
+		r := httptest.NewRequest("POST", "/data", bytes.NewReader(body))
+		r.Header.Set("Content-Encoding", encoding)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Code
+	}
+	payload := []byte(`{"key": "samplekey", "samples": []}`)
+
+	t.Run("gzip", func(t *testing.T) {
+		var body bytes.Buffer
+		gz := gzip.NewWriter(&body)
+		gz.Write(payload)
+		gz.Close()
+		if got := send(body.Bytes(), "gzip"); got != http.StatusOK || !bytes.Equal(received, payload) {
+			t.Errorf("Got %v %s, want %v %s", got, received, http.StatusOK, payload)
+		}
+	})
+
+	t.Run("zstd", func(t *testing.T) {
+		encoder, _ := zstd.NewWriter(nil)
+		if got := send(encoder.EncodeAll(payload, nil), "zstd"); got != http.StatusOK || !bytes.Equal(received, payload) {
+			t.Errorf("Got %v %s, want %v %s", got, received, http.StatusOK, payload)
+		}
+	})
+
+	t.Run("Too large once decompressed", func(t *testing.T) {
+		defer func(old int64) { maxDecompressedBody = old }(maxDecompressedBody)
+		maxDecompressedBody = 1024
+		var body bytes.Buffer
+		gz := gzip.NewWriter(&body)
+		gz.Write(bytes.Repeat([]byte("a"), 4096))
+		gz.Close()
+		if got := send(body.Bytes(), "gzip"); got != http.StatusRequestEntityTooLarge || received != nil {
+			t.Errorf("Got %v, want %v", got, http.StatusRequestEntityTooLarge)
+		}
+	})
+
+	t.Run("Unknown encoding", func(t *testing.T) {
+		if got := send(payload, "br"); got != http.StatusUnsupportedMediaType {
+			t.Errorf("Got %v, want %v", got, http.StatusUnsupportedMediaType)
+		}
+	})
+}
+
+func Test_embeddedMetricsStore(t *testing.T) {
+	store, err := newEmbeddedMetricsStore(t.TempDir() + "/metrics.db")
+	if err != nil {
+		t.Fatalf("Failed to open metrics store, %v", err)
+	}
+	defer store.Close()
+
+	start := time.Date(2026, 1, 1, 10, 0, 0, 0, time.UTC)
+	var samples []Sample
+	for i := 0; i < 120; i++ {
+		// one sample every 30s for an hour, two per minute with values i and i+1
+		samples = append(samples, Sample{Name: "load1", Value: float64(i), Timestamp: start.Add(time.Duration(i) * 30 * time.Second)})
+		samples = append(samples, Sample{Name: "disk_used", Labels: map[string]string{"mountpoint": "/"}, Value: 1, Timestamp: start.Add(time.Duration(i) * 30 * time.Second)})
+	}
+	err = store.Write("sampledevice", samples)
+	if err != nil {
+		t.Fatalf("Failed to write samples, %v", err)
+	}
+	err = store.Rollup(start, start.Add(time.Hour))
+	if err != nil {
+		t.Fatalf("Failed to roll up samples, %v", err)
+	}
+	query := func(resolution string, labels map[string]string) []MetricSeries {
+		series, err := store.Query(MetricsQuery{Name: "load1", Labels: labels, From: start, To: start.Add(time.Hour), Resolution: resolution})
+		if err != nil {
+			t.Fatalf("Failed to query %s, %v", resolution, err)
+		}
+		return series
+	}
+
+	t.Run("Raw", func(t *testing.T) {
+		series := query("raw", nil)
+		if len(series) != 1 || len(series[0].Points) != 120 || series[0].Device != "sampledevice" {
+			t.Fatalf("Got %v, want 1 series of 120 points", series)
+		}
+	})
+
+	t.Run("1m", func(t *testing.T) {
+		series := query("1m", nil)
+		if len(series) != 1 || len(series[0].Points) != 60 {
+			t.Fatalf("Got %v, want 1 series of 60 points", series)
+		}
+		got := series[0].Points[1]
+		want := MetricPoint{Timestamp: start.Add(time.Minute), Min: 2, Max: 3, Sum: 5, Count: 2}
+		if got != want {
+			t.Errorf("Got %v, want %v", got, want)
+		}
+	})
+
+	t.Run("1h", func(t *testing.T) {
+		series := query("1h", nil)
+		if len(series) != 1 || len(series[0].Points) != 1 {
+			t.Fatalf("Got %v, want 1 series of 1 point", series)
+		}
+		got := series[0].Points[0]
+		if got.Min != 0 || got.Max != 119 || got.Count != 120 || got.Avg() != 59.5 {
+			t.Errorf("Got %v, want min 0, max 119, count 120, avg 59.5", got)
+		}
+	})
+
+	t.Run("Labels", func(t *testing.T) {
+		if series := query("raw", map[string]string{"mountpoint": "/"}); len(series) != 0 {
+			t.Errorf("Got %v, want no series", series)
+		}
+	})
+
+	t.Run("Late samples", func(t *testing.T) {
+		err := store.Write("sampledevice", []Sample{{Name: "load1", Value: 1000, Timestamp: start.Add(90 * time.Second)}})
+		if err != nil {
+			t.Fatalf("Failed to write samples, %v", err)
+		}
+		store.Rollup(start.Add(90*time.Second), start.Add(time.Hour))
+		got := query("1m", nil)[0].Points[1]
+		want := MetricPoint{Timestamp: start.Add(time.Minute), Min: 2, Max: 1000, Sum: 1002, Count: 2}
+		if got != want {
+			t.Errorf("Got %v, want %v", got, want)
+		}
+		if got := query("1h", nil)[0].Points[0].Max; got != 1000 {
+			t.Errorf("Got %v, want %v", got, 1000)
+		}
+	})
+
+	t.Run("Prune", func(t *testing.T) {
+		err := store.Prune(start.Add(metricsRetention["raw"] + 30*time.Minute))
+		if err != nil {
+			t.Fatalf("Failed to prune, %v", err)
+		}
+		if series := query("raw", nil); len(series) != 1 || len(series[0].Points) != 60 {
+			t.Errorf("Got %v, want 1 series of 60 points", series)
+		}
+		if series := query("1h", nil); len(series) != 1 {
+			t.Errorf("Got %v, want 1 series", series)
+		}
+	})
+}
+
+func Test_writeMetrics(t *testing.T) {
+	// devices pick their own names, series are told apart by the device identifier
+	store, err := newEmbeddedMetricsStore(t.TempDir() + "/metrics.db")
+	if err != nil {
+		t.Fatalf("Failed to open metrics store, %v", err)
+	}
+	defer store.Close()
+	oldStore := metricsStore
+	metricsStore = store
+	defer func() { metricsStore = oldStore }()
+
+	start := time.Date(2026, 1, 1, 10, 0, 0, 0, time.UTC)
+	writeMetrics(Device{ID: "id-1", Name: "web"}, []Sample{{Name: "load1", Value: 1, Timestamp: start}})
+	writeMetrics(Device{ID: "id-2", Name: "web"}, []Sample{{Name: "load1", Value: 2, Timestamp: start}})
+	writeMetrics(Device{ID: "id-1", Name: "web-renamed"}, []Sample{{Name: "load1", Value: 3, Timestamp: start.Add(time.Minute)}})
+	store.Write("web", []Sample{{Name: "load1", Value: 4, Timestamp: start}})
+	query := func(device string) []MetricSeries {
+		series, err := store.Query(MetricsQuery{Name: "load1", Device: device, From: start, To: start.Add(time.Hour), Resolution: "raw"})
+		if err != nil {
+			t.Fatalf("Failed to query %s, %v", device, err)
+		}
+		sortSeries(series)
+		return series
+	}
+
+	t.Run("Same name", func(t *testing.T) {
+		series := query("web")
+		if len(series) != 3 {
+			t.Fatalf("Got %v, want 3 series", series)
+		}
+		got := []string{series[0].DeviceID, series[1].DeviceID, series[2].DeviceID}
+		want := []string{"", "id-1", "id-2"}
+		if strings.Join(got, ",") != strings.Join(want, ",") {
+			t.Errorf("Got %v, want %v", got, want)
+		}
+		if len(series[1].Labels) != 0 {
+			t.Errorf("Got %v, want no labels", series[1].Labels)
+		}
+	})
+
+	t.Run("Renamed", func(t *testing.T) {
+		series := query("web-renamed")
+		if len(series) != 1 || series[0].DeviceID != "id-1" || series[0].Points[0].Sum != 3 {
+			t.Errorf("Got %v, want 1 series of id-1", series)
+		}
+	})
+}
+
+func Test_runMetricsRequest(t *testing.T) {
+	store, err := newEmbeddedMetricsStore(t.TempDir() + "/metrics.db")
+	if err != nil {
+		t.Fatalf("Failed to open metrics store, %v", err)
+	}
+	defer store.Close()
+	defer func(old []Device) { deviceList = old }(deviceList)
+	deviceList = []Device{{Name: "web-1", Tags: []string{"web"}}, {Name: "db-1"}}
+
+	start := time.Date(2026, 1, 1, 10, 0, 0, 0, time.UTC)
+	now := start.Add(time.Hour)
+	for i, dev := range deviceList {
+		var samples []Sample
+		for j := 0; j < 6; j++ {
+			// one sample every 10s for a minute, the counter is reset after the fourth sample
+			ts := start.Add(time.Duration(j) * 10 * time.Second)
+			samples = append(samples, Sample{Name: "load1", Value: float64(j + i*10), Timestamp: ts})
+			samples = append(samples, Sample{Name: "rx_bytes", Labels: map[string]string{"interface": "eth0"}, Value: float64(j%4) * 100, Timestamp: ts})
+		}
+		store.Write(dev.Name, samples)
+	}
+	store.Rollup(start, now)
+	run := func(metric, params string) MetricsResult {
+		values, _ := url.ParseQuery(params)
+		req, err := parseMetricsRequest(metric, "", values, now)
+		if err != nil {
+			t.Fatalf("Failed to parse %s, %v", params, err)
+		}
+		result, err := runMetricsRequest(store, req)
+		if err != nil {
+			t.Fatalf("Failed to run %s, %v", params, err)
+		}
+		return result
+	}
+	from := "from=" + start.Format(time.RFC3339) + "&to=" + start.Add(time.Minute).Format(time.RFC3339)
+
+	t.Run("Avg per device", func(t *testing.T) {
+		result := run("load1", from+"&step=30s")
+		if len(result.Series) != 2 || result.Resolution != "raw" {
+			t.Fatalf("Got %v, want 2 raw series", result)
+		}
+		got := result.Series[0]
+		want := ResultSeries{Labels: map[string]string{"device": "db-1"}, Points: [][2]float64{{float64(start.Unix()), 11}, {float64(start.Unix() + 30), 14}}}
+		if got.Labels["device"] != want.Labels["device"] || len(got.Points) != 2 || got.Points[0] != want.Points[0] || got.Points[1] != want.Points[1] {
+			t.Errorf("Got %v, want %v", got, want)
+		}
+	})
+
+	t.Run("Percentile by tag", func(t *testing.T) {
+		result := run("load1", from+"&step=1m&agg=p50&tag=web")
+		if len(result.Series) != 1 || len(result.Series[0].Points) != 1 || result.Series[0].Points[0][1] != 2.5 {
+			t.Errorf("Got %v, want one series with p50 2.5", result.Series)
+		}
+	})
+
+	t.Run("Max combined", func(t *testing.T) {
+		result := run("load1", from+"&step=1m&agg=max&by=")
+		if len(result.Series) != 1 || len(result.Series[0].Points) != 1 || result.Series[0].Points[0][1] != 15 {
+			t.Errorf("Got %v, want one series with max 15", result.Series)
+		}
+	})
+
+	t.Run("Rate with reset", func(t *testing.T) {
+		// 0, 100, 200, 300, 0, 100 increases by 400 in the minute
+		result := run("rx_bytes", from+"&step=1m&agg=rate&label=interface=eth0&by=interface&resolution=raw")
+		if len(result.Series) != 1 || len(result.Series[0].Points) != 1 || result.Series[0].Points[0][1] != 2*400.0/60 {
+			t.Errorf("Got %v, want %v", result.Series, 2*400.0/60)
+		}
+	})
+
+	t.Run("Resolution", func(t *testing.T) {
+		if got := chooseResolution(now.Add(-24*time.Hour), time.Minute, now); got != "1m" {
+			t.Errorf("Got %v, want %v", got, "1m")
+		}
+		if got := chooseResolution(now.Add(-60*24*time.Hour), time.Minute, now); got != "1h" {
+			t.Errorf("Got %v, want %v", got, "1h")
+		}
+		if got := chooseResolution(now.Add(-time.Hour), 10*time.Second, now); got != "raw" {
+			t.Errorf("Got %v, want %v", got, "raw")
+		}
+	})
+
+	t.Run("Bad parameters", func(t *testing.T) {
+		for _, params := range []string{"agg=median", "agg=pNaN", "agg=pInf", "agg=p101", "step=0", "from=yesterday", "label=eth0", "step=1ms&from=0"} {
+			values, _ := url.ParseQuery(params)
+			if _, err := parseMetricsRequest("load1", "", values, now); err == nil {
+				t.Errorf("Got no error for %s, want one", params)
+			}
+		}
+	})
+}
+
+func Test_parsePromQL(t *testing.T) {
+	t.Run("Valid", func(t *testing.T) {
+		for _, query := range []string{
+			`load1`,
+			`load1{device="web-1", mountpoint=~"/var.*"} offset 1h`,
+			`{__name__="load1"}`,
+			`sum by (device) (rate(rx_bytes{interface!="lo"}[5m]))`,
+			`max(irate(rx_bytes[1m30s])) without (interface)`,
+			`disk_used / disk_size * 100 > bool 90`,
+			`-load1 + 2 ^ 3 ^ 2`,
+			`load1 > on (device) load5`,
+		} {
+			if _, err := parsePromQL(query); err != nil {
+				t.Errorf("Got %v for %s, want no error", err, query)
+			}
+		}
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		for _, query := range []string{
+			``,
+			`load1{device="web-1"`,
+			`{device="web-1"}`,
+			`rate(load1)`,
+			`load1[5x]`,
+			`load1 +`,
+			`sum(load1`,
+			`load1 + bool load5`,
+			`load1{mountpoint=~"("}`,
+		} {
+			if _, err := parsePromQL(query); err == nil {
+				t.Errorf("Got no error for %s, want one", query)
+			}
+		}
+	})
+
+	t.Run("Precedence", func(t *testing.T) {
+		expr, _ := parsePromQL(`1 + 2 * 3 ^ 2 ^ 0.5`)
+		value, err := (&promEvaluator{}).eval(expr, time.Now())
+		if want := 1 + 2*math.Pow(3, math.Pow(2, 0.5)); err != nil || value != want {
+			t.Errorf("Got %v, want %v", value, want)
+		}
+	})
+}
+
+func Test_evalPromQL(t *testing.T) {
+	store, err := newEmbeddedMetricsStore(t.TempDir() + "/metrics.db")
+	if err != nil {
+		t.Fatalf("Failed to open metrics store, %v", err)
+	}
+	defer store.Close()
+
+	now := time.Now().Truncate(time.Minute)
+	start := now.Add(-10 * time.Minute)
+	for i, device := range []string{"web-1", "web-2"} {
+		var samples []Sample
+		for j := 0; j <= 10; j++ {
+			// counters growing by 60 and 120 a minute, web-1 restarts counting halfway
+			ts := start.Add(time.Duration(j) * time.Minute)
+			counter := float64(j * 60 * (i + 1))
+			if i == 0 && j >= 5 {
+				counter = float64((j - 4) * 60)
+			}
+			samples = append(samples, Sample{Name: "rx_bytes", Labels: map[string]string{"interface": "eth0"}, Value: counter, Timestamp: ts})
+			samples = append(samples, Sample{Name: "load1", Value: float64(i + 1), Timestamp: ts})
+		}
+		store.Write(device, samples)
+	}
+	store.Rollup(start, now.Add(time.Minute))
+	instant := func(query string) interface{} {
+		value, err := evalPromInstant(store, query, now, now)
+		if err != nil {
+			t.Fatalf("Failed to evaluate %s, %v", query, err)
+		}
+		return value
+	}
+
+	t.Run("Selector", func(t *testing.T) {
+		got := instant(`load1{device=~"web-.", device!="web-1"}`).([]promSample)
+		if len(got) != 1 || got[0].Value != 2 || got[0].Labels["__name__"] != "load1" || got[0].Labels["device"] != "web-2" {
+			t.Errorf("Got %v, want load1 of web-2", got)
+		}
+	})
+
+	t.Run("Rate with reset", func(t *testing.T) {
+		got := instant(`sum by (interface) (rate(rx_bytes[11m]))`).([]promSample)
+		if len(got) != 1 || got[0].Value != 3 || len(got[0].Labels) != 1 || got[0].Labels["interface"] != "eth0" {
+			t.Errorf("Got %v, want 3 for eth0", got)
+		}
+	})
+
+	t.Run("Comparison", func(t *testing.T) {
+		if got := instant(`load1 > 1`).([]promSample); len(got) != 1 || got[0].Value != 2 {
+			t.Errorf("Got %v, want load1 of web-2", got)
+		}
+		if got := instant(`load1 > bool 1`).([]promSample); len(got) != 2 || got[0].Value != 0 || got[1].Value != 1 {
+			t.Errorf("Got %v, want 0 and 1", got)
+		}
+		if got := instant(`count(load1 * on (device) irate(rx_bytes[5m]) >= 1)`).([]promSample); len(got) != 1 || got[0].Value != 2 {
+			t.Errorf("Got %v, want a count of 2", got)
+		}
+	})
+
+	t.Run("Range", func(t *testing.T) {
+		series, err := evalPromRange(store, `avg(load1)`, start, now, time.Minute, now)
+		if err != nil || len(series) != 1 || len(series[0].Points) != 11 || series[0].Points[10].V != 1.5 {
+			t.Errorf("Got %v %v, want 11 points of 1.5", series, err)
+		}
+	})
+
+	t.Run("API", func(t *testing.T) {
+		defer func(old MetricsStore) { metricsStore = old }(metricsStore)
+		metricsStore = store
+		form := url.Values{"query": {`max(load1)`}, "time": {strconv.FormatInt(now.Unix(), 10)}}
+		r := httptest.NewRequest("POST", "/api/v1/query", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		promQuery(w, r)
+		want := fmt.Sprintf(`{"status":"success","data":{"resultType":"vector","result":[{"metric":{},"value":[%d,"2"]}]}}`, now.Unix())
+		if got := strings.TrimSpace(w.Body.String()); got != want {
+			t.Errorf("Got %v, want %v", got, want)
+		}
+	})
+}
+
+func Test_metricsHandler(t *testing.T) {
+	err := importReturnCodes(sampleCodeListLocation)
+	if err != nil {
+		t.Fatalf("Failed to get return codes, %v", err)
+	}
+	now := time.Now()
+	deviceList = []Device{
+		{Name: "web-1", Key: "samplekey", Mac: "00:01:02:03:04:05", Tags: []string{"web", "eu"}, LastCheckin: now, Registered: now.Add(-time.Hour)},
+		{Name: "web-2", Mac: "00:01:02:03:04:06", LastCheckin: now.Add(-time.Hour)},
+	}
+	defer func() { deviceList = nil }()
+
+	router := mux.NewRouter()
+	router.Use(instrumentRequest)
+	router.HandleFunc("/checkin", checkInDevice).Methods("POST")
+	router.Handle("/metrics", metricsHandler()).Methods("GET")
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/checkin", strings.NewReader(`{"key": "wrongkey"}`)))
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	for _, want := range []string{
+		`remotemonitor_device_up{mac="00:01:02:03:04:05",name="web-1",tags="eu,web"} 1`,
+		`remotemonitor_device_up{mac="00:01:02:03:04:06",name="web-2",tags=""} 0`,
+		fmt.Sprintf(`remotemonitor_device_registered_timestamp_seconds{mac="00:01:02:03:04:05",name="web-1",tags="eu,web"} %s`, strconv.FormatFloat(float64(now.Add(-time.Hour).UnixNano())/1e9, 'e', -1, 64)),
+		`remotemonitor_requests_total{api="http",code="3001",route="/checkin",status="400"} 1`,
+		`remotemonitor_bad_key_rejections_total{api="http"} 1`,
+		`remotemonitor_cache_entries{cache="devices"} 2`,
+	} {
+		if !strings.Contains(w.Body.String(), want) {
+			t.Errorf("Got no %s, want it", want)
+		}
+	}
+
+	t.Run("Checked out", func(t *testing.T) {
+		dev := Device{LastCheckin: now.Add(-time.Minute), LastCheckout: now}
+		if got := dev.IsUp(now); got {
+			t.Errorf("Got %v, want %v", got, false)
+		}
+	})
+}
+
+func Test_recordCheckinWhileAdding(t *testing.T) {
+	// check-ins land on the device in the list even while devices are added, which moves the list to a new array
+	deviceList = []Device{{Name: "web-1", Key: "samplekey"}}
+	defer func() { deviceList = nil }()
+
+	var wg sync.WaitGroup
+	var last time.Time
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			deviceListMutex.Lock()
+			deviceList = append(deviceList, Device{Name: fmt.Sprintf("device-%d", i), Key: fmt.Sprintf("key-%d", i)})
+			deviceListMutex.Unlock()
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			last = recordCheckin("samplekey")
+		}
+	}()
+	wg.Wait()
+
+	dev, found := deviceByKey("samplekey")
+	if !found || !dev.LastCheckin.Equal(last) {
+		t.Errorf("Got %v, want %v", dev.LastCheckin, last)
+	}
+}
+
+func Test_checkDeviceStatuses(t *testing.T) {
+	now := time.Now()
+	deviceList = []Device{{Name: "web-1", Key: "samplekey", Registered: now.Add(-time.Hour), LastCheckin: now}}
+	defer func() { deviceList = nil }()
+	dev := &deviceList[0]
+
+	// the default check-in interval is 10s, late after 20s and offline after 50s
+	for _, tt := range []struct {
+		name   string
+		at     time.Time
+		status string
+		reason string
+		since  time.Time
+	}{
+		{"Online", now.Add(15 * time.Second), StatusOnline, "checkin", now},
+		{"Late", now.Add(25 * time.Second), StatusLate, "missed_checkins", now.Add(20 * time.Second)},
+		{"Offline", now.Add(time.Minute), StatusOffline, "missed_checkins", now.Add(50 * time.Second)},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			checkDeviceStatuses(tt.at)
+			if dev.Status != tt.status || !dev.StatusSince.Equal(tt.since) {
+				t.Errorf("Got %v since %v, want %v since %v", dev.Status, dev.StatusSince, tt.status, tt.since)
+			}
+			if _, reason, _ := dev.CurrentStatus(tt.at); reason != tt.reason {
+				t.Errorf("Got %v, want %v", reason, tt.reason)
+			}
+		})
+	}
+
+	t.Run("Checkin", func(t *testing.T) {
+		recordCheckin(dev.Key)
+		if dev.Status != StatusOnline {
+			t.Errorf("Got %v, want %v", dev.Status, StatusOnline)
+		}
+	})
+
+	t.Run("Checkout", func(t *testing.T) {
+		recordCheckout(dev.Key)
+		status, reason, _ := dev.CurrentStatus(time.Now())
+		if dev.Status != StatusOffline || status != StatusOffline || reason != "checkout" {
+			t.Errorf("Got %v (%v), want %v (checkout)", dev.Status, reason, StatusOffline)
+		}
+	})
+}
+
+func Test_statusAfterRestart(t *testing.T) {
+	// devices keep the status they had before a restart, check-ins missed while the backend was down do not count
+	now := time.Now()
+	statusGraceFrom = now
+	defer func() { statusGraceFrom = time.Time{} }()
+
+	// the default check-in interval is 10s, late after 20s and offline after 50s
+	for _, tt := range []struct {
+		name   string
+		status string
+		at     time.Time
+		want   string
+	}{
+		{"Online stays online", StatusOnline, now.Add(15 * time.Second), StatusOnline},
+		{"Online goes late", StatusOnline, now.Add(25 * time.Second), StatusLate},
+		{"Late stays late", StatusLate, now.Add(time.Second), StatusLate},
+		{"Late goes offline", StatusLate, now.Add(31 * time.Second), StatusOffline},
+		{"Offline stays offline", StatusOffline, now.Add(time.Second), StatusOffline},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			dev := Device{Name: "web-1", Key: "samplekey", Registered: now.Add(-2 * time.Hour), LastCheckin: now.Add(-time.Hour), Status: tt.status}
+			if got, _, _ := dev.CurrentStatus(tt.at); got != tt.want {
+				t.Errorf("Got %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	t.Run("No transition", func(t *testing.T) {
+		var notifications []StatusNotification
+		statusListeners = []func(StatusNotification){func(n StatusNotification) { notifications = append(notifications, n) }}
+		defer func() { statusListeners = nil }()
+		since := now.Add(-3 * time.Hour)
+		deviceList = []Device{
+			{Name: "web-1", Key: "key-1", Registered: now.Add(-4 * time.Hour), LastCheckin: now.Add(-time.Hour), Status: StatusOnline, StatusSince: since},
+			{Name: "web-2", Key: "key-2", Registered: now.Add(-4 * time.Hour), LastCheckin: since, Status: StatusOffline, StatusSince: since},
+		}
+		defer func() { deviceList = nil }()
+
+		checkDeviceStatuses(now.Add(time.Second))
+		if len(notifications) != 0 || !deviceList[0].StatusSince.Equal(since) || !deviceList[1].StatusSince.Equal(since) {
+			t.Errorf("Got %v, want the devices to keep their status", notifications)
+		}
+	})
+}
+
+func Test_flapDetection(t *testing.T) {
+	var notifications []StatusNotification
+	statusListeners = []func(StatusNotification){func(n StatusNotification) { notifications = append(notifications, n) }}
+	defer func() { statusListeners = nil }()
+
+	// a device going late and back online every minute
+	base := time.Now()
+	dev := &Device{Name: "web-1", Key: "samplekey", Registered: base.Add(-time.Hour), LastCheckin: base}
+	updateDeviceStatus(dev, base)
+	for i := 0; i < 6; i++ {
+		at := base.Add(time.Duration(i) * time.Minute)
+		dev.LastCheckin = at
+		applyStatusUpdate(updateDeviceStatus(dev, at))
+		applyStatusUpdate(updateDeviceStatus(dev, at.Add(30*time.Second)))
+	}
+
+	t.Run("Started", func(t *testing.T) {
+		if !dev.Flapping || dev.FlapScore < flapStartThreshold {
+			t.Fatalf("Got flapping %v with score %v, want flapping", dev.Flapping, dev.FlapScore)
+		}
+		// transitions are notified until flapping starts, then nothing more
+		last := notifications[len(notifications)-1]
+		if last.Kind != "flapping_started" {
+			t.Errorf("Got %v, want flapping_started", last.Kind)
+		}
+		for _, n := range notifications[:len(notifications)-1] {
+			if n.Kind != "transition" {
+				t.Errorf("Got %v, want only transitions before flapping started", n.Kind)
+			}
+		}
+	})
+
+	t.Run("Stopped", func(t *testing.T) {
+		// once the transitions leave the window the device stops flapping
+		count := len(notifications)
+		applyStatusUpdate(updateDeviceStatus(dev, base.Add(time.Hour)))
+		if dev.Flapping || len(notifications) != count+1 || notifications[count].Kind != "flapping_stopped" {
+			t.Errorf("Got flapping %v and %v, want a single flapping_stopped", dev.Flapping, notifications[count:])
+		}
+	})
+
+	t.Run("Score", func(t *testing.T) {
+		// a transition counts for 1 when it happens and 0.5 at the edge of the window
+		score := flapScore([]time.Time{base, base.Add(-flapWindow)}, base)
+		if score != 1.5 {
+			t.Errorf("Got %v, want 1.5", score)
+		}
+	})
+}
+
+func Test_evaluateAlerts(t *testing.T) {
+	store, err := newEmbeddedMetricsStore(t.TempDir() + "/metrics.db")
+	if err != nil {
+		t.Fatalf("Failed to open metrics store, %v", err)
+	}
+	defer store.Close()
+	defer func(old MetricsStore) { metricsStore = old }(metricsStore)
+	metricsStore = store
+
+	var notified []Alert
+	alertListeners = []func(Alert){func(alert Alert) { notified = append(notified, alert) }}
+	defer func() {
+		alertListeners = nil
+		alertRules = make(map[string]AlertRule)
+		alerts = make(map[alertKey]*Alert)
+		deviceList = nil
+	}()
+
+	now := time.Now().Truncate(time.Second)
+	deviceList = []Device{
+		{Name: "web-1", Status: StatusOffline, StatusSince: now.Add(-30 * time.Second)},
+		{Name: "web-2", Status: StatusOnline, StatusSince: now.Add(-time.Hour)},
+	}
+	store.Write("web-1", []Sample{{Name: "load1", Value: 1, Timestamp: now.Add(-time.Minute)}})
+	store.Write("web-2", []Sample{{Name: "load1", Value: 8, Timestamp: now.Add(-time.Minute)}})
+	for _, rule := range []AlertRule{
+		{Name: "DeviceOffline", Status: StatusOffline, For: "1m", Severity: "critical"},
+		{Name: "HighLoad", Query: "load1 > 4", Labels: map[string]string{"team": "ops"}},
+	} {
+		rule = normalizeAlertRule(rule, "api")
+		if err := validateAlertRule(rule); err != nil {
+			t.Fatalf("Got %v, want a valid rule", err)
+		}
+		alertRules[rule.Name] = rule
+	}
+
+	t.Run("Pending", func(t *testing.T) {
+		// the status rule waits for its for duration, the query rule fires right away
+		evaluateAlerts(now)
+		pending := listAlerts(AlertPending)
+		if len(pending) != 1 || pending[0].Labels["device"] != "web-1" || pending[0].Labels["severity"] != "critical" {
+			t.Errorf("Got %v, want web-1 pending", pending)
+		}
+		if len(notified) != 1 || notified[0].Rule != "HighLoad" || notified[0].Labels["device"] != "web-2" ||
+			notified[0].Labels["team"] != "ops" || notified[0].Value != 8 {
+			t.Errorf("Got %v, want HighLoad firing for web-2", notified)
+		}
+	})
+
+	t.Run("Firing", func(t *testing.T) {
+		evaluateAlerts(now.Add(30 * time.Second))
+		firing := listAlerts(AlertFiring)
+		if len(firing) != 2 || len(notified) != 2 || notified[1].Rule != "DeviceOffline" {
+			t.Errorf("Got %v, want both alerts firing and notified once", firing)
+		}
+		// still holding, nothing new to tell
+		evaluateAlerts(now.Add(45 * time.Second))
+		if len(notified) != 2 {
+			t.Errorf("Got %v notifications, want 2", len(notified))
+		}
+	})
+
+	t.Run("Resolved", func(t *testing.T) {
+		deviceList[0].Status = StatusOnline
+		evaluateAlerts(now.Add(time.Minute))
+		resolved := listAlerts(AlertResolved)
+		if len(resolved) != 1 || resolved[0].Rule != "DeviceOffline" || len(notified) != 3 || notified[2].State != AlertResolved {
+			t.Errorf("Got %v, want DeviceOffline resolved", resolved)
+		}
+	})
+
+	t.Run("UnknownDevice", func(t *testing.T) {
+		// alerts of devices that did not register again yet are kept
+		deviceList = deviceList[1:]
+		key := alertKey{"DeviceOffline", encodeLabels(alertLabels(alertRules["DeviceOffline"], map[string]string{"device": "web-3"}))}
+		alerts[key] = &Alert{Rule: "DeviceOffline", Labels: map[string]string{"device": "web-3"}, State: AlertFiring}
+		evaluateAlerts(now.Add(2 * time.Minute))
+		if alerts[key].State != AlertFiring {
+			t.Errorf("Got %v, want %v", alerts[key].State, AlertFiring)
+		}
+	})
+
+	t.Run("Maintenance", func(t *testing.T) {
+		// devices in a maintenance window raise no alert until it ends
+		maintenanceWindows["always"], _ = parseMaintenanceWindow(MaintenanceWindow{Name: "always", SilenceMatcher: SilenceMatcher{Device: "web-2"}, Schedule: "* * * * *", Duration: "1h"})
+		defer func() { maintenanceWindows = make(map[string]MaintenanceWindow) }()
+		deviceList[0].Status = StatusOffline
+		deviceList[0].StatusSince = now
+		evaluateAlerts(now.Add(3 * time.Minute))
+		if pending := listAlerts(AlertPending); len(pending) != 0 {
+			t.Errorf("Got %v, want no alert during maintenance", pending)
+		}
+		delete(maintenanceWindows, "always")
+		evaluateAlerts(now.Add(4 * time.Minute))
+		if firing := listAlerts(AlertFiring); len(firing) != 2 || firing[0].Labels["device"] != "web-2" && firing[1].Labels["device"] != "web-2" {
+			t.Errorf("Got %v, want web-2 offline once maintenance ended", firing)
+		}
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		for _, rule := range []AlertRule{{Name: "x"}, {Name: "x", Status: "gone"}, {Name: "x", Query: "load1 >"}, {Name: "x", Status: StatusLate, Query: "load1"}} {
+			if validateAlertRule(rule) == nil {
+				t.Errorf("Got nil, want an error for %v", rule)
+			}
+		}
+	})
+}
+
+func Test_alertsAfterRestart(t *testing.T) {
+	// alerts that were firing when the backend stopped keep firing once it started again, without being notified again
+	var notified []Alert
+	alertListeners = []func(Alert){func(alert Alert) { notified = append(notified, alert) }}
+	defer func() {
+		alertListeners = nil
+		alertRules = make(map[string]AlertRule)
+		alerts = make(map[alertKey]*Alert)
+		deviceList = nil
+		statusGraceFrom = time.Time{}
+	}()
+
+	now := time.Now().Truncate(time.Second)
+	rule := normalizeAlertRule(AlertRule{Name: "DeviceOffline", Status: StatusOffline, For: "1m"}, "api")
+	alertRules[rule.Name] = rule
+	deviceList = []Device{
+		{Name: "web-1", Key: "key-1", Registered: now.Add(-2 * time.Hour), LastCheckin: now.Add(-time.Hour)},
+		{Name: "web-2", Key: "key-2", Registered: now.Add(-2 * time.Hour), LastCheckin: now},
+	}
+	checkDeviceStatuses(now)
+	evaluateAlerts(now)
+	if len(notified) != 1 || notified[0].Labels["device"] != "web-1" {
+		t.Fatalf("Got %v, want DeviceOffline firing for web-1", notified)
+	}
+
+	// the backend stops, only what is in the database survives: the registration table, the last transition and the alert state
+	var saved [][]byte
+	for _, alert := range alerts {
+		jsonData, _ := json.Marshal(alert)
+		saved = append(saved, jsonData)
+	}
+	var restored []Device
+	for _, dev := range deviceList {
+		restored = append(restored, Device{Name: dev.Name, Key: dev.Key, Registered: dev.Registered, LastCheckin: dev.LastCheckin,
+			Status: dev.Status, StatusSince: dev.StatusSince})
+	}
+	restart := now.Add(10 * time.Minute)
+	statusGraceFrom = restart
+	deviceList = restored
+	alerts = make(map[alertKey]*Alert)
+	for _, jsonData := range saved {
+		var alert Alert
+		json.Unmarshal(jsonData, &alert)
+		alerts[alertKey{alert.Rule, encodeLabels(alert.Labels)}] = &alert
+	}
+
+	for _, at := range []time.Time{restart, restart.Add(alertEvalInterval), restart.Add(time.Minute)} {
+		checkDeviceStatuses(at)
+		evaluateAlerts(at)
+	}
+	firing := listAlerts(AlertFiring)
+	if len(notified) != 1 || len(firing) != 1 || firing[0].Labels["device"] != "web-1" || !firing[0].FiredAt.Equal(now) {
+		t.Errorf("Got %v notified and %v firing, want web-1 still firing from before the restart", notified, firing)
+	}
+}
+
+func Test_notifications(t *testing.T) {
+	defer func(old time.Duration) { notifyBackoff = old }(notifyBackoff)
+	notifyBackoff = time.Millisecond
+
+	// a webhook failing once, a chat webhook, and an SMTP stand-in
+	var webhookCalls int
+	var webhookBody []byte
+	var webhookSignature string
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		webhookCalls++
+		if webhookCalls == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		webhookBody, _ = ioutil.ReadAll(r.Body)
+		webhookSignature = r.Header.Get("X-RemoteMonitor-Signature")
+	}))
+	defer webhook.Close()
+	var chatPayload map[string]string
+	chat := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&chatPayload)
+	}))
+	defer chat.Close()
+	smtpAddr, mails := fakeSMTPServer(t)
+	smtpHost, smtpPort, _ := net.SplitHostPort(smtpAddr)
+	port, _ := strconv.Atoi(smtpPort)
+
+	creds := map[string]interface{}{"notifications": map[string]interface{}{
+		"channels": []map[string]interface{}{
+			{"name": "hook", "type": "webhook", "url": webhook.URL, "secret": "s3cret"},
+			{"name": "chat", "type": "mattermost", "url": chat.URL, "title": "{{.Name}} is {{.State}}"},
+			{"name": "mail", "type": "email", "smtp_host": smtpHost, "smtp_port": port, "from": "rm@example.com", "to": []string{"ops@example.com"}},
+		},
+		"routes": []map[string]interface{}{
+			{"match": map[string]string{"severity": "critical"}, "channels": []string{"mail"}, "continue": true},
+			{"match": map[string]string{"severity": "critical"}, "channels": []string{"hook"}},
+			{"channels": []string{"chat"}},
+		},
+	}}
+	defer func() {
+		notificationTargets = make(map[string]*notificationTarget)
+		notificationRoutes = nil
+		alertListeners = nil
+		statusListeners = nil
+	}()
+	if err := loadNotifier(creds); err != nil {
+		t.Fatalf("Failed to load notifier, %v", err)
+	}
+
+	t.Run("Routing", func(t *testing.T) {
+		for _, tt := range []struct {
+			labels map[string]string
+			want   string
+		}{
+			{map[string]string{"severity": "critical"}, "mail,hook"},
+			{map[string]string{"severity": "warning"}, "chat"},
+			{map[string]string{"device": "web-1"}, "chat"},
+		} {
+			if got := strings.Join(routeNotification(tt.labels), ","); got != tt.want {
+				t.Errorf("Got %v, want %v", got, tt.want)
+			}
+		}
+	})
+
+	n := Notification{Kind: "alert", Name: "DeviceOffline", State: AlertFiring, Labels: map[string]string{"device": "web-1", "severity": "critical"},
+		Summary: "web-1 is down", Timestamp: time.Now()}
+
+	t.Run("Webhook", func(t *testing.T) {
+		delivery := deliverNotification(notificationTargets["hook"], n)
+		if !delivery.Success || delivery.Attempts != 2 {
+			t.Fatalf("Got %v, want a success on the second attempt", delivery)
+		}
+		if webhookSignature != "sha256="+signPayload(webhookBody, "s3cret") {
+			t.Errorf("Got %v, want the HMAC of the body", webhookSignature)
+		}
+		var payload map[string]interface{}
+		json.Unmarshal(webhookBody, &payload)
+		if payload["name"] != "DeviceOffline" || payload["title"] != "[firing] DeviceOffline on web-1" {
+			t.Errorf("Got %v, want the notification with its title", payload)
+		}
+	})
+
+	t.Run("Chat", func(t *testing.T) {
+		delivery := deliverNotification(notificationTargets["chat"], n)
+		if !delivery.Success || !strings.HasPrefix(chatPayload["text"], "*DeviceOffline is firing*\nweb-1 is down\n") {
+			t.Errorf("Got %v, want the rendered title and body", chatPayload)
+		}
+	})
+
+	t.Run("Email", func(t *testing.T) {
+		delivery := deliverNotification(notificationTargets["mail"], n)
+		if !delivery.Success {
+			t.Fatalf("Got %v, want a success", delivery.Error)
+		}
+		mail := <-mails
+		if !strings.Contains(mail, "Subject: [firing] DeviceOffline on web-1\r\n") || !strings.Contains(mail, "severity=critical\r\n") {
+			t.Errorf("Got %v, want the rendered subject and body", mail)
+		}
+
+		// device names are self-reported, they must not add headers
+		injected := n
+		injected.Labels = map[string]string{"device": "web-1\r\nBcc: victim@example.com", "severity": "critical"}
+		delivery = deliverNotification(notificationTargets["mail"], injected)
+		if !delivery.Success {
+			t.Fatalf("Got %v, want a success", delivery.Error)
+		}
+		headers := strings.SplitN(<-mails, "\r\n\r\n", 2)[0]
+		if strings.Contains(headers, "\r\nBcc:") || !strings.Contains(headers, "Subject: [firing] DeviceOffline on web-1 Bcc: victim@example.com\r\n") {
+			t.Errorf("Got %v, want the line break removed from the subject", headers)
+		}
+	})
+
+	t.Run("Failure", func(t *testing.T) {
+		target, _ := newNotificationTarget(NotificationChannel{Name: "down", Type: "slack", URL: "http://127.0.0.1:1/hook"})
+		delivery := deliverNotification(target, n)
+		if delivery.Success || delivery.Attempts != notifyAttempts || delivery.Error == "" {
+			t.Errorf("Got %v, want %v failed attempts", delivery, notifyAttempts)
+		}
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		for _, channel := range []NotificationChannel{{Name: "x", Type: "pager"}, {Name: "x", Type: "email"}, {Name: "x", Type: "webhook", URL: "http://a", Title: "{{"},
+			{Name: "x", Type: "email", SMTPHost: "localhost", From: "rm@example.com", To: []string{"ops@example.com\r\nBcc: victim@example.com"}}} {
+			if _, err := newNotificationTarget(channel); err == nil {
+				t.Errorf("Got nil, want an error for %v", channel)
+			}
+		}
+	})
+}
+
+func Test_silences(t *testing.T) {
+	t.Run("Cron", func(t *testing.T) {
+		saturday := time.Date(2026, 3, 7, 2, 30, 0, 0, time.UTC)
+		for _, tt := range []struct {
+			expr string
+			at   time.Time
+			want bool
+		}{
+			{"30 2 * * 6", saturday, true},
+			{"30 2 * * 0,7", saturday, false},
+			{"*/15 1-3 * * *", saturday, true},
+			{"*/20 1-3 * * *", saturday, false},
+			{"30 2 7 * 1", saturday, true}, // day of month or day of week
+			{"30 2 8 * 1", saturday, false},
+			{"30 2 * 4 *", saturday, false},
+		} {
+			schedule, err := parseCronSchedule(tt.expr)
+			if err != nil {
+				t.Fatalf("Got %v, want %s to parse", err, tt.expr)
+			}
+			if got := schedule.matches(tt.at); got != tt.want {
+				t.Errorf("Got %v, want %v for %s", got, tt.want, tt.expr)
+			}
+		}
+		for _, expr := range []string{"* * * *", "60 * * * *", "* * 0 * *", "*/0 * * * *", "a * * * *", "5-2 * * * *"} {
+			if _, err := parseCronSchedule(expr); err == nil {
+				t.Errorf("Got nil, want an error for %s", expr)
+			}
+		}
+	})
+
+	t.Run("Window", func(t *testing.T) {
+		mw := MaintenanceWindow{Name: "patching", SilenceMatcher: SilenceMatcher{Tag: "rack-4"}, Schedule: "0 2 * * 6", Duration: "4h", Timezone: "UTC"}
+		mw, err := parseMaintenanceWindow(mw)
+		if err != nil {
+			t.Fatalf("Got %v, want a valid window", err)
+		}
+		for _, tt := range []struct {
+			at   time.Time
+			want bool
+		}{
+			{time.Date(2026, 3, 7, 1, 59, 0, 0, time.UTC), false},
+			{time.Date(2026, 3, 7, 2, 0, 0, 0, time.UTC), true},
+			{time.Date(2026, 3, 7, 5, 59, 59, 0, time.UTC), true},
+			{time.Date(2026, 3, 7, 6, 0, 0, 0, time.UTC), false},
+		} {
+			if got := mw.activeAt(tt.at); got != tt.want {
+				t.Errorf("Got %v, want %v at %v", got, tt.want, tt.at)
+			}
+		}
+
+		// windows across midnight and lasting days, starting on the last minute of the month
+		for _, tt := range []struct {
+			schedule, duration string
+			at                 time.Time
+			want               bool
+		}{
+			{"30 23 * * 5", "3h", time.Date(2026, 3, 7, 2, 29, 0, 0, time.UTC), true},
+			{"30 23 * * 5", "3h", time.Date(2026, 3, 7, 2, 30, 0, 0, time.UTC), false},
+			{"59 23 28 2 *", "168h", time.Date(2026, 3, 7, 23, 58, 0, 0, time.UTC), true},
+			{"59 23 28 2 *", "168h", time.Date(2026, 3, 7, 23, 59, 0, 0, time.UTC), false},
+			{"*/15 * * * *", "10m", time.Date(2026, 3, 7, 2, 39, 0, 0, time.UTC), true},
+			{"*/15 * * * *", "10m", time.Date(2026, 3, 7, 2, 40, 0, 0, time.UTC), false},
+		} {
+			window, err := parseMaintenanceWindow(MaintenanceWindow{Name: "w", SilenceMatcher: SilenceMatcher{Tag: "a"}, Schedule: tt.schedule, Duration: tt.duration, Timezone: "UTC"})
+			if err != nil {
+				t.Fatalf("Got %v, want a valid window", err)
+			}
+			if got := window.activeAt(tt.at); got != tt.want {
+				t.Errorf("Got %v, want %v for %s at %v", got, tt.want, tt.schedule, tt.at)
+			}
+		}
+	})
+
+	now := time.Date(2026, 3, 7, 3, 0, 0, 0, time.UTC)
+	deviceList = []Device{
+		{Name: "web-1", Mac: "aa:bb:cc:dd:ee:01", Tags: []string{"rack-4"}},
+		{Name: "web-2", Mac: "aa:bb:cc:dd:ee:02"},
+	}
+	silences[1] = Silence{ID: 1, SilenceMatcher: SilenceMatcher{Mac: "AA:BB:CC:DD:EE:02", Labels: map[string]string{"alertname": "HighLoad"}},
+		StartsAt: now.Add(-time.Hour), EndsAt: now.Add(time.Hour)}
+	silences[2] = Silence{ID: 2, SilenceMatcher: SilenceMatcher{Device: "web-2"}, StartsAt: now.Add(time.Hour), EndsAt: now.Add(2 * time.Hour)}
+	maintenanceWindows["patching"], _ = parseMaintenanceWindow(MaintenanceWindow{Name: "patching", SilenceMatcher: SilenceMatcher{Tag: "rack-4"}, Schedule: "0 2 * * 6", Duration: "4h", Timezone: "UTC"})
+	defer func() {
+		deviceList = nil
+		silences = make(map[int]Silence)
+		maintenanceWindows = make(map[string]MaintenanceWindow)
+	}()
+
+	t.Run("Matching", func(t *testing.T) {
+		for _, tt := range []struct {
+			labels map[string]string
+			at     time.Time
+			want   string
+		}{
+			{map[string]string{"device": "web-1", "event": "device_offline"}, now, "maintenance patching"},
+			{map[string]string{"device": "web-1", "event": "device_offline"}, now.Add(4 * time.Hour), ""},
+			{map[string]string{"device": "web-2", "alertname": "HighLoad"}, now, "silence 1"},
+			{map[string]string{"device": "web-2", "alertname": "DeviceOffline"}, now, ""},
+			{map[string]string{"device": "web-2", "alertname": "DeviceOffline"}, now.Add(90 * time.Minute), "silence 2"},
+			{map[string]string{"alertname": "HighLoad"}, now, ""},
+		} {
+			if got := silencedBy(tt.labels, tt.at); got != tt.want {
+				t.Errorf("Got %q, want %q for %v", got, tt.want, tt.labels)
+			}
+		}
+		if got := devicesInMaintenance(now); len(got) != 1 || !got["web-1"] {
+			t.Errorf("Got %v, want web-1 in maintenance", got)
+		}
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		for _, s := range []Silence{{StartsAt: now, EndsAt: now.Add(time.Hour)}, {SilenceMatcher: SilenceMatcher{Device: "web-1"}, StartsAt: now, EndsAt: now}} {
+			if validateSilence(s) == nil {
+				t.Errorf("Got nil, want an error for %v", s)
+			}
+		}
+		if _, err := parseMaintenanceWindow(MaintenanceWindow{Name: "x", SilenceMatcher: SilenceMatcher{Tag: "a"}, Schedule: "0 2 * * 6", Duration: "8d"}); err == nil {
+			t.Errorf("Got nil, want an error for a window longer than a week")
+		}
+	})
+}
+
+func fakeSMTPServer(t *testing.T) (string, chan string) {
+	// just enough SMTP to receive mails from net/smtp, every mail received is sent to the channel
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen, %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	mails := make(chan string, 10)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				fmt.Fprint(conn, "220 localhost\r\n")
+				for {
+					line, err := reader.ReadString('\n')
+					if err != nil {
+						return
+					}
+					switch command := strings.ToUpper(strings.Fields(line + " x")[0]); command {
+					case "EHLO", "HELO", "MAIL", "RCPT", "RSET", "NOOP":
+						fmt.Fprint(conn, "250 OK\r\n")
+					case "DATA":
+						fmt.Fprint(conn, "354 go ahead\r\n")
+						var mail strings.Builder
+						for {
+							line, err = reader.ReadString('\n')
+							if err != nil || line == ".\r\n" {
+								break
+							}
+							mail.WriteString(line)
+						}
+						mails <- mail.String()
+						fmt.Fprint(conn, "250 OK\r\n")
+					case "QUIT":
+						fmt.Fprint(conn, "221 bye\r\n")
+						return
+					default:
+						fmt.Fprint(conn, "502 not implemented\r\n")
+					}
+				}
+			}()
+		}
+	}()
+	return listener.Addr().String(), mails
+}
+
+func Test_computeAvailability(t *testing.T) {
+	from := time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+	to := from.Add(10 * time.Hour)
+	at := func(hours float64) time.Time { return from.Add(time.Duration(hours * float64(time.Hour))) }
+
+	// online before the window, one outage going through late and offline, a check-out, and a second outage
+	initial := &StatusChange{Timestamp: from.Add(-time.Hour), Status: StatusOnline, Reason: "checkin"}
+	changes := []StatusChange{
+		{Timestamp: at(2), Status: StatusLate, Previous: StatusOnline, Reason: "missed_checkins"},
+		{Timestamp: at(3), Status: StatusOffline, Previous: StatusLate, Reason: "missed_checkins"},
+		{Timestamp: at(4), Status: StatusOnline, Previous: StatusOffline, Reason: "checkin"},
+		{Timestamp: at(5), Status: StatusOffline, Previous: StatusOnline, Reason: "checkout"},
+		{Timestamp: at(7), Status: StatusOnline, Previous: StatusOffline, Reason: "checkin"},
+		{Timestamp: at(8), Status: StatusOffline, Previous: StatusOnline, Reason: "missed_checkins"},
+		{Timestamp: at(9.5), Status: StatusOnline, Previous: StatusOffline, Reason: "checkin"},
+	}
+	intervals := statusIntervals(initial, changes, from, to)
+	if len(intervals) != 8 || !intervals[0].Start.Equal(from) || !intervals[7].End.Equal(to) {
+		t.Fatalf("Got %v, want 8 intervals covering the window", intervals)
+	}
+
+	report := computeAvailability(intervals, from, to)
+	t.Run("Device", func(t *testing.T) {
+		// up 2 + 1 (late) + 1 + 1 + 0.5 hours, down 1 + 1.5 hours, planned 2 hours
+		if report.Uptime != 5.5*3600 || report.Downtime != 2.5*3600 || report.Planned != 2*3600 || report.Monitored != 8*3600 {
+			t.Errorf("Got %v, want 5.5h up, 2.5h down, 2h planned", report)
+		}
+		if report.Outages != 2 || report.LongestOutage != 1.5*3600 || *report.MTTR != 1.25*3600 || *report.MTBF != 2.75*3600 {
+			t.Errorf("Got %v, want 2 outages, longest 1.5h, MTTR 1.25h, MTBF 2.75h", report)
+		}
+		if *report.Availability != 100*5.5/8 {
+			t.Errorf("Got %v, want %v", *report.Availability, 100*5.5/8)
+		}
+	})
+
+	t.Run("Restart", func(t *testing.T) {
+		// a first status written in the middle of an outage by a restart of an older version is not a recovery
+		restarted := append([]StatusChange{}, changes[:6]...)
+		restarted = append(restarted, StatusChange{Timestamp: at(9), Status: StatusOnline, Reason: "register"})
+		restarted = append(restarted, changes[6:]...)
+		if got := computeAvailability(statusIntervals(initial, restarted, from, to), from, to); got.Downtime != report.Downtime {
+			t.Errorf("Got %v, want %v", got.Downtime, report.Downtime)
+		}
+	})
+
+	t.Run("Group", func(t *testing.T) {
+		unknown := computeAvailability(statusIntervals(nil, nil, from, to), from, to)
+		if unknown.Availability != nil || unknown.MTTR != nil {
+			t.Errorf("Got %v, want no availability without history", unknown)
+		}
+		total := sumAvailability([]AvailabilityReport{report, unknown, report}, from, to)
+		if total.Outages != 4 || *total.Availability != *report.Availability || *total.MTTR != *report.MTTR {
+			t.Errorf("Got %v, want the figures of a single device, with 4 outages", total)
+		}
+	})
+
+	t.Run("CSV", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		report.Device = "web-1"
+		writeReportCSV(w, []AvailabilityReport{report}, "web-1-availability.csv")
+		want := strings.Join(reportCSVHeader, ",") + "\n" +
+			"web-1,2026-03-01T00:00:00Z,2026-03-01T10:00:00Z,68.750,28800.000,19800.000,9000.000,7200.000,2,5400.000,4500.000,9900.000\n"
+		if got := w.Body.String(); got != want {
+			t.Errorf("Got %v, want %v", got, want)
+		}
+	})
+}
@@ -0,0 +1,192 @@
+// results of the Nagios-compatible checks run by node-reporter
+
+package backendapi
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// CheckResult is the outcome of a single run of a check on a device
+type CheckResult struct {
+	Name       string      `json:"name"`        // name of the check
+	Status     int         `json:"status"`      // 0 OK, 1 WARNING, 2 CRITICAL, 3 UNKNOWN
+	StatusText string      `json:"status_text"` // status as text
+	Output     string      `json:"output"`      // plugin output without performance data
+	PerfData   []PerfDatum `json:"perf_data"`   // performance data returned by the plugin
+	Duration   float64     `json:"duration"`    // how long the command took, in seconds
+	Timestamp  time.Time   `json:"timestamp"`   // when the command was started
+}
+
+// PerfDatum is a single performance data item returned by a check
+type PerfDatum struct {
+	Label string   `json:"label"`
+	Value float64  `json:"value"`
+	UOM   string   `json:"uom,omitempty"`
+	Warn  string   `json:"warn,omitempty"`
+	Crit  string   `json:"crit,omitempty"`
+	Min   *float64 `json:"min,omitempty"`
+	Max   *float64 `json:"max,omitempty"`
+}
+
+var checkStatusText = map[int]string{0: "OK", 1: "WARNING", 2: "CRITICAL", 3: "UNKNOWN"}
+
+////////////
+// respond to HTTP calls from client
+func receiveCheckResults(w http.ResponseWriter, r *http.Request) {
+	// devices send the results of their checks here, the latest result of each check is kept with the device
+	w.Header().Set("Content-Type", "application/json")
+	tmpDev, results, code := readCheckResultsRequestBody(r.Body)
+
+	if code != returnCodeList["DataOK"].Code {
+		var response string
+		if code == returnCodeList["BadKey"].Code {
+			response, _ = generateErrorResponse("BadKey")
+		} else {
+			response, _ = generateErrorResponse("DataMalformed")
+		}
+
+		log.Printf("Received bad check results (error %d), %s\n", code, response)
+		http.Error(w, response, http.StatusBadRequest)
+		return
+	}
+
+	// the latest results are kept with the device, events and history are stored once the lock is released
+	var events []Event
+	withDevice(tmpDev.Key, func(dev *Device) {
+		if dev.Checks == nil {
+			dev.Checks = make(map[string]CheckResult)
+		}
+		for _, result := range results {
+			// a change of status is worth an event, the first result of a check is not
+			previous, known := dev.Checks[result.Name]
+			if known && previous.Status != result.Status {
+				events = append(events, Event{Type: "check_status_changed", Timestamp: result.Timestamp,
+					Labels:  map[string]string{"check": result.Name, "status": result.StatusText},
+					Message: fmt.Sprintf("check %s changed from %s to %s: %s", result.Name, previous.StatusText, result.StatusText, result.Output)})
+			}
+			dev.Checks[result.Name] = result
+		}
+	})
+	name, key := tmpDev.Name, tmpDev.Key
+
+	for _, event := range events {
+		log.Printf("Event from %s: %s, %s\n", name, event.Type, event.Message)
+		err := newDeviceEvent(key, event, dbObj)
+		if err != nil {
+			log.Println(err)
+		}
+	}
+	for _, result := range results {
+		err := newCheckResult(key, result, dbObj)
+		if err != nil {
+			log.Println(err)
+		}
+	}
+
+	responseMap := make(map[string]interface{})
+	responseMap["code"] = returnCodeList["DataOK"].Code
+	responseMap["code_string"] = returnCodeList["DataOK"].CodeString
+	responseMap["accepted"] = len(results)
+	json.NewEncoder(w).Encode(responseMap)
+}
+
+func getDeviceCheckHistory(w http.ResponseWriter, r *http.Request) {
+	// return the recent results of a single check of a device, newest first
+	w.Header().Set("Content-Type", "application/json")
+	vars := mux.Vars(r)
+	dev, found := deviceByName(vars["name"])
+	if !found {
+		http.Error(w, `{"error": "device not found"}`, http.StatusNotFound)
+		return
+	}
+
+	results, err := readCheckResults(dev.Key, vars["check"], dbObj)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, `{"error": "failed to read check results"}`, http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(results)
+}
+
+/////////////
+// helpful functions for API calls
+func readCheckResultsRequestBody(body io.ReadCloser) (Device, []CheckResult, int) {
+	// check if a check results request body is valid
+	// if valid, return a copy of the device sending the results and the results
+	var req struct {
+		Key     string        `json:"key"`
+		Results []CheckResult `json:"results"`
+	}
+
+	err := json.NewDecoder(body).Decode(&req)
+	if err != nil || len(req.Results) == 0 {
+		return Device{}, nil, returnCodeList["DataMalformed"].Code
+	}
+
+	tmpDev, found := deviceByKey(req.Key)
+	if !found {
+		return Device{}, nil, returnCodeList["BadKey"].Code
+	}
+
+	for i, result := range req.Results {
+		if result.Name == "" || result.Timestamp.IsZero() {
+			return Device{}, nil, returnCodeList["DataMalformed"].Code
+		}
+		if _, ok := checkStatusText[result.Status]; !ok {
+			return Device{}, nil, returnCodeList["DataMalformed"].Code
+		}
+		req.Results[i].StatusText = checkStatusText[result.Status]
+	}
+
+	return tmpDev, req.Results, returnCodeList["DataOK"].Code
+}
+
+/////////////
+// database
+func newCheckResult(key string, result CheckResult, dbObj *sql.DB) error {
+	// store a check result received from the device with the given key
+	perfData, err := json.Marshal(result.PerfData)
+	if err != nil {
+		return err
+	}
+
+	sqlStatement := `INSERT INTO check_results (device_key, ts, name, status, output, perf_data, duration)
+VALUES ($1, $2, $3, $4, $5, $6, $7)`
+	_, err = dbObj.Exec(sqlStatement, key, result.Timestamp, result.Name, result.Status, result.Output, string(perfData), result.Duration)
+	return err
+}
+
+func readCheckResults(key, name string, dbObj *sql.DB) ([]CheckResult, error) {
+	// read the most recent results of a check of the device with the given key, newest first
+	rows, err := dbObj.Query(`SELECT ts, status, output, perf_data, duration FROM check_results
+WHERE device_key = $1 AND name = $2 ORDER BY ts DESC LIMIT 1000`, key, name)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	results := []CheckResult{}
+	for rows.Next() {
+		tmpResult := CheckResult{Name: name}
+		var perfData []byte
+		err = rows.Scan(&tmpResult.Timestamp, &tmpResult.Status, &tmpResult.Output, &perfData, &tmpResult.Duration)
+		if err != nil {
+			return nil, err
+		}
+		tmpResult.StatusText = checkStatusText[tmpResult.Status]
+		json.Unmarshal(perfData, &tmpResult.PerfData)
+		results = append(results, tmpResult)
+	}
+
+	return results, rows.Err()
+}
@@ -0,0 +1,345 @@
+// commands queued for devices from the admin API, delivered in check-in responses and reported back by the device
+
+package backendapi
+
+import (
+	"database/sql"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Command is an action a device is asked to perform
+type Command struct {
+	ID         int64             `json:"id"`                    // identifier, assigned by the database
+	Type       string            `json:"type"`                  // one of commandTypes
+	Args       map[string]string `json:"args,omitempty"`        // arguments, depending on the type
+	Timeout    int               `json:"timeout"`               // seconds the device lets the command run for
+	Status     string            `json:"status"`                // pending, sent, succeeded, failed, timed_out, rejected or expired
+	ExitCode   *int              `json:"exit_code,omitempty"`   // exit code, if the command ran
+	Output     string            `json:"output,omitempty"`      // output of the command, truncated to maxCommandOutput
+	CreatedAt  time.Time         `json:"created_at"`            // when the command was queued
+	SentAt     *time.Time        `json:"sent_at,omitempty"`     // when the command was delivered to the device
+	FinishedAt *time.Time        `json:"finished_at,omitempty"` // when the device reported the result
+}
+
+// command types devices understand, each device still decides which ones it allows
+var commandTypes = map[string]bool{"run_check": true, "collect_diagnostics": true, "restart_service": true}
+
+// statuses a device can report for a command
+var commandResultStatuses = map[string]bool{"succeeded": true, "failed": true, "timed_out": true, "rejected": true}
+
+const maxCommandOutput = 64 * 1024 // bytes of output kept for each command
+const defaultCommandTimeout = 60   // seconds, when the command does not specify one
+
+var commandRedeliverAfter = 2 * time.Minute // sent commands without a result are delivered again after this long, in case the delivery was lost
+var commandExpireAfter = time.Hour          // commands without a result this long after they were queued, plus their timeout, are given up
+
+// commands stay queued with their device until the device reports a result, or they expire
+// a command is only marked sent once the response carrying it was written, the device runs each command once even if it gets it again
+
+func dueCommands(dev *Device, now time.Time) []Command {
+	// commands to deliver with the next check-in response of the device, the ones never sent and the ones sent long ago without a result
+	// the caller holds deviceListMutex
+	var output []Command
+	for _, cmd := range dev.PendingCommands {
+		if cmd.SentAt == nil || now.Sub(*cmd.SentAt) >= commandRedeliverAfter {
+			output = append(output, cmd)
+		}
+	}
+	return output
+}
+
+func commandsDelivered(key string, response map[string]interface{}) {
+	// the response carrying commands was written to the device, they are marked as sent
+	commands, _ := response["commands"].([]Command)
+	if len(commands) == 0 {
+		return
+	}
+
+	now := time.Now()
+	delivered := make(map[int64]bool)
+	for _, cmd := range commands {
+		delivered[cmd.ID] = true
+	}
+	withDevice(key, func(dev *Device) {
+		for i := range dev.PendingCommands {
+			if delivered[dev.PendingCommands[i].ID] {
+				dev.PendingCommands[i].Status = "sent"
+				dev.PendingCommands[i].SentAt = &now
+			}
+		}
+	})
+
+	for id := range delivered {
+		if dbObj == nil {
+			break
+		}
+		err := updateCommandSent(id, now, dbObj)
+		if err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+func finishCommand(key string, id int64) {
+	// the device reported the result of a command, it leaves the queue
+	withDevice(key, func(dev *Device) {
+		for i, cmd := range dev.PendingCommands {
+			if cmd.ID == id {
+				dev.PendingCommands = append(dev.PendingCommands[:i:i], dev.PendingCommands[i+1:]...)
+				return
+			}
+		}
+	})
+}
+
+func expireCommands(now time.Time) {
+	// give up on the commands that got no result in time, e.g. because their device never came back
+	var expired []int64
+	deviceListMutex.Lock()
+	for i := range deviceList {
+		var kept []Command
+		for _, cmd := range deviceList[i].PendingCommands {
+			if now.Sub(cmd.CreatedAt) >= commandExpireAfter+time.Duration(cmd.Timeout)*time.Second {
+				log.Printf("Command %d (%s) for %s expired without a result\n", cmd.ID, cmd.Type, deviceList[i].Name)
+				expired = append(expired, cmd.ID)
+				continue
+			}
+			kept = append(kept, cmd)
+		}
+		deviceList[i].PendingCommands = kept
+	}
+	deviceListMutex.Unlock()
+
+	for _, id := range expired {
+		if dbObj == nil {
+			break
+		}
+		err := updateCommandExpired(id, now, dbObj)
+		if err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+////////////
+// respond to HTTP calls from client
+func receiveCommandResult(w http.ResponseWriter, r *http.Request) {
+	// devices report the outcome of a command here
+	w.Header().Set("Content-Type", "application/json")
+	req, code := readCommandResultRequestBody(r.Body)
+	if code != returnCodeList["DataOK"].Code {
+		var response string
+		if code == returnCodeList["BadKey"].Code {
+			response, _ = generateErrorResponse("BadKey")
+		} else {
+			response, _ = generateErrorResponse("DataMalformed")
+		}
+		http.Error(w, response, http.StatusBadRequest)
+		return
+	}
+	log.Printf("Command %d finished, %s\n", req.ID, req.Status)
+
+	// the device key is part of the update, a device cannot report results of commands meant for another one
+	finishCommand(req.Key, req.ID)
+	err := updateCommandResult(req.ID, req.Key, req.Status, req.ExitCode, req.Output, time.Now(), dbObj)
+	if err != nil {
+		log.Println(err)
+	}
+
+	responseMap := make(map[string]interface{})
+	responseMap["code"] = returnCodeList["DataOK"].Code
+	responseMap["code_string"] = returnCodeList["DataOK"].CodeString
+	json.NewEncoder(w).Encode(responseMap)
+}
+
+// CommandResultRequest is the body devices post to /command-result
+type CommandResultRequest struct {
+	Key      string `json:"key"`
+	ID       int64  `json:"id"`
+	Status   string `json:"status"`
+	ExitCode *int   `json:"exit_code"`
+	Output   string `json:"output"`
+}
+
+func readCommandResultRequestBody(body io.ReadCloser) (CommandResultRequest, int) {
+	// decode and validate a command result, truncating its output
+	var req CommandResultRequest
+	err := json.NewDecoder(body).Decode(&req)
+	if err != nil || req.ID == 0 || !commandResultStatuses[req.Status] {
+		return req, returnCodeList["DataMalformed"].Code
+	}
+
+	if _, found := deviceByKey(req.Key); !found {
+		return req, returnCodeList["BadKey"].Code
+	}
+
+	if len(req.Output) > maxCommandOutput {
+		req.Output = req.Output[:maxCommandOutput]
+	}
+	return req, returnCodeList["DataOK"].Code
+}
+
+func getDeviceCommands(w http.ResponseWriter, r *http.Request) {
+	// return the commands of a device and their results, newest first
+	w.Header().Set("Content-Type", "application/json")
+	dev, found := deviceByName(mux.Vars(r)["name"])
+	if !found {
+		http.Error(w, `{"error": "device not found"}`, http.StatusNotFound)
+		return
+	}
+
+	commands, err := readDeviceCommands(dev.Key, dbObj)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, `{"error": "failed to read commands"}`, http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(commands)
+}
+
+/////////////
+// admin API
+func queueDeviceCommand(w http.ResponseWriter, r *http.Request) {
+	// queue a command for a device, it is delivered with the response to its next check-in
+	w.Header().Set("Content-Type", "application/json")
+	tmpDev, found := deviceByName(mux.Vars(r)["name"])
+	if !found {
+		http.Error(w, `{"error": "device not found"}`, http.StatusNotFound)
+		return
+	}
+	var cmd Command
+	err := json.NewDecoder(r.Body).Decode(&cmd)
+	if err != nil || !commandTypes[cmd.Type] || cmd.Timeout < 0 {
+		http.Error(w, `{"error": "expected a command with a known type"}`, http.StatusBadRequest)
+		return
+	}
+	if cmd.Timeout == 0 {
+		cmd.Timeout = defaultCommandTimeout
+	}
+	cmd.Status = "pending"
+	cmd.CreatedAt = time.Now()
+
+	cmd.ID, err = newDeviceCommand(tmpDev.Key, cmd, dbObj)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, `{"error": "failed to store command"}`, http.StatusInternalServerError)
+		return
+	}
+
+	withDevice(tmpDev.Key, func(dev *Device) {
+		dev.PendingCommands = append(dev.PendingCommands, cmd)
+	})
+	log.Printf("Queued command %d (%s) for %s\n", cmd.ID, cmd.Type, tmpDev.Name)
+	pushCheckin(tmpDev.Key)
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(cmd)
+}
+
+/////////////
+// database
+func newDeviceCommand(key string, cmd Command, dbObj *sql.DB) (int64, error) {
+	// store a new command, returning its identifier
+	args, err := json.Marshal(cmd.Args)
+	if err != nil {
+		return 0, err
+	}
+
+	var id int64
+	sqlStatement := `INSERT INTO device_commands (device_key, type, args, timeout, status, created_ts)
+VALUES ($1, $2, $3, $4, $5, $6) RETURNING id`
+	err = dbObj.QueryRow(sqlStatement, key, cmd.Type, string(args), cmd.Timeout, cmd.Status, cmd.CreatedAt).Scan(&id)
+	return id, err
+}
+
+func updateCommandSent(id int64, sentAt time.Time, dbObj *sql.DB) error {
+	_, err := dbObj.Exec(`UPDATE device_commands SET status = 'sent', sent_ts = $1 WHERE id = $2`, sentAt, id)
+	return err
+}
+
+func updateCommandExpired(id int64, expiredAt time.Time, dbObj *sql.DB) error {
+	_, err := dbObj.Exec(`UPDATE device_commands SET status = 'expired', finished_ts = $1 WHERE id = $2`, expiredAt, id)
+	return err
+}
+
+func loadPendingCommands(dbObj *sql.DB) error {
+	// queue the commands that got no result before the backend stopped again with their devices
+	rows, err := dbObj.Query(`SELECT id, device_key, type, args, timeout, status, created_ts, sent_ts
+FROM device_commands WHERE status IN ('pending', 'sent') ORDER BY id`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	deviceListMutex.Lock()
+	defer deviceListMutex.Unlock()
+	for rows.Next() {
+		var cmd Command
+		var key string
+		var args []byte
+		var sentAt sql.NullTime
+		err = rows.Scan(&cmd.ID, &key, &cmd.Type, &args, &cmd.Timeout, &cmd.Status, &cmd.CreatedAt, &sentAt)
+		if err != nil {
+			return err
+		}
+		json.Unmarshal(args, &cmd.Args)
+		if sentAt.Valid {
+			cmd.SentAt = &sentAt.Time
+		}
+		if index := FindDeviceByKey(deviceList, Device{Key: key}); index != -1 {
+			deviceList[index].PendingCommands = append(deviceList[index].PendingCommands, cmd)
+		}
+	}
+
+	return rows.Err()
+}
+
+func updateCommandResult(id int64, key, status string, exitCode *int, output string, finishedAt time.Time, dbObj *sql.DB) error {
+	sqlStatement := `UPDATE device_commands SET status = $1, exit_code = $2, output = $3, finished_ts = $4
+WHERE id = $5 AND device_key = $6`
+	_, err := dbObj.Exec(sqlStatement, status, exitCode, output, finishedAt, id, key)
+	return err
+}
+
+func readDeviceCommands(key string, dbObj *sql.DB) ([]Command, error) {
+	// read the most recent commands of the device with the given key, newest first
+	rows, err := dbObj.Query(`SELECT id, type, args, timeout, status, exit_code, output, created_ts, sent_ts, finished_ts
+FROM device_commands WHERE device_key = $1 ORDER BY id DESC LIMIT 1000`, key)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	commands := []Command{}
+	for rows.Next() {
+		var cmd Command
+		var args []byte
+		var exitCode sql.NullInt64
+		var output sql.NullString
+		var sentAt, finishedAt sql.NullTime
+		err = rows.Scan(&cmd.ID, &cmd.Type, &args, &cmd.Timeout, &cmd.Status, &exitCode, &output, &cmd.CreatedAt, &sentAt, &finishedAt)
+		if err != nil {
+			return nil, err
+		}
+		json.Unmarshal(args, &cmd.Args)
+		if exitCode.Valid {
+			code := int(exitCode.Int64)
+			cmd.ExitCode = &code
+		}
+		cmd.Output = output.String
+		if sentAt.Valid {
+			cmd.SentAt = &sentAt.Time
+		}
+		if finishedAt.Valid {
+			cmd.FinishedAt = &finishedAt.Time
+		}
+		commands = append(commands, cmd)
+	}
+
+	return commands, rows.Err()
+}
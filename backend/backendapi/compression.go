@@ -0,0 +1,73 @@
+// compressed request bodies, devices send batches of samples with Content-Encoding gzip or zstd
+
+package backendapi
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+var maxDecompressedBody int64 = 32 * 1024 * 1024 // bytes a compressed request body may expand to
+
+func decompressRequest(next http.Handler) http.Handler {
+	// replace a compressed request body with its decompressed content, refusing bodies that expand too much
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encoding := r.Header.Get("Content-Encoding")
+		if encoding == "" || encoding == "identity" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		var reader io.Reader
+		switch encoding {
+		case "gzip":
+			gz, err := gzip.NewReader(r.Body)
+			if err != nil {
+				response, _ := generateErrorResponse("DataMalformed")
+				http.Error(w, response, http.StatusBadRequest)
+				return
+			}
+			defer gz.Close()
+			reader = gz
+		case "zstd":
+			zr, err := zstd.NewReader(r.Body, zstd.WithDecoderMaxMemory(uint64(maxDecompressedBody)))
+			if err != nil {
+				response, _ := generateErrorResponse("DataMalformed")
+				http.Error(w, response, http.StatusBadRequest)
+				return
+			}
+			defer zr.Close()
+			reader = zr
+		default:
+			response, _ := generateErrorResponse("DataMalformed")
+			http.Error(w, response, http.StatusUnsupportedMediaType)
+			return
+		}
+
+		// read one byte more than allowed, to tell a body at the limit from one over it
+		data, err := ioutil.ReadAll(io.LimitReader(reader, maxDecompressedBody+1))
+		if err != nil {
+			log.Printf("Failed to decompress %s request body from %s, %v\n", encoding, r.RemoteAddr, err)
+			response, _ := generateErrorResponse("DataMalformed")
+			http.Error(w, response, http.StatusBadRequest)
+			return
+		}
+		if int64(len(data)) > maxDecompressedBody {
+			log.Printf("Refused %s request body from %s, larger than %d bytes once decompressed\n", encoding, r.RemoteAddr, maxDecompressedBody)
+			response, _ := generateErrorResponse("DataMalformed")
+			http.Error(w, response, http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		r.Body = ioutil.NopCloser(bytes.NewReader(data))
+		r.ContentLength = int64(len(data))
+		r.Header.Del("Content-Encoding")
+		next.ServeHTTP(w, r)
+	})
+}
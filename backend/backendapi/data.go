@@ -0,0 +1,147 @@
+// data sent by devices after they registered, e.g. metrics produced by the node-reporter collectors
+
+package backendapi
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Sample is a single timestamped measurement sent by a device
+type Sample struct {
+	Name      string            `json:"name"`             // metric name, e.g. load1
+	Labels    map[string]string `json:"labels,omitempty"` // labels identifying the measured object, e.g. the mountpoint
+	Value     float64           `json:"value"`            // measured value
+	Timestamp time.Time         `json:"timestamp"`        // when the value was measured on the device
+}
+
+// RejectedSample tells a device which sample of a batch was not accepted and why
+type RejectedSample struct {
+	Index int `json:"index"` // position of the sample in the batch
+	Code  int `json:"code"`  // return code explaining why it was rejected
+}
+
+var maxSampleAge = 10 * time.Minute           // samples older than this are rejected
+var maxReplayAge = 7 * 24 * time.Hour         // same, for samples a device kept while it could not send them
+var maxSampleSkew = 1 * time.Minute           // samples further in the future than this are rejected
+var latestSamples = make(map[string][]Sample) // last samples received from each device, keyed by device identifier
+var latestSamplesMutex sync.Mutex             // protects latestSamples, written by every API devices send data through
+
+////////////
+// respond to HTTP calls from client
+func receiveData(w http.ResponseWriter, r *http.Request) {
+	// devices send samples here, the request must carry the key of a registered device
+	w.Header().Set("Content-Type", "application/json")
+	tmpDev, samples, rejected, code := readDataRequestBody(r.Body)
+
+	if code != returnCodeList["DataOK"].Code {
+		var response string
+		if code == returnCodeList["BadKey"].Code {
+			response, _ = generateErrorResponse("BadKey")
+		} else if code == returnCodeList["DataTimestampBad"].Code {
+			response, _ = generateErrorResponse("DataTimestampBad")
+		} else {
+			response, _ = generateErrorResponse("DataMalformed")
+		}
+
+		log.Printf("Received bad data (error %d), %s\n", code, response)
+		http.Error(w, response, http.StatusBadRequest)
+		return
+	}
+
+	storeSamples(tmpDev, samples)
+
+	responseMap := make(map[string]interface{})
+	responseMap["code"] = returnCodeList["DataOK"].Code
+	responseMap["code_string"] = returnCodeList["DataOK"].CodeString
+	responseMap["accepted"] = len(samples)
+	if len(rejected) > 0 {
+		// samples that were not accepted are listed, so the device can decide what to send again
+		log.Printf("Rejected %d samples from %s\n", len(rejected), tmpDev.Name)
+		responseMap["rejected"] = rejected
+	}
+	json.NewEncoder(w).Encode(responseMap)
+}
+
+func storeSamples(tmpDev Device, samples []Sample) {
+	// keep samples that passed validation, shared by the HTTP and gRPC APIs
+	log.Printf("Received %d samples from %s\n", len(samples), tmpDev.Name)
+	writeMetrics(tmpDev, samples)
+
+	// replayed samples are older than the ones already received, they are not the latest
+	latestSamplesMutex.Lock()
+	defer latestSamplesMutex.Unlock()
+	if latest := latestSamples[tmpDev.ID]; len(latest) > 0 && samples[0].Timestamp.Before(latest[0].Timestamp) {
+		return
+	}
+	latestSamples[tmpDev.ID] = samples
+}
+
+/////////////
+// helpful functions for API calls
+func readDataRequestBody(body io.ReadCloser) (Device, []Sample, []RejectedSample, int) {
+	// check if a data request body is valid
+	// if valid, return a copy of the device sending the data, the samples that passed validation and the ones that did not
+	// the request is only refused as a whole if none of its samples is valid
+	var req struct {
+		Key     string   `json:"key"`
+		Samples []Sample `json:"samples"`
+		Replay  bool     `json:"replay"` // samples were buffered by the device, their timestamps may be older
+	}
+
+	err := json.NewDecoder(body).Decode(&req)
+	if err != nil || len(req.Samples) == 0 {
+		return Device{}, nil, nil, returnCodeList["DataMalformed"].Code
+	}
+
+	tmpDev, found := deviceByKey(req.Key)
+	if !found {
+		return Device{}, nil, nil, returnCodeList["BadKey"].Code
+	}
+
+	accepted, rejected := partitionSamples(req.Samples, time.Now(), sampleMaxAge(req.Replay))
+	if len(accepted) == 0 {
+		return Device{}, nil, rejected, rejected[0].Code
+	}
+
+	return tmpDev, accepted, rejected, returnCodeList["DataOK"].Code
+}
+
+func partitionSamples(samples []Sample, now time.Time, maxAge time.Duration) ([]Sample, []RejectedSample) {
+	// split samples into the ones that pass validation and the ones that do not
+	var accepted []Sample
+	var rejected []RejectedSample
+	for i, sample := range samples {
+		code := validateSample(sample, now, maxAge)
+		if code != returnCodeList["DataOK"].Code {
+			rejected = append(rejected, RejectedSample{Index: i, Code: code})
+		} else {
+			accepted = append(accepted, sample)
+		}
+	}
+	return accepted, rejected
+}
+
+func sampleMaxAge(replay bool) time.Duration {
+	// how old samples may be, depending on whether the device is replaying what it buffered
+	if replay {
+		return maxReplayAge
+	}
+	return maxSampleAge
+}
+
+func validateSample(sample Sample, now time.Time, maxAge time.Duration) int {
+	// a sample needs a name, a usable value and a timestamp no older than maxAge and not in the future
+	if sample.Name == "" || math.IsNaN(sample.Value) || math.IsInf(sample.Value, 0) {
+		return returnCodeList["DataMalformed"].Code
+	}
+	if sample.Timestamp.Before(now.Add(-maxAge)) || sample.Timestamp.After(now.Add(maxSampleSkew)) {
+		return returnCodeList["DataTimestampBad"].Code
+	}
+	return returnCodeList["DataOK"].Code
+}
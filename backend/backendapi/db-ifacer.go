@@ -19,7 +19,7 @@ func connectToPostgres(host, user, password, dbname string, port int) (*sql.DB,
 	psqlInfo := fmt.Sprintf("host=%s port=%d user=%s "+
 		"password=%s dbname=%s sslmode=disable",
 		host, port, user, password, dbname)
-	db, err := sql.Open("postgres", psqlInfo)
+	db, err := sql.Open(instrumentedDriverName, psqlInfo)
 	if err != nil {
 		return nil, err
 	}
@@ -54,22 +54,241 @@ func readPostgresCredentialsFromFile(fileLoc string) (map[string]interface{}, er
 
 }
 
+func migrateDatabase(table string, dbObj *sql.DB) error {
+	// add columns introduced after the registration table was first created, and the tables backing newer features
+	statements := []string{
+		fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS machine_id TEXT", table),
+		fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS interfaces JSONB", table),
+		fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS tags JSONB", table),
+		fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS config_version TEXT", table),
+		fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS device_id TEXT", table),
+		`CREATE TABLE IF NOT EXISTS inventory_history (
+	id SERIAL PRIMARY KEY,
+	device_key TEXT NOT NULL,
+	ts TIMESTAMPTZ NOT NULL,
+	changed JSONB,
+	inventory JSONB)`,
+		`CREATE INDEX IF NOT EXISTS inventory_history_device_key_ts ON inventory_history (device_key, ts)`,
+		`CREATE TABLE IF NOT EXISTS device_events (
+	id SERIAL PRIMARY KEY,
+	device_key TEXT NOT NULL,
+	ts TIMESTAMPTZ NOT NULL,
+	type TEXT NOT NULL,
+	labels JSONB,
+	message TEXT)`,
+		`CREATE INDEX IF NOT EXISTS device_events_device_key_ts ON device_events (device_key, ts)`,
+		`CREATE TABLE IF NOT EXISTS check_results (
+	id SERIAL PRIMARY KEY,
+	device_key TEXT NOT NULL,
+	ts TIMESTAMPTZ NOT NULL,
+	name TEXT NOT NULL,
+	status INTEGER NOT NULL,
+	output TEXT,
+	perf_data JSONB,
+	duration DOUBLE PRECISION)`,
+		`CREATE INDEX IF NOT EXISTS check_results_device_key_name_ts ON check_results (device_key, name, ts)`,
+		`CREATE TABLE IF NOT EXISTS remote_config (
+	scope TEXT NOT NULL,
+	name TEXT NOT NULL,
+	config JSONB NOT NULL,
+	updated_ts TIMESTAMPTZ NOT NULL,
+	PRIMARY KEY (scope, name))`,
+		`CREATE TABLE IF NOT EXISTS device_commands (
+	id SERIAL PRIMARY KEY,
+	device_key TEXT NOT NULL,
+	type TEXT NOT NULL,
+	args JSONB,
+	timeout INTEGER NOT NULL,
+	status TEXT NOT NULL,
+	exit_code INTEGER,
+	output TEXT,
+	created_ts TIMESTAMPTZ NOT NULL,
+	sent_ts TIMESTAMPTZ,
+	finished_ts TIMESTAMPTZ)`,
+		`CREATE INDEX IF NOT EXISTS device_commands_device_key ON device_commands (device_key, id)`,
+		`CREATE TABLE IF NOT EXISTS device_status_history (
+	id SERIAL PRIMARY KEY,
+	device_key TEXT NOT NULL,
+	ts TIMESTAMPTZ NOT NULL,
+	status TEXT NOT NULL,
+	previous TEXT NOT NULL,
+	reason TEXT NOT NULL)`,
+		`CREATE INDEX IF NOT EXISTS device_status_history_device_key_ts ON device_status_history (device_key, ts)`,
+		`CREATE TABLE IF NOT EXISTS alert_rules (
+	name TEXT PRIMARY KEY,
+	rule JSONB NOT NULL,
+	updated_ts TIMESTAMPTZ NOT NULL)`,
+		`CREATE TABLE IF NOT EXISTS alert_state (
+	rule TEXT NOT NULL,
+	labels TEXT NOT NULL,
+	alert JSONB NOT NULL,
+	updated_ts TIMESTAMPTZ NOT NULL,
+	PRIMARY KEY (rule, labels))`,
+		`CREATE TABLE IF NOT EXISTS notification_log (
+	id SERIAL PRIMARY KEY,
+	ts TIMESTAMPTZ NOT NULL,
+	channel TEXT NOT NULL,
+	kind TEXT NOT NULL,
+	name TEXT NOT NULL,
+	state TEXT NOT NULL,
+	labels JSONB,
+	summary TEXT NOT NULL,
+	event_ts TIMESTAMPTZ NOT NULL,
+	attempts INTEGER NOT NULL,
+	success BOOLEAN NOT NULL,
+	error TEXT NOT NULL)`,
+		`CREATE INDEX IF NOT EXISTS notification_log_ts ON notification_log (ts)`,
+		`ALTER TABLE notification_log ADD COLUMN IF NOT EXISTS silenced_by TEXT NOT NULL DEFAULT ''`,
+		`CREATE TABLE IF NOT EXISTS silences (
+	id SERIAL PRIMARY KEY,
+	silence JSONB NOT NULL,
+	ends_at TIMESTAMPTZ NOT NULL,
+	created_ts TIMESTAMPTZ NOT NULL)`,
+		`CREATE TABLE IF NOT EXISTS maintenance_windows (
+	name TEXT PRIMARY KEY,
+	maintenance JSONB NOT NULL,
+	updated_ts TIMESTAMPTZ NOT NULL)`,
+	}
+
+	for _, sqlStatement := range statements {
+		_, err := dbObj.Exec(sqlStatement)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func loadDevices(table string, dbObj *sql.DB) error {
+	// load the devices registered before the backend started, they keep their keys and do not need to register again
+	// their status is restored as it was, from their last transition and flapping event, loading them is not a transition
+	// check-ins missed while the backend was down do not count, see statusGraceFrom
+	now := time.Now()
+	transitions, err := readRecentTransitions(now.Add(-flapWindow), dbObj)
+	if err != nil {
+		return err
+	}
+
+	sqlStatement := fmt.Sprintf(`SELECT r.key, r.device_id, r.name, r.os, r.mac, r.machine_id, r.interfaces, r.tags, r.config_version,
+COALESCE(r.last_register_ts, r.first_register_ts), r.last_checkin_ts, r.last_checkout_ts, s.status, s.ts, f.type
+FROM %s r
+LEFT JOIN LATERAL (SELECT status, ts FROM device_status_history
+	WHERE device_key = r.key ORDER BY ts DESC, id DESC LIMIT 1) s ON true
+LEFT JOIN LATERAL (SELECT type FROM device_events
+	WHERE device_key = r.key AND type IN ('flapping_started', 'flapping_stopped') ORDER BY ts DESC, id DESC LIMIT 1) f ON true`, table)
+	rows, err := dbObj.Query(sqlStatement)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	deviceListMutex.Lock()
+	defer deviceListMutex.Unlock()
+	statusGraceFrom = now
+	var newIDs []Device
+	for rows.Next() {
+		var tmpDev Device
+		var id, os, machineID, configVersion, status, flapping sql.NullString
+		var interfaces, tags []byte
+		var registered, lastCheckin, lastCheckout, statusSince sql.NullTime
+		err = rows.Scan(&tmpDev.Key, &id, &tmpDev.Name, &os, &tmpDev.Mac, &machineID, &interfaces, &tags, &configVersion,
+			&registered, &lastCheckin, &lastCheckout, &status, &statusSince, &flapping)
+		if err != nil {
+			return err
+		}
+		tmpDev.ID, tmpDev.OS, tmpDev.MachineID, tmpDev.ConfigVersion = id.String, os.String, machineID.String, configVersion.String
+		if tmpDev.ID == "" {
+			// registered before devices had an identifier
+			tmpDev.ID = generateDeviceID()
+			newIDs = append(newIDs, tmpDev)
+		}
+		json.Unmarshal(interfaces, &tmpDev.Interfaces)
+		json.Unmarshal(tags, &tmpDev.Tags)
+		tmpDev.Registered, tmpDev.LastCheckin, tmpDev.LastCheckout = registered.Time, lastCheckin.Time, lastCheckout.Time
+		if tmpDev.Registered.IsZero() {
+			tmpDev.Registered = now
+		}
+		tmpDev.Status, tmpDev.StatusSince = status.String, statusSince.Time
+		tmpDev.StatusTransitions = transitions[tmpDev.Key]
+		tmpDev.FlapScore = flapScore(tmpDev.StatusTransitions, now)
+		tmpDev.Flapping = flapping.String == "flapping_started"
+		deviceList = append(deviceList, tmpDev)
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	for _, dev := range newIDs {
+		_, err = dbObj.Exec(fmt.Sprintf("UPDATE %s SET device_id = $1 WHERE key = $2", table), dev.ID, dev.Key)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func updateDeviceRegister(oldKey string, dev Device, table string, dbObj *sql.DB) error {
+	// a device registered again with a new key, its history follows it
+	interfaces, err := json.Marshal(dev.Interfaces)
+	if err != nil {
+		return err
+	}
+	tags, err := json.Marshal(dev.Tags)
+	if err != nil {
+		return err
+	}
+
+	tx, err := dbObj.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	sqlStatement := fmt.Sprintf("UPDATE %s SET ", table)
+	sqlStatement += `key = $1, name = $2, os = $3, mac = $4, machine_id = $5, interfaces = $6, tags = $7, last_register_ts = $8 WHERE key = $9`
+	_, err = tx.Exec(sqlStatement, dev.Key, dev.Name, dev.OS, dev.Mac, dev.MachineID, string(interfaces), string(tags), dev.Registered, oldKey)
+	if err != nil {
+		return err
+	}
+	for _, historyTable := range []string{"inventory_history", "device_events", "check_results", "device_commands", "device_status_history"} {
+		_, err = tx.Exec("UPDATE "+historyTable+" SET device_key = $1 WHERE device_key = $2", dev.Key, oldKey)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
 func newDeviceRegister(dev Device, table string, dbObj *sql.DB) error {
 	// add device to postgres
 	now := time.Now()
 
 	sqlStatement := fmt.Sprintf("INSERT INTO %s ", table)
-	sqlStatement += `(key, name, os, mac, first_register_ts, last_register_ts, last_checkin_ts, last_checkout_ts)
-VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`
+	sqlStatement += `(key, name, os, mac, machine_id, interfaces, tags, first_register_ts, last_register_ts, last_checkin_ts, last_checkout_ts, device_id)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)`
+	interfaces, err := json.Marshal(dev.Interfaces)
+	if err != nil {
+		return err
+	}
+	tags, err := json.Marshal(dev.Tags)
+	if err != nil {
+		return err
+	}
 	values := []interface{}{dev.Key,
 		dev.Name,
 		dev.OS,
 		dev.Mac,
+		dev.MachineID,
+		string(interfaces),
+		string(tags),
 		now,
 		nil,
 		nil,
-		nil}
-	_, err := dbObj.Exec(sqlStatement, values...)
+		nil,
+		dev.ID}
+	_, err = dbObj.Exec(sqlStatement, values...)
 	if err != nil {
 		return err
 	}
@@ -3,16 +3,40 @@ package backendapi
 import (
 	"encoding/json"
 	"log"
+	"strings"
 	"time"
 )
 
 // Device is for maintaining devices currently being handled by this backend process
 type Device struct {
-	Name        string    `json:"name"`         // name a device identified itself with
-	Key         string    `json:"key"`          // key the device will use to authenticate itself with backend-api
-	Mac         string    `json:"mac"`          // MAC address of any interface provided by the device
-	LastCheckin time.Time `json:"last_checkin"` // time when the device last checked in
-	OS          string    `json:"os"`           // operating system running on the device
+	ID                string                 `json:"id"`                     // identifier of the device, kept when it registers again with a new key
+	Name              string                 `json:"name"`                   // name a device identified itself with
+	Key               string                 `json:"key,omitempty"`          // key the device will use to authenticate itself with backend-api
+	Mac               string                 `json:"mac"`                    // MAC address of the interface the device identifies itself by
+	MachineID         string                 `json:"machine_id"`             // stable machine identifier, e.g. /etc/machine-id or DMI product UUID
+	Interfaces        []NetInterface         `json:"interfaces"`             // physical interfaces reported by the device
+	LastCheckin       time.Time              `json:"last_checkin"`           // time when the device last checked in
+	LastCheckout      time.Time              `json:"last_checkout"`          // time when the device last checked out, i.e. stopped reporting on purpose
+	Registered        time.Time              `json:"registered"`             // time when the device last registered
+	Status            string                 `json:"status"`                 // online, late or offline
+	StatusSince       time.Time              `json:"status_since"`           // time when the device got its current status
+	Flapping          bool                   `json:"flapping"`               // whether the device keeps changing status
+	FlapScore         float64                `json:"flap_score"`             // weighted number of recent transitions
+	StatusTransitions []time.Time            `json:"-"`                      // times of recent transitions, for the flap score
+	OS                string                 `json:"os"`                     // operating system running on the device
+	Inventory         *Inventory             `json:"inventory,omitempty"`    // last inventory reported by the device
+	Checks            map[string]CheckResult `json:"checks,omitempty"`       // latest result of each check run by the device
+	Tags              []string               `json:"tags"`                   // tags of the device, each tag is a group whose configuration applies to it
+	ConfigVersion     string                 `json:"config_version"`         // configuration version the device last acknowledged
+	ConfigError       string                 `json:"config_error,omitempty"` // why the device could not apply the latest configuration, if it could not
+	PendingCommands   []Command              `json:"-"`                      // commands queued for the device, delivered at its next check-in
+}
+
+// NetInterface is a physical network interface reported by a device
+type NetInterface struct {
+	Name string   `json:"name"` // interface name, e.g. eth0
+	Mac  string   `json:"mac"`  // MAC address of the interface
+	IPs  []string `json:"ips"`  // addresses configured on the interface, in CIDR notation
 }
 
 func FindDeviceByMac(list []Device, dev Device) int {
@@ -25,6 +49,163 @@ func FindDeviceByMac(list []Device, dev Device) int {
 	return -1 // not in list
 }
 
+func FindDeviceByIdentity(list []Device, dev Device) int {
+	// find device dev in the list, matching on any of its known identifiers
+	// the machine identifier is checked first, then every MAC address the devices reported
+	if dev.MachineID != "" {
+		for i := 0; i < len(list); i++ {
+			if list[i].MachineID == dev.MachineID {
+				return i
+			}
+		}
+	}
+
+	devMacs := dev.KnownMacs()
+	for i := 0; i < len(list); i++ {
+		for mac := range list[i].KnownMacs() {
+			if devMacs[mac] {
+				return i
+			}
+		}
+	}
+	return -1 // not in list
+}
+
+func (dev Device) KnownMacs() map[string]bool {
+	// every MAC address the device is known by, normalised to lower case
+	output := make(map[string]bool)
+	if dev.Mac != "" {
+		output[strings.ToLower(dev.Mac)] = true
+	}
+	for _, ifa := range dev.Interfaces {
+		if ifa.Mac != "" {
+			output[strings.ToLower(ifa.Mac)] = true
+		}
+	}
+	return output
+}
+
+func FindDeviceByName(list []Device, name string) int {
+	// find device in list, check for matching name
+	for i := 0; i < len(list); i++ {
+		if list[i].Name == name {
+			return i
+		}
+	}
+	return -1 // not in list
+}
+
+func (dev Device) Public() Device {
+	// copy of the device that can be returned by the API, without its key
+	dev.Key = ""
+	dev.StatusTransitions, dev.PendingCommands = nil, nil
+	return dev.clone()
+}
+
+func (dev Device) clone() Device {
+	// copy of the device, maps, slices and the inventory are copied too
+	// the caller may use the copy after releasing deviceListMutex
+	if dev.StatusTransitions != nil {
+		dev.StatusTransitions = append([]time.Time{}, dev.StatusTransitions...)
+	}
+	if dev.PendingCommands != nil {
+		commands := make([]Command, len(dev.PendingCommands))
+		for i, command := range dev.PendingCommands {
+			if command.Args != nil {
+				args := make(map[string]string, len(command.Args))
+				for name, value := range command.Args {
+					args[name] = value
+				}
+				command.Args = args
+			}
+			commands[i] = command
+		}
+		dev.PendingCommands = commands
+	}
+	dev.Interfaces = cloneInterfaces(dev.Interfaces)
+	if dev.Tags != nil {
+		dev.Tags = append([]string{}, dev.Tags...)
+	}
+	if dev.Inventory != nil {
+		inv := *dev.Inventory
+		inv.Interfaces = cloneInterfaces(inv.Interfaces)
+		dev.Inventory = &inv
+	}
+	if dev.Checks != nil {
+		checks := make(map[string]CheckResult, len(dev.Checks))
+		for name, result := range dev.Checks {
+			if result.PerfData != nil {
+				result.PerfData = append([]PerfDatum{}, result.PerfData...)
+			}
+			checks[name] = result
+		}
+		dev.Checks = checks
+	}
+	return dev
+}
+
+func cloneInterfaces(list []NetInterface) []NetInterface {
+	// copy of the interfaces with their addresses, see clone
+	if list == nil {
+		return nil
+	}
+	interfaces := make([]NetInterface, len(list))
+	for i, iface := range list {
+		if iface.IPs != nil {
+			iface.IPs = append([]string{}, iface.IPs...)
+		}
+		interfaces[i] = iface
+	}
+	return interfaces
+}
+
+func (dev Device) CurrentStatus(now time.Time) (string, string, time.Time) {
+	// status the device should have at now, why, and since when
+	// a device that never checked in counts from its registration
+	if !dev.LastCheckout.IsZero() && !dev.LastCheckout.Before(dev.LastCheckin) {
+		return StatusOffline, "checkout", dev.LastCheckout
+	}
+	last, reason := dev.LastCheckin, "checkin"
+	if last.IsZero() {
+		last, reason = dev.Registered, "register"
+	}
+
+	interval := float64(expectedCheckinInterval(dev))
+	if dev.Status != StatusOffline && last.Before(statusGraceFrom) {
+		// check-ins missed while the backend was down do not count, a device that was up counts from when it started
+		// a late device keeps the check-ins it had already missed
+		last = statusGraceFrom
+		if dev.Status == StatusLate {
+			last = statusGraceFrom.Add(-time.Duration(lateFactor * interval))
+		}
+	}
+	offlineAt := last.Add(time.Duration(offlineFactor * interval))
+	lateAt := last.Add(time.Duration(lateFactor * interval))
+	if now.After(offlineAt) {
+		return StatusOffline, "missed_checkins", offlineAt
+	}
+	if now.After(lateAt) {
+		return StatusLate, "missed_checkins", lateAt
+	}
+	return StatusOnline, reason, last
+}
+
+func (dev Device) IsUp(now time.Time) bool {
+	// whether the device is online or late, i.e. not offline yet
+	status, _, _ := dev.CurrentStatus(now)
+	return status != StatusOffline
+}
+
+func (dev Device) HasTag(tag string) bool {
+	// whether the device belongs to the group named tag
+	for _, t := range dev.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
 func FindDeviceByKey(list []Device, dev Device) int {
 	// find device in list, check for matching key
 	for i := 0; i < len(list); i++ {
@@ -35,6 +216,41 @@ func FindDeviceByKey(list []Device, dev Device) int {
 	return -1 // not in list
 }
 
+func withDevice(key string, fn func(dev *Device)) bool {
+	// run fn on the device with the given key while holding deviceListMutex, return whether the device was found
+	// fn must not keep the pointer, the list moves to a new array when a device is added to it
+	deviceListMutex.Lock()
+	defer deviceListMutex.Unlock()
+	index := FindDeviceByKey(deviceList, Device{Key: key})
+	if index == -1 {
+		return false
+	}
+	fn(&deviceList[index])
+	return true
+}
+
+func deviceByKey(key string) (Device, bool) {
+	// copy of the device with the given key, looked up under deviceListMutex
+	deviceListMutex.Lock()
+	defer deviceListMutex.Unlock()
+	index := FindDeviceByKey(deviceList, Device{Key: key})
+	if index == -1 {
+		return Device{}, false
+	}
+	return deviceList[index].clone(), true
+}
+
+func deviceByName(name string) (Device, bool) {
+	// copy of the device with the given name, looked up under deviceListMutex
+	deviceListMutex.Lock()
+	defer deviceListMutex.Unlock()
+	index := FindDeviceByName(deviceList, name)
+	if index == -1 {
+		return Device{}, false
+	}
+	return deviceList[index].clone(), true
+}
+
 /////////////
 /////////////
 // debug functions
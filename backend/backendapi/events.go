@@ -0,0 +1,142 @@
+// events sent by devices as they happen, e.g. a watched process disappearing
+
+package backendapi
+
+import (
+	"database/sql"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Event is something that happened on a device
+type Event struct {
+	Type      string            `json:"type"`             // event type, e.g. process_disappeared
+	Labels    map[string]string `json:"labels,omitempty"` // labels identifying what the event is about
+	Message   string            `json:"message"`          // human readable description
+	Timestamp time.Time         `json:"timestamp"`        // when the event happened on the device
+}
+
+////////////
+// respond to HTTP calls from client
+func receiveEvents(w http.ResponseWriter, r *http.Request) {
+	// devices send events here, they are stored with the device they came from
+	w.Header().Set("Content-Type", "application/json")
+	tmpDev, events, code := readEventsRequestBody(r.Body)
+
+	if code != returnCodeList["DataOK"].Code {
+		var response string
+		if code == returnCodeList["BadKey"].Code {
+			response, _ = generateErrorResponse("BadKey")
+		} else {
+			response, _ = generateErrorResponse("DataMalformed")
+		}
+
+		log.Printf("Received bad events (error %d), %s\n", code, response)
+		http.Error(w, response, http.StatusBadRequest)
+		return
+	}
+
+	for _, event := range events {
+		log.Printf("Event from %s: %s, %s\n", tmpDev.Name, event.Type, event.Message)
+		err := newDeviceEvent(tmpDev.Key, event, dbObj)
+		if err != nil {
+			log.Println(err)
+		}
+	}
+
+	responseMap := make(map[string]interface{})
+	responseMap["code"] = returnCodeList["DataOK"].Code
+	responseMap["code_string"] = returnCodeList["DataOK"].CodeString
+	responseMap["accepted"] = len(events)
+	json.NewEncoder(w).Encode(responseMap)
+}
+
+func getDeviceEvents(w http.ResponseWriter, r *http.Request) {
+	// return the events of a device, newest first
+	w.Header().Set("Content-Type", "application/json")
+	dev, found := deviceByName(mux.Vars(r)["name"])
+	if !found {
+		http.Error(w, `{"error": "device not found"}`, http.StatusNotFound)
+		return
+	}
+
+	events, err := readDeviceEvents(dev.Key, dbObj)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, `{"error": "failed to read events"}`, http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(events)
+}
+
+/////////////
+// helpful functions for API calls
+func readEventsRequestBody(body io.ReadCloser) (Device, []Event, int) {
+	// check if an events request body is valid
+	// if valid, return a copy of the device sending the events and the events
+	var req struct {
+		Key    string  `json:"key"`
+		Events []Event `json:"events"`
+	}
+
+	err := json.NewDecoder(body).Decode(&req)
+	if err != nil || len(req.Events) == 0 {
+		return Device{}, nil, returnCodeList["DataMalformed"].Code
+	}
+
+	tmpDev, found := deviceByKey(req.Key)
+	if !found {
+		return Device{}, nil, returnCodeList["BadKey"].Code
+	}
+
+	for _, event := range req.Events {
+		if event.Type == "" || event.Timestamp.IsZero() {
+			return Device{}, nil, returnCodeList["DataMalformed"].Code
+		}
+	}
+
+	return tmpDev, req.Events, returnCodeList["DataOK"].Code
+}
+
+/////////////
+// database
+func newDeviceEvent(key string, event Event, dbObj *sql.DB) error {
+	// store an event received from the device with the given key
+	labels, err := json.Marshal(event.Labels)
+	if err != nil {
+		return err
+	}
+
+	sqlStatement := `INSERT INTO device_events (device_key, ts, type, labels, message) VALUES ($1, $2, $3, $4, $5)`
+	_, err = dbObj.Exec(sqlStatement, key, event.Timestamp, event.Type, string(labels), event.Message)
+	return err
+}
+
+func readDeviceEvents(key string, dbObj *sql.DB) ([]Event, error) {
+	// read the most recent events of the device with the given key, newest first
+	rows, err := dbObj.Query(`SELECT ts, type, labels, message FROM device_events WHERE device_key = $1 ORDER BY ts DESC LIMIT 1000`, key)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []Event{}
+	for rows.Next() {
+		var tmpEvent Event
+		var labels []byte
+		err = rows.Scan(&tmpEvent.Timestamp, &tmpEvent.Type, &labels, &tmpEvent.Message)
+		if err != nil {
+			return nil, err
+		}
+		json.Unmarshal(labels, &tmpEvent.Labels)
+		events = append(events, tmpEvent)
+	}
+
+	return events, rows.Err()
+}
@@ -0,0 +1,338 @@
+// Prometheus metrics about the fleet and the backend itself, served on GET /metrics
+// device gauges are computed from the device list at scrape time, so devices the backend forgot disappear from them
+// requests are counted by API, route and return code, the return code being read from the JSON answer of HTTP requests
+// and from the ErrorInfo details of gRPC errors
+
+package backendapi
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"net"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+const instrumentedDriverName = "postgres-instrumented" // lib/pq, timing every query
+
+var exporterRegistry = prometheus.NewRegistry()
+
+var requestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "remotemonitor_requests_total",
+	Help: "Requests handled by the backend, by API, route, HTTP status or gRPC code, and return code.",
+}, []string{"api", "route", "status", "code"})
+
+var requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "remotemonitor_request_duration_seconds",
+	Help:    "Time spent handling requests, by API, route and return code.",
+	Buckets: prometheus.DefBuckets,
+}, []string{"api", "route", "code"})
+
+var registrationsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "remotemonitor_registrations_total",
+	Help: "Registration attempts of devices that passed validation, by result.",
+}, []string{"result"})
+
+var badKeyTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "remotemonitor_bad_key_rejections_total",
+	Help: "Requests rejected because of an unknown key, by API.",
+}, []string{"api"})
+
+var dbQueryDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "remotemonitor_db_query_duration_seconds",
+	Help:    "Time spent in Postgres queries, by statement type.",
+	Buckets: []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+}, []string{"statement"})
+
+var returnCodeRE = regexp.MustCompile(`"code"\s*:\s*([0-9]+)`)
+
+// deviceCollector exposes a set of gauges for every device known to the backend
+type deviceCollector struct{}
+
+var deviceLabels = []string{"name", "mac", "tags"}
+var deviceUpDesc = prometheus.NewDesc("remotemonitor_device_up", "Whether the device is online or late, 0 once it is offline.", deviceLabels, nil)
+var deviceCheckinAgeDesc = prometheus.NewDesc("remotemonitor_device_last_checkin_age_seconds", "Seconds since the last check-in of the device.", deviceLabels, nil)
+var deviceRegisteredDesc = prometheus.NewDesc("remotemonitor_device_registered_timestamp_seconds", "When the device last registered.", deviceLabels, nil)
+var deviceFlappingDesc = prometheus.NewDesc("remotemonitor_device_flapping", "Whether the device keeps changing status.", deviceLabels, nil)
+
+func init() {
+	sql.Register(instrumentedDriverName, instrumentedDriver{&pq.Driver{}})
+
+	exporterRegistry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		requestsTotal,
+		requestDuration,
+		registrationsTotal,
+		badKeyTotal,
+		dbQueryDuration,
+		deviceCollector{},
+	)
+
+	// sizes of what the backend keeps in memory
+	for cache, size := range map[string]func() int{
+		"devices": func() int {
+			deviceListMutex.Lock()
+			defer deviceListMutex.Unlock()
+			return len(deviceList)
+		},
+		"latest_samples": func() int {
+			latestSamplesMutex.Lock()
+			defer latestSamplesMutex.Unlock()
+			return len(latestSamples)
+		},
+		"group_configs": func() int {
+			remoteConfigsMutex.RLock()
+			defer remoteConfigsMutex.RUnlock()
+			return len(groupConfigs)
+		},
+		"device_configs": func() int {
+			remoteConfigsMutex.RLock()
+			defer remoteConfigsMutex.RUnlock()
+			return len(deviceConfigs)
+		},
+		"sessions": func() int {
+			sessionsMutex.Lock()
+			defer sessionsMutex.Unlock()
+			return len(sessions)
+		},
+	} {
+		size := size
+		exporterRegistry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name:        "remotemonitor_cache_entries",
+			Help:        "Entries kept in memory by the backend, by cache.",
+			ConstLabels: prometheus.Labels{"cache": cache},
+		}, func() float64 { return float64(size()) }))
+	}
+}
+
+func metricsHandler() http.Handler {
+	// handler for GET /metrics
+	return promhttp.HandlerFor(exporterRegistry, promhttp.HandlerOpts{})
+}
+
+func (deviceCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- deviceUpDesc
+	ch <- deviceCheckinAgeDesc
+	ch <- deviceRegisteredDesc
+	ch <- deviceFlappingDesc
+}
+
+func (deviceCollector) Collect(ch chan<- prometheus.Metric) {
+	now := time.Now()
+	deviceListMutex.Lock()
+	defer deviceListMutex.Unlock()
+	for _, dev := range deviceList {
+		tags := append([]string{}, dev.Tags...)
+		sort.Strings(tags)
+		labels := []string{dev.Name, dev.Mac, strings.Join(tags, ",")}
+
+		up := 0.0
+		if dev.IsUp(now) {
+			up = 1
+		}
+		ch <- prometheus.MustNewConstMetric(deviceUpDesc, prometheus.GaugeValue, up, labels...)
+		flapping := 0.0
+		if dev.Flapping {
+			flapping = 1
+		}
+		ch <- prometheus.MustNewConstMetric(deviceFlappingDesc, prometheus.GaugeValue, flapping, labels...)
+		if !dev.LastCheckin.IsZero() {
+			ch <- prometheus.MustNewConstMetric(deviceCheckinAgeDesc, prometheus.GaugeValue, now.Sub(dev.LastCheckin).Seconds(), labels...)
+		}
+		if !dev.Registered.IsZero() {
+			ch <- prometheus.MustNewConstMetric(deviceRegisteredDesc, prometheus.GaugeValue, float64(dev.Registered.UnixNano())/1e9, labels...)
+		}
+	}
+}
+
+////////////
+// middleware
+func instrumentRequest(next http.Handler) http.Handler {
+	// count HTTP requests and time them, by route template so device names do not end up in labels
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r)
+
+		route := r.URL.Path
+		if current := mux.CurrentRoute(r); current != nil {
+			if template, err := current.GetPathTemplate(); err == nil {
+				route = template
+			}
+		}
+		code := ""
+		if match := returnCodeRE.FindSubmatch(recorder.body); match != nil {
+			code = string(match[1])
+		}
+		observeRequest("http", route, strconv.Itoa(recorder.status), code, start)
+	})
+}
+
+func instrumentUnaryRPC(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	// count gRPC calls and time them
+	start := time.Now()
+	resp, err := handler(ctx, req)
+	observeRPC(info.FullMethod, err, start)
+	return resp, err
+}
+
+func instrumentStreamRPC(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	// same as instrumentUnaryRPC, for the whole stream
+	start := time.Now()
+	err := handler(srv, stream)
+	observeRPC(info.FullMethod, err, start)
+	return err
+}
+
+func observeRPC(method string, err error, start time.Time) {
+	// the return code of failed calls comes with their status
+	st := status.Convert(err)
+	code := ""
+	for _, detail := range st.Details() {
+		if info, ok := detail.(*errdetails.ErrorInfo); ok {
+			code = info.Metadata["code"]
+		}
+	}
+	observeRequest("grpc", method, st.Code().String(), code, start)
+}
+
+func observeRequest(api, route, status, code string, start time.Time) {
+	requestsTotal.WithLabelValues(api, route, status, code).Inc()
+	requestDuration.WithLabelValues(api, route, code).Observe(time.Since(start).Seconds())
+	if code == strconv.Itoa(returnCodeList["BadKey"].Code) {
+		badKeyTotal.WithLabelValues(api).Inc()
+	}
+}
+
+// responseRecorder keeps the status and the beginning of the body of a response
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   []byte
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(data []byte) (int, error) {
+	// the return code is at the start of every answer, keeping the first bytes is enough
+	if missing := 512 - len(r.body); missing > 0 {
+		if missing > len(data) {
+			missing = len(data)
+		}
+		r.body = append(r.body, data[:missing]...)
+	}
+	return r.ResponseWriter.Write(data)
+}
+
+func (r *responseRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	// sessions take over the connection
+	hijacker, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("connection cannot be hijacked")
+	}
+	r.status = http.StatusSwitchingProtocols
+	return hijacker.Hijack()
+}
+
+func (r *responseRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+/////////////
+// database driver timing every query
+type instrumentedDriver struct {
+	driver.Driver
+}
+
+type instrumentedConn struct {
+	driver.Conn
+}
+
+func (d instrumentedDriver) Open(name string) (driver.Conn, error) {
+	conn, err := d.Driver.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return instrumentedConn{conn}, nil
+}
+
+func (c instrumentedConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	execer, ok := c.Conn.(driver.ExecerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	defer observeDBQuery(query, time.Now())
+	return execer.ExecContext(ctx, query, args)
+}
+
+func (c instrumentedConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	queryer, ok := c.Conn.(driver.QueryerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	defer observeDBQuery(query, time.Now())
+	return queryer.QueryContext(ctx, query, args)
+}
+
+func (c instrumentedConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	if preparer, ok := c.Conn.(driver.ConnPrepareContext); ok {
+		return preparer.PrepareContext(ctx, query)
+	}
+	return c.Conn.Prepare(query)
+}
+
+func (c instrumentedConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if beginner, ok := c.Conn.(driver.ConnBeginTx); ok {
+		return beginner.BeginTx(ctx, opts)
+	}
+	return c.Conn.Begin()
+}
+
+func (c instrumentedConn) Ping(ctx context.Context) error {
+	if pinger, ok := c.Conn.(driver.Pinger); ok {
+		return pinger.Ping(ctx)
+	}
+	return nil
+}
+
+func (c instrumentedConn) ResetSession(ctx context.Context) error {
+	if resetter, ok := c.Conn.(driver.SessionResetter); ok {
+		return resetter.ResetSession(ctx)
+	}
+	return nil
+}
+
+func (c instrumentedConn) IsValid() bool {
+	if validator, ok := c.Conn.(driver.Validator); ok {
+		return validator.IsValid()
+	}
+	return true
+}
+
+func observeDBQuery(query string, start time.Time) {
+	// queries are labelled by their first keyword, e.g. SELECT
+	statement := strings.ToUpper(strings.Fields(query + " ?")[0])
+	dbQueryDuration.WithLabelValues(statement).Observe(time.Since(start).Seconds())
+}
@@ -0,0 +1,232 @@
+// gRPC API, served alongside the HTTP one and sharing its handlers
+// the service and its messages are defined in proto/remotemonitor.proto, the Go code in that directory is generated from it
+
+package backendapi
+
+import (
+	"context"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"time"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	pb "github.com/DPinato/RemoteMonitor/proto"
+)
+
+type grpcBackend struct {
+	pb.UnimplementedBackendServer
+}
+
+// gRPC codes for the return codes that are not successes, anything not listed is InvalidArgument
+var grpcCodes = map[string]codes.Code{
+	"AlreadyRegistered": codes.AlreadyExists,
+	"BadKey":            codes.Unauthenticated,
+	"TooManyDevices":    codes.ResourceExhausted,
+	"Wait":              codes.Unavailable,
+	"WaitAndResend":     codes.Unavailable,
+}
+
+func serveGRPC(address string) {
+	// serve the gRPC API until it fails, which stops the backend like a failure of the HTTP server would
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	server := grpc.NewServer(grpc.UnaryInterceptor(instrumentUnaryRPC), grpc.StreamInterceptor(instrumentStreamRPC))
+	pb.RegisterBackendServer(server, grpcBackend{})
+	log.Printf("Serving gRPC on %s\n", address)
+	err = server.Serve(listener)
+	if err != nil {
+		log.Println("gRPC server terminated, PANIC")
+		log.Panic(err)
+	}
+}
+
+func returnCodeStatus(code int) error {
+	// turn a return code into a gRPC status, the return code is attached as ErrorInfo details
+	rc := returnCodeByCode(code)
+
+	grpcCode, ok := grpcCodes[rc.CodeString]
+	if !ok {
+		grpcCode = codes.InvalidArgument
+	}
+
+	st := status.New(grpcCode, rc.Comment)
+	withDetails, err := st.WithDetails(&errdetails.ErrorInfo{
+		Reason:   rc.CodeString,
+		Domain:   "remotemonitor",
+		Metadata: map[string]string{"code": strconv.Itoa(rc.Code)},
+	})
+	if err != nil {
+		return st.Err()
+	}
+	return withDetails.Err()
+}
+
+/////////////
+// service implementation
+func (grpcBackend) Register(ctx context.Context, req *pb.RegisterRequest) (*pb.RegisterResponse, error) {
+	// same as POST /register
+	log.Println("New device registration attempt over gRPC")
+	dev := deviceFromRegisterRequest(req)
+	code := validateRegisterRequest(dev)
+	if code != returnCodeList["RequestOK"].Code {
+		return nil, returnCodeStatus(code)
+	}
+
+	tmpDev, code := registerNewDevice(dev)
+	if code != returnCodeList["RegisterOK"].Code {
+		return nil, returnCodeStatus(code)
+	}
+
+	return &pb.RegisterResponse{
+		Code:       int32(returnCodeList["RegisterOK"].Code),
+		CodeString: returnCodeList["RegisterOK"].CodeString,
+		Comment:    returnCodeList["RegisterOK"].Comment,
+		Key:        tmpDev.Key,
+		Mac:        tmpDev.Mac,
+	}, nil
+}
+
+func (grpcBackend) Checkin(ctx context.Context, req *pb.KeyRequest) (*pb.CheckinResponse, error) {
+	// same as POST /checkin
+	tmpDev, found := deviceByKey(req.Key)
+	if !found {
+		return nil, returnCodeStatus(returnCodeList["BadKey"].Code)
+	}
+
+	log.Printf("Received valid checkin from %s over gRPC\n", tmpDev.Name)
+	recordCheckin(tmpDev.Key)
+	response := checkinResponse(tmpDev.Key)
+	if code, _ := response["code"].(int); code != returnCodeList["CheckinOK"].Code {
+		return nil, returnCodeStatus(code)
+	}
+	commandsDelivered(tmpDev.Key, response)
+
+	resp := &pb.CheckinResponse{Code: int32(returnCodeList["CheckinOK"].Code)}
+	resp.LastCheckin, _ = response["last_checkin"].(string)
+	resp.ConfigVersion, _ = response["config_version"].(string)
+	commands, _ := response["commands"].([]Command)
+	for _, cmd := range commands {
+		resp.Commands = append(resp.Commands, &pb.Command{Id: cmd.ID, Type: cmd.Type, Args: cmd.Args, Timeout: int32(cmd.Timeout)})
+	}
+	return resp, nil
+}
+
+func (grpcBackend) Checkout(ctx context.Context, req *pb.KeyRequest) (*pb.CheckoutResponse, error) {
+	// same as POST /checkout
+	tmpDev, found := deviceByKey(req.Key)
+	if !found {
+		return nil, returnCodeStatus(returnCodeList["BadKey"].Code)
+	}
+
+	response := checkoutResponse(tmpDev)
+	resp := &pb.CheckoutResponse{Code: int32(returnCodeList["CheckoutOK"].Code), CodeString: returnCodeList["CheckoutOK"].CodeString}
+	resp.LastCheckout, _ = response["last_checkout"].(string)
+	return resp, nil
+}
+
+func (grpcBackend) SendData(stream pb.Backend_SendDataServer) error {
+	// like POST /data, for as many batches of samples as the device streams
+	// samples that fail validation are counted as rejected, the others are stored
+	accepted, rejected := 0, 0
+	lastCode := returnCodeList["DataOK"].Code
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		tmpDev, found := deviceByKey(req.Key)
+		if !found {
+			return returnCodeStatus(returnCodeList["BadKey"].Code)
+		}
+
+		samples, rejectedSamples := partitionSamples(samplesFromPB(req.Samples), time.Now(), sampleMaxAge(req.Replay))
+		rejected += len(rejectedSamples)
+		if len(rejectedSamples) > 0 {
+			lastCode = rejectedSamples[0].Code
+		}
+		if len(samples) > 0 {
+			storeSamples(tmpDev, samples)
+			accepted += len(samples)
+		}
+	}
+
+	// nothing was usable, tell the device why
+	if accepted == 0 && rejected > 0 {
+		return returnCodeStatus(lastCode)
+	}
+
+	return stream.SendAndClose(&pb.DataResponse{
+		Code:       int32(returnCodeList["DataOK"].Code),
+		CodeString: returnCodeList["DataOK"].CodeString,
+		Accepted:   int32(accepted),
+		Rejected:   int32(rejected),
+	})
+}
+
+/////////////
+// conversions between the messages and the types shared with the HTTP API
+func deviceFromRegisterRequest(req *pb.RegisterRequest) Device {
+	// the device described by a register request, as it would have been decoded from POST /register
+	dev := Device{
+		Name:       req.Name,
+		Mac:        req.Mac,
+		MachineID:  req.MachineId,
+		Interfaces: interfacesFromPB(req.Interfaces),
+		Tags:       req.Tags,
+		OS:         req.Os,
+	}
+	if inv := req.Inventory; inv != nil {
+		dev.Inventory = &Inventory{
+			OS:              inv.Os,
+			OSID:            inv.OsId,
+			OSVersion:       inv.OsVersion,
+			Kernel:          inv.Kernel,
+			Arch:            inv.Arch,
+			CPUModel:        inv.CpuModel,
+			CPUCount:        int(inv.CpuCount),
+			MemoryTotal:     inv.MemoryTotal,
+			BootTime:        timeFromPB(inv.BootTime),
+			Interfaces:      interfacesFromPB(inv.Interfaces),
+			ReporterVersion: inv.ReporterVersion,
+		}
+	}
+	return dev
+}
+
+func interfacesFromPB(list []*pb.NetInterface) []NetInterface {
+	var output []NetInterface
+	for _, iface := range list {
+		output = append(output, NetInterface{Name: iface.Name, Mac: iface.Mac, IPs: iface.Ips})
+	}
+	return output
+}
+
+func samplesFromPB(list []*pb.Sample) []Sample {
+	output := make([]Sample, 0, len(list))
+	for _, sample := range list {
+		output = append(output, Sample{Name: sample.Name, Labels: sample.Labels, Value: sample.Value, Timestamp: timeFromPB(sample.Timestamp)})
+	}
+	return output
+}
+
+func timeFromPB(ts *timestamppb.Timestamp) time.Time {
+	// a missing timestamp is the zero time, like a missing field in JSON
+	if ts == nil {
+		return time.Time{}
+	}
+	return ts.AsTime()
+}
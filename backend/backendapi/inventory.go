@@ -0,0 +1,174 @@
+// inventory reported by devices: operating system, kernel, hardware and network details, with a history of changes
+
+package backendapi
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Inventory describes a device, as reported by node-reporter
+type Inventory struct {
+	OS              string         `json:"os"`               // distribution, e.g. Debian GNU/Linux 12 (bookworm)
+	OSID            string         `json:"os_id"`            // distribution identifier, e.g. debian
+	OSVersion       string         `json:"os_version"`       // distribution version, e.g. 12
+	Kernel          string         `json:"kernel"`           // kernel release
+	Arch            string         `json:"arch"`             // CPU architecture
+	CPUModel        string         `json:"cpu_model"`        // model name of the first CPU
+	CPUCount        int            `json:"cpu_count"`        // number of logical CPUs
+	MemoryTotal     uint64         `json:"memory_total"`     // total memory, in bytes
+	BootTime        time.Time      `json:"boot_time"`        // time the device booted
+	Interfaces      []NetInterface `json:"interfaces"`       // physical interfaces and their addresses
+	ReporterVersion string         `json:"reporter_version"` // version of node-reporter running on the device
+}
+
+// InventoryChange is an entry in the inventory history of a device
+type InventoryChange struct {
+	Timestamp time.Time `json:"timestamp"` // when the change was received
+	Changed   []string  `json:"changed"`   // inventory fields that changed
+	Inventory Inventory `json:"inventory"` // inventory after the change
+}
+
+func diffInventory(old *Inventory, new Inventory) []string {
+	// list the JSON names of the fields that differ between old and new inventory, every field if there was no old one
+	var oldMap, newMap map[string]interface{}
+	newJson, _ := json.Marshal(new)
+	json.Unmarshal(newJson, &newMap)
+	if old != nil {
+		oldJson, _ := json.Marshal(old)
+		json.Unmarshal(oldJson, &oldMap)
+	}
+
+	var changed []string
+	for field, value := range newMap {
+		if !reflect.DeepEqual(oldMap[field], value) {
+			changed = append(changed, field)
+		}
+	}
+	sort.Strings(changed)
+
+	return changed
+}
+
+////////////
+// respond to HTTP calls from client
+func receiveInventory(w http.ResponseWriter, r *http.Request) {
+	// devices send their inventory here whenever it changes, changes are stored in the inventory history
+	w.Header().Set("Content-Type", "application/json")
+	var req struct {
+		Key       string     `json:"key"`
+		Inventory *Inventory `json:"inventory"`
+	}
+
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil || req.Inventory == nil {
+		response, _ := generateErrorResponse("DataMalformed")
+		log.Printf("Received malformed inventory, %s\n", response)
+		http.Error(w, response, http.StatusBadRequest)
+		return
+	}
+
+	var changed []string
+	var dev Device
+	found := withDevice(req.Key, func(tmpDev *Device) {
+		changed = diffInventory(tmpDev.Inventory, *req.Inventory)
+		if len(changed) > 0 {
+			tmpDev.Inventory = req.Inventory
+			tmpDev.OS = req.Inventory.OS
+		}
+		dev = tmpDev.clone()
+	})
+	if !found {
+		response, _ := generateErrorResponse("BadKey")
+		log.Printf("Received inventory with unknown key, %s\n", response)
+		http.Error(w, response, http.StatusBadRequest)
+		return
+	}
+
+	if len(changed) > 0 {
+		log.Printf("Inventory of %s changed: %v\n", dev.Name, changed)
+		err = newInventoryChange(dev, changed, pCreds["reg_table"].(string), dbObj)
+		if err != nil {
+			log.Println(err)
+		}
+	}
+
+	responseMap := make(map[string]interface{})
+	responseMap["code"] = returnCodeList["DataOK"].Code
+	responseMap["code_string"] = returnCodeList["DataOK"].CodeString
+	responseMap["changed"] = changed
+	json.NewEncoder(w).Encode(responseMap)
+}
+
+func getDeviceInventoryHistory(w http.ResponseWriter, r *http.Request) {
+	// return every inventory change recorded for a device, oldest first
+	w.Header().Set("Content-Type", "application/json")
+	dev, found := deviceByName(mux.Vars(r)["name"])
+	if !found {
+		http.Error(w, `{"error": "device not found"}`, http.StatusNotFound)
+		return
+	}
+
+	history, err := readInventoryHistory(dev.Key, dbObj)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, `{"error": "failed to read inventory history"}`, http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(history)
+}
+
+/////////////
+// database
+func newInventoryChange(dev Device, changed []string, regTable string, dbObj *sql.DB) error {
+	// record an inventory change and keep the OS column of the registration table up to date
+	inventory, err := json.Marshal(dev.Inventory)
+	if err != nil {
+		return err
+	}
+	changedJson, err := json.Marshal(changed)
+	if err != nil {
+		return err
+	}
+
+	sqlStatement := `INSERT INTO inventory_history (device_key, ts, changed, inventory) VALUES ($1, $2, $3, $4)`
+	_, err = dbObj.Exec(sqlStatement, dev.Key, time.Now(), string(changedJson), string(inventory))
+	if err != nil {
+		return err
+	}
+
+	_, err = dbObj.Exec("UPDATE "+regTable+" SET os = $1 WHERE key = $2", dev.OS, dev.Key)
+	return err
+}
+
+func readInventoryHistory(key string, dbObj *sql.DB) ([]InventoryChange, error) {
+	// read the inventory history of the device with the given key, oldest first
+	rows, err := dbObj.Query(`SELECT ts, changed, inventory FROM inventory_history WHERE device_key = $1 ORDER BY ts`, key)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	history := []InventoryChange{}
+	for rows.Next() {
+		var tmpChange InventoryChange
+		var changed, inventory []byte
+		err = rows.Scan(&tmpChange.Timestamp, &changed, &inventory)
+		if err != nil {
+			return nil, err
+		}
+		json.Unmarshal(changed, &tmpChange.Changed)
+		json.Unmarshal(inventory, &tmpChange.Inventory)
+		history = append(history, tmpChange)
+	}
+
+	return history, rows.Err()
+}
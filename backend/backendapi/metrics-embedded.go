@@ -0,0 +1,226 @@
+// metrics store in a single file, for installs without a Postgres server sized for metrics
+// the file has a bucket per resolution, holding a bucket per series, keyed by timestamp
+
+package backendapi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+type embeddedMetricsStore struct {
+	db *bolt.DB
+}
+
+func newEmbeddedMetricsStore(path string) (*embeddedMetricsStore, error) {
+	// open or create the file at path
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, resolution := range []string{"raw", "1m", "1h"} {
+			_, err := tx.CreateBucketIfNotExists([]byte(resolution))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &embeddedMetricsStore{db: db}, nil
+}
+
+func (s *embeddedMetricsStore) Write(device string, samples []Sample) error {
+	// samples with the same series and timestamp as one already stored replace it
+	return s.db.Update(func(tx *bolt.Tx) error {
+		raw := tx.Bucket([]byte("raw"))
+		for _, sample := range samples {
+			series, err := raw.CreateBucketIfNotExists(seriesKey(device, sample.Name, sample.Labels))
+			if err != nil {
+				return err
+			}
+			point := MetricPoint{Min: sample.Value, Max: sample.Value, Sum: sample.Value, Count: 1}
+			err = series.Put(timeKey(sample.Timestamp), encodePoint(point))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *embeddedMetricsStore) Query(query MetricsQuery) ([]MetricSeries, error) {
+	// read the points of every matching series between From and To
+	var result []MetricSeries
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(query.Resolution))
+		if bucket == nil {
+			return fmt.Errorf("unknown resolution %q", query.Resolution)
+		}
+		return bucket.ForEachBucket(func(key []byte) error {
+			device, name, labels, err := parseSeriesKey(key)
+			if err != nil || name != query.Name || (query.Device != "" && !seriesDeviceMatches(device, labels, query.Device)) || !labelsMatch(labels, query.Labels) {
+				return err
+			}
+			tmpSeries := storedSeries(device, name, labels)
+			tmpSeries.Points = readPoints(bucket.Bucket(key), query.From, query.To)
+			if len(tmpSeries.Points) > 0 {
+				result = append(result, tmpSeries)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sortSeries(result)
+	return result, nil
+}
+
+func (s *embeddedMetricsStore) Rollup(from, to time.Time) error {
+	// 1-minute buckets come from raw samples, 1-hour buckets from the 1-minute ones
+	return s.db.Update(func(tx *bolt.Tx) error {
+		err := rollupBucket(tx.Bucket([]byte("raw")), tx.Bucket([]byte("1m")), from.Truncate(time.Minute), to, time.Minute)
+		if err != nil {
+			return err
+		}
+		return rollupBucket(tx.Bucket([]byte("1m")), tx.Bucket([]byte("1h")), from.Truncate(time.Hour), to, time.Hour)
+	})
+}
+
+func (s *embeddedMetricsStore) Prune(now time.Time) error {
+	// delete points older than the retention of their resolution, and series left empty
+	return s.db.Update(func(tx *bolt.Tx) error {
+		for resolution, retention := range metricsRetention {
+			bucket := tx.Bucket([]byte(resolution))
+			cutoff := timeKey(now.Add(-retention))
+
+			var empty [][]byte
+			err := bucket.ForEachBucket(func(key []byte) error {
+				series := bucket.Bucket(key)
+				var old [][]byte
+				cursor := series.Cursor()
+				for k, _ := cursor.First(); k != nil && bytes.Compare(k, cutoff) < 0; k, _ = cursor.Next() {
+					old = append(old, append([]byte(nil), k...))
+				}
+				for _, k := range old {
+					err := series.Delete(k)
+					if err != nil {
+						return err
+					}
+				}
+				if k, _ := series.Cursor().First(); k == nil {
+					empty = append(empty, append([]byte(nil), key...))
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			for _, key := range empty {
+				err = bucket.DeleteBucket(key)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+func (s *embeddedMetricsStore) Close() error {
+	return s.db.Close()
+}
+
+/////////////
+// helpful functions for the embedded store
+func rollupBucket(source, target *bolt.Bucket, from, to time.Time, step time.Duration) error {
+	// aggregate the points of every series of source between from and to into target
+	return source.ForEachBucket(func(key []byte) error {
+		points := readPoints(source.Bucket(key), from, to)
+		if len(points) == 0 {
+			return nil
+		}
+		series, err := target.CreateBucketIfNotExists(key)
+		if err != nil {
+			return err
+		}
+		for _, bucket := range rollupBuckets(points, step) {
+			err = series.Put(timeKey(bucket.Timestamp), encodePoint(bucket))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func readPoints(series *bolt.Bucket, from, to time.Time) []MetricPoint {
+	// points of series in [from, to), ordered by time
+	var points []MetricPoint
+	end := timeKey(to)
+	cursor := series.Cursor()
+	for k, v := cursor.Seek(timeKey(from)); k != nil && bytes.Compare(k, end) < 0; k, v = cursor.Next() {
+		point := decodePoint(v)
+		point.Timestamp = time.Unix(0, int64(binary.BigEndian.Uint64(k))).UTC()
+		points = append(points, point)
+	}
+	return points
+}
+
+func seriesKey(device, name string, labels map[string]string) []byte {
+	// device, metric name and labels, separated by NUL bytes which none of them can contain
+	return []byte(device + "\x00" + name + "\x00" + encodeLabels(labels))
+}
+
+func parseSeriesKey(key []byte) (string, string, map[string]string, error) {
+	// reverse of seriesKey
+	parts := strings.SplitN(string(key), "\x00", 3)
+	if len(parts) != 3 {
+		return "", "", nil, fmt.Errorf("bad series key %q", key)
+	}
+	var labels map[string]string
+	err := json.Unmarshal([]byte(parts[2]), &labels)
+	return parts[0], parts[1], labels, err
+}
+
+func timeKey(ts time.Time) []byte {
+	// big endian nanoseconds, so keys sort by time, times before 1970 are all stored as 1970
+	key := make([]byte, 8)
+	if ts.After(time.Unix(0, 0)) {
+		binary.BigEndian.PutUint64(key, uint64(ts.UnixNano()))
+	}
+	return key
+}
+
+func encodePoint(point MetricPoint) []byte {
+	// min, max, sum and count, the timestamp is the key
+	value := make([]byte, 32)
+	binary.BigEndian.PutUint64(value[0:], math.Float64bits(point.Min))
+	binary.BigEndian.PutUint64(value[8:], math.Float64bits(point.Max))
+	binary.BigEndian.PutUint64(value[16:], math.Float64bits(point.Sum))
+	binary.BigEndian.PutUint64(value[24:], uint64(point.Count))
+	return value
+}
+
+func decodePoint(value []byte) MetricPoint {
+	return MetricPoint{
+		Min:   math.Float64frombits(binary.BigEndian.Uint64(value[0:])),
+		Max:   math.Float64frombits(binary.BigEndian.Uint64(value[8:])),
+		Sum:   math.Float64frombits(binary.BigEndian.Uint64(value[16:])),
+		Count: int64(binary.BigEndian.Uint64(value[24:])),
+	}
+}
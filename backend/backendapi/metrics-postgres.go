@@ -0,0 +1,251 @@
+// metrics store in Postgres
+// raw samples go to metric_samples, partitioned by day so old samples are dropped a whole partition at a time
+// rollups of every resolution go to metric_rollups
+
+package backendapi
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const metricPartitionPrefix = "metric_samples_"
+
+type postgresMetricsStore struct {
+	db         *sql.DB
+	partitions map[string]bool // partitions known to exist, by name
+	mutex      sync.Mutex      // protects partitions
+}
+
+func newPostgresMetricsStore(db *sql.DB) (*postgresMetricsStore, error) {
+	// create the tables the store needs
+	statements := []string{
+		`CREATE TABLE IF NOT EXISTS metric_samples (
+	device TEXT NOT NULL,
+	name TEXT NOT NULL,
+	labels JSONB NOT NULL,
+	ts TIMESTAMPTZ NOT NULL,
+	value DOUBLE PRECISION NOT NULL)
+	PARTITION BY RANGE (ts)`,
+		`CREATE INDEX IF NOT EXISTS metric_samples_name_device_ts ON metric_samples (name, device, ts)`,
+		`CREATE TABLE IF NOT EXISTS metric_rollups (
+	resolution TEXT NOT NULL,
+	device TEXT NOT NULL,
+	name TEXT NOT NULL,
+	labels JSONB NOT NULL,
+	bucket TIMESTAMPTZ NOT NULL,
+	min DOUBLE PRECISION NOT NULL,
+	max DOUBLE PRECISION NOT NULL,
+	sum DOUBLE PRECISION NOT NULL,
+	count BIGINT NOT NULL,
+	PRIMARY KEY (resolution, name, device, labels, bucket))`,
+		`CREATE INDEX IF NOT EXISTS metric_rollups_resolution_bucket ON metric_rollups (resolution, bucket)`,
+	}
+	for _, sqlStatement := range statements {
+		_, err := db.Exec(sqlStatement)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &postgresMetricsStore{db: db, partitions: make(map[string]bool)}, nil
+}
+
+func (s *postgresMetricsStore) Write(device string, samples []Sample) error {
+	// copy samples into metric_samples, creating the daily partitions they fall in
+	for _, sample := range samples {
+		err := s.ensurePartition(sample.Timestamp)
+		if err != nil {
+			return err
+		}
+	}
+
+	txn, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	stmt, err := txn.Prepare(pq.CopyIn("metric_samples", "device", "name", "labels", "ts", "value"))
+	if err != nil {
+		txn.Rollback()
+		return err
+	}
+	for _, sample := range samples {
+		_, err = stmt.Exec(device, sample.Name, encodeLabels(sample.Labels), sample.Timestamp, sample.Value)
+		if err != nil {
+			stmt.Close()
+			txn.Rollback()
+			return err
+		}
+	}
+	_, err = stmt.Exec()
+	if err != nil {
+		stmt.Close()
+		txn.Rollback()
+		return err
+	}
+	err = stmt.Close()
+	if err != nil {
+		txn.Rollback()
+		return err
+	}
+	return txn.Commit()
+}
+
+func (s *postgresMetricsStore) Query(query MetricsQuery) ([]MetricSeries, error) {
+	// read raw samples or rollups of one metric
+	var sqlStatement string
+	values := []interface{}{query.Name, query.From, query.To}
+	if query.Resolution == "raw" {
+		sqlStatement = `SELECT device, labels, ts, value, value, value, 1 FROM metric_samples
+WHERE name = $1 AND ts >= $2 AND ts < $3`
+	} else if _, ok := rollupResolutions[query.Resolution]; ok {
+		sqlStatement = `SELECT device, labels, bucket, min, max, sum, count FROM metric_rollups
+WHERE name = $1 AND bucket >= $2 AND bucket < $3 AND resolution = $4`
+		values = append(values, query.Resolution)
+	} else {
+		return nil, fmt.Errorf("unknown resolution %q", query.Resolution)
+	}
+	if query.Device != "" {
+		// the device name is a label, or the device column for series stored before devices had an identifier
+		values = append(values, encodeLabels(map[string]string{"device": query.Device}), query.Device)
+		sqlStatement += fmt.Sprintf(" AND (labels @> $%d OR (device = $%d AND NOT labels ? 'device'))", len(values)-1, len(values))
+	}
+	if len(query.Labels) > 0 {
+		values = append(values, encodeLabels(query.Labels))
+		sqlStatement += fmt.Sprintf(" AND labels @> $%d", len(values))
+	}
+	sqlStatement += " ORDER BY 1, 2, 3"
+
+	rows, err := s.db.Query(sqlStatement, values...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var series []MetricSeries
+	lastKey := ""
+	for rows.Next() {
+		var device, labels string
+		var point MetricPoint
+		err = rows.Scan(&device, &labels, &point.Timestamp, &point.Min, &point.Max, &point.Sum, &point.Count)
+		if err != nil {
+			return nil, err
+		}
+		if key := device + "\x00" + labels; len(series) == 0 || key != lastKey {
+			var labelMap map[string]string
+			err = json.Unmarshal([]byte(labels), &labelMap)
+			if err != nil {
+				return nil, err
+			}
+			series = append(series, storedSeries(device, query.Name, labelMap))
+			lastKey = key
+		}
+		current := &series[len(series)-1]
+		current.Points = append(current.Points, point)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	sortSeries(series)
+	return series, nil
+}
+
+func (s *postgresMetricsStore) Rollup(from, to time.Time) error {
+	// 1-minute buckets come from raw samples, 1-hour buckets from the 1-minute ones
+	from = from.Truncate(time.Minute)
+	_, err := s.db.Exec(`INSERT INTO metric_rollups (resolution, device, name, labels, bucket, min, max, sum, count)
+SELECT '1m', device, name, labels, date_trunc('minute', ts), min(value), max(value), sum(value), count(*)
+FROM metric_samples WHERE ts >= $1 AND ts < $2
+GROUP BY device, name, labels, date_trunc('minute', ts)
+ON CONFLICT (resolution, name, device, labels, bucket)
+DO UPDATE SET min = EXCLUDED.min, max = EXCLUDED.max, sum = EXCLUDED.sum, count = EXCLUDED.count`, from, to)
+	if err != nil {
+		return err
+	}
+
+	from = from.Truncate(time.Hour)
+	_, err = s.db.Exec(`INSERT INTO metric_rollups (resolution, device, name, labels, bucket, min, max, sum, count)
+SELECT '1h', device, name, labels, date_trunc('hour', bucket), min(min), max(max), sum(sum), sum(count)
+FROM metric_rollups WHERE resolution = '1m' AND bucket >= $1 AND bucket < $2
+GROUP BY device, name, labels, date_trunc('hour', bucket)
+ON CONFLICT (resolution, name, device, labels, bucket)
+DO UPDATE SET min = EXCLUDED.min, max = EXCLUDED.max, sum = EXCLUDED.sum, count = EXCLUDED.count`, from, to)
+	return err
+}
+
+func (s *postgresMetricsStore) Prune(now time.Time) error {
+	// drop daily partitions that only hold samples older than the raw retention, then old rollups
+	rows, err := s.db.Query(`SELECT c.relname FROM pg_inherits i
+JOIN pg_class c ON c.oid = i.inhrelid
+JOIN pg_class p ON p.oid = i.inhparent
+WHERE p.relname = 'metric_samples'`)
+	if err != nil {
+		return err
+	}
+	var partitions []string
+	for rows.Next() {
+		var name string
+		err = rows.Scan(&name)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		partitions = append(partitions, name)
+	}
+	rows.Close()
+
+	cutoff := now.Add(-metricsRetention["raw"])
+	for _, name := range partitions {
+		day, err := time.Parse("20060102", strings.TrimPrefix(name, metricPartitionPrefix))
+		if err != nil || day.Add(24*time.Hour).After(cutoff) {
+			continue
+		}
+		_, err = s.db.Exec(fmt.Sprintf("DROP TABLE IF EXISTS %s", pq.QuoteIdentifier(name)))
+		if err != nil {
+			return err
+		}
+		s.mutex.Lock()
+		delete(s.partitions, name)
+		s.mutex.Unlock()
+	}
+
+	for resolution := range rollupResolutions {
+		_, err = s.db.Exec("DELETE FROM metric_rollups WHERE resolution = $1 AND bucket < $2",
+			resolution, now.Add(-metricsRetention[resolution]))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *postgresMetricsStore) Close() error {
+	// the database connection belongs to the backend
+	return nil
+}
+
+func (s *postgresMetricsStore) ensurePartition(ts time.Time) error {
+	// create the partition holding the day of ts, partitions are days in UTC
+	day := ts.UTC().Truncate(24 * time.Hour)
+	name := metricPartitionPrefix + day.Format("20060102")
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.partitions[name] {
+		return nil
+	}
+	_, err := s.db.Exec(fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s PARTITION OF metric_samples FOR VALUES FROM ('%s') TO ('%s')",
+		pq.QuoteIdentifier(name), day.Format(time.RFC3339), day.Add(24*time.Hour).Format(time.RFC3339)))
+	if err != nil {
+		return err
+	}
+	s.partitions[name] = true
+	return nil
+}
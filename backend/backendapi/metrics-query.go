@@ -0,0 +1,473 @@
+// querying stored metrics, for charts and analysis
+// GET /devices/{name}/metrics/{metric} reads a metric of one device
+// GET /metrics/{metric} reads a metric of every device, or of the devices with a tag
+// both accept:
+//   from, to    RFC 3339 or unix seconds, the last hour by default
+//   step        width of each returned point, e.g. 30s or 5m, by default the range is split in about 300 points
+//   agg         avg (default), min, max, sum, count, rate, or a percentile like p95 or p99.9
+//   label       k=v, only series carrying the label, can be repeated
+//   tag         only devices with the tag, /metrics/{metric} only
+//   by          comma separated labels, series with the same values for them are combined, "device" is a label too
+//   resolution  raw, 1m or 1h, by default the coarsest one the step and the retentions allow
+// percentiles and rate read rollups when the range needs them, they are then computed from bucket averages and maxima
+
+package backendapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+var defaultQueryRange = time.Hour // range queried when from is not given
+var defaultQueryPoints = 300      // points per series when step is not given
+var maxQueryPoints = 11000        // steps per series a query can ask for
+
+// metricsRequest is a parsed query for stored metrics
+type metricsRequest struct {
+	MetricsQuery
+	Step       time.Duration
+	Agg        string
+	Percentile float64  // 0-100, for percentile aggregations
+	Tag        string   // only devices with this tag
+	By         []string // labels series are combined by, nil to keep them separate
+}
+
+// MetricsResult is the JSON answer to a metrics query, points are [unix seconds, value] pairs
+type MetricsResult struct {
+	Metric     string         `json:"metric"`
+	From       int64          `json:"from"`
+	To         int64          `json:"to"`
+	Step       float64        `json:"step"` // seconds
+	Agg        string         `json:"agg"`
+	Resolution string         `json:"resolution"`
+	Series     []ResultSeries `json:"series"`
+}
+
+// ResultSeries is one line of a chart
+type ResultSeries struct {
+	Labels map[string]string `json:"labels"` // labels of the series, including the device name unless combined away
+	Points [][2]float64      `json:"points"`
+}
+
+// stepValue is the value of a series over one step
+type stepValue struct {
+	Step  int // index of the step
+	Value float64
+}
+
+////////////
+// respond to HTTP calls from client
+func getDeviceMetric(w http.ResponseWriter, r *http.Request) {
+	// query a metric of one device, identified by name
+	w.Header().Set("Content-Type", "application/json")
+	vars := mux.Vars(r)
+	if _, ok := deviceByName(vars["name"]); !ok {
+		http.Error(w, `{"error": "device not found"}`, http.StatusNotFound)
+		return
+	}
+	serveMetricsQuery(w, r, vars["name"])
+}
+
+func getMetric(w http.ResponseWriter, r *http.Request) {
+	// query a metric of every device matching the request
+	w.Header().Set("Content-Type", "application/json")
+	serveMetricsQuery(w, r, "")
+}
+
+func serveMetricsQuery(w http.ResponseWriter, r *http.Request, device string) {
+	// parse the query parameters, read the store and aggregate
+	if metricsStore == nil {
+		http.Error(w, `{"error": "metrics are not stored"}`, http.StatusServiceUnavailable)
+		return
+	}
+
+	req, err := parseMetricsRequest(mux.Vars(r)["metric"], device, r.URL.Query(), time.Now())
+	if err != nil {
+		errorJSON, _ := json.Marshal(map[string]string{"error": err.Error()})
+		http.Error(w, string(errorJSON), http.StatusBadRequest)
+		return
+	}
+
+	result, err := runMetricsRequest(metricsStore, req)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, `{"error": "failed to read metrics"}`, http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(result)
+}
+
+/////////////
+// helpful functions for API calls
+func parseMetricsRequest(metric, device string, params url.Values, now time.Time) (metricsRequest, error) {
+	// read the query parameters documented at the top of this file
+	req := metricsRequest{MetricsQuery: MetricsQuery{Name: metric, Device: device, To: now}, Agg: "avg"}
+	var err error
+
+	if value := params.Get("to"); value != "" {
+		req.To, err = parseQueryTime(value)
+		if err != nil {
+			return req, fmt.Errorf("bad to %q", value)
+		}
+	}
+	req.From = req.To.Add(-defaultQueryRange)
+	if value := params.Get("from"); value != "" {
+		req.From, err = parseQueryTime(value)
+		if err != nil {
+			return req, fmt.Errorf("bad from %q", value)
+		}
+	}
+	if !req.From.Before(req.To) {
+		return req, fmt.Errorf("from must be before to")
+	}
+
+	req.Step = req.To.Sub(req.From) / time.Duration(defaultQueryPoints)
+	if value := params.Get("step"); value != "" {
+		req.Step, err = parseQueryDuration(value)
+		if err != nil || req.Step <= 0 {
+			return req, fmt.Errorf("bad step %q", value)
+		}
+	}
+	if req.Step < time.Second {
+		req.Step = time.Second
+	}
+	if req.To.Sub(req.From)/req.Step > time.Duration(maxQueryPoints) {
+		return req, fmt.Errorf("too many points, use a larger step")
+	}
+
+	if value := params.Get("agg"); value != "" {
+		req.Agg = value
+	}
+	switch req.Agg {
+	case "avg", "min", "max", "sum", "count", "rate":
+	default:
+		req.Percentile, err = strconv.ParseFloat(strings.TrimPrefix(req.Agg, "p"), 64)
+		if !strings.HasPrefix(req.Agg, "p") || err != nil || math.IsNaN(req.Percentile) || math.IsInf(req.Percentile, 0) || req.Percentile < 0 || req.Percentile > 100 {
+			return req, fmt.Errorf("unknown aggregation %q", req.Agg)
+		}
+	}
+
+	for _, value := range params["label"] {
+		parts := strings.SplitN(value, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return req, fmt.Errorf("bad label %q, expected key=value", value)
+		}
+		if req.Labels == nil {
+			req.Labels = make(map[string]string)
+		}
+		req.Labels[parts[0]] = parts[1]
+	}
+	req.Tag = params.Get("tag")
+	if _, ok := params["by"]; ok {
+		req.By = []string{}
+		for _, label := range strings.Split(params.Get("by"), ",") {
+			if label = strings.TrimSpace(label); label != "" {
+				req.By = append(req.By, label)
+			}
+		}
+	}
+
+	req.Resolution = params.Get("resolution")
+	if req.Resolution == "" {
+		req.Resolution = chooseResolution(req.From, req.Step, now)
+	} else if _, ok := metricsRetention[req.Resolution]; !ok {
+		return req, fmt.Errorf("unknown resolution %q", req.Resolution)
+	}
+
+	return req, nil
+}
+
+func chooseResolution(from time.Time, step time.Duration, now time.Time) string {
+	// the coarsest resolution with buckets no larger than step, or a coarser one if the finer ones no longer go back to from
+	resolution := "raw"
+	if step >= time.Hour {
+		resolution = "1h"
+	} else if step >= time.Minute {
+		resolution = "1m"
+	}
+	if resolution == "raw" && from.Before(now.Add(-metricsRetention["raw"])) {
+		resolution = "1m"
+	}
+	if resolution == "1m" && from.Before(now.Add(-metricsRetention["1m"])) {
+		resolution = "1h"
+	}
+	return resolution
+}
+
+func runMetricsRequest(store MetricsStore, req metricsRequest) (MetricsResult, error) {
+	// read the series and reduce each of them to one value per step
+	result := MetricsResult{
+		Metric:     req.Name,
+		From:       req.From.Unix(),
+		To:         req.To.Unix(),
+		Step:       req.Step.Seconds(),
+		Agg:        req.Agg,
+		Resolution: req.Resolution,
+		Series:     []ResultSeries{},
+	}
+
+	// rate needs the value before the first step
+	query := req.MetricsQuery
+	if req.Agg == "rate" {
+		query.From = query.From.Add(-req.Step)
+	}
+	series, err := queryWithRecentSamples(store, query)
+	if err != nil {
+		return result, err
+	}
+
+	// devices with the tag, by identifier, and by name for series stored before devices had an identifier
+	tagged := make(map[string]bool)
+	if req.Tag != "" {
+		deviceListMutex.Lock()
+		for _, dev := range deviceList {
+			if dev.HasTag(req.Tag) {
+				if dev.ID != "" {
+					tagged[dev.ID] = true
+				}
+				tagged[dev.Name] = true
+			}
+		}
+		deviceListMutex.Unlock()
+	}
+
+	groups := make(map[string]*ResultSeries)
+	groupValues := make(map[string]map[int][]float64)
+	var order []string
+	for _, tmpSeries := range series {
+		if req.Tag != "" && !tagged[tmpSeries.DeviceID] && !(tmpSeries.DeviceID == "" && tagged[tmpSeries.Device]) {
+			continue
+		}
+		labels := map[string]string{"device": tmpSeries.Device}
+		if tmpSeries.DeviceID != "" {
+			labels["device_id"] = tmpSeries.DeviceID // devices can share a name
+		}
+		for key, value := range tmpSeries.Labels {
+			labels[key] = value
+		}
+		values := stepSeries(tmpSeries.Points, req)
+
+		if req.By == nil {
+			result.Series = append(result.Series, ResultSeries{Labels: labels, Points: stepPoints(values, req)})
+			continue
+		}
+		groupLabels := make(map[string]string)
+		for _, key := range req.By {
+			if value, ok := labels[key]; ok {
+				groupLabels[key] = value
+			}
+		}
+		key := encodeLabels(groupLabels)
+		if groups[key] == nil {
+			groups[key] = &ResultSeries{Labels: groupLabels}
+			groupValues[key] = make(map[int][]float64)
+			order = append(order, key)
+		}
+		for _, value := range values {
+			groupValues[key][value.Step] = append(groupValues[key][value.Step], value.Value)
+		}
+	}
+
+	sort.Strings(order)
+	for _, key := range order {
+		var values []stepValue
+		for step, stepValues := range groupValues[key] {
+			values = append(values, stepValue{Step: step, Value: combineValues(stepValues, req)})
+		}
+		sort.Slice(values, func(i, j int) bool { return values[i].Step < values[j].Step })
+		groups[key].Points = stepPoints(values, req)
+		result.Series = append(result.Series, *groups[key])
+	}
+
+	return result, nil
+}
+
+func queryWithRecentSamples(store MetricsStore, query MetricsQuery) ([]MetricSeries, error) {
+	// rollups lag behind the samples, the part of the range that was not rolled up yet is rolled up from raw samples
+	rollupMutex.Lock()
+	watermark := rollupWatermark
+	rollupMutex.Unlock()
+	step, ok := rollupResolutions[query.Resolution]
+	if !ok || watermark.IsZero() || !watermark.Before(query.To) {
+		return store.Query(query)
+	}
+
+	cut := watermark.Truncate(step)
+	if cut.Before(query.From) {
+		cut = query.From
+	}
+	rolledUp := query
+	rolledUp.To = cut
+	series, err := store.Query(rolledUp)
+	if err != nil {
+		return nil, err
+	}
+	recent := query
+	recent.From = cut
+	recent.Resolution = "raw"
+	recentSeries, err := store.Query(recent)
+	if err != nil {
+		return nil, err
+	}
+
+	index := make(map[string]int)
+	for i, tmpSeries := range series {
+		index[tmpSeries.DeviceID+"\x00"+tmpSeries.Device+"\x00"+encodeLabels(tmpSeries.Labels)] = i
+	}
+	for _, tmpSeries := range recentSeries {
+		points := rollupBuckets(tmpSeries.Points, step)
+		if i, ok := index[tmpSeries.DeviceID+"\x00"+tmpSeries.Device+"\x00"+encodeLabels(tmpSeries.Labels)]; ok {
+			series[i].Points = append(series[i].Points, points...)
+		} else {
+			tmpSeries.Points = points
+			series = append(series, tmpSeries)
+		}
+	}
+	sortSeries(series)
+	return series, nil
+}
+
+func stepSeries(points []MetricPoint, req metricsRequest) []stepValue {
+	// reduce the points of a series, ordered by time, to one value per step with data
+	var values []stepValue
+	var stepPoints []MetricPoint
+	var previous *MetricPoint // last point before the current step, for rate
+	current := -1
+
+	flush := func() {
+		if len(stepPoints) > 0 && current >= 0 {
+			if value, ok := aggregatePoints(stepPoints, previous, req); ok {
+				values = append(values, stepValue{Step: current, Value: value})
+			}
+		}
+		if len(stepPoints) > 0 {
+			previous = &stepPoints[len(stepPoints)-1]
+		}
+		stepPoints = nil
+	}
+
+	for _, point := range points {
+		step := int(point.Timestamp.Sub(req.From) / req.Step)
+		if point.Timestamp.Before(req.From) {
+			step = -1
+		}
+		if step != current {
+			flush()
+			current = step
+		}
+		stepPoints = append(stepPoints, point)
+	}
+	flush()
+	return values
+}
+
+func aggregatePoints(points []MetricPoint, previous *MetricPoint, req metricsRequest) (float64, bool) {
+	// value of the points of one step, previous is the point before them, if any
+	// rollup points count as their average for percentiles, and as their maximum for counters
+	switch req.Agg {
+	case "avg":
+		return mergePoints(points).Avg(), true
+	case "min":
+		return mergePoints(points).Min, true
+	case "max":
+		return mergePoints(points).Max, true
+	case "sum":
+		return mergePoints(points).Sum, true
+	case "count":
+		return float64(mergePoints(points).Count), true
+	case "rate":
+		// increase of a counter per second, a counter going down was reset and counts from 0
+		if previous != nil {
+			points = append([]MetricPoint{*previous}, points...)
+		}
+		if len(points) < 2 {
+			return 0, false
+		}
+		increase := 0.0
+		for i := 1; i < len(points); i++ {
+			if points[i].Max >= points[i-1].Max {
+				increase += points[i].Max - points[i-1].Max
+			} else {
+				increase += points[i].Max
+			}
+		}
+		return increase / req.Step.Seconds(), true
+	}
+
+	values := make([]float64, len(points))
+	for i, point := range points {
+		values[i] = point.Avg()
+	}
+	return percentile(values, req.Percentile), true
+}
+
+func combineValues(values []float64, req metricsRequest) float64 {
+	// value of several series over the same step, combined the way their aggregation suggests
+	switch req.Agg {
+	case "min":
+		sort.Float64s(values)
+		return values[0]
+	case "max":
+		sort.Float64s(values)
+		return values[len(values)-1]
+	case "sum", "count", "rate":
+		sum := 0.0
+		for _, value := range values {
+			sum += value
+		}
+		return sum
+	case "avg":
+		sum := 0.0
+		for _, value := range values {
+			sum += value
+		}
+		return sum / float64(len(values))
+	}
+	return percentile(values, req.Percentile)
+}
+
+func percentile(values []float64, p float64) float64 {
+	// p-th percentile of values, interpolating between the closest ranks
+	sort.Float64s(values)
+	rank := p / 100 * float64(len(values)-1)
+	lower := int(math.Floor(rank))
+	upper := int(math.Ceil(rank))
+	return values[lower] + (values[upper]-values[lower])*(rank-float64(lower))
+}
+
+func stepPoints(values []stepValue, req metricsRequest) [][2]float64 {
+	// [unix seconds, value] pairs, the time of a point is the start of its step
+	points := make([][2]float64, 0, len(values))
+	for _, value := range values {
+		ts := req.From.Add(time.Duration(value.Step) * req.Step)
+		points = append(points, [2]float64{float64(ts.Unix()), value.Value})
+	}
+	return points
+}
+
+func parseQueryTime(value string) (time.Time, error) {
+	// RFC 3339, or unix seconds with an optional fraction
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+		return time.Unix(0, int64(seconds*float64(time.Second))), nil
+	}
+	return time.Parse(time.RFC3339Nano, value)
+}
+
+func parseQueryDuration(value string) (time.Duration, error) {
+	// Go duration, or seconds
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+		return time.Duration(seconds * float64(time.Second)), nil
+	}
+	return time.ParseDuration(value)
+}
@@ -0,0 +1,295 @@
+// time-series storage for the samples devices send
+// raw samples are kept for a short time, rollups to 1-minute and 1-hour min/max/avg are kept for longer
+// samples live in Postgres by default, single-box installs can keep them in an embedded file instead
+// series are stored under the identifier of their device, which does not change, the device name is their "device" label
+
+package backendapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MetricPoint is either a raw sample (Count is 1) or the aggregate of the samples in a rollup bucket
+type MetricPoint struct {
+	Timestamp time.Time `json:"timestamp"` // time of the sample, or start of the bucket
+	Min       float64   `json:"min"`
+	Max       float64   `json:"max"`
+	Sum       float64   `json:"sum"`
+	Count     int64     `json:"count"`
+}
+
+// MetricSeries is a list of points of one metric of one device, with one set of labels
+type MetricSeries struct {
+	DeviceID string            `json:"device_id,omitempty"` // device identifier, empty for series stored before devices had one
+	Device   string            `json:"device"`              // device name
+	Name     string            `json:"name"`                // metric name
+	Labels   map[string]string `json:"labels,omitempty"`
+	Points   []MetricPoint     `json:"points"`
+}
+
+// MetricsQuery selects the series and the time range to read from a MetricsStore
+type MetricsQuery struct {
+	Device     string            // device name, empty for every device
+	Name       string            // metric name
+	Labels     map[string]string // series must carry at least these labels
+	From       time.Time         // inclusive
+	To         time.Time         // exclusive
+	Resolution string            // "raw", "1m" or "1h"
+}
+
+// MetricsStore keeps samples and their rollups
+type MetricsStore interface {
+	Write(device string, samples []Sample) error // device is the device identifier, samples carry the device name as a label
+	Query(query MetricsQuery) ([]MetricSeries, error)
+	Rollup(from, to time.Time) error // recompute the rollup buckets overlapping [from, to)
+	Prune(now time.Time) error       // drop data older than its retention
+	Close() error
+}
+
+var metricsStore MetricsStore // nil until SetupBackend opened it
+
+// how long each resolution is kept
+var metricsRetention = map[string]time.Duration{
+	"raw": 7 * 24 * time.Hour,
+	"1m":  30 * 24 * time.Hour,
+	"1h":  365 * 24 * time.Hour,
+}
+
+var rollupResolutions = map[string]time.Duration{
+	"1m": time.Minute,
+	"1h": time.Hour,
+}
+
+var rollupLag = 2 * time.Minute  // buckets closer to now than this may still receive samples, they are rolled up again later
+var rollupInterval = time.Minute // how often rollups are computed
+var pruneInterval = time.Hour    // how often old data is dropped
+var rollupWatermark time.Time    // rollups are up to date before this time
+var rollupDirtySince time.Time   // earliest sample written before the watermark since the last rollup, zero if none
+var rollupMutex sync.Mutex       // protects rollupWatermark and rollupDirtySince
+var metricsStoreKinds = []string{"postgres", "embedded"}
+
+func openMetricsStore(creds map[string]interface{}) (MetricsStore, error) {
+	// open the store named by metrics_store, Postgres if not set
+	// retentions can be overridden with metrics_raw_retention, metrics_1m_retention and metrics_1h_retention, e.g. "72h"
+	for resolution := range metricsRetention {
+		value, ok := creds[fmt.Sprintf("metrics_%s_retention", resolution)].(string)
+		if !ok || value == "" {
+			continue
+		}
+		retention, err := time.ParseDuration(value)
+		if err != nil || retention <= 0 {
+			return nil, fmt.Errorf("bad %s retention %q", resolution, value)
+		}
+		metricsRetention[resolution] = retention
+	}
+
+	kind, _ := creds["metrics_store"].(string)
+	switch kind {
+	case "", "postgres":
+		return newPostgresMetricsStore(dbObj)
+	case "embedded":
+		path, _ := creds["metrics_path"].(string)
+		if path == "" {
+			path = "metrics.db"
+		}
+		return newEmbeddedMetricsStore(path)
+	}
+	return nil, fmt.Errorf("unknown metrics store %q, expected one of %v", kind, metricsStoreKinds)
+}
+
+func runMetricsMaintenance(store MetricsStore) {
+	// compute rollups and drop old data in the background, for as long as the backend runs
+	// the last hour is rolled up again at startup, samples received right before a restart may be missing from it
+	rollupMutex.Lock()
+	rollupWatermark = time.Now().Add(-time.Hour)
+	rollupMutex.Unlock()
+
+	rollupTicker := time.NewTicker(rollupInterval)
+	pruneTicker := time.NewTicker(pruneInterval)
+	defer rollupTicker.Stop()
+	defer pruneTicker.Stop()
+
+	for {
+		select {
+		case now := <-rollupTicker.C:
+			err := rollupMetrics(store, now)
+			if err != nil {
+				log.Printf("Failed to roll up metrics, %s\n", err)
+			}
+		case now := <-pruneTicker.C:
+			err := store.Prune(now)
+			if err != nil {
+				log.Printf("Failed to prune metrics, %s\n", err)
+			}
+		}
+	}
+}
+
+func rollupMetrics(store MetricsStore, now time.Time) error {
+	// roll up everything between the watermark and now, minus the lag
+	// and again from the earliest sample written behind the watermark, e.g. replayed by a device that was offline
+	to := now.Add(-rollupLag).Truncate(time.Minute)
+
+	rollupMutex.Lock()
+	from := rollupWatermark
+	if !rollupDirtySince.IsZero() && rollupDirtySince.Before(from) {
+		from = rollupDirtySince
+	}
+	if oldest := now.Add(-metricsRetention["raw"]); from.Before(oldest) {
+		from = oldest
+	}
+	rollupDirtySince = time.Time{}
+	rollupMutex.Unlock()
+
+	if !from.Before(to) {
+		return nil
+	}
+	err := store.Rollup(from, to)
+	if err != nil {
+		// try the same range again next time
+		markRollupDirty(from)
+		return err
+	}
+
+	rollupMutex.Lock()
+	if to.After(rollupWatermark) {
+		rollupWatermark = to
+	}
+	rollupMutex.Unlock()
+	return nil
+}
+
+func markRollupDirty(ts time.Time) {
+	// samples at ts were written after their bucket may have been rolled up
+	rollupMutex.Lock()
+	defer rollupMutex.Unlock()
+	if ts.Before(rollupWatermark) && (rollupDirtySince.IsZero() || ts.Before(rollupDirtySince)) {
+		rollupDirtySince = ts
+	}
+}
+
+func writeMetrics(dev Device, samples []Sample) {
+	// keep samples in the metrics store, shared by every API devices send data through
+	// the series are stored under the device identifier, with the name as a label, so they follow the device if it registers again
+	if metricsStore == nil {
+		return
+	}
+	labeled := make([]Sample, len(samples))
+	for i, sample := range samples {
+		sample.Labels = withoutLabels(sample.Labels)
+		sample.Labels["device"] = dev.Name
+		labeled[i] = sample
+	}
+	err := metricsStore.Write(dev.ID, labeled)
+	if err != nil {
+		log.Printf("Failed to store %d samples from %s, %s\n", len(samples), dev.Name, err)
+		return
+	}
+	oldest := samples[0].Timestamp
+	for _, sample := range samples {
+		if sample.Timestamp.Before(oldest) {
+			oldest = sample.Timestamp
+		}
+	}
+	markRollupDirty(oldest)
+}
+
+/////////////
+// helpful functions shared by the metrics stores
+func rollupBuckets(points []MetricPoint, step time.Duration) []MetricPoint {
+	// aggregate points, ordered by time, into buckets of step
+	var buckets []MetricPoint
+	for _, point := range points {
+		start := point.Timestamp.Truncate(step)
+		if len(buckets) == 0 || !buckets[len(buckets)-1].Timestamp.Equal(start) {
+			buckets = append(buckets, MetricPoint{Timestamp: start, Min: point.Min, Max: point.Max})
+		}
+		buckets[len(buckets)-1] = addPoint(buckets[len(buckets)-1], point)
+	}
+	return buckets
+}
+
+func mergePoints(points []MetricPoint) MetricPoint {
+	// aggregate of every point, with the timestamp of the first one
+	merged := MetricPoint{Timestamp: points[0].Timestamp, Min: points[0].Min, Max: points[0].Max}
+	for _, point := range points {
+		merged = addPoint(merged, point)
+	}
+	return merged
+}
+
+func addPoint(bucket, point MetricPoint) MetricPoint {
+	// bucket with point added to it
+	if point.Min < bucket.Min {
+		bucket.Min = point.Min
+	}
+	if point.Max > bucket.Max {
+		bucket.Max = point.Max
+	}
+	bucket.Sum += point.Sum
+	bucket.Count += point.Count
+	return bucket
+}
+
+func labelsMatch(labels, want map[string]string) bool {
+	// series labels must include every wanted label
+	for key, value := range want {
+		if labels[key] != value {
+			return false
+		}
+	}
+	return true
+}
+
+func encodeLabels(labels map[string]string) string {
+	// labels as JSON with sorted keys, so the same labels always give the same series
+	if labels == nil {
+		labels = map[string]string{}
+	}
+	encoded, _ := json.Marshal(labels)
+	return string(encoded)
+}
+
+func storedSeries(device, metric string, labels map[string]string) MetricSeries {
+	// series as a store holds it: device is the device identifier and the device name is a label
+	// series stored before devices had an identifier hold the name instead, without the label
+	name, ok := labels["device"]
+	if !ok {
+		return MetricSeries{Device: device, Name: metric, Labels: labels}
+	}
+	return MetricSeries{DeviceID: device, Device: name, Name: metric, Labels: withoutLabels(labels, "device")}
+}
+
+func seriesDeviceMatches(device string, labels map[string]string, name string) bool {
+	// whether a stored series belongs to a device with the given name, see storedSeries
+	if value, ok := labels["device"]; ok {
+		return value == name
+	}
+	return device == name
+}
+
+func sortSeries(series []MetricSeries) {
+	// order series by device, then labels, so query results are stable
+	sort.Slice(series, func(i, j int) bool {
+		if series[i].Device != series[j].Device {
+			return series[i].Device < series[j].Device
+		}
+		if series[i].DeviceID != series[j].DeviceID {
+			return series[i].DeviceID < series[j].DeviceID
+		}
+		return encodeLabels(series[i].Labels) < encodeLabels(series[j].Labels)
+	})
+}
+
+// Avg is the average value of the samples in the point
+func (p MetricPoint) Avg() float64 {
+	if p.Count == 0 {
+		return 0
+	}
+	return p.Sum / float64(p.Count)
+}
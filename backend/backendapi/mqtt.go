@@ -0,0 +1,229 @@
+// MQTT bridge, for devices where HTTP polling is too expensive
+// devices publish to per-device topics, carrying their key in the payload like the HTTP API:
+//   remotemonitor/devices/<name>/checkin   {"key": ...}
+//   remotemonitor/devices/<name>/data      {"key": ..., "samples": [...]}
+//   remotemonitor/devices/<name>/status    {"key": ..., "status": "offline"}, meant to be the will of the device
+// the backend answers on:
+//   remotemonitor/devices/<name>/commands  check-in responses, also published as soon as a command is queued
+//   remotemonitor/devices/<name>/responses errors about data, successful data is not acknowledged
+// the broker should only let a device publish and subscribe to its own topics
+//
+// check-in responses are only pushed to a device while it is up, has not checked in over another API since its last
+// MQTT check-in and has not published its will, otherwise commands wait for its next check-in
+// devices whose name is not a valid topic level, i.e. contains /, + or #, cannot use the bridge
+
+package backendapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+const mqttTopicPrefix = "remotemonitor/devices/"
+
+var mqttClient mqtt.Client                   // connection to the broker, nil if the bridge is not configured
+var mqttDevices = make(map[string]time.Time) // keys of devices that checked in over MQTT and when they last did
+var mqttDevicesMutex sync.Mutex
+
+func startMQTTBridge(broker, username, password string) {
+	// connect to the broker in the background, subscribing again every time the connection is established
+	opts := mqtt.NewClientOptions()
+	opts.AddBroker(broker)
+	opts.SetClientID("remotemonitor-backend")
+	opts.SetUsername(username)
+	opts.SetPassword(password)
+	opts.SetAutoReconnect(true)
+	opts.SetConnectRetry(true)
+	opts.SetOrderMatters(false) // handlers publish responses, they must not block the delivery of other messages
+	opts.SetOnConnectHandler(func(c mqtt.Client) {
+		log.Printf("MQTT bridge connected to %s\n", broker)
+		for _, topic := range []string{mqttTopicPrefix + "+/checkin", mqttTopicPrefix + "+/data", mqttTopicPrefix + "+/status"} {
+			token := c.Subscribe(topic, 1, mqttMessageHandler)
+			if token.WaitTimeout(10*time.Second) && token.Error() != nil {
+				log.Printf("MQTT bridge failed to subscribe to %s, %v\n", topic, token.Error())
+			}
+		}
+	})
+	opts.SetConnectionLostHandler(func(c mqtt.Client, err error) {
+		log.Printf("MQTT bridge lost connection to %s, %v\n", broker, err)
+	})
+
+	mqttClient = mqtt.NewClient(opts)
+	mqttClient.Connect()
+	log.Printf("MQTT bridge connecting to %s\n", broker)
+}
+
+func mqttMessageHandler(c mqtt.Client, msg mqtt.Message) {
+	topic, response := handleMQTTMessage(msg.Topic(), msg.Payload())
+	if topic == "" {
+		return
+	}
+	// commands in a check-in response count as sent once the broker took the response
+	var delivered func()
+	if checkin, ok := response.(map[string]interface{}); ok {
+		var req struct {
+			Key string `json:"key"`
+		}
+		json.Unmarshal(msg.Payload(), &req)
+		delivered = func() { commandsDelivered(req.Key, checkin) }
+	}
+	publishMQTT(topic, response, delivered)
+}
+
+func handleMQTTMessage(topic string, payload []byte) (string, interface{}) {
+	// feed a message published by a device into the same pipeline as the HTTP API
+	// return the topic to answer on and the answer, or an empty topic if there is nothing to answer
+	name, kind := parseMQTTTopic(topic)
+	if name == "" {
+		return "", nil
+	}
+
+	switch kind {
+	case "checkin":
+		tmpDev, code := readCheckinRequestBody(ioutil.NopCloser(bytes.NewReader(payload)))
+		if code == returnCodeList["CheckinOK"].Code && tmpDev.Name != name {
+			code = returnCodeList["BadKey"].Code // a key is only valid on the topics of its own device
+		}
+		if code == returnCodeList["BadKey"].Code {
+			badKeyTotal.WithLabelValues("mqtt").Inc()
+		}
+		if code != returnCodeList["CheckinOK"].Code {
+			log.Printf("Received bad checkin over MQTT for %s (error %d)\n", name, code)
+			return mqttTopicPrefix + name + "/commands", returnCodeByCode(code)
+		}
+
+		log.Printf("Received valid checkin from %s over MQTT\n", tmpDev.Name)
+		lastCheckin := recordCheckin(tmpDev.Key)
+		mqttDevicesMutex.Lock()
+		mqttDevices[tmpDev.Key] = lastCheckin
+		mqttDevicesMutex.Unlock()
+		return mqttTopicPrefix + name + "/commands", checkinResponse(tmpDev.Key)
+
+	case "data":
+		tmpDev, samples, _, code := readDataRequestBody(ioutil.NopCloser(bytes.NewReader(payload)))
+		if code == returnCodeList["DataOK"].Code && tmpDev.Name != name {
+			code = returnCodeList["BadKey"].Code
+		}
+		if code == returnCodeList["BadKey"].Code {
+			badKeyTotal.WithLabelValues("mqtt").Inc()
+		}
+		if code != returnCodeList["DataOK"].Code {
+			log.Printf("Received bad data over MQTT for %s (error %d)\n", name, code)
+			return mqttTopicPrefix + name + "/responses", returnCodeByCode(code)
+		}
+
+		storeSamples(tmpDev, samples)
+		return "", nil
+
+	case "status":
+		// the device went away, most likely its will published by the broker, it gets nothing pushed until it checks in again
+		var req struct {
+			Key    string `json:"key"`
+			Status string `json:"status"`
+		}
+		err := json.Unmarshal(payload, &req)
+		if err != nil || req.Status != "offline" {
+			return "", nil
+		}
+		tmpDev, found := deviceByKey(req.Key)
+		if !found || tmpDev.Name != name {
+			badKeyTotal.WithLabelValues("mqtt").Inc()
+			return "", nil
+		}
+		log.Printf("%s disconnected from the MQTT broker\n", name)
+		mqttDevicesMutex.Lock()
+		delete(mqttDevices, req.Key)
+		mqttDevicesMutex.Unlock()
+		return "", nil
+	}
+
+	return "", nil
+}
+
+func parseMQTTTopic(topic string) (string, string) {
+	// split remotemonitor/devices/<name>/<kind> into name and kind
+	if !strings.HasPrefix(topic, mqttTopicPrefix) {
+		return "", ""
+	}
+	parts := strings.Split(strings.TrimPrefix(topic, mqttTopicPrefix), "/")
+	if len(parts) != 2 || !validMQTTName(parts[0]) {
+		return "", ""
+	}
+	return parts[0], parts[1]
+}
+
+func validMQTTName(name string) bool {
+	// whether name can be used as a single topic level, wildcards and separators would let it reach other topics
+	return name != "" && !strings.ContainsAny(name, "/+#\x00")
+}
+
+func publishMQTT(topic string, msg interface{}, delivered func()) {
+	// publish msg as JSON, without waiting for the broker to acknowledge it
+	// delivered, if not nil, is called once the broker acknowledged the message
+	jsonData, err := json.Marshal(msg)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	token := mqttClient.Publish(topic, 1, false, jsonData)
+	go func() {
+		if !token.WaitTimeout(10 * time.Second) {
+			return
+		}
+		if token.Error() != nil {
+			log.Printf("MQTT bridge failed to publish to %s, %v\n", topic, token.Error())
+			return
+		}
+		if delivered != nil {
+			delivered()
+		}
+	}()
+}
+
+func pushMQTTCheckin(key string) bool {
+	// publish a check-in response to the device with the given key if it checks in over MQTT, return whether it was published
+	if mqttClient == nil {
+		return false
+	}
+	dev, found := deviceByKey(key)
+	if !found {
+		return false
+	}
+	name, lastCheckin, up := dev.Name, dev.LastCheckin, dev.IsUp(time.Now())
+	mqttDevicesMutex.Lock()
+	lastSeen, known := mqttDevices[key]
+	mqttDevicesMutex.Unlock()
+
+	// the device stopped checking in, or checked in over another API since, which is where it gets its commands now
+	if !known || !validMQTTName(name) {
+		return false
+	}
+	if !up || lastCheckin.After(lastSeen) {
+		mqttDevicesMutex.Lock()
+		delete(mqttDevices, key)
+		mqttDevicesMutex.Unlock()
+		return false
+	}
+
+	response := checkinResponse(key)
+	publishMQTT(mqttTopicPrefix+name+"/commands", response, func() { commandsDelivered(key, response) })
+	return true
+}
+
+func returnCodeByCode(code int) ReturnCode {
+	// look up a return code by its number
+	for _, element := range returnCodeList {
+		if element.Code == code {
+			return element
+		}
+	}
+	return ReturnCode{Code: code}
+}
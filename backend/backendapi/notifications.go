@@ -0,0 +1,489 @@
+// notifications of alerts firing and resolving, and of devices going offline, coming back and flapping
+// channels and routes are set under notifications in the credentials file:
+//   channels  name, type and the settings of the type, plus optional title and body templates (text/template over Notification)
+//             webhook     url, secret: the notification as JSON, signed with HMAC-SHA256 of the body in X-RemoteMonitor-Signature
+//             email       smtp_host, smtp_port, username, password, from, to
+//             slack       url of an incoming webhook, mattermost incoming webhooks take the same payload
+//   routes    match (labels that must all be equal) and channels, the first route matching the labels of a notification is used
+//             unless it sets continue, a route without match takes every notification
+// failed deliveries are retried with exponential backoff, every delivery ends up in notification_log
+// notifications matching a silence or maintenance window are not sent, they are logged as silenced instead
+
+package backendapi
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Notification is what channels send, about an alert or a device
+type Notification struct {
+	Kind      string            `json:"kind"`  // alert or device
+	Name      string            `json:"name"`  // rule of the alert, or device_offline, device_online, flapping_started and flapping_stopped
+	State     string            `json:"state"` // firing or resolved for alerts, status of the device otherwise
+	Labels    map[string]string `json:"labels"`
+	Summary   string            `json:"summary,omitempty"`
+	Value     float64           `json:"value"`
+	Timestamp time.Time         `json:"timestamp"`
+}
+
+// NotificationChannel is somewhere notifications are sent
+type NotificationChannel struct {
+	Name     string   `json:"name"`
+	Type     string   `json:"type"`                // webhook, email, slack or mattermost
+	URL      string   `json:"url,omitempty"`       // webhook, slack and mattermost
+	Secret   string   `json:"secret,omitempty"`    // key signing webhook bodies
+	SMTPHost string   `json:"smtp_host,omitempty"` // email
+	SMTPPort int      `json:"smtp_port,omitempty"` // 25 by default
+	Username string   `json:"username,omitempty"`  // SMTP authentication, none if empty
+	Password string   `json:"password,omitempty"`
+	From     string   `json:"from,omitempty"`
+	To       []string `json:"to,omitempty"`
+	Title    string   `json:"title,omitempty"` // template of the title, or subject of emails
+	Body     string   `json:"body,omitempty"`  // template of the text
+}
+
+// NotificationRoute sends notifications with the given labels to channels
+type NotificationRoute struct {
+	Match    map[string]string `json:"match,omitempty"`
+	Channels []string          `json:"channels"`
+	Continue bool              `json:"continue,omitempty"` // also try the routes after this one
+}
+
+// NotificationDelivery is the outcome of sending a notification to a channel
+type NotificationDelivery struct {
+	Timestamp  time.Time    `json:"timestamp"` // when the last attempt finished
+	Channel    string       `json:"channel"`
+	Attempts   int          `json:"attempts"`
+	Success    bool         `json:"success"`
+	Error      string       `json:"error,omitempty"`
+	SilencedBy string       `json:"silenced_by,omitempty"` // silence or maintenance window that suppressed the notification
+	Sent       Notification `json:"notification"`
+}
+
+// notifier sends rendered notifications through one type of channel
+type notifier interface {
+	send(n Notification, title, body string) error
+}
+
+// notificationTarget is a configured channel with its parsed templates
+type notificationTarget struct {
+	channel  NotificationChannel
+	notifier notifier
+	title    *template.Template
+	body     *template.Template
+}
+
+const defaultTitleTemplate = `[{{.State}}] {{.Name}}{{with .Labels.device}} on {{.}}{{end}}`
+const defaultBodyTemplate = `{{if .Summary}}{{.Summary}}
+{{end}}{{range $key, $value := .Labels}}{{$key}}={{$value}}
+{{end}}at {{.Timestamp.Format "2006-01-02 15:04:05 MST"}}`
+
+// notifierTypes builds the notifier of each type of channel
+var notifierTypes = map[string]func(NotificationChannel) (notifier, error){
+	"webhook":    newWebhookNotifier,
+	"email":      newEmailNotifier,
+	"slack":      newChatNotifier,
+	"mattermost": newChatNotifier,
+}
+
+var notificationTargets = make(map[string]*notificationTarget) // channels by name
+var notificationRoutes []NotificationRoute
+var notifyAttempts = 5              // attempts per delivery
+var notifyBackoff = 2 * time.Second // wait before the second attempt, doubling after each
+var notifyClient = &http.Client{Timeout: 10 * time.Second}
+
+func loadNotifier(creds map[string]interface{}) error {
+	// read channels and routes from the credentials file, then listen to alerts and device status
+	config, ok := creds["notifications"]
+	if !ok {
+		return nil
+	}
+	jsonData, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+	var settings struct {
+		Channels []NotificationChannel `json:"channels"`
+		Routes   []NotificationRoute   `json:"routes"`
+	}
+	err = json.Unmarshal(jsonData, &settings)
+	if err != nil {
+		return fmt.Errorf("notifications must have channels and routes, %v", err)
+	}
+
+	for _, channel := range settings.Channels {
+		target, err := newNotificationTarget(channel)
+		if err != nil {
+			return err
+		}
+		notificationTargets[channel.Name] = target
+	}
+	for _, route := range settings.Routes {
+		for _, name := range route.Channels {
+			if notificationTargets[name] == nil {
+				return fmt.Errorf("route to unknown channel %s", name)
+			}
+		}
+	}
+	notificationRoutes = settings.Routes
+
+	alertListeners = append(alertListeners, notifyAlert)
+	statusListeners = append(statusListeners, notifyStatus)
+	return nil
+}
+
+func newNotificationTarget(channel NotificationChannel) (*notificationTarget, error) {
+	// check the channel and parse its templates
+	newNotifier, ok := notifierTypes[channel.Type]
+	if channel.Name == "" || !ok {
+		return nil, fmt.Errorf("channel %q needs a name and a type among webhook, email, slack and mattermost", channel.Name)
+	}
+	n, err := newNotifier(channel)
+	if err != nil {
+		return nil, fmt.Errorf("channel %s, %v", channel.Name, err)
+	}
+
+	target := &notificationTarget{channel: channel, notifier: n}
+	titleTemplate, bodyTemplate := channel.Title, channel.Body
+	if titleTemplate == "" {
+		titleTemplate = defaultTitleTemplate
+	}
+	if bodyTemplate == "" {
+		bodyTemplate = defaultBodyTemplate
+	}
+	if target.title, err = template.New("title").Parse(titleTemplate); err != nil {
+		return nil, fmt.Errorf("channel %s has a bad title, %v", channel.Name, err)
+	}
+	if target.body, err = template.New("body").Parse(bodyTemplate); err != nil {
+		return nil, fmt.Errorf("channel %s has a bad body, %v", channel.Name, err)
+	}
+	return target, nil
+}
+
+func notifyAlert(alert Alert) {
+	// alerts are notified when they fire and when they resolve
+	timestamp := alert.FiredAt
+	if alert.State == AlertResolved {
+		timestamp = alert.ResolvedAt
+	}
+	notify(Notification{Kind: "alert", Name: alert.Rule, State: alert.State, Labels: alert.Labels, Summary: alert.Summary, Value: alert.Value, Timestamp: timestamp})
+}
+
+func notifyStatus(sn StatusNotification) {
+	// devices going offline without checking out, coming back from offline, and starting or stopping to flap
+	name := sn.Kind
+	if sn.Kind == "transition" {
+		if sn.Change.Status == StatusOffline && sn.Change.Reason != "checkout" {
+			name = "device_offline"
+		} else if sn.Change.Status == StatusOnline && sn.Change.Previous == StatusOffline {
+			name = "device_online"
+		} else {
+			return
+		}
+	}
+
+	summary := fmt.Sprintf("%s is %s (%s)", sn.Device, sn.Change.Status, sn.Change.Reason)
+	if name == "flapping_started" || name == "flapping_stopped" {
+		summary = fmt.Sprintf("%s %s, flap score %.2f", sn.Device, strings.Replace(name, "_", " ", 1), sn.Score)
+	}
+	labels := map[string]string{"device": sn.Device, "event": name}
+	notify(Notification{Kind: "device", Name: name, State: sn.Change.Status, Labels: labels, Summary: summary, Value: sn.Score, Timestamp: sn.Change.Timestamp})
+}
+
+func notify(n Notification) {
+	// send n to the channels of the routes matching its labels, each in the background, unless it is silenced
+	channels := routeNotification(n.Labels)
+	if reason := silencedBy(n.Labels, time.Now()); reason != "" {
+		log.Printf("Not notifying %s %s %v, silenced by %s\n", n.Name, n.State, n.Labels, reason)
+		if dbObj == nil {
+			return
+		}
+		for _, name := range channels {
+			delivery := NotificationDelivery{Timestamp: time.Now(), Channel: name, SilencedBy: reason, Sent: n}
+			if err := saveNotificationDelivery(delivery, dbObj); err != nil {
+				log.Println(err)
+			}
+		}
+		return
+	}
+
+	for _, name := range channels {
+		go deliverNotification(notificationTargets[name], n)
+	}
+}
+
+func routeNotification(labels map[string]string) []string {
+	// channels of the first matching route, and of the matching routes before it that continue
+	var channels []string
+	for _, route := range notificationRoutes {
+		if !labelsMatch(labels, route.Match) {
+			continue
+		}
+		for _, name := range route.Channels {
+			if !containsString(channels, name) {
+				channels = append(channels, name)
+			}
+		}
+		if !route.Continue {
+			break
+		}
+	}
+	return channels
+}
+
+func deliverNotification(target *notificationTarget, n Notification) NotificationDelivery {
+	// render and send n, retrying with backoff, then keep the outcome in the delivery log
+	delivery := NotificationDelivery{Channel: target.channel.Name, Sent: n}
+	title, body, err := renderNotification(target, n)
+	if err == nil {
+		wait := notifyBackoff
+		for delivery.Attempts = 1; ; delivery.Attempts++ {
+			err = target.notifier.send(n, title, body)
+			if err == nil || delivery.Attempts >= notifyAttempts {
+				break
+			}
+			time.Sleep(wait)
+			wait *= 2
+		}
+	}
+
+	delivery.Timestamp = time.Now()
+	delivery.Success = err == nil
+	if err != nil {
+		delivery.Error = err.Error()
+		log.Printf("Failed to notify %s through %s after %d attempts, %v\n", n.Name, target.channel.Name, delivery.Attempts, err)
+	}
+	if dbObj != nil {
+		if err := saveNotificationDelivery(delivery, dbObj); err != nil {
+			log.Println(err)
+		}
+	}
+	return delivery
+}
+
+func renderNotification(target *notificationTarget, n Notification) (string, string, error) {
+	// title and body of n for the channel
+	var title, body bytes.Buffer
+	if err := target.title.Execute(&title, n); err != nil {
+		return "", "", err
+	}
+	if err := target.body.Execute(&body, n); err != nil {
+		return "", "", err
+	}
+	return strings.TrimSpace(title.String()), body.String(), nil
+}
+
+////////////
+// channels
+type webhookNotifier struct {
+	url    string
+	secret string
+}
+
+type emailNotifier struct {
+	addr string
+	auth smtp.Auth
+	from string
+	to   []string
+}
+
+type chatNotifier struct {
+	url string
+}
+
+func newWebhookNotifier(channel NotificationChannel) (notifier, error) {
+	if channel.URL == "" {
+		return nil, fmt.Errorf("webhooks need a url")
+	}
+	return webhookNotifier{channel.URL, channel.Secret}, nil
+}
+
+func (wn webhookNotifier) send(n Notification, title, body string) error {
+	// the notification as JSON, with its rendered title and body
+	payload, err := json.Marshal(struct {
+		Notification
+		Title string `json:"title"`
+		Body  string `json:"body"`
+	}{n, title, body})
+	if err != nil {
+		return err
+	}
+	headers := map[string]string{}
+	if wn.secret != "" {
+		headers["X-RemoteMonitor-Signature"] = "sha256=" + signPayload(payload, wn.secret)
+	}
+	return postJSON(wn.url, payload, headers)
+}
+
+func newEmailNotifier(channel NotificationChannel) (notifier, error) {
+	if channel.SMTPHost == "" || channel.From == "" || len(channel.To) == 0 {
+		return nil, fmt.Errorf("email needs smtp_host, from and to")
+	}
+	for _, address := range append([]string{channel.From}, channel.To...) {
+		if strings.ContainsAny(address, "\r\n") {
+			return nil, fmt.Errorf("email address %q has a line break", address)
+		}
+	}
+	port := channel.SMTPPort
+	if port == 0 {
+		port = 25
+	}
+	en := emailNotifier{addr: channel.SMTPHost + ":" + strconv.Itoa(port), from: channel.From, to: channel.To}
+	if channel.Username != "" {
+		en.auth = smtp.PlainAuth("", channel.Username, channel.Password, channel.SMTPHost)
+	}
+	return en, nil
+}
+
+func (en emailNotifier) send(n Notification, title, body string) error {
+	// a plain text email, the title being the subject
+	// the title can hold what devices report, e.g. their name, line breaks are removed so it cannot add headers
+	subject := strings.NewReplacer("\r\n", " ", "\r", " ", "\n", " ").Replace(title)
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", en.from)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(en.to, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(strings.Replace(body, "\n", "\r\n", -1))
+	return smtp.SendMail(en.addr, en.auth, en.from, en.to, msg.Bytes())
+}
+
+func newChatNotifier(channel NotificationChannel) (notifier, error) {
+	if channel.URL == "" {
+		return nil, fmt.Errorf("incoming webhooks need a url")
+	}
+	return chatNotifier{channel.URL}, nil
+}
+
+func (cn chatNotifier) send(n Notification, title, body string) error {
+	// Slack and Mattermost incoming webhooks show text, with markdown
+	payload, err := json.Marshal(map[string]string{"text": "*" + title + "*\n" + body})
+	if err != nil {
+		return err
+	}
+	return postJSON(cn.url, payload, nil)
+}
+
+func postJSON(url string, payload []byte, headers map[string]string) error {
+	// POST payload, anything but a 2xx answer is a failure
+	req, err := http.NewRequest("POST", url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+	resp, err := notifyClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s answered %s", url, resp.Status)
+	}
+	return nil
+}
+
+func signPayload(payload []byte, secret string) string {
+	// hex HMAC-SHA256 of payload, receivers compute the same to check notifications come from the backend
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+/////////////
+// admin API
+func getNotificationLog(w http.ResponseWriter, r *http.Request) {
+	// latest deliveries first, limit is 100 by default
+	w.Header().Set("Content-Type", "application/json")
+	limit := 100
+	if value := r.URL.Query().Get("limit"); value != "" {
+		var err error
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit <= 0 {
+			http.Error(w, `{"error": "bad limit"}`, http.StatusBadRequest)
+			return
+		}
+	}
+
+	deliveries, err := readNotificationDeliveries(r.URL.Query().Get("channel"), limit, dbObj)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, `{"error": "failed to read notification log"}`, http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(deliveries)
+}
+
+func testNotificationChannel(w http.ResponseWriter, r *http.Request) {
+	// send a test notification through a channel and wait for the outcome
+	w.Header().Set("Content-Type", "application/json")
+	target := notificationTargets[mux.Vars(r)["channel"]]
+	if target == nil {
+		http.Error(w, `{"error": "channel not found"}`, http.StatusNotFound)
+		return
+	}
+
+	n := Notification{Kind: "test", Name: "test", State: "test", Labels: map[string]string{"channel": target.channel.Name},
+		Summary: "Test notification from RemoteMonitor", Timestamp: time.Now()}
+	json.NewEncoder(w).Encode(deliverNotification(target, n))
+}
+
+/////////////
+// database
+func saveNotificationDelivery(delivery NotificationDelivery, dbObj *sql.DB) error {
+	labels, err := json.Marshal(delivery.Sent.Labels)
+	if err != nil {
+		return err
+	}
+
+	sqlStatement := `INSERT INTO notification_log (ts, channel, kind, name, state, labels, summary, event_ts, attempts, success, error, silenced_by)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)`
+	_, err = dbObj.Exec(sqlStatement, delivery.Timestamp, delivery.Channel, delivery.Sent.Kind, delivery.Sent.Name, delivery.Sent.State,
+		string(labels), delivery.Sent.Summary, delivery.Sent.Timestamp, delivery.Attempts, delivery.Success, delivery.Error, delivery.SilencedBy)
+	return err
+}
+
+func readNotificationDeliveries(channel string, limit int, dbObj *sql.DB) ([]NotificationDelivery, error) {
+	// latest deliveries first, of every channel if channel is empty
+	rows, err := dbObj.Query(`SELECT ts, channel, kind, name, state, labels, summary, event_ts, attempts, success, error, silenced_by FROM notification_log
+WHERE $1 = '' OR channel = $1 ORDER BY ts DESC, id DESC LIMIT $2`, channel, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deliveries := []NotificationDelivery{}
+	for rows.Next() {
+		var tmpDelivery NotificationDelivery
+		var labels []byte
+		err = rows.Scan(&tmpDelivery.Timestamp, &tmpDelivery.Channel, &tmpDelivery.Sent.Kind, &tmpDelivery.Sent.Name, &tmpDelivery.Sent.State,
+			&labels, &tmpDelivery.Sent.Summary, &tmpDelivery.Sent.Timestamp, &tmpDelivery.Attempts, &tmpDelivery.Success, &tmpDelivery.Error,
+			&tmpDelivery.SilencedBy)
+		if err != nil {
+			return nil, err
+		}
+		json.Unmarshal(labels, &tmpDelivery.Sent.Labels)
+		deliveries = append(deliveries, tmpDelivery)
+	}
+
+	return deliveries, rows.Err()
+}
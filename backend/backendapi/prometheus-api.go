@@ -0,0 +1,153 @@
+// Prometheus-compatible query API, so Grafana can use the backend as a Prometheus datasource
+// GET or POST /api/v1/query        query, time
+// GET or POST /api/v1/query_range  query, start, end, step
+// queries are written in the subset of PromQL described in promql.go, answers use the Prometheus JSON format
+
+package backendapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// promResponse is the envelope of every answer of the Prometheus API
+type promResponse struct {
+	Status    string      `json:"status"` // success or error
+	Data      interface{} `json:"data,omitempty"`
+	ErrorType string      `json:"errorType,omitempty"`
+	Error     string      `json:"error,omitempty"`
+}
+
+// promQueryResult is the data of a successful query
+type promQueryResult struct {
+	ResultType string      `json:"resultType"` // scalar, vector or matrix
+	Result     interface{} `json:"result"`
+}
+
+////////////
+// respond to HTTP calls from client
+func promQuery(w http.ResponseWriter, r *http.Request) {
+	// evaluate a query at a single time, now by default
+	w.Header().Set("Content-Type", "application/json")
+	if !promReady(w) {
+		return
+	}
+	r.ParseForm()
+
+	now := time.Now()
+	t := now
+	if value := r.Form.Get("time"); value != "" {
+		var err error
+		t, err = parseQueryTime(value)
+		if err != nil {
+			writePromError(w, http.StatusBadRequest, "bad_data", fmt.Errorf("bad time %q", value))
+			return
+		}
+	}
+
+	value, err := evalPromInstant(metricsStore, r.Form.Get("query"), t, now)
+	if err != nil {
+		writePromError(w, http.StatusBadRequest, "bad_data", err)
+		return
+	}
+
+	var result promQueryResult
+	switch value := value.(type) {
+	case float64:
+		result = promQueryResult{ResultType: "scalar", Result: promValue(t, value)}
+	case []promSample:
+		vector := []map[string]interface{}{}
+		for _, sample := range value {
+			vector = append(vector, map[string]interface{}{"metric": sample.Labels, "value": promValue(t, sample.Value)})
+		}
+		result = promQueryResult{ResultType: "vector", Result: vector}
+	case []promSeries:
+		result = promQueryResult{ResultType: "matrix", Result: promMatrix(value)}
+	}
+	json.NewEncoder(w).Encode(promResponse{Status: "success", Data: result})
+}
+
+func promQueryRange(w http.ResponseWriter, r *http.Request) {
+	// evaluate a query at every step between start and end
+	w.Header().Set("Content-Type", "application/json")
+	if !promReady(w) {
+		return
+	}
+	r.ParseForm()
+
+	start, err := parseQueryTime(r.Form.Get("start"))
+	if err != nil {
+		writePromError(w, http.StatusBadRequest, "bad_data", fmt.Errorf("bad start %q", r.Form.Get("start")))
+		return
+	}
+	end, err := parseQueryTime(r.Form.Get("end"))
+	if err != nil || end.Before(start) {
+		writePromError(w, http.StatusBadRequest, "bad_data", fmt.Errorf("bad end %q", r.Form.Get("end")))
+		return
+	}
+	step, err := parseQueryDuration(r.Form.Get("step"))
+	if err != nil {
+		step, err = parsePromDuration(r.Form.Get("step"))
+	}
+	if err != nil || step <= 0 {
+		writePromError(w, http.StatusBadRequest, "bad_data", fmt.Errorf("bad step %q", r.Form.Get("step")))
+		return
+	}
+	if end.Sub(start)/step > time.Duration(maxQueryPoints) {
+		writePromError(w, http.StatusBadRequest, "bad_data", fmt.Errorf("too many points, use a larger step"))
+		return
+	}
+
+	series, err := evalPromRange(metricsStore, r.Form.Get("query"), start, end, step, time.Now())
+	if err != nil {
+		writePromError(w, http.StatusBadRequest, "bad_data", err)
+		return
+	}
+	json.NewEncoder(w).Encode(promResponse{Status: "success", Data: promQueryResult{ResultType: "matrix", Result: promMatrix(series)}})
+}
+
+/////////////
+// helpful functions for API calls
+func promReady(w http.ResponseWriter) bool {
+	// queries need the metrics store
+	if metricsStore == nil {
+		writePromError(w, http.StatusServiceUnavailable, "unavailable", fmt.Errorf("metrics are not stored"))
+		return false
+	}
+	return true
+}
+
+func writePromError(w http.ResponseWriter, status int, errorType string, err error) {
+	response, _ := json.Marshal(promResponse{Status: "error", ErrorType: errorType, Error: err.Error()})
+	http.Error(w, string(response), status)
+}
+
+func promMatrix(series []promSeries) []map[string]interface{} {
+	// series as the Prometheus API returns them
+	matrix := []map[string]interface{}{}
+	for _, tmpSeries := range series {
+		values := make([][2]interface{}, len(tmpSeries.Points))
+		for i, point := range tmpSeries.Points {
+			values[i] = promValue(point.T, point.V)
+		}
+		matrix = append(matrix, map[string]interface{}{"metric": tmpSeries.Labels, "values": values})
+	}
+	return matrix
+}
+
+func promValue(t time.Time, value float64) [2]interface{} {
+	// [unix seconds, value as a string], the way Prometheus keeps NaN and infinities in JSON
+	formatted := strconv.FormatFloat(value, 'f', -1, 64)
+	if math.IsInf(value, 1) {
+		formatted = "+Inf"
+	} else if math.IsInf(value, -1) {
+		formatted = "-Inf"
+	} else if math.IsNaN(value) {
+		formatted = "NaN"
+	}
+	return [2]interface{}{float64(t.UnixNano()) / float64(time.Second), formatted}
+}
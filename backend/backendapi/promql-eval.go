@@ -0,0 +1,495 @@
+// evaluation of parsed PromQL against the metrics store
+// the series every selector needs for the whole query are read once, then the expression is evaluated at each step
+// unlike Prometheus, rate and increase are not extrapolated to the edges of their range:
+// rate is the increase between the first and last points in the range divided by the time between them,
+// increase is that rate over the whole range
+
+package backendapi
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+var promLookback = 5 * time.Minute // how far back an instant selector looks for the latest point
+
+// promSample is one element of an instant vector
+type promSample struct {
+	Labels map[string]string
+	Value  float64
+}
+
+// promPoint is one point of a range vector
+type promPoint struct {
+	T time.Time
+	V float64
+}
+
+// promSeries is one element of a range vector, or of the result of a range query
+type promSeries struct {
+	Labels map[string]string
+	Points []promPoint
+}
+
+type promEvaluator struct {
+	series map[*promSelector][]promSeries // points every selector can read during the query
+}
+
+func evalPromInstant(store MetricsStore, query string, t, now time.Time) (interface{}, error) {
+	// value of query at t, a float64, []promSample or []promSeries
+	expr, err := parsePromQL(query)
+	if err != nil {
+		return nil, err
+	}
+	evaluator, err := newPromEvaluator(store, expr, t, t, 0, now)
+	if err != nil {
+		return nil, err
+	}
+	return evaluator.eval(expr, t)
+}
+
+func evalPromRange(store MetricsStore, query string, start, end time.Time, step time.Duration, now time.Time) ([]promSeries, error) {
+	// values of query at every step between start and end, scalars become a series without labels
+	expr, err := parsePromQL(query)
+	if err != nil {
+		return nil, err
+	}
+	evaluator, err := newPromEvaluator(store, expr, start, end, step, now)
+	if err != nil {
+		return nil, err
+	}
+
+	series := make(map[string]*promSeries)
+	for t := start; !t.After(end); t = t.Add(step) {
+		value, err := evaluator.eval(expr, t)
+		if err != nil {
+			return nil, err
+		}
+		var samples []promSample
+		switch value := value.(type) {
+		case float64:
+			samples = []promSample{{Labels: map[string]string{}, Value: value}}
+		case []promSample:
+			samples = value
+		default:
+			return nil, fmt.Errorf("range queries must return a number or an instant vector")
+		}
+		for _, sample := range samples {
+			key := encodeLabels(sample.Labels)
+			if series[key] == nil {
+				series[key] = &promSeries{Labels: sample.Labels}
+			}
+			series[key].Points = append(series[key].Points, promPoint{T: t, V: sample.Value})
+		}
+	}
+
+	result := make([]promSeries, 0, len(series))
+	for _, tmpSeries := range series {
+		result = append(result, *tmpSeries)
+	}
+	sortPromSeries(result)
+	return result, nil
+}
+
+func newPromEvaluator(store MetricsStore, expr interface{}, start, end time.Time, step time.Duration, now time.Time) (*promEvaluator, error) {
+	// read the points every selector of expr can need between start and end
+	evaluator := &promEvaluator{series: make(map[*promSelector][]promSeries)}
+	for _, selector := range promSelectors(expr) {
+		window := selector.Range
+		if window == 0 {
+			window = promLookback
+		}
+		from := start.Add(-selector.Offset - window)
+
+		// rollups can be used as long as the window still holds a few buckets, instant queries read raw samples while there are some
+		resolutionStep := window / 2
+		if step < resolutionStep {
+			resolutionStep = step
+		}
+		query := MetricsQuery{
+			Name:       selector.Name,
+			From:       from,
+			To:         end.Add(-selector.Offset + time.Nanosecond),
+			Resolution: chooseResolution(from, resolutionStep, now),
+		}
+		for _, matcher := range selector.Matchers {
+			if matcher.Op != "=" {
+				continue
+			}
+			if matcher.Label == "device" {
+				query.Device = matcher.Value
+			} else if matcher.Value != "" {
+				if query.Labels == nil {
+					query.Labels = make(map[string]string)
+				}
+				query.Labels[matcher.Label] = matcher.Value
+			}
+		}
+
+		series, err := queryWithRecentSamples(store, query)
+		if err != nil {
+			return nil, err
+		}
+		for _, tmpSeries := range series {
+			labels := map[string]string{"__name__": tmpSeries.Name, "device": tmpSeries.Device}
+			if tmpSeries.DeviceID != "" {
+				labels["device_id"] = tmpSeries.DeviceID // devices can share a name
+			}
+			for key, value := range tmpSeries.Labels {
+				labels[key] = value
+			}
+			if !promMatches(labels, selector.Matchers) {
+				continue
+			}
+			points := make([]promPoint, len(tmpSeries.Points))
+			for i, point := range tmpSeries.Points {
+				points[i] = promPoint{T: point.Timestamp, V: point.Avg()}
+				if selector.Counter {
+					points[i].V = point.Max
+				}
+			}
+			evaluator.series[selector] = append(evaluator.series[selector], promSeries{Labels: labels, Points: points})
+		}
+	}
+	return evaluator, nil
+}
+
+func (e *promEvaluator) eval(expr interface{}, t time.Time) (interface{}, error) {
+	// value of expr at t
+	switch expr := expr.(type) {
+	case *promNumber:
+		return expr.Value, nil
+	case *promSelector:
+		if expr.Range == 0 {
+			return e.instantSelector(expr, t), nil
+		}
+		return e.rangeSelector(expr, t), nil
+	case *promCall:
+		return e.call(expr, t), nil
+	case *promAggregate:
+		value, err := e.eval(expr.Expr, t)
+		if err != nil {
+			return nil, err
+		}
+		samples, ok := value.([]promSample)
+		if !ok {
+			return nil, fmt.Errorf("%s expects an instant vector", expr.Op)
+		}
+		return promAggregateSamples(expr, samples), nil
+	case *promBinary:
+		lhs, err := e.eval(expr.LHS, t)
+		if err != nil {
+			return nil, err
+		}
+		rhs, err := e.eval(expr.RHS, t)
+		if err != nil {
+			return nil, err
+		}
+		return promBinaryOp(expr, lhs, rhs)
+	}
+	return nil, fmt.Errorf("cannot evaluate %T", expr)
+}
+
+func (e *promEvaluator) instantSelector(selector *promSelector, t time.Time) []promSample {
+	// latest point of every series within the lookback
+	t = t.Add(-selector.Offset)
+	samples := []promSample{}
+	for _, series := range e.series[selector] {
+		i := sort.Search(len(series.Points), func(i int) bool { return series.Points[i].T.After(t) }) - 1
+		if i >= 0 && series.Points[i].T.After(t.Add(-promLookback)) {
+			samples = append(samples, promSample{Labels: series.Labels, Value: series.Points[i].V})
+		}
+	}
+	return samples
+}
+
+func (e *promEvaluator) rangeSelector(selector *promSelector, t time.Time) []promSeries {
+	// points of every series within the range, series without any are left out
+	t = t.Add(-selector.Offset)
+	result := []promSeries{}
+	for _, series := range e.series[selector] {
+		first := sort.Search(len(series.Points), func(i int) bool { return series.Points[i].T.After(t.Add(-selector.Range)) })
+		last := sort.Search(len(series.Points), func(i int) bool { return series.Points[i].T.After(t) })
+		if first < last {
+			result = append(result, promSeries{Labels: series.Labels, Points: series.Points[first:last]})
+		}
+	}
+	return result
+}
+
+func (e *promEvaluator) call(call *promCall, t time.Time) []promSample {
+	// rate, irate and increase of every series with at least two points in the range
+	samples := []promSample{}
+	for _, series := range e.rangeSelector(call.Arg, t) {
+		points := series.Points
+		if len(points) < 2 {
+			continue
+		}
+		if call.Func == "irate" {
+			points = points[len(points)-2:]
+		}
+		increase := 0.0
+		for i := 1; i < len(points); i++ {
+			if points[i].V >= points[i-1].V {
+				increase += points[i].V - points[i-1].V
+			} else {
+				// counter was reset
+				increase += points[i].V
+			}
+		}
+		rate := increase / points[len(points)-1].T.Sub(points[0].T).Seconds()
+		value := rate
+		if call.Func == "increase" {
+			value = rate * call.Arg.Range.Seconds()
+		}
+		samples = append(samples, promSample{Labels: withoutLabels(series.Labels, "__name__"), Value: value})
+	}
+	return samples
+}
+
+/////////////
+// helpful functions for evaluation
+func promSelectors(expr interface{}) []*promSelector {
+	// every selector in expr
+	switch expr := expr.(type) {
+	case *promSelector:
+		return []*promSelector{expr}
+	case *promCall:
+		return []*promSelector{expr.Arg}
+	case *promAggregate:
+		return promSelectors(expr.Expr)
+	case *promBinary:
+		return append(promSelectors(expr.LHS), promSelectors(expr.RHS)...)
+	}
+	return nil
+}
+
+func promMatches(labels map[string]string, matchers []promMatcher) bool {
+	// whether labels satisfy every matcher, missing labels are empty
+	for _, matcher := range matchers {
+		value := labels[matcher.Label]
+		switch matcher.Op {
+		case "=":
+			if value != matcher.Value {
+				return false
+			}
+		case "!=":
+			if value == matcher.Value {
+				return false
+			}
+		case "=~":
+			if !matcher.re.MatchString(value) {
+				return false
+			}
+		case "!~":
+			if matcher.re.MatchString(value) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func promAggregateSamples(aggregate *promAggregate, samples []promSample) []promSample {
+	// combine samples with the same grouping labels
+	groups := make(map[string][]float64)
+	groupLabels := make(map[string]map[string]string)
+	for _, sample := range samples {
+		var labels map[string]string
+		if aggregate.Without {
+			labels = withoutLabels(sample.Labels, append([]string{"__name__"}, aggregate.Grouping...)...)
+		} else {
+			labels = make(map[string]string)
+			for _, key := range aggregate.Grouping {
+				if value, ok := sample.Labels[key]; ok {
+					labels[key] = value
+				}
+			}
+		}
+		key := encodeLabels(labels)
+		groups[key] = append(groups[key], sample.Value)
+		groupLabels[key] = labels
+	}
+
+	result := []promSample{}
+	for key, values := range groups {
+		value := values[0]
+		switch aggregate.Op {
+		case "sum", "avg":
+			value = 0
+			for _, v := range values {
+				value += v
+			}
+			if aggregate.Op == "avg" {
+				value /= float64(len(values))
+			}
+		case "min":
+			for _, v := range values {
+				value = math.Min(value, v)
+			}
+		case "max":
+			for _, v := range values {
+				value = math.Max(value, v)
+			}
+		case "count":
+			value = float64(len(values))
+		}
+		result = append(result, promSample{Labels: groupLabels[key], Value: value})
+	}
+	sortPromSamples(result)
+	return result
+}
+
+func promBinaryOp(binary *promBinary, lhs, rhs interface{}) (interface{}, error) {
+	// apply an operator to numbers and instant vectors
+	comparison := promComparisons[binary.Op]
+	lhsNumber, lhsIsNumber := lhs.(float64)
+	rhsNumber, rhsIsNumber := rhs.(float64)
+	lhsSamples, lhsIsVector := lhs.([]promSample)
+	rhsSamples, rhsIsVector := rhs.([]promSample)
+	if (!lhsIsNumber && !lhsIsVector) || (!rhsIsNumber && !rhsIsVector) {
+		return nil, fmt.Errorf("%s expects numbers or instant vectors", binary.Op)
+	}
+
+	// two numbers
+	if lhsIsNumber && rhsIsNumber {
+		if comparison && !binary.Bool {
+			return nil, fmt.Errorf("comparisons between numbers need bool")
+		}
+		value, _ := promApply(binary.Op, lhsNumber, rhsNumber)
+		return value, nil
+	}
+
+	// a vector and a number, the vector keeps its values when filtered by a comparison
+	if lhsIsNumber || rhsIsNumber {
+		result := []promSample{}
+		samples := lhsSamples
+		if lhsIsNumber {
+			samples = rhsSamples
+		}
+		for _, sample := range samples {
+			a, b := sample.Value, rhsNumber
+			if lhsIsNumber {
+				a, b = lhsNumber, sample.Value
+			}
+			if value, keep := promResult(binary, a, b, sample.Value); keep {
+				result = append(result, promSample{Labels: promResultLabels(binary, sample.Labels), Value: value})
+			}
+		}
+		return result, nil
+	}
+
+	// two vectors, samples are matched one to one on their labels
+	rhsBySignature := make(map[string]promSample)
+	for _, sample := range rhsSamples {
+		signature := encodeLabels(promMatchingLabels(binary, sample.Labels))
+		if _, ok := rhsBySignature[signature]; ok {
+			return nil, fmt.Errorf("several series on the right of %s match the same labels, only one-to-one matching is supported", binary.Op)
+		}
+		rhsBySignature[signature] = sample
+	}
+	result := []promSample{}
+	for _, sample := range lhsSamples {
+		other, ok := rhsBySignature[encodeLabels(promMatchingLabels(binary, sample.Labels))]
+		if !ok {
+			continue
+		}
+		if value, keep := promResult(binary, sample.Value, other.Value, sample.Value); keep {
+			labels := promResultLabels(binary, sample.Labels)
+			if binary.Matching != nil && (!comparison || binary.Bool) {
+				labels = promMatchingLabels(binary, labels)
+			}
+			result = append(result, promSample{Labels: labels, Value: value})
+		}
+	}
+	return result, nil
+}
+
+func promResult(binary *promBinary, a, b, kept float64) (float64, bool) {
+	// value of a op b, whether it is kept, and kept as value of comparisons that filter
+	value, ok := promApply(binary.Op, a, b)
+	if !promComparisons[binary.Op] || binary.Bool {
+		return value, true
+	}
+	return kept, ok
+}
+
+func promApply(op string, a, b float64) (float64, bool) {
+	// value of a op b, comparisons give 1 when true, 0 when false
+	compare := func(ok bool) (float64, bool) {
+		if ok {
+			return 1, true
+		}
+		return 0, false
+	}
+	switch op {
+	case "+":
+		return a + b, true
+	case "-":
+		return a - b, true
+	case "*":
+		return a * b, true
+	case "/":
+		return a / b, true
+	case "%":
+		return math.Mod(a, b), true
+	case "^":
+		return math.Pow(a, b), true
+	case "==":
+		return compare(a == b)
+	case "!=":
+		return compare(a != b)
+	case ">":
+		return compare(a > b)
+	case "<":
+		return compare(a < b)
+	case ">=":
+		return compare(a >= b)
+	case "<=":
+		return compare(a <= b)
+	}
+	return math.NaN(), false
+}
+
+func promResultLabels(binary *promBinary, labels map[string]string) map[string]string {
+	// arithmetic and bool comparisons drop the metric name, filtering comparisons keep it
+	if promComparisons[binary.Op] && !binary.Bool {
+		return labels
+	}
+	return withoutLabels(labels, "__name__")
+}
+
+func promMatchingLabels(binary *promBinary, labels map[string]string) map[string]string {
+	// labels two samples must share to be matched
+	if binary.On {
+		matching := make(map[string]string)
+		for _, key := range binary.Matching {
+			if value, ok := labels[key]; ok {
+				matching[key] = value
+			}
+		}
+		return matching
+	}
+	return withoutLabels(labels, append([]string{"__name__"}, binary.Matching...)...)
+}
+
+func withoutLabels(labels map[string]string, keys ...string) map[string]string {
+	// copy of labels without keys
+	result := make(map[string]string, len(labels))
+	for key, value := range labels {
+		if !containsString(keys, key) {
+			result[key] = value
+		}
+	}
+	return result
+}
+
+func sortPromSamples(samples []promSample) {
+	sort.Slice(samples, func(i, j int) bool { return encodeLabels(samples[i].Labels) < encodeLabels(samples[j].Labels) })
+}
+
+func sortPromSeries(series []promSeries) {
+	sort.Slice(series, func(i, j int) bool { return encodeLabels(series[i].Labels) < encodeLabels(series[j].Labels) })
+}
@@ -0,0 +1,532 @@
+// parser for the subset of PromQL the backend understands
+// metrics are named after the samples devices send, every series carries a device label with the device name
+// supported:
+//   selectors        load1, load1{device="web-1", mountpoint=~"/var.*"}, {__name__="load1"}
+//   range selectors  rx_bytes[5m], with an optional offset after either kind: load1 offset 1h
+//   functions        rate, irate and increase of a range selector
+//   aggregations     sum, avg, min, max and count, with by (...) or without (...) before or after the expression
+//   operators        ^ * / % + - == != > < >= <=, comparisons can be followed by bool, on (...) and ignoring (...) after any of them
+
+package backendapi
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// promNumber is a number literal
+type promNumber struct {
+	Value float64
+}
+
+// promSelector reads series from the metrics store
+type promSelector struct {
+	Name     string
+	Matchers []promMatcher
+	Range    time.Duration // zero for an instant selector
+	Offset   time.Duration
+	Counter  bool // read by rate, irate or increase, rollups are read by their maximum instead of their average
+}
+
+// promMatcher is a condition on one label of a selector
+type promMatcher struct {
+	Label string
+	Op    string // =, !=, =~ or !~
+	Value string
+	re    *regexp.Regexp
+}
+
+// promCall is a function applied to a range selector
+type promCall struct {
+	Func string
+	Arg  *promSelector
+}
+
+// promAggregate combines the series of a vector
+type promAggregate struct {
+	Op       string
+	Without  bool
+	Grouping []string
+	Expr     interface{}
+}
+
+// promBinary is an arithmetic or comparison operator
+type promBinary struct {
+	Op       string
+	Bool     bool // comparison returns 0 or 1 instead of filtering
+	On       bool // Matching lists the labels to match on, otherwise the ones to ignore
+	Matching []string
+	LHS, RHS interface{}
+}
+
+type promToken struct {
+	Kind  string // ident, number, duration, string, op or eof
+	Value string
+	Pos   int
+}
+
+var promDurationRE = regexp.MustCompile(`^(([0-9]+)(ms|s|m|h|d|w|y))+$`)
+var promDurationPartRE = regexp.MustCompile(`([0-9]+)(ms|s|m|h|d|w|y)`)
+var promDurationUnits = map[string]time.Duration{
+	"ms": time.Millisecond,
+	"s":  time.Second,
+	"m":  time.Minute,
+	"h":  time.Hour,
+	"d":  24 * time.Hour,
+	"w":  7 * 24 * time.Hour,
+	"y":  365 * 24 * time.Hour,
+}
+var promFunctions = map[string]bool{"rate": true, "irate": true, "increase": true}
+var promAggregations = map[string]bool{"sum": true, "avg": true, "min": true, "max": true, "count": true}
+var promComparisons = map[string]bool{"==": true, "!=": true, ">": true, "<": true, ">=": true, "<=": true}
+
+// operators by precedence, lowest first
+var promPrecedence = [][]string{
+	{"==", "!=", ">", "<", ">=", "<="},
+	{"+", "-"},
+	{"*", "/", "%"},
+}
+
+type promParser struct {
+	tokens []promToken
+	pos    int
+}
+
+func parsePromQL(query string) (interface{}, error) {
+	// parse query into its syntax tree
+	tokens, err := lexPromQL(query)
+	if err != nil {
+		return nil, err
+	}
+	p := &promParser{tokens: tokens}
+	expr, err := p.parseBinary(0)
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.Kind != "eof" {
+		return nil, fmt.Errorf("unexpected %q at position %d", tok.Value, tok.Pos)
+	}
+	return expr, nil
+}
+
+func (p *promParser) parseBinary(level int) (interface{}, error) {
+	// operators of promPrecedence[level] and above, left associative
+	if level == len(promPrecedence) {
+		return p.parsePower()
+	}
+	lhs, err := p.parseBinary(level + 1)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		tok := p.peek()
+		if tok.Kind != "op" || !containsString(promPrecedence[level], tok.Value) {
+			return lhs, nil
+		}
+		p.next()
+		binary := &promBinary{Op: tok.Value, LHS: lhs}
+		err = p.parseBinaryModifiers(binary)
+		if err != nil {
+			return nil, err
+		}
+		binary.RHS, err = p.parseBinary(level + 1)
+		if err != nil {
+			return nil, err
+		}
+		lhs = binary
+	}
+}
+
+func (p *promParser) parsePower() (interface{}, error) {
+	// ^ binds tighter than the other operators and is right associative
+	lhs, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.Kind != "op" || tok.Value != "^" {
+		return lhs, nil
+	}
+	p.next()
+	binary := &promBinary{Op: "^", LHS: lhs}
+	err = p.parseBinaryModifiers(binary)
+	if err != nil {
+		return nil, err
+	}
+	binary.RHS, err = p.parsePower()
+	return binary, err
+}
+
+func (p *promParser) parseBinaryModifiers(binary *promBinary) error {
+	// bool, on (...) and ignoring (...) following an operator
+	if p.peek().Kind == "ident" && p.peek().Value == "bool" {
+		if !promComparisons[binary.Op] {
+			return fmt.Errorf("bool is only allowed after comparisons")
+		}
+		p.next()
+		binary.Bool = true
+	}
+	if tok := p.peek(); tok.Kind == "ident" && (tok.Value == "on" || tok.Value == "ignoring") {
+		p.next()
+		labels, err := p.parseLabelList()
+		if err != nil {
+			return err
+		}
+		binary.On = tok.Value == "on"
+		binary.Matching = labels
+	}
+	return nil
+}
+
+func (p *promParser) parseUnary() (interface{}, error) {
+	// leading + and -
+	if tok := p.peek(); tok.Kind == "op" && (tok.Value == "-" || tok.Value == "+") {
+		p.next()
+		expr, err := p.parseUnary()
+		if err != nil || tok.Value == "+" {
+			return expr, err
+		}
+		if number, ok := expr.(*promNumber); ok {
+			return &promNumber{Value: -number.Value}, nil
+		}
+		return &promBinary{Op: "*", LHS: &promNumber{Value: -1}, RHS: expr}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *promParser) parsePrimary() (interface{}, error) {
+	// numbers, parentheses, function calls, aggregations and selectors
+	tok := p.next()
+	switch tok.Kind {
+	case "number":
+		value, err := strconv.ParseFloat(tok.Value, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad number %q", tok.Value)
+		}
+		return &promNumber{Value: value}, nil
+	case "op":
+		if tok.Value == "(" {
+			expr, err := p.parseBinary(0)
+			if err != nil {
+				return nil, err
+			}
+			return expr, p.expect(")")
+		}
+		if tok.Value == "{" {
+			p.pos--
+			return p.parseSelector("")
+		}
+	case "ident":
+		if promAggregations[tok.Value] {
+			return p.parseAggregate(tok.Value)
+		}
+		if promFunctions[tok.Value] && p.peek().Value == "(" {
+			return p.parseCall(tok.Value)
+		}
+		return p.parseSelector(tok.Value)
+	}
+	if tok.Kind == "eof" {
+		return nil, fmt.Errorf("unexpected end of query")
+	}
+	return nil, fmt.Errorf("unexpected %q at position %d", tok.Value, tok.Pos)
+}
+
+func (p *promParser) parseCall(name string) (interface{}, error) {
+	// rate(selector[range]) and the like
+	p.next()
+	arg, err := p.parseBinary(0)
+	if err != nil {
+		return nil, err
+	}
+	selector, ok := arg.(*promSelector)
+	if !ok || selector.Range == 0 {
+		return nil, fmt.Errorf("%s expects a range selector, e.g. %s(metric[5m])", name, name)
+	}
+	selector.Counter = true
+	return &promCall{Func: name, Arg: selector}, p.expect(")")
+}
+
+func (p *promParser) parseAggregate(op string) (interface{}, error) {
+	// sum by (labels) (expr), or sum (expr) by (labels)
+	aggregate := &promAggregate{Op: op}
+	parseGrouping := func() error {
+		tok := p.peek()
+		if tok.Kind != "ident" || (tok.Value != "by" && tok.Value != "without") {
+			return nil
+		}
+		p.next()
+		labels, err := p.parseLabelList()
+		aggregate.Without = tok.Value == "without"
+		aggregate.Grouping = labels
+		return err
+	}
+
+	err := parseGrouping()
+	if err != nil {
+		return nil, err
+	}
+	err = p.expect("(")
+	if err != nil {
+		return nil, err
+	}
+	aggregate.Expr, err = p.parseBinary(0)
+	if err != nil {
+		return nil, err
+	}
+	err = p.expect(")")
+	if err != nil {
+		return nil, err
+	}
+	if aggregate.Grouping == nil {
+		err = parseGrouping()
+	}
+	return aggregate, err
+}
+
+func (p *promParser) parseLabelList() ([]string, error) {
+	// (label, label, ...)
+	err := p.expect("(")
+	if err != nil {
+		return nil, err
+	}
+	labels := []string{}
+	for p.peek().Value != ")" {
+		tok := p.next()
+		if tok.Kind != "ident" {
+			return nil, fmt.Errorf("expected a label name at position %d", tok.Pos)
+		}
+		labels = append(labels, tok.Value)
+		if p.peek().Value != ")" {
+			err = p.expect(",")
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	p.next()
+	return labels, nil
+}
+
+func (p *promParser) parseSelector(name string) (interface{}, error) {
+	// name{matchers}[range] offset duration
+	selector := &promSelector{Name: name}
+	if p.peek().Kind == "op" && p.peek().Value == "{" {
+		p.next()
+		for p.peek().Value != "}" {
+			label := p.next()
+			if label.Kind != "ident" {
+				return nil, fmt.Errorf("expected a label name at position %d", label.Pos)
+			}
+			op := p.next()
+			if op.Kind != "op" || (op.Value != "=" && op.Value != "!=" && op.Value != "=~" && op.Value != "!~") {
+				return nil, fmt.Errorf("expected a label matcher at position %d", op.Pos)
+			}
+			value := p.next()
+			if value.Kind != "string" {
+				return nil, fmt.Errorf("expected a string at position %d", value.Pos)
+			}
+			matcher := promMatcher{Label: label.Value, Op: op.Value, Value: value.Value}
+			if strings.HasSuffix(op.Value, "~") {
+				re, err := regexp.Compile("^(?:" + value.Value + ")$")
+				if err != nil {
+					return nil, fmt.Errorf("bad regular expression %q", value.Value)
+				}
+				matcher.re = re
+			}
+			if matcher.Label == "__name__" && matcher.Op == "=" {
+				selector.Name = matcher.Value
+			} else {
+				selector.Matchers = append(selector.Matchers, matcher)
+			}
+			if p.peek().Value != "}" {
+				err := p.expect(",")
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+		p.next()
+	}
+	if selector.Name == "" {
+		return nil, fmt.Errorf("selectors need a metric name")
+	}
+
+	if p.peek().Kind == "op" && p.peek().Value == "[" {
+		p.next()
+		duration, err := p.parseDuration()
+		if err != nil {
+			return nil, err
+		}
+		selector.Range = duration
+		err = p.expect("]")
+		if err != nil {
+			return nil, err
+		}
+	}
+	if tok := p.peek(); tok.Kind == "ident" && tok.Value == "offset" {
+		p.next()
+		duration, err := p.parseDuration()
+		if err != nil {
+			return nil, err
+		}
+		selector.Offset = duration
+	}
+	return selector, nil
+}
+
+func (p *promParser) parseDuration() (time.Duration, error) {
+	// 5m, 1h30m, ...
+	tok := p.next()
+	if tok.Kind != "duration" {
+		return 0, fmt.Errorf("expected a duration at position %d", tok.Pos)
+	}
+	return parsePromDuration(tok.Value)
+}
+
+func (p *promParser) peek() promToken {
+	return p.tokens[p.pos]
+}
+
+func (p *promParser) next() promToken {
+	tok := p.tokens[p.pos]
+	if tok.Kind != "eof" {
+		p.pos++
+	}
+	return tok
+}
+
+func (p *promParser) expect(op string) error {
+	tok := p.next()
+	if tok.Kind != "op" || tok.Value != op {
+		if tok.Kind == "eof" {
+			return fmt.Errorf("expected %q at the end of the query", op)
+		}
+		return fmt.Errorf("expected %q at position %d, got %q", op, tok.Pos, tok.Value)
+	}
+	return nil
+}
+
+/////////////
+// helpful functions for parsing
+func lexPromQL(query string) ([]promToken, error) {
+	// split query into tokens
+	var tokens []promToken
+	runes := []rune(query)
+	isIdent := func(r rune, first bool) bool {
+		return r == '_' || r == ':' || unicode.IsLetter(r) || (!first && unicode.IsDigit(r))
+	}
+
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		start := i
+		switch {
+		case unicode.IsSpace(r):
+			i++
+			continue
+		case r == '#':
+			// comment until the end of the line
+			for i < len(runes) && runes[i] != '\n' {
+				i++
+			}
+			continue
+		case isIdent(r, true):
+			for i < len(runes) && isIdent(runes[i], false) {
+				i++
+			}
+			tokens = append(tokens, promToken{Kind: "ident", Value: string(runes[start:i]), Pos: start})
+		case unicode.IsDigit(r) || (r == '.' && i+1 < len(runes) && unicode.IsDigit(runes[i+1])):
+			// numbers, or durations when followed by a unit
+			for i < len(runes) && (unicode.IsDigit(runes[i]) || runes[i] == '.') {
+				i++
+			}
+			if i < len(runes) && (runes[i] == 'e' || runes[i] == 'E') && i+1 < len(runes) &&
+				(unicode.IsDigit(runes[i+1]) || ((runes[i+1] == '+' || runes[i+1] == '-') && i+2 < len(runes) && unicode.IsDigit(runes[i+2]))) {
+				i += 2
+				for i < len(runes) && unicode.IsDigit(runes[i]) {
+					i++
+				}
+			}
+			kind := "number"
+			if i < len(runes) && unicode.IsLetter(runes[i]) {
+				kind = "duration"
+				for i < len(runes) && (unicode.IsLetter(runes[i]) || unicode.IsDigit(runes[i])) {
+					i++
+				}
+			}
+			tokens = append(tokens, promToken{Kind: kind, Value: string(runes[start:i]), Pos: start})
+		case r == '"' || r == '\'' || r == '`':
+			i++
+			for i < len(runes) && runes[i] != r {
+				if runes[i] == '\\' && r != '`' {
+					i++
+				}
+				i++
+			}
+			if i >= len(runes) {
+				return nil, fmt.Errorf("unterminated string at position %d", start)
+			}
+			i++
+			value, err := unquotePromString(string(runes[start:i]))
+			if err != nil {
+				return nil, fmt.Errorf("bad string at position %d", start)
+			}
+			tokens = append(tokens, promToken{Kind: "string", Value: value, Pos: start})
+		default:
+			// operators and punctuation, longest first
+			op := ""
+			for _, candidate := range []string{"==", "!=", "=~", "!~", ">=", "<=", "(", ")", "{", "}", "[", "]", ",", "=", "+", "-", "*", "/", "%", "^", ">", "<"} {
+				if strings.HasPrefix(string(runes[i:]), candidate) {
+					op = candidate
+					break
+				}
+			}
+			if op == "" {
+				return nil, fmt.Errorf("unexpected character %q at position %d", r, start)
+			}
+			i += len([]rune(op))
+			tokens = append(tokens, promToken{Kind: "op", Value: op, Pos: start})
+		}
+	}
+
+	return append(tokens, promToken{Kind: "eof", Pos: len(runes)}), nil
+}
+
+func unquotePromString(quoted string) (string, error) {
+	// strings can be quoted with ", ' or `, the first two with Go escapes
+	switch quoted[0] {
+	case '\'':
+		inner := strings.ReplaceAll(quoted[1:len(quoted)-1], `\'`, `'`)
+		return strconv.Unquote(`"` + strings.ReplaceAll(inner, `"`, `\"`) + `"`)
+	case '`':
+		return quoted[1 : len(quoted)-1], nil
+	}
+	return strconv.Unquote(quoted)
+}
+
+func parsePromDuration(value string) (time.Duration, error) {
+	// Prometheus durations, units from ms to y, e.g. 1h30m
+	if !promDurationRE.MatchString(value) {
+		return 0, fmt.Errorf("bad duration %q", value)
+	}
+	var duration time.Duration
+	for _, part := range promDurationPartRE.FindAllStringSubmatch(value, -1) {
+		amount, _ := strconv.Atoi(part[1])
+		duration += time.Duration(amount) * promDurationUnits[part[2]]
+	}
+	if duration <= 0 {
+		return 0, fmt.Errorf("bad duration %q", value)
+	}
+	return duration, nil
+}
+
+func containsString(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,375 @@
+// configuration of node-reporter managed from the backend, per group (device tag) and per device
+// devices learn about changes through the config version in check-in responses, then fetch and acknowledge it
+
+package backendapi
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// RemoteConfig is the part of the node-reporter configuration that can be set from the backend
+// empty fields are not set, and leave the value from a less specific scope or from the device itself
+type RemoteConfig struct {
+	CheckinInterval string                  `json:"checkin_interval,omitempty"` // e.g. "10s"
+	CollectInterval string                  `json:"collect_interval,omitempty"` // e.g. "30s"
+	Collectors      []string                `json:"collectors,omitempty"`       // collectors to enable
+	Checks          []RemoteCheckDefinition `json:"checks,omitempty"`           // checks to run, merged by name across scopes
+}
+
+// RemoteCheckDefinition is a check run by node-reporter, see CheckDefinition in node-reporter
+type RemoteCheckDefinition struct {
+	Name     string   `json:"name"`
+	Command  []string `json:"command"`
+	Interval string   `json:"interval"`
+	Timeout  string   `json:"timeout"`
+}
+
+var groupConfigs = make(map[string]RemoteConfig)  // configuration of each group, keyed by tag
+var deviceConfigs = make(map[string]RemoteConfig) // configuration of single devices, keyed by device name
+var remoteConfigsMutex sync.RWMutex               // protects groupConfigs and deviceConfigs
+
+func validateRemoteConfig(rc RemoteConfig) error {
+	// check durations parse and checks are complete, the device validates collector names itself
+	for field, value := range map[string]string{"checkin_interval": rc.CheckinInterval, "collect_interval": rc.CollectInterval} {
+		if value == "" {
+			continue
+		}
+		d, err := time.ParseDuration(value)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("%s must be a positive duration", field)
+		}
+	}
+
+	for _, c := range rc.Checks {
+		if c.Name == "" || len(c.Command) == 0 {
+			return fmt.Errorf("every check needs a name and a command")
+		}
+		interval, err := time.ParseDuration(c.Interval)
+		if err != nil || interval <= 0 {
+			return fmt.Errorf("check %s needs a positive interval", c.Name)
+		}
+		timeout, err := time.ParseDuration(c.Timeout)
+		if err != nil || timeout <= 0 || timeout > interval {
+			return fmt.Errorf("check %s needs a positive timeout no longer than its interval", c.Name)
+		}
+	}
+
+	return nil
+}
+
+func mergeRemoteConfig(base, override RemoteConfig) RemoteConfig {
+	// apply the fields set in override on top of base, checks with the same name are replaced
+	if override.CheckinInterval != "" {
+		base.CheckinInterval = override.CheckinInterval
+	}
+	if override.CollectInterval != "" {
+		base.CollectInterval = override.CollectInterval
+	}
+	if override.Collectors != nil {
+		base.Collectors = override.Collectors
+	}
+
+	if override.Checks != nil {
+		var checks []RemoteCheckDefinition
+		replaced := make(map[string]bool)
+		for _, c := range override.Checks {
+			replaced[c.Name] = true
+		}
+		for _, c := range base.Checks {
+			if !replaced[c.Name] {
+				checks = append(checks, c)
+			}
+		}
+		base.Checks = append(checks, override.Checks...)
+	}
+
+	return base
+}
+
+func effectiveConfig(dev Device) (RemoteConfig, string) {
+	// configuration of a device: its groups in tag order, then the device itself
+	// the version is derived from the content, so it changes whenever the configuration does
+	var rc RemoteConfig
+	tags := append([]string{}, dev.Tags...)
+	sort.Strings(tags)
+	remoteConfigsMutex.RLock()
+	for _, tag := range tags {
+		if groupRC, ok := groupConfigs[tag]; ok {
+			rc = mergeRemoteConfig(rc, groupRC)
+		}
+	}
+	if deviceRC, ok := deviceConfigs[dev.Name]; ok {
+		rc = mergeRemoteConfig(rc, deviceRC)
+	}
+	remoteConfigsMutex.RUnlock()
+
+	jsonData, _ := json.Marshal(rc)
+	return rc, fmt.Sprintf("%x", sha256.Sum256(jsonData))[:16]
+}
+
+////////////
+// respond to HTTP calls from client
+func getDeviceConfig(w http.ResponseWriter, r *http.Request) {
+	// devices fetch their effective configuration here after seeing a new version in a check-in response
+	w.Header().Set("Content-Type", "application/json")
+	tmpDev, code := readCheckinRequestBody(r.Body)
+	if code != returnCodeList["CheckinOK"].Code {
+		response, _ := generateErrorResponse("BadKey")
+		http.Error(w, response, http.StatusBadRequest)
+		return
+	}
+
+	rc, version := effectiveConfig(tmpDev)
+	responseMap := make(map[string]interface{})
+	responseMap["code"] = returnCodeList["DataOK"].Code
+	responseMap["code_string"] = returnCodeList["DataOK"].CodeString
+	responseMap["config_version"] = version
+	responseMap["config"] = rc
+	json.NewEncoder(w).Encode(responseMap)
+}
+
+func ackDeviceConfig(w http.ResponseWriter, r *http.Request) {
+	// devices acknowledge the configuration version they applied, or report why they could not apply it
+	w.Header().Set("Content-Type", "application/json")
+	var req struct {
+		Key           string `json:"key"`
+		ConfigVersion string `json:"config_version"`
+		Error         string `json:"error"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil || req.ConfigVersion == "" {
+		response, _ := generateErrorResponse("DataMalformed")
+		http.Error(w, response, http.StatusBadRequest)
+		return
+	}
+
+	var name, key string
+	found := withDevice(req.Key, func(tmpDev *Device) {
+		if req.Error != "" {
+			tmpDev.ConfigError = req.Error
+		} else {
+			tmpDev.ConfigVersion = req.ConfigVersion
+			tmpDev.ConfigError = ""
+		}
+		name, key = tmpDev.Name, tmpDev.Key
+	})
+	if !found {
+		response, _ := generateErrorResponse("BadKey")
+		http.Error(w, response, http.StatusBadRequest)
+		return
+	}
+
+	if req.Error != "" {
+		log.Printf("%s failed to apply config version %s, %s\n", name, req.ConfigVersion, req.Error)
+	} else {
+		log.Printf("%s applied config version %s\n", name, req.ConfigVersion)
+		err = updateDeviceConfigVersion(key, req.ConfigVersion, pCreds["reg_table"].(string), dbObj)
+		if err != nil {
+			log.Println(err)
+		}
+	}
+
+	responseMap := make(map[string]interface{})
+	responseMap["code"] = returnCodeList["DataOK"].Code
+	responseMap["code_string"] = returnCodeList["DataOK"].CodeString
+	json.NewEncoder(w).Encode(responseMap)
+}
+
+/////////////
+// admin API
+func getRemoteConfig(w http.ResponseWriter, r *http.Request) {
+	// return the configuration of a group or of a single device, as set, not merged
+	w.Header().Set("Content-Type", "application/json")
+	vars := mux.Vars(r)
+	configs := remoteConfigScope(vars["scope"])
+	if configs == nil {
+		http.Error(w, `{"error": "scope must be groups or devices"}`, http.StatusNotFound)
+		return
+	}
+
+	remoteConfigsMutex.RLock()
+	rc, ok := configs[vars["name"]]
+	remoteConfigsMutex.RUnlock()
+	if !ok {
+		http.Error(w, `{"error": "no configuration set"}`, http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode(rc)
+}
+
+func putRemoteConfig(w http.ResponseWriter, r *http.Request) {
+	// set the configuration of a group or of a single device, devices with a session open get it right away, the others at their next check-in
+	w.Header().Set("Content-Type", "application/json")
+	vars := mux.Vars(r)
+	configs := remoteConfigScope(vars["scope"])
+	if configs == nil {
+		http.Error(w, `{"error": "scope must be groups or devices"}`, http.StatusNotFound)
+		return
+	}
+
+	var rc RemoteConfig
+	err := json.NewDecoder(r.Body).Decode(&rc)
+	if err == nil {
+		err = validateRemoteConfig(rc)
+	}
+	if err != nil {
+		jsonData, _ := json.Marshal(map[string]string{"error": err.Error()})
+		http.Error(w, string(jsonData), http.StatusBadRequest)
+		return
+	}
+
+	err = saveRemoteConfig(vars["scope"], vars["name"], rc, dbObj)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, `{"error": "failed to store configuration"}`, http.StatusInternalServerError)
+		return
+	}
+	remoteConfigsMutex.Lock()
+	configs[vars["name"]] = rc
+	remoteConfigsMutex.Unlock()
+	log.Printf("Configuration of %s %s updated\n", vars["scope"], vars["name"])
+	pushCheckinToAll()
+	json.NewEncoder(w).Encode(rc)
+}
+
+func deleteRemoteConfig(w http.ResponseWriter, r *http.Request) {
+	// remove the configuration of a group or of a single device
+	vars := mux.Vars(r)
+	configs := remoteConfigScope(vars["scope"])
+	if configs == nil {
+		http.Error(w, `{"error": "scope must be groups or devices"}`, http.StatusNotFound)
+		return
+	}
+
+	err := deleteRemoteConfigFromDB(vars["scope"], vars["name"], dbObj)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, `{"error": "failed to delete configuration"}`, http.StatusInternalServerError)
+		return
+	}
+	remoteConfigsMutex.Lock()
+	delete(configs, vars["name"])
+	remoteConfigsMutex.Unlock()
+	pushCheckinToAll()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func putDeviceTags(w http.ResponseWriter, r *http.Request) {
+	// replace the tags of a device, tags select the group configurations that apply to it
+	w.Header().Set("Content-Type", "application/json")
+	tmpDev, found := deviceByName(mux.Vars(r)["name"])
+	if !found {
+		http.Error(w, `{"error": "device not found"}`, http.StatusNotFound)
+		return
+	}
+
+	var tags []string
+	err := json.NewDecoder(r.Body).Decode(&tags)
+	if err != nil {
+		http.Error(w, `{"error": "expected a JSON list of tags"}`, http.StatusBadRequest)
+		return
+	}
+
+	var dev Device
+	found = withDevice(tmpDev.Key, func(current *Device) {
+		current.Tags = tags
+		dev = current.Public()
+	})
+	if !found {
+		// the device registered again with a new key in the meantime
+		http.Error(w, `{"error": "device not found"}`, http.StatusNotFound)
+		return
+	}
+
+	err = updateDeviceTags(tmpDev.Key, tags, pCreds["reg_table"].(string), dbObj)
+	if err != nil {
+		log.Println(err)
+	}
+	pushCheckin(tmpDev.Key)
+	json.NewEncoder(w).Encode(dev)
+}
+
+func remoteConfigScope(scope string) map[string]RemoteConfig {
+	// map holding the configurations of a scope, nil if the scope does not exist
+	if scope == "groups" {
+		return groupConfigs
+	} else if scope == "devices" {
+		return deviceConfigs
+	}
+	return nil
+}
+
+/////////////
+// database
+func loadRemoteConfigs(dbObj *sql.DB) error {
+	// load every group and device configuration into memory
+	rows, err := dbObj.Query(`SELECT scope, name, config FROM remote_config`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var scope, name string
+		var config []byte
+		err = rows.Scan(&scope, &name, &config)
+		if err != nil {
+			return err
+		}
+
+		var rc RemoteConfig
+		err = json.Unmarshal(config, &rc)
+		if err != nil {
+			log.Printf("Ignoring invalid configuration of %s %s, %v\n", scope, name, err)
+			continue
+		}
+		if configs := remoteConfigScope(scope); configs != nil {
+			remoteConfigsMutex.Lock()
+			configs[name] = rc
+			remoteConfigsMutex.Unlock()
+		}
+	}
+
+	return rows.Err()
+}
+
+func saveRemoteConfig(scope, name string, rc RemoteConfig, dbObj *sql.DB) error {
+	config, err := json.Marshal(rc)
+	if err != nil {
+		return err
+	}
+
+	sqlStatement := `INSERT INTO remote_config (scope, name, config, updated_ts) VALUES ($1, $2, $3, $4)
+ON CONFLICT (scope, name) DO UPDATE SET config = EXCLUDED.config, updated_ts = EXCLUDED.updated_ts`
+	_, err = dbObj.Exec(sqlStatement, scope, name, string(config), time.Now())
+	return err
+}
+
+func deleteRemoteConfigFromDB(scope, name string, dbObj *sql.DB) error {
+	_, err := dbObj.Exec(`DELETE FROM remote_config WHERE scope = $1 AND name = $2`, scope, name)
+	return err
+}
+
+func updateDeviceConfigVersion(key, version, regTable string, dbObj *sql.DB) error {
+	_, err := dbObj.Exec("UPDATE "+regTable+" SET config_version = $1 WHERE key = $2", version, key)
+	return err
+}
+
+func updateDeviceTags(key string, tags []string, regTable string, dbObj *sql.DB) error {
+	jsonData, err := json.Marshal(tags)
+	if err != nil {
+		return err
+	}
+	_, err = dbObj.Exec("UPDATE "+regTable+" SET tags = $1 WHERE key = $2", string(jsonData), key)
+	return err
+}
@@ -0,0 +1,180 @@
+// persistent device sessions over WebSocket
+// the backend pushes check-in responses, carrying commands and configuration versions, as soon as something changes
+// an open session counts as checking in, devices fall back to HTTP check-ins when it drops
+
+package backendapi
+
+import (
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+type deviceSession struct {
+	key  string                      // key of the device the session belongs to
+	conn *websocket.Conn             // connection to the device
+	send chan map[string]interface{} // messages waiting to be written to the device
+	done chan struct{}               // closed once the session is over
+}
+
+var sessions = make(map[string]*deviceSession) // open sessions, by device key
+var sessionsMutex sync.Mutex
+
+var upgrader = websocket.Upgrader{ReadBufferSize: 1024, WriteBufferSize: 1024}
+
+const sessionMaxPingInterval = 20 * time.Second // longest time between two pings, devices checking in more often are pinged as often
+const sessionReadTimeouts = 3                   // sessions that stay silent for this many ping intervals are closed
+const sessionWriteTimeout = 10 * time.Second    // time allowed to write a message to a device
+const sessionSendBuffer = 16                    // messages queued for a device before the session is closed as too slow
+
+func openDeviceSession(w http.ResponseWriter, r *http.Request) {
+	// upgrade the request to a WebSocket session, the device authenticates with its key as a bearer token
+	key := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	dev, ok := deviceByKey(key)
+	if key == "" || !ok {
+		response, _ := generateErrorResponse("BadKey")
+		log.Printf("Refused session from %s, %s\n", r.RemoteAddr, response)
+		http.Error(w, response, http.StatusBadRequest)
+		return
+	}
+	name := dev.Name // the session can outlive the entry, e.g. when the device registers again
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Println(err) // the upgrader already replied to the device
+		return
+	}
+
+	session := &deviceSession{key: key, conn: conn, send: make(chan map[string]interface{}, sessionSendBuffer), done: make(chan struct{})}
+	sessionsMutex.Lock()
+	if old := sessions[key]; old != nil {
+		old.conn.Close() // a device only has one session, the newest wins
+	}
+	sessions[key] = session
+	sessionsMutex.Unlock()
+	log.Printf("Session opened by %s\n", name)
+
+	// the device gets the same information a check-in would give it straight away
+	recordCheckin(key)
+	session.push(checkinResponse(key))
+
+	go session.writeLoop()
+	session.readLoop()
+	close(session.done)
+
+	sessionsMutex.Lock()
+	if sessions[key] == session {
+		delete(sessions, key)
+	}
+	sessionsMutex.Unlock()
+	log.Printf("Session of %s closed\n", name)
+}
+
+func (s *deviceSession) readLoop() {
+	// read until the connection fails, every pong answered by the device counts as a check-in
+	s.conn.SetReadDeadline(time.Now().Add(sessionReadTimeouts * s.pingInterval()))
+	s.conn.SetPongHandler(func(string) error {
+		s.conn.SetReadDeadline(time.Now().Add(sessionReadTimeouts * s.pingInterval()))
+		recordCheckin(s.key)
+		return nil
+	})
+
+	for {
+		// devices do not send anything over the session, reading is still needed to process control messages
+		_, _, err := s.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (s *deviceSession) writeLoop() {
+	// write queued messages and pings until the session is over, closing the connection on any error
+	// the interval is looked up again after every ping, it follows configuration changes
+	ping := time.NewTimer(s.pingInterval())
+	defer ping.Stop()
+	defer s.conn.Close()
+
+	for {
+		select {
+		case msg := <-s.send:
+			s.conn.SetWriteDeadline(time.Now().Add(sessionWriteTimeout))
+			err := s.conn.WriteJSON(msg)
+			if err != nil {
+				return
+			}
+			commandsDelivered(s.key, msg)
+		case <-ping.C:
+			err := s.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(sessionWriteTimeout))
+			if err != nil {
+				return
+			}
+			ping.Reset(s.pingInterval())
+		case <-s.done:
+			return
+		}
+	}
+}
+
+func (s *deviceSession) pingInterval() time.Duration {
+	// each pong counts as a check-in, so the device is pinged at least as often as it is expected to check in
+	// otherwise a device with a short check-in interval would keep going late between two pings
+	dev, ok := deviceByKey(s.key)
+	if !ok {
+		return sessionMaxPingInterval
+	}
+
+	interval := expectedCheckinInterval(dev)
+	if interval > sessionMaxPingInterval {
+		return sessionMaxPingInterval
+	}
+	return interval
+}
+
+func (s *deviceSession) push(msg map[string]interface{}) bool {
+	// queue a message for the device, without blocking if the session is over or the device is not keeping up
+	// a device that is not keeping up loses its session, it checks in over HTTP and opens a new one, getting everything it missed
+	select {
+	case s.send <- msg:
+		return true
+	case <-s.done:
+		return false
+	default:
+		log.Printf("Closing session of device with key %s, too many messages queued\n", s.key)
+		s.conn.Close()
+		return false
+	}
+}
+
+func pushCheckin(key string) {
+	// send a check-in response to the device with the given key right away, if it has a session open or checks in over MQTT
+	// otherwise whatever changed is delivered at its next HTTP check-in
+	sessionsMutex.Lock()
+	session := sessions[key]
+	sessionsMutex.Unlock()
+	if session != nil {
+		session.push(checkinResponse(key))
+		return
+	}
+
+	// devices checking in over MQTT get it on their command topic
+	pushMQTTCheckin(key)
+}
+
+func pushCheckinToAll() {
+	// send a check-in response to every device with a session open, e.g. after a group configuration changed
+	sessionsMutex.Lock()
+	keys := make([]string, 0, len(sessions))
+	for key := range sessions {
+		keys = append(keys, key)
+	}
+	sessionsMutex.Unlock()
+
+	for _, key := range keys {
+		pushCheckin(key)
+	}
+}
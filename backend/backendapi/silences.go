@@ -0,0 +1,549 @@
+// silences and maintenance windows, during which notifications about the devices and alerts they match are not sent
+// a silence covers a time range, a maintenance window recurs on a cron schedule (minute hour day-of-month month day-of-week)
+// and lasts for its duration, e.g. "0 2 * * 6" and "4h" for every Saturday from 2am to 6am
+// both match devices by name, MAC or tag, and alerts or device events by label, every field set must match
+// transitions and alerts are still recorded as usual, and suppressed notifications are kept in notification_log
+// alerts about devices in a maintenance window are not evaluated until it ends, so they neither fire nor resolve during it
+
+package backendapi
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// SilenceMatcher selects what a silence or maintenance window applies to
+type SilenceMatcher struct {
+	Device string            `json:"device,omitempty"` // device name
+	Mac    string            `json:"mac,omitempty"`
+	Tag    string            `json:"tag,omitempty"`
+	Labels map[string]string `json:"labels,omitempty"` // labels of the alert or device event, e.g. alertname
+}
+
+// Silence suppresses notifications between two times
+type Silence struct {
+	ID int `json:"id"`
+	SilenceMatcher
+	StartsAt  time.Time `json:"starts_at"`
+	EndsAt    time.Time `json:"ends_at"`
+	Comment   string    `json:"comment,omitempty"`
+	CreatedBy string    `json:"created_by,omitempty"`
+}
+
+// MaintenanceWindow suppresses notifications on a recurring schedule
+type MaintenanceWindow struct {
+	Name string `json:"name"`
+	SilenceMatcher
+	Schedule string `json:"schedule"`           // cron expression of when the window starts
+	Duration string `json:"duration"`           // how long it lasts, at most a week
+	Timezone string `json:"timezone,omitempty"` // time zone of the schedule, the one of the backend by default
+	Comment  string `json:"comment,omitempty"`
+
+	schedule *cronSchedule // parsed by parseMaintenanceWindow
+	duration time.Duration
+	location *time.Location
+}
+
+// cronSchedule is a parsed cron expression, with the allowed values of each field
+type cronSchedule struct {
+	minutes, hours, days, months, weekdays []bool
+	anyDay, anyWeekday                     bool // the day of month or day of week field is *
+}
+
+var silences = make(map[int]Silence)                        // silences by ID, expired ones are dropped
+var maintenanceWindows = make(map[string]MaintenanceWindow) // maintenance windows by name
+var silencesMutex sync.Mutex                                // protects silences and maintenanceWindows
+var maxMaintenanceDuration = 7 * 24 * time.Hour
+
+func (m SilenceMatcher) empty() bool {
+	return m.Device == "" && m.Mac == "" && m.Tag == "" && len(m.Labels) == 0
+}
+
+func (m SilenceMatcher) matches(labels map[string]string, dev *Device) bool {
+	// devices are found through the device label of alerts and device events
+	if (m.Device != "" && labels["device"] != m.Device) || !labelsMatch(labels, m.Labels) {
+		return false
+	}
+	if m.Mac != "" || m.Tag != "" {
+		if dev == nil || (m.Mac != "" && !strings.EqualFold(dev.Mac, m.Mac)) || (m.Tag != "" && !dev.HasTag(m.Tag)) {
+			return false
+		}
+	}
+	return true
+}
+
+func validateSilence(s Silence) error {
+	// a silence needs something to match and a time range
+	if s.empty() {
+		return fmt.Errorf("silences need a device, mac, tag or labels to match")
+	}
+	if s.EndsAt.IsZero() || !s.EndsAt.After(s.StartsAt) {
+		return fmt.Errorf("ends_at must be after starts_at")
+	}
+	return nil
+}
+
+func parseMaintenanceWindow(mw MaintenanceWindow) (MaintenanceWindow, error) {
+	// a maintenance window needs a name, something to match, a schedule and a duration
+	// they are parsed once here, activeAt uses what this returns
+	var err error
+	if mw.Name == "" {
+		return mw, fmt.Errorf("maintenance windows need a name")
+	}
+	if mw.empty() {
+		return mw, fmt.Errorf("maintenance window %s needs a device, mac, tag or labels to match", mw.Name)
+	}
+	if mw.schedule, err = parseCronSchedule(mw.Schedule); err != nil {
+		return mw, fmt.Errorf("maintenance window %s has a bad schedule, %v", mw.Name, err)
+	}
+	mw.duration, err = time.ParseDuration(mw.Duration)
+	if err != nil || mw.duration <= 0 || mw.duration > maxMaintenanceDuration {
+		return mw, fmt.Errorf("maintenance window %s needs a duration of at most %v", mw.Name, maxMaintenanceDuration)
+	}
+	mw.location = time.Local
+	if mw.Timezone != "" {
+		if mw.location, err = time.LoadLocation(mw.Timezone); err != nil {
+			return mw, fmt.Errorf("maintenance window %s has an unknown timezone %s", mw.Name, mw.Timezone)
+		}
+	}
+	return mw, nil
+}
+
+func (mw MaintenanceWindow) activeAt(t time.Time) bool {
+	// whether a window started by the schedule less than duration before t
+	if mw.schedule == nil {
+		return false
+	}
+	start, ok := mw.schedule.previous(t.In(mw.location), mw.duration)
+	return ok && t.Sub(start) < mw.duration
+}
+
+func devicesInMaintenance(now time.Time) map[string]bool {
+	// names of the devices a maintenance window covers at now, whatever the alert or event
+	silencesMutex.Lock()
+	var active []MaintenanceWindow
+	for _, mw := range maintenanceWindows {
+		if mw.Device != "" || mw.Mac != "" || mw.Tag != "" {
+			active = append(active, mw)
+		}
+	}
+	silencesMutex.Unlock()
+
+	maintained := make(map[string]bool)
+	for _, mw := range active {
+		if !mw.activeAt(now) {
+			continue
+		}
+		deviceListMutex.Lock()
+		for i := range deviceList {
+			if mw.matches(map[string]string{"device": deviceList[i].Name}, &deviceList[i]) {
+				maintained[deviceList[i].Name] = true
+			}
+		}
+		deviceListMutex.Unlock()
+	}
+	return maintained
+}
+
+func silencedBy(labels map[string]string, now time.Time) string {
+	// what silences notifications with these labels at now, empty if nothing does
+	var dev *Device
+	if tmpDev, ok := deviceByName(labels["device"]); ok {
+		dev = &tmpDev
+	}
+
+	silencesMutex.Lock()
+	defer silencesMutex.Unlock()
+	ids := make([]int, 0, len(silences))
+	for id := range silences {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		s := silences[id]
+		if !now.Before(s.StartsAt) && now.Before(s.EndsAt) && s.matches(labels, dev) {
+			return fmt.Sprintf("silence %d", id)
+		}
+	}
+	names := make([]string, 0, len(maintenanceWindows))
+	for name := range maintenanceWindows {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		mw := maintenanceWindows[name]
+		if mw.matches(labels, dev) && mw.activeAt(now) {
+			return "maintenance " + name
+		}
+	}
+	return ""
+}
+
+func expireSilences(now time.Time) {
+	// forget silences that ended, they stay in the database
+	silencesMutex.Lock()
+	defer silencesMutex.Unlock()
+	for id, s := range silences {
+		if !now.Before(s.EndsAt) {
+			delete(silences, id)
+		}
+	}
+}
+
+////////////
+// cron schedules
+func parseCronSchedule(expr string) (*cronSchedule, error) {
+	// five fields, each *, a value, a range a-b, a step */n or a-b/n, or a comma separated list of those
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("expected 5 fields, got %d", len(fields))
+	}
+
+	schedule := &cronSchedule{anyDay: fields[2] == "*", anyWeekday: fields[4] == "*"}
+	var err error
+	if schedule.minutes, err = parseCronField(fields[0], 0, 59); err != nil {
+		return nil, fmt.Errorf("minute %v", err)
+	}
+	if schedule.hours, err = parseCronField(fields[1], 0, 23); err != nil {
+		return nil, fmt.Errorf("hour %v", err)
+	}
+	if schedule.days, err = parseCronField(fields[2], 1, 31); err != nil {
+		return nil, fmt.Errorf("day of month %v", err)
+	}
+	if schedule.months, err = parseCronField(fields[3], 1, 12); err != nil {
+		return nil, fmt.Errorf("month %v", err)
+	}
+	if schedule.weekdays, err = parseCronField(fields[4], 0, 7); err != nil {
+		return nil, fmt.Errorf("day of week %v", err)
+	}
+	schedule.weekdays[0] = schedule.weekdays[0] || schedule.weekdays[7] // 7 is Sunday too
+	return schedule, nil
+}
+
+func parseCronField(field string, min, max int) ([]bool, error) {
+	values := make([]bool, max+1)
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i != -1 {
+			var err error
+			step, err = strconv.Atoi(part[i+1:])
+			if err != nil || step <= 0 {
+				return nil, fmt.Errorf("has a bad step in %s", part)
+			}
+			part = part[:i]
+		}
+
+		low, high := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			if low, err = strconv.Atoi(bounds[0]); err != nil {
+				return nil, fmt.Errorf("has a bad value in %s", part)
+			}
+			high = low
+			if len(bounds) == 2 {
+				if high, err = strconv.Atoi(bounds[1]); err != nil {
+					return nil, fmt.Errorf("has a bad value in %s", part)
+				}
+			} else if step > 1 {
+				high = max
+			}
+		}
+		if low < min || high > max || low > high {
+			return nil, fmt.Errorf("must be between %d and %d", min, max)
+		}
+		for value := low; value <= high; value += step {
+			values[value] = true
+		}
+	}
+	return values, nil
+}
+
+func (cs *cronSchedule) matches(t time.Time) bool {
+	return cs.minutes[t.Minute()] && cs.hours[t.Hour()] && cs.matchesDay(t)
+}
+
+func (cs *cronSchedule) matchesDay(t time.Time) bool {
+	// like cron, when both the day of month and day of week are restricted either of them is enough
+	if !cs.months[t.Month()] {
+		return false
+	}
+	day, weekday := cs.days[t.Day()], cs.weekdays[t.Weekday()]
+	if cs.anyDay || cs.anyWeekday {
+		return day && weekday
+	}
+	return day || weekday
+}
+
+func (cs *cronSchedule) previous(t time.Time, limit time.Duration) (time.Time, bool) {
+	// latest time matching the schedule at or before t, false if there is none within limit before t
+	// days that match are looked at from the latest, then their hours and minutes from the latest
+	t = t.Truncate(time.Minute)
+	earliest := t.Add(-limit)
+	year, month, day := t.Date()
+	for days := 0; ; days++ {
+		date := time.Date(year, month, day-days, 0, 0, 0, 0, t.Location())
+		if date.AddDate(0, 0, 1).Before(earliest) {
+			return time.Time{}, false
+		}
+		if !cs.matchesDay(date) {
+			continue
+		}
+		lastHour := 23
+		if days == 0 {
+			lastHour = t.Hour()
+		}
+		for hour := lastHour; hour >= 0; hour-- {
+			if !cs.hours[hour] {
+				continue
+			}
+			lastMinute := 59
+			if days == 0 && hour == t.Hour() {
+				lastMinute = t.Minute()
+			}
+			for minute := lastMinute; minute >= 0; minute-- {
+				if cs.minutes[minute] {
+					start := time.Date(date.Year(), date.Month(), date.Day(), hour, minute, 0, 0, t.Location())
+					return start, !start.Before(earliest)
+				}
+			}
+		}
+	}
+}
+
+/////////////
+// admin API
+func getSilences(w http.ResponseWriter, r *http.Request) {
+	// list current and future silences, by ID
+	w.Header().Set("Content-Type", "application/json")
+	expireSilences(time.Now())
+	silencesMutex.Lock()
+	output := []Silence{}
+	for _, s := range silences {
+		output = append(output, s)
+	}
+	silencesMutex.Unlock()
+	sort.Slice(output, func(i, j int) bool { return output[i].ID < output[j].ID })
+	json.NewEncoder(w).Encode(output)
+}
+
+func postSilence(w http.ResponseWriter, r *http.Request) {
+	// add a silence, starting now unless starts_at is given
+	w.Header().Set("Content-Type", "application/json")
+	var s Silence
+	err := json.NewDecoder(r.Body).Decode(&s)
+	if err == nil {
+		if s.StartsAt.IsZero() {
+			s.StartsAt = time.Now()
+		}
+		err = validateSilence(s)
+	}
+	if err != nil {
+		jsonData, _ := json.Marshal(map[string]string{"error": err.Error()})
+		http.Error(w, string(jsonData), http.StatusBadRequest)
+		return
+	}
+
+	s.ID, err = newSilence(s, dbObj)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, `{"error": "failed to store silence"}`, http.StatusInternalServerError)
+		return
+	}
+	silencesMutex.Lock()
+	silences[s.ID] = s
+	silencesMutex.Unlock()
+	log.Printf("Silence %d added until %v, %s\n", s.ID, s.EndsAt, s.Comment)
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(s)
+}
+
+func deleteSilence(w http.ResponseWriter, r *http.Request) {
+	// end a silence now
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	silencesMutex.Lock()
+	_, ok := silences[id]
+	silencesMutex.Unlock()
+	if err != nil || !ok {
+		http.Error(w, `{"error": "silence not found"}`, http.StatusNotFound)
+		return
+	}
+
+	err = expireSilence(id, time.Now(), dbObj)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, `{"error": "failed to end silence"}`, http.StatusInternalServerError)
+		return
+	}
+	silencesMutex.Lock()
+	delete(silences, id)
+	silencesMutex.Unlock()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func getMaintenanceWindows(w http.ResponseWriter, r *http.Request) {
+	// list every maintenance window, by name
+	w.Header().Set("Content-Type", "application/json")
+	silencesMutex.Lock()
+	output := []MaintenanceWindow{}
+	for _, mw := range maintenanceWindows {
+		output = append(output, mw)
+	}
+	silencesMutex.Unlock()
+	sort.Slice(output, func(i, j int) bool { return output[i].Name < output[j].Name })
+	json.NewEncoder(w).Encode(output)
+}
+
+func putMaintenanceWindow(w http.ResponseWriter, r *http.Request) {
+	// add or replace a maintenance window
+	w.Header().Set("Content-Type", "application/json")
+	var mw MaintenanceWindow
+	err := json.NewDecoder(r.Body).Decode(&mw)
+	if err == nil {
+		mw.Name = mux.Vars(r)["name"]
+		mw, err = parseMaintenanceWindow(mw)
+	}
+	if err != nil {
+		jsonData, _ := json.Marshal(map[string]string{"error": err.Error()})
+		http.Error(w, string(jsonData), http.StatusBadRequest)
+		return
+	}
+
+	err = saveMaintenanceWindow(mw, dbObj)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, `{"error": "failed to store maintenance window"}`, http.StatusInternalServerError)
+		return
+	}
+	silencesMutex.Lock()
+	maintenanceWindows[mw.Name] = mw
+	silencesMutex.Unlock()
+	log.Printf("Maintenance window %s updated\n", mw.Name)
+	json.NewEncoder(w).Encode(mw)
+}
+
+func deleteMaintenanceWindow(w http.ResponseWriter, r *http.Request) {
+	// remove a maintenance window
+	name := mux.Vars(r)["name"]
+	silencesMutex.Lock()
+	_, ok := maintenanceWindows[name]
+	silencesMutex.Unlock()
+	if !ok {
+		http.Error(w, `{"error": "maintenance window not found"}`, http.StatusNotFound)
+		return
+	}
+
+	err := deleteMaintenanceWindowFromDB(name, dbObj)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, `{"error": "failed to delete maintenance window"}`, http.StatusInternalServerError)
+		return
+	}
+	silencesMutex.Lock()
+	delete(maintenanceWindows, name)
+	silencesMutex.Unlock()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+/////////////
+// database
+func loadSilences(dbObj *sql.DB) error {
+	// load silences that did not end yet, and every maintenance window
+	rows, err := dbObj.Query(`SELECT id, silence FROM silences WHERE ends_at > $1`, time.Now())
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var s Silence
+		var jsonData []byte
+		err = rows.Scan(&s.ID, &jsonData)
+		if err != nil {
+			return err
+		}
+		id := s.ID
+		if err = json.Unmarshal(jsonData, &s); err != nil {
+			log.Printf("Ignoring invalid silence %d, %v\n", id, err)
+			continue
+		}
+		s.ID = id
+		silences[id] = s
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	windowRows, err := dbObj.Query(`SELECT name, maintenance FROM maintenance_windows`)
+	if err != nil {
+		return err
+	}
+	defer windowRows.Close()
+
+	for windowRows.Next() {
+		var name string
+		var jsonData []byte
+		err = windowRows.Scan(&name, &jsonData)
+		if err != nil {
+			return err
+		}
+		var mw MaintenanceWindow
+		err = json.Unmarshal(jsonData, &mw)
+		if err == nil {
+			mw, err = parseMaintenanceWindow(mw)
+		}
+		if err != nil {
+			log.Printf("Ignoring invalid maintenance window %s, %v\n", name, err)
+			continue
+		}
+		maintenanceWindows[name] = mw
+	}
+
+	return windowRows.Err()
+}
+
+func newSilence(s Silence, dbObj *sql.DB) (int, error) {
+	// store a silence, return its ID
+	jsonData, err := json.Marshal(s)
+	if err != nil {
+		return 0, err
+	}
+
+	var id int
+	err = dbObj.QueryRow(`INSERT INTO silences (silence, ends_at, created_ts) VALUES ($1, $2, $3) RETURNING id`,
+		string(jsonData), s.EndsAt, time.Now()).Scan(&id)
+	return id, err
+}
+
+func expireSilence(id int, now time.Time, dbObj *sql.DB) error {
+	_, err := dbObj.Exec(`UPDATE silences SET ends_at = $1, silence = jsonb_set(silence, '{ends_at}', to_jsonb($2::text)) WHERE id = $3`,
+		now, now.Format(time.RFC3339Nano), id)
+	return err
+}
+
+func saveMaintenanceWindow(mw MaintenanceWindow, dbObj *sql.DB) error {
+	jsonData, err := json.Marshal(mw)
+	if err != nil {
+		return err
+	}
+
+	sqlStatement := `INSERT INTO maintenance_windows (name, maintenance, updated_ts) VALUES ($1, $2, $3)
+ON CONFLICT (name) DO UPDATE SET maintenance = EXCLUDED.maintenance, updated_ts = EXCLUDED.updated_ts`
+	_, err = dbObj.Exec(sqlStatement, mw.Name, string(jsonData), time.Now())
+	return err
+}
+
+func deleteMaintenanceWindowFromDB(name string, dbObj *sql.DB) error {
+	_, err := dbObj.Exec(`DELETE FROM maintenance_windows WHERE name = $1`, name)
+	return err
+}
@@ -0,0 +1,364 @@
+// online / offline detection, from how long ago each device checked in compared to how often it is expected to
+// online   the last check-in is no older than late_factor check-in intervals
+// late     the device missed check-ins, for less than offline_factor intervals
+// offline  the device stayed silent for longer, or checked out, which is an expected offline
+// every transition is recorded in device_status_history
+// devices keep their status over a restart of the backend, check-ins they missed while it was down do not count
+//
+// devices changing status too often are flapping: each transition in the last flap_window counts for 1 if it just happened,
+// down to 0.5 at the edge of the window, a device starts flapping when the sum reaches flap_start_threshold
+// and stops once it falls under flap_stop_threshold
+// while a device is flapping its transitions are still recorded, but listeners are only told when flapping starts and stops
+
+package backendapi
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	StatusOnline  = "online"
+	StatusLate    = "late"
+	StatusOffline = "offline"
+)
+
+// StatusNotification is what listeners are told about the status of a device
+type StatusNotification struct {
+	Device string       // device name
+	Key    string       // device key
+	Kind   string       // transition, flapping_started or flapping_stopped
+	Change StatusChange // transition, or the one that made the device start or stop flapping
+	Score  float64      // flap score when the notification was sent
+}
+
+// statusUpdate is what changed about a device in one look at it, applied once deviceListMutex is released
+type statusUpdate struct {
+	device   string
+	key      string
+	changed  bool
+	change   StatusChange
+	flapping string // flapping_started, flapping_stopped, or empty if that did not change
+	score    float64
+	notify   bool // the transition is notified, i.e. the device is not flapping
+}
+
+// StatusChange is a transition of a device from one status to another
+type StatusChange struct {
+	Timestamp time.Time `json:"timestamp"`          // when the transition happened
+	Status    string    `json:"status"`             // status after the transition
+	Previous  string    `json:"previous,omitempty"` // status before, empty for the first one
+	Reason    string    `json:"reason"`             // register, checkin, missed_checkins or checkout
+}
+
+var defaultCheckinInterval = 10 * time.Second  // node-reporter default, for devices whose configuration does not set one
+var lateFactor = 2.0                           // devices are late once their last check-in is older than this many intervals
+var offlineFactor = 5.0                        // and offline once it is older than this many
+var statusCheckInterval = 5 * time.Second      // how often the monitor looks at every device
+var deviceListMutex sync.Mutex                 // protects deviceList and the devices in it, see withDevice
+var flapWindow = 30 * time.Minute              // transitions older than this do not count towards flapping
+var flapStartThreshold = 6.0                   // flap score from which a device is flapping
+var flapStopThreshold = 3.0                    // flap score under which it stops flapping
+var statusListeners []func(StatusNotification) // told about transitions and flapping, e.g. to send alerts
+var statusGraceFrom time.Time                  // when the backend started, devices that were up count their check-ins from here
+
+func loadStatusSettings(creds map[string]interface{}) {
+	// the grace factors can be set with status_late_factor and status_offline_factor
+	if factor, ok := creds["status_late_factor"].(float64); ok && factor >= 1 {
+		lateFactor = factor
+	}
+	if factor, ok := creds["status_offline_factor"].(float64); ok && factor > lateFactor {
+		offlineFactor = factor
+	}
+	log.Printf("Devices are late after %v and offline after %v check-in intervals\n", lateFactor, offlineFactor)
+	if value, ok := creds["flap_window"].(string); ok {
+		if window, err := time.ParseDuration(value); err == nil && window > 0 {
+			flapWindow = window
+		}
+	}
+	if threshold, ok := creds["flap_start_threshold"].(float64); ok && threshold > 0 {
+		flapStartThreshold = threshold
+	}
+	if threshold, ok := creds["flap_stop_threshold"].(float64); ok && threshold > 0 && threshold < flapStartThreshold {
+		flapStopThreshold = threshold
+	}
+}
+
+func startStatusMonitor() {
+	// look at every device every statusCheckInterval
+	go func() {
+		ticker := time.NewTicker(statusCheckInterval)
+		defer ticker.Stop()
+		for now := range ticker.C {
+			checkDeviceStatuses(now)
+			expireCommands(now)
+		}
+	}()
+}
+
+func checkDeviceStatuses(now time.Time) {
+	// update the status of every device, devices that stopped checking in become late, then offline
+	// and devices that stopped changing status stop flapping
+	var updates []statusUpdate
+	deviceListMutex.Lock()
+	for i := range deviceList {
+		updates = append(updates, updateDeviceStatus(&deviceList[i], now))
+	}
+	deviceListMutex.Unlock()
+
+	for _, update := range updates {
+		applyStatusUpdate(update)
+	}
+}
+
+func recordCheckin(key string) time.Time {
+	// the device with the given key checked in, over any API, return the time of the check-in
+	now := time.Now()
+	var update statusUpdate
+	found := withDevice(key, func(dev *Device) {
+		dev.LastCheckin = now
+		update = updateDeviceStatus(dev, now)
+	})
+	if found {
+		applyStatusUpdate(update)
+		saveDeviceTimestamp(key, "last_checkin_ts", now)
+	}
+	return now
+}
+
+func recordCheckout(key string) time.Time {
+	// the device with the given key stopped reporting on purpose, return the time of the check-out
+	now := time.Now()
+	var update statusUpdate
+	found := withDevice(key, func(dev *Device) {
+		dev.LastCheckout = now
+		update = updateDeviceStatus(dev, now)
+	})
+	if found {
+		applyStatusUpdate(update)
+		saveDeviceTimestamp(key, "last_checkout_ts", now)
+	}
+	return now
+}
+
+func saveDeviceTimestamp(key, column string, ts time.Time) {
+	// keep a check-in or check-out time in the registration table, the device is judged from it after a restart
+	if dbObj == nil {
+		return
+	}
+	err := updateDeviceTimestamp(key, column, ts, pCreds["reg_table"].(string), dbObj)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+func updateDeviceStatus(dev *Device, now time.Time) statusUpdate {
+	// set the status and flapping state of the device for now, return what changed
+	// the caller holds deviceListMutex
+	update := statusUpdate{device: dev.Name, key: dev.Key}
+	status, reason, since := dev.CurrentStatus(now)
+	if status != dev.Status {
+		update.changed = true
+		update.change = StatusChange{Timestamp: since, Status: status, Previous: dev.Status, Reason: reason}
+		dev.Status = status
+		dev.StatusSince = since
+		// the first status and check-outs are not the device changing its mind
+		if update.change.Previous != "" && reason != "checkout" {
+			dev.StatusTransitions = append(dev.StatusTransitions, since)
+		}
+	}
+
+	// forget transitions that left the window
+	for len(dev.StatusTransitions) > 0 && now.Sub(dev.StatusTransitions[0]) > flapWindow {
+		dev.StatusTransitions = dev.StatusTransitions[1:]
+	}
+	dev.FlapScore = flapScore(dev.StatusTransitions, now)
+	if !dev.Flapping && dev.FlapScore >= flapStartThreshold {
+		dev.Flapping = true
+		update.flapping = "flapping_started"
+	} else if dev.Flapping && dev.FlapScore < flapStopThreshold {
+		dev.Flapping = false
+		update.flapping = "flapping_stopped"
+	}
+	update.score = dev.FlapScore
+	update.notify = update.changed && !dev.Flapping && update.flapping == ""
+	if update.flapping != "" && !update.changed {
+		update.change = StatusChange{Timestamp: now, Status: dev.Status, Reason: reason}
+	}
+	return update
+}
+
+func applyStatusUpdate(update statusUpdate) {
+	// keep the transition in the database, if there is one, and tell listeners what they need to know
+	if update.changed {
+		if update.notify {
+			log.Printf("%s is now %s (%s), was %q\n", update.device, update.change.Status, update.change.Reason, update.change.Previous)
+		}
+		if dbObj != nil {
+			err := newStatusChange(update.key, update.change, dbObj)
+			if err != nil {
+				log.Println(err)
+			}
+		}
+	}
+	if update.flapping != "" {
+		log.Printf("%s %s, flap score %.2f\n", update.device, strings.Replace(update.flapping, "_", " ", 1), update.score)
+		if dbObj != nil {
+			event := Event{
+				Type:      update.flapping,
+				Labels:    map[string]string{"status": update.change.Status},
+				Message:   fmt.Sprintf("flap score %.2f over %v", update.score, flapWindow),
+				Timestamp: update.change.Timestamp,
+			}
+			err := newDeviceEvent(update.key, event, dbObj)
+			if err != nil {
+				log.Println(err)
+			}
+		}
+	}
+
+	var notifications []StatusNotification
+	if update.notify {
+		notifications = append(notifications, StatusNotification{Device: update.device, Key: update.key, Kind: "transition", Change: update.change, Score: update.score})
+	}
+	if update.flapping != "" {
+		notifications = append(notifications, StatusNotification{Device: update.device, Key: update.key, Kind: update.flapping, Change: update.change, Score: update.score})
+	}
+	for _, notification := range notifications {
+		for _, listener := range statusListeners {
+			listener(notification)
+		}
+	}
+}
+
+func flapScore(transitions []time.Time, now time.Time) float64 {
+	// transitions within the window, weighted from 1 for the newest to 0.5 at the edge of the window
+	score := 0.0
+	for _, ts := range transitions {
+		age := now.Sub(ts)
+		if age < 0 {
+			age = 0
+		}
+		if age <= flapWindow {
+			score += 1 - 0.5*float64(age)/float64(flapWindow)
+		}
+	}
+	return score
+}
+
+func expectedCheckinInterval(dev Device) time.Duration {
+	// how often the device is configured to check in
+	rc, _ := effectiveConfig(dev)
+	if interval, err := time.ParseDuration(rc.CheckinInterval); err == nil && interval > 0 {
+		return interval
+	}
+	return defaultCheckinInterval
+}
+
+////////////
+// respond to HTTP calls from client
+func getDeviceStatusHistory(w http.ResponseWriter, r *http.Request) {
+	// return the status transitions of a device, oldest first
+	// from and to are RFC 3339 or unix seconds, the last 7 days by default
+	w.Header().Set("Content-Type", "application/json")
+	dev, found := deviceByName(mux.Vars(r)["name"])
+	if !found {
+		http.Error(w, `{"error": "device not found"}`, http.StatusNotFound)
+		return
+	}
+
+	to := time.Now()
+	from := to.Add(-7 * 24 * time.Hour)
+	var err error
+	if value := r.URL.Query().Get("from"); value != "" {
+		if from, err = parseQueryTime(value); err != nil {
+			http.Error(w, `{"error": "bad from"}`, http.StatusBadRequest)
+			return
+		}
+	}
+	if value := r.URL.Query().Get("to"); value != "" {
+		if to, err = parseQueryTime(value); err != nil {
+			http.Error(w, `{"error": "bad to"}`, http.StatusBadRequest)
+			return
+		}
+	}
+
+	changes, err := readStatusChanges(dev.Key, from, to, dbObj)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, `{"error": "failed to read status history"}`, http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(changes)
+}
+
+/////////////
+// database
+func updateDeviceTimestamp(key, column string, ts time.Time, table string, dbObj *sql.DB) error {
+	// set one of the timestamp columns of the registration table, for the device with the given key
+	sqlStatement := fmt.Sprintf("UPDATE %s SET %s = $1 WHERE key = $2", table, column)
+	_, err := dbObj.Exec(sqlStatement, ts, key)
+	return err
+}
+
+func newStatusChange(key string, change StatusChange, dbObj *sql.DB) error {
+	// store a status transition of the device with the given key
+	sqlStatement := `INSERT INTO device_status_history (device_key, ts, status, previous, reason) VALUES ($1, $2, $3, $4, $5)`
+	_, err := dbObj.Exec(sqlStatement, key, change.Timestamp, change.Status, change.Previous, change.Reason)
+	return err
+}
+
+func readStatusChanges(key string, from, to time.Time, dbObj *sql.DB) ([]StatusChange, error) {
+	// read the transitions of the device with the given key between from and to, oldest first
+	rows, err := dbObj.Query(`SELECT ts, status, previous, reason FROM device_status_history
+WHERE device_key = $1 AND ts >= $2 AND ts <= $3 ORDER BY ts, id`, key, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	changes := []StatusChange{}
+	for rows.Next() {
+		var tmpChange StatusChange
+		err = rows.Scan(&tmpChange.Timestamp, &tmpChange.Status, &tmpChange.Previous, &tmpChange.Reason)
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, tmpChange)
+	}
+
+	return changes, rows.Err()
+}
+
+func readRecentTransitions(since time.Time, dbObj *sql.DB) (map[string][]time.Time, error) {
+	// read the times of the transitions that count towards flapping after since, by device key, oldest first
+	// as in updateDeviceStatus, the first status of a device and check-outs do not count
+	rows, err := dbObj.Query(`SELECT device_key, ts FROM device_status_history
+WHERE ts > $1 AND previous <> '' AND reason <> 'checkout' ORDER BY ts, id`, since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	transitions := make(map[string][]time.Time)
+	for rows.Next() {
+		var key string
+		var ts time.Time
+		err = rows.Scan(&key, &ts)
+		if err != nil {
+			return nil, err
+		}
+		transitions[key] = append(transitions[key], ts)
+	}
+
+	return transitions, rows.Err()
+}
@@ -0,0 +1,93 @@
+// batching and compression of samples, so large fleets do not send one small request per collector run
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"net/http"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Batcher collects samples until the batch window ends or the batch is full
+type Batcher struct {
+	mutex      sync.Mutex
+	samples    []Sample
+	maxSamples int // the batch is sent as soon as it holds this many samples
+}
+
+var batcher *Batcher // nil if samples are sent as soon as they are produced
+
+var compressions = map[string]bool{"none": true, "gzip": true, "zstd": true}
+
+var zstdEncoder *zstd.Encoder // shared, EncodeAll can be used concurrently
+var zstdEncoderOnce sync.Once
+
+func newBatcher(maxSamples int) *Batcher {
+	return &Batcher{maxSamples: maxSamples}
+}
+
+func (b *Batcher) Add(samples []Sample) bool {
+	// add samples to the batch, returning whether it is full
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.samples = append(b.samples, samples...)
+	return len(b.samples) >= b.maxSamples
+}
+
+func (b *Batcher) Take() []Sample {
+	// empty the batch, returning what it held
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	output := b.samples
+	b.samples = nil
+	return output
+}
+
+func queueSamples(ctx context.Context, samples []Sample, clientObj *http.Client) error {
+	// send samples with the next batch, or right away if batching is disabled or the batch is full
+	if batcher == nil {
+		return sendSamples(ctx, samples, clientObj)
+	}
+	if batcher.Add(samples) {
+		return flushBatch(ctx, clientObj)
+	}
+	return nil
+}
+
+func flushBatch(ctx context.Context, clientObj *http.Client) error {
+	// send everything in the batch, samples that cannot be sent end up in the buffer like any others
+	samples := batcher.Take()
+	if len(samples) == 0 {
+		return nil
+	}
+	logDebugf("Sending batch of %d samples\n", len(samples))
+	return sendSamples(ctx, samples, clientObj)
+}
+
+func compressBody(body []byte, compression string) ([]byte, string, error) {
+	// compress a request body, returning it with the Content-Encoding to send it with
+	switch compression {
+	case "gzip":
+		var output bytes.Buffer
+		gz := gzip.NewWriter(&output)
+		_, err := gz.Write(body)
+		if err == nil {
+			err = gz.Close()
+		}
+		return output.Bytes(), "gzip", err
+	case "zstd":
+		var err error
+		zstdEncoderOnce.Do(func() {
+			zstdEncoder, err = zstd.NewWriter(nil)
+		})
+		if zstdEncoder == nil {
+			return nil, "", err
+		}
+		return zstdEncoder.EncodeAll(body, nil), "zstd", nil
+	}
+	return body, "", nil
+}
@@ -0,0 +1,231 @@
+// on-disk queue of samples, or events, the backend did not accept, replayed in order once it accepts data again
+// every entry is a file named after its sequence number, so the queue survives restarts
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Buffer is the queue of unsent items, samples or events, kept in a directory
+type Buffer[T any] struct {
+	mutex    sync.Mutex
+	kind     string   // what the buffer holds, for logging
+	dir      string   // directory the entries are kept in
+	maxBytes int64    // total size the entries may take up
+	policy   string   // what to drop when full, drop_oldest or drop_newest
+	entries  []string // file names of the entries, oldest first
+	sizes    []int64  // size of each entry
+	size     int64    // total size of the entries
+	nextSeq  uint64   // sequence number of the next entry
+	dropped  float64  // items dropped because the buffer was full
+}
+
+var buffer *Buffer[Sample]     // nil if buffering is disabled
+var eventBuffer *Buffer[Event] // same, for events, kept in a subdirectory of the samples buffer
+
+// returned when the backend could not be reached or asked to send the data again later
+var errBackendUnavailable = errors.New("backend cannot take data now")
+
+var bufferPolicies = map[string]bool{"drop_oldest": true, "drop_newest": true}
+
+const maxReplayPerRun = 100 // entries replayed at most each time samples are sent, so a long outage does not stall the collectors
+
+func openBuffers(dir string, maxBytes int64, policy string) (*Buffer[Sample], *Buffer[Event]) {
+	// open the sample and event buffers in dir, or in the user cache directory if dir cannot be used,
+	// e.g. the default one when running as a user who cannot write to /var/lib
+	// without buffers if neither can be used, node-reporter still runs but loses what the backend cannot take
+	dirs := []string{dir}
+	if cacheDir, err := os.UserCacheDir(); err == nil {
+		dirs = append(dirs, filepath.Join(cacheDir, "remotemonitor", "buffer"))
+	}
+
+	for _, dir := range dirs {
+		samples, err := openBuffer[Sample]("samples", dir, maxBytes, policy)
+		if err != nil {
+			logWarnf("Cannot buffer in %s, %v\n", dir, err)
+			continue
+		}
+		events, err := openBuffer[Event]("events", filepath.Join(dir, "events"), maxBytes, policy)
+		if err != nil {
+			logWarnf("Cannot buffer in %s, %v\n", dir, err)
+			continue
+		}
+		if dir != dirs[0] {
+			logWarnf("Buffering in %s instead\n", dir)
+		}
+		return samples, events
+	}
+
+	logWarnf("Running without a buffer, samples and events the backend cannot take are lost\n")
+	return nil, nil
+}
+
+func openBuffer[T any](kind string, dir string, maxBytes int64, policy string) (*Buffer[T], error) {
+	// open the buffer in dir, picking up entries left by a previous run
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	b := &Buffer[T]{kind: kind, dir: dir, maxBytes: maxBytes, policy: policy}
+	for _, f := range files {
+		// leftovers of interrupted writes are removed, they were never part of the queue
+		if strings.HasSuffix(f.Name(), ".tmp") {
+			os.Remove(filepath.Join(dir, f.Name()))
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(f.Name(), ".json"), 10, 64)
+		if err != nil || f.IsDir() || !strings.HasSuffix(f.Name(), ".json") {
+			continue
+		}
+
+		b.entries = append(b.entries, f.Name())
+		b.sizes = append(b.sizes, f.Size())
+		b.size += f.Size()
+		if seq >= b.nextSeq {
+			b.nextSeq = seq + 1
+		}
+	}
+	// names are zero padded, sorting them sorts by sequence number
+	sort.Strings(b.entries)
+
+	if len(b.entries) > 0 {
+		logInfof("Buffer of %s in %s holds %d entries, %d bytes\n", kind, dir, len(b.entries), b.size)
+	}
+	return b, nil
+}
+
+func (b *Buffer[T]) Push(items []T) error {
+	// append items to the queue, dropping entries according to the policy if it is full
+	jsonData, err := json.Marshal(items)
+	if err != nil {
+		return err
+	}
+	size := int64(len(jsonData))
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if size > b.maxBytes || (b.policy == "drop_newest" && b.size+size > b.maxBytes) {
+		b.dropped += float64(len(items))
+		logWarnf("Buffer is full, dropped %d new %s\n", len(items), b.kind)
+		return nil
+	}
+	for b.size+size > b.maxBytes && len(b.entries) > 0 {
+		dropped, _ := b.read(b.entries[0])
+		b.dropped += float64(len(dropped))
+		logWarnf("Buffer is full, dropped %d of the oldest %s\n", len(dropped), b.kind)
+		b.removeFirst()
+	}
+
+	name := fmt.Sprintf("%020d.json", b.nextSeq)
+	tmpFile := filepath.Join(b.dir, name+".tmp")
+	err = ioutil.WriteFile(tmpFile, jsonData, 0600)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmpFile, filepath.Join(b.dir, name))
+	if err != nil {
+		return err
+	}
+
+	b.nextSeq++
+	b.entries = append(b.entries, name)
+	b.sizes = append(b.sizes, size)
+	b.size += size
+	return nil
+}
+
+func (b *Buffer[T]) Len() int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return len(b.entries)
+}
+
+func (b *Buffer[T]) Replay(ctx context.Context, send func(ctx context.Context, items []T) error) error {
+	// send the oldest entries in order, stopping at the first one the backend does not accept for now
+	// entries the backend rejects for good are dropped, sending them again would not change anything
+	// only one replay runs at a time, entries are removed once they were sent
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	for i := 0; i < maxReplayPerRun && len(b.entries) > 0; i++ {
+		items, err := b.read(b.entries[0])
+		if err != nil {
+			logWarnf("Dropping unreadable buffer entry %s, %v\n", b.entries[0], err)
+			b.removeFirst()
+			continue
+		}
+
+		err = send(ctx, items)
+		if shouldBuffer(err) {
+			return err
+		}
+		if err != nil {
+			b.dropped += float64(len(items))
+			logWarnf("Backend rejected %d buffered %s, dropping them, %v\n", len(items), b.kind, err)
+		}
+		b.removeFirst()
+	}
+
+	if len(b.entries) == 0 {
+		logInfof("Buffer of %s replayed, backend is up to date\n", b.kind)
+	}
+	return nil
+}
+
+func (b *Buffer[T]) read(name string) ([]T, error) {
+	var items []T
+	byteData, err := ioutil.ReadFile(filepath.Join(b.dir, name))
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(byteData, &items)
+	return items, err
+}
+
+func (b *Buffer[T]) removeFirst() {
+	// remove the oldest entry, the caller holds the mutex
+	os.Remove(filepath.Join(b.dir, b.entries[0]))
+	b.size -= b.sizes[0]
+	b.entries = b.entries[1:]
+	b.sizes = b.sizes[1:]
+}
+
+func (b *Buffer[T]) Name() string {
+	return "buffer"
+}
+
+func (b *Buffer[T]) Collect() ([]Sample, error) {
+	// report how much the buffer holds, so outages show up in the data once it is replayed
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	now := time.Now()
+	return []Sample{
+		{Name: "buffer_entries", Value: float64(len(b.entries)), Timestamp: now},
+		{Name: "buffer_bytes", Value: float64(b.size), Timestamp: now},
+		{Name: "buffer_dropped_samples_total", Value: b.dropped, Timestamp: now},
+	}, nil
+}
+
+func shouldBuffer(err error) bool {
+	// data is kept when it could be accepted later, i.e. the backend was unreachable, busy or did not know the key
+	return errors.Is(err, errBackendUnavailable) || err == errBadKey
+}
@@ -0,0 +1,239 @@
+// Nagios-compatible check plugins, external commands whose exit code and output are reported to the backend
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CheckDefinition is a check command run on its own schedule
+type CheckDefinition struct {
+	Name     string   `json:"name"`     // name the check is reported as
+	Command  []string `json:"command"`  // command and arguments, not run through a shell
+	Interval Duration `json:"interval"` // time between runs
+	Timeout  Duration `json:"timeout"`  // the command is killed and the check is UNKNOWN after this long
+}
+
+// CheckResult is the outcome of a single run of a check
+type CheckResult struct {
+	Name       string      `json:"name"`        // name of the check
+	Status     int         `json:"status"`      // 0 OK, 1 WARNING, 2 CRITICAL, 3 UNKNOWN
+	StatusText string      `json:"status_text"` // status as text
+	Output     string      `json:"output"`      // plugin output without performance data, truncated
+	PerfData   []PerfDatum `json:"perf_data"`   // performance data returned by the plugin
+	Duration   float64     `json:"duration"`    // how long the command took, in seconds
+	Timestamp  time.Time   `json:"timestamp"`   // when the command was started
+}
+
+// PerfDatum is a single performance data item, 'label'=value[UOM];[warn];[crit];[min];[max]
+type PerfDatum struct {
+	Label string   `json:"label"`
+	Value float64  `json:"value"`
+	UOM   string   `json:"uom,omitempty"`
+	Warn  string   `json:"warn,omitempty"`
+	Crit  string   `json:"crit,omitempty"`
+	Min   *float64 `json:"min,omitempty"`
+	Max   *float64 `json:"max,omitempty"`
+}
+
+// Nagios plugin exit codes
+const (
+	checkOK       = 0
+	checkWarning  = 1
+	checkCritical = 2
+	checkUnknown  = 3
+)
+
+var checkStatusText = map[int]string{checkOK: "OK", checkWarning: "WARNING", checkCritical: "CRITICAL", checkUnknown: "UNKNOWN"}
+
+// plugin output kept in a result, anything beyond this is truncated
+const maxCheckOutput = 4096
+
+func validateChecks(checks []CheckDefinition) error {
+	// every check needs a unique name, a command and sensible interval and timeout
+	names := make(map[string]bool)
+	for _, c := range checks {
+		if c.Name == "" {
+			return fmt.Errorf("check without a name")
+		}
+		if names[c.Name] {
+			return fmt.Errorf("duplicate check %q", c.Name)
+		}
+		names[c.Name] = true
+
+		if len(c.Command) == 0 || c.Command[0] == "" {
+			return fmt.Errorf("check %q has no command", c.Name)
+		}
+		if c.Interval.Duration <= 0 {
+			return fmt.Errorf("check %q needs a positive interval", c.Name)
+		}
+		if c.Timeout.Duration <= 0 || c.Timeout.Duration > c.Interval.Duration {
+			return fmt.Errorf("check %q needs a positive timeout no longer than its interval", c.Name)
+		}
+	}
+	return nil
+}
+
+func runCheck(ctx context.Context, def CheckDefinition) CheckResult {
+	// run the check command, killing it once its timeout expires
+	result := CheckResult{Name: def.Name, Timestamp: time.Now()}
+	ctx, cancel := context.WithTimeout(ctx, def.Timeout.Duration)
+	defer cancel()
+
+	var stdout bytes.Buffer
+	cmd := exec.CommandContext(ctx, def.Command[0], def.Command[1:]...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stdout
+	err := cmd.Run()
+	result.Duration = time.Since(result.Timestamp).Seconds()
+
+	result.Output, result.PerfData = parseCheckOutput(stdout.String())
+	if ctx.Err() == context.DeadlineExceeded {
+		result.Status = checkUnknown
+		result.Output = fmt.Sprintf("check timed out after %v", def.Timeout.Duration)
+	} else if exitErr, ok := err.(*exec.ExitError); ok {
+		result.Status = exitErr.ExitCode()
+	} else if err != nil {
+		result.Status = checkUnknown
+		result.Output = fmt.Sprintf("failed to run check, %v", err)
+	}
+
+	// anything outside of the plugin API, including being killed by a signal, is UNKNOWN
+	if result.Status < checkOK || result.Status > checkUnknown {
+		result.Status = checkUnknown
+	}
+	result.StatusText = checkStatusText[result.Status]
+
+	if len(result.Output) > maxCheckOutput {
+		result.Output = result.Output[:maxCheckOutput]
+	}
+	return result
+}
+
+func parseCheckOutput(output string) (string, []PerfDatum) {
+	// split plugin output into text and performance data
+	// performance data follows a | on the first line, and on the first line of long output that has one, up to the end
+	lines := strings.Split(strings.TrimRight(output, "\n"), "\n")
+	var text []string
+	var perf []string
+
+	first := strings.SplitN(lines[0], "|", 2)
+	text = append(text, strings.TrimSpace(first[0]))
+	if len(first) == 2 {
+		perf = append(perf, first[1])
+	}
+
+	inPerf := false
+	for _, line := range lines[1:] {
+		if inPerf {
+			perf = append(perf, line)
+			continue
+		}
+		parts := strings.SplitN(line, "|", 2)
+		text = append(text, parts[0])
+		if len(parts) == 2 {
+			perf = append(perf, parts[1])
+			inPerf = true
+		}
+	}
+
+	return strings.TrimSpace(strings.Join(text, "\n")), parsePerfData(strings.Join(perf, " "))
+}
+
+func parsePerfData(perf string) []PerfDatum {
+	// parse space separated 'label'=value[UOM];[warn];[crit];[min];[max] items, labels may be quoted and contain spaces
+	var output []PerfDatum
+	perf = strings.TrimSpace(perf)
+	for perf != "" {
+		var label string
+		if perf[0] == '\'' {
+			end := strings.Index(perf[1:], "'=")
+			if end == -1 {
+				break
+			}
+			label = perf[1 : end+1]
+			perf = perf[end+3:]
+		} else {
+			end := strings.IndexByte(perf, '=')
+			if end == -1 {
+				break
+			}
+			label = perf[:end]
+			perf = perf[end+1:]
+		}
+
+		item := perf
+		if end := strings.IndexAny(perf, " \t"); end != -1 {
+			item = perf[:end]
+			perf = strings.TrimSpace(perf[end:])
+		} else {
+			perf = ""
+		}
+
+		datum, ok := parsePerfDatum(strings.TrimSpace(label), item)
+		if ok {
+			output = append(output, datum)
+		}
+	}
+	return output
+}
+
+func parsePerfDatum(label, item string) (PerfDatum, bool) {
+	// parse value[UOM];[warn];[crit];[min];[max], items without a numeric value are skipped
+	datum := PerfDatum{Label: label}
+	fields := strings.Split(item, ";")
+
+	value := fields[0]
+	uomStart := len(value)
+	for uomStart > 0 && !strings.ContainsAny(value[uomStart-1:uomStart], "0123456789.") {
+		uomStart--
+	}
+	var err error
+	datum.Value, err = strconv.ParseFloat(value[:uomStart], 64)
+	if err != nil || label == "" {
+		return datum, false
+	}
+	datum.UOM = value[uomStart:]
+
+	if len(fields) > 1 {
+		datum.Warn = fields[1]
+	}
+	if len(fields) > 2 {
+		datum.Crit = fields[2]
+	}
+	if len(fields) > 3 {
+		if min, err := strconv.ParseFloat(fields[3], 64); err == nil {
+			datum.Min = &min
+		}
+	}
+	if len(fields) > 4 {
+		if max, err := strconv.ParseFloat(fields[4], 64); err == nil {
+			datum.Max = &max
+		}
+	}
+	return datum, true
+}
+
+func checkResultSamples(result CheckResult) []Sample {
+	// turn a check result into samples, so its status and performance data are stored as metrics
+	labels := map[string]string{"check": result.Name}
+	output := []Sample{
+		{Name: "check_status", Labels: labels, Value: float64(result.Status), Timestamp: result.Timestamp},
+		{Name: "check_duration_seconds", Labels: labels, Value: result.Duration, Timestamp: result.Timestamp},
+	}
+
+	for _, datum := range result.PerfData {
+		perfLabels := map[string]string{"check": result.Name, "label": datum.Label}
+		if datum.UOM != "" {
+			perfLabels["uom"] = datum.UOM
+		}
+		output = append(output, Sample{Name: "check_perfdata", Labels: perfLabels, Value: datum.Value, Timestamp: result.Timestamp})
+	}
+	return output
+}
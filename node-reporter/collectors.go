@@ -0,0 +1,384 @@
+// collectors gather system metrics on the node, reading from /proc and /sys
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Sample is a single timestamped measurement produced by a collector
+type Sample struct {
+	Name      string            `json:"name"`             // metric name, e.g. load1
+	Labels    map[string]string `json:"labels,omitempty"` // labels identifying the measured object, e.g. the mountpoint
+	Value     float64           `json:"value"`            // measured value
+	Timestamp time.Time         `json:"timestamp"`        // when the value was measured
+}
+
+// Collector is anything that can produce samples, collectors may keep state between calls to compute rates
+type Collector interface {
+	Name() string
+	Collect() ([]Sample, error)
+}
+
+// collectors node-reporter knows about, by the name used in the configuration
+var collectorConstructors = map[string]func() Collector{
+	"cpu":        func() Collector { return &cpuCollector{statFile: "/proc/stat"} },
+	"load":       func() Collector { return &loadCollector{loadFile: "/proc/loadavg"} },
+	"memory":     func() Collector { return &memoryCollector{meminfoFile: "/proc/meminfo"} },
+	"filesystem": func() Collector { return &filesystemCollector{mountsFile: "/proc/self/mounts"} },
+	"diskio": func() Collector {
+		return &diskIOCollector{diskstatsFile: "/proc/diskstats", sysBlockDir: "/sys/class/block"}
+	},
+	"netdev":  func() Collector { return &netDevCollector{netDevFile: "/proc/net/dev"} },
+	"process": func() Collector { return newProcessCollector(getConf().ProcessWatches) },
+}
+
+func init() {
+	for name := range collectorConstructors {
+		availableCollectors[name] = true
+	}
+}
+
+func newCollectors(names []string) []Collector {
+	// instantiate the collectors with the given names, names have already been validated with the configuration
+	var output []Collector
+	for _, name := range names {
+		output = append(output, collectorConstructors[name]())
+	}
+	return output
+}
+
+func collectAll(collectors []Collector) ([]Sample, []Event) {
+	// run every collector, a failing collector does not prevent the others from reporting
+	var output []Sample
+	var events []Event
+	for _, c := range collectors {
+		samples, err := c.Collect()
+		if err != nil {
+			logWarnf("Collector %s failed, %v\n", c.Name(), err)
+		} else {
+			output = append(output, samples...)
+		}
+
+		if source, ok := c.(EventSource); ok {
+			events = append(events, source.Events()...)
+		}
+	}
+	return output, events
+}
+
+/////////////
+// cpu utilisation, from the difference between two reads of /proc/stat
+type cpuCollector struct {
+	statFile  string
+	lastTotal uint64
+	lastIdle  uint64
+	lastWait  uint64
+}
+
+func (c *cpuCollector) Name() string { return "cpu" }
+
+func (c *cpuCollector) Collect() ([]Sample, error) {
+	f, err := os.Open(c.statFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	if !scanner.Scan() {
+		return nil, fmt.Errorf("%s is empty", c.statFile)
+	}
+
+	// cpu  user nice system idle iowait irq softirq steal guest guest_nice
+	fields := strings.Fields(scanner.Text())
+	if len(fields) < 5 || fields[0] != "cpu" {
+		return nil, fmt.Errorf("unexpected first line in %s", c.statFile)
+	}
+
+	var total, idle, wait uint64
+	for i, field := range fields[1:] {
+		value, err := strconv.ParseUint(field, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		if i >= 8 {
+			break // guest time is already accounted for in user time
+		}
+		total += value
+		if i == 3 {
+			idle = value
+		} else if i == 4 {
+			wait = value
+		}
+	}
+
+	// utilisation needs two reads, the first one only primes the collector
+	var output []Sample
+	if c.lastTotal != 0 && total > c.lastTotal {
+		deltaTotal := float64(total - c.lastTotal)
+		now := time.Now()
+		output = append(output,
+			Sample{Name: "cpu_usage_percent", Value: 100 * (deltaTotal - float64(idle-c.lastIdle) - float64(wait-c.lastWait)) / deltaTotal, Timestamp: now},
+			Sample{Name: "cpu_iowait_percent", Value: 100 * float64(wait-c.lastWait) / deltaTotal, Timestamp: now})
+	}
+	c.lastTotal, c.lastIdle, c.lastWait = total, idle, wait
+
+	return output, nil
+}
+
+/////////////
+// load average, from /proc/loadavg
+type loadCollector struct {
+	loadFile string
+}
+
+func (c *loadCollector) Name() string { return "load" }
+
+func (c *loadCollector) Collect() ([]Sample, error) {
+	byteData, err := ioutil.ReadFile(c.loadFile)
+	if err != nil {
+		return nil, err
+	}
+
+	fields := strings.Fields(string(byteData))
+	if len(fields) < 3 {
+		return nil, fmt.Errorf("unexpected content in %s", c.loadFile)
+	}
+
+	now := time.Now()
+	var output []Sample
+	for i, name := range []string{"load1", "load5", "load15"} {
+		value, err := strconv.ParseFloat(fields[i], 64)
+		if err != nil {
+			return nil, err
+		}
+		output = append(output, Sample{Name: name, Value: value, Timestamp: now})
+	}
+
+	return output, nil
+}
+
+/////////////
+// memory and swap, from /proc/meminfo
+type memoryCollector struct {
+	meminfoFile string
+}
+
+func (c *memoryCollector) Name() string { return "memory" }
+
+func (c *memoryCollector) Collect() ([]Sample, error) {
+	f, err := os.Open(c.meminfoFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	// values in /proc/meminfo are in kB
+	meminfo := make(map[string]float64)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		value, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil {
+			continue
+		}
+		meminfo[strings.TrimSuffix(fields[0], ":")] = value * 1024
+	}
+
+	if meminfo["MemTotal"] == 0 {
+		return nil, fmt.Errorf("MemTotal not found in %s", c.meminfoFile)
+	}
+
+	// MemAvailable is missing on old kernels, estimate it the way free(1) used to
+	available, ok := meminfo["MemAvailable"]
+	if !ok {
+		available = meminfo["MemFree"] + meminfo["Buffers"] + meminfo["Cached"]
+	}
+
+	now := time.Now()
+	output := []Sample{
+		{Name: "memory_total_bytes", Value: meminfo["MemTotal"], Timestamp: now},
+		{Name: "memory_available_bytes", Value: available, Timestamp: now},
+		{Name: "memory_used_percent", Value: 100 * (meminfo["MemTotal"] - available) / meminfo["MemTotal"], Timestamp: now},
+		{Name: "swap_total_bytes", Value: meminfo["SwapTotal"], Timestamp: now},
+		{Name: "swap_free_bytes", Value: meminfo["SwapFree"], Timestamp: now},
+	}
+	if meminfo["SwapTotal"] > 0 {
+		output = append(output, Sample{Name: "swap_used_percent", Value: 100 * (meminfo["SwapTotal"] - meminfo["SwapFree"]) / meminfo["SwapTotal"], Timestamp: now})
+	}
+
+	return output, nil
+}
+
+/////////////
+// filesystem usage, statfs on the block device mounts listed in /proc/self/mounts
+type filesystemCollector struct {
+	mountsFile string
+}
+
+func (c *filesystemCollector) Name() string { return "filesystem" }
+
+func (c *filesystemCollector) Collect() ([]Sample, error) {
+	f, err := os.Open(c.mountsFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	now := time.Now()
+	var output []Sample
+	seen := make(map[string]bool) // the same device can be mounted more than once, e.g. bind mounts
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// device mountpoint fstype options dump pass
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 || !strings.HasPrefix(fields[0], "/dev/") || seen[fields[0]] {
+			continue
+		}
+		seen[fields[0]] = true
+
+		// spaces and other special characters are escaped as octal in mountpoints
+		mountpoint, _ := strconv.Unquote("\"" + strings.ReplaceAll(fields[1], "\"", "\\\"") + "\"")
+		if mountpoint == "" {
+			mountpoint = fields[1]
+		}
+
+		total, free, avail, files, filesFree, err := statFilesystem(mountpoint)
+		if err != nil {
+			logDebugf("statfs %s failed, %v\n", mountpoint, err)
+			continue
+		}
+		if total == 0 {
+			continue
+		}
+
+		labels := map[string]string{"device": fields[0], "mountpoint": mountpoint, "fstype": fields[2]}
+		output = append(output,
+			Sample{Name: "filesystem_size_bytes", Labels: labels, Value: float64(total), Timestamp: now},
+			Sample{Name: "filesystem_free_bytes", Labels: labels, Value: float64(free), Timestamp: now},
+			Sample{Name: "filesystem_avail_bytes", Labels: labels, Value: float64(avail), Timestamp: now},
+			Sample{Name: "filesystem_used_percent", Labels: labels, Value: 100 * float64(total-free) / float64(total), Timestamp: now},
+			Sample{Name: "filesystem_files", Labels: labels, Value: float64(files), Timestamp: now},
+			Sample{Name: "filesystem_files_free", Labels: labels, Value: float64(filesFree), Timestamp: now})
+	}
+
+	return output, scanner.Err()
+}
+
+/////////////
+// disk I/O counters, from /proc/diskstats
+// partitions are left out, their I/O is already counted in the disk they are on
+type diskIOCollector struct {
+	diskstatsFile string
+	sysBlockDir   string // partitions have a partition file in their directory here
+}
+
+func (c *diskIOCollector) Name() string { return "diskio" }
+
+func (c *diskIOCollector) Collect() ([]Sample, error) {
+	f, err := os.Open(c.diskstatsFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	now := time.Now()
+	var output []Sample
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// major minor name reads merged sectors_read ms_reading writes merged sectors_written ms_writing in_progress ms_io weighted_ms_io
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 14 {
+			continue
+		}
+		name := fields[2]
+		if strings.HasPrefix(name, "loop") || strings.HasPrefix(name, "ram") {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(c.sysBlockDir, name, "partition")); err == nil {
+			continue
+		}
+
+		values := make([]float64, len(fields))
+		for i := 3; i < len(fields); i++ {
+			values[i], _ = strconv.ParseFloat(fields[i], 64)
+		}
+
+		// sectors in /proc/diskstats are always 512 bytes
+		labels := map[string]string{"device": name}
+		output = append(output,
+			Sample{Name: "disk_reads_total", Labels: labels, Value: values[3], Timestamp: now},
+			Sample{Name: "disk_read_bytes_total", Labels: labels, Value: values[5] * 512, Timestamp: now},
+			Sample{Name: "disk_writes_total", Labels: labels, Value: values[7], Timestamp: now},
+			Sample{Name: "disk_written_bytes_total", Labels: labels, Value: values[9] * 512, Timestamp: now},
+			Sample{Name: "disk_io_time_seconds_total", Labels: labels, Value: values[12] / 1000, Timestamp: now})
+	}
+
+	return output, scanner.Err()
+}
+
+/////////////
+// network interface counters, from /proc/net/dev
+type netDevCollector struct {
+	netDevFile string
+}
+
+func (c *netDevCollector) Name() string { return "netdev" }
+
+func (c *netDevCollector) Collect() ([]Sample, error) {
+	f, err := os.Open(c.netDevFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	// receive: bytes packets errs drop fifo frame compressed multicast, transmit: bytes packets errs drop fifo colls carrier compressed
+	counters := map[int]string{
+		0:  "net_receive_bytes_total",
+		1:  "net_receive_packets_total",
+		2:  "net_receive_errors_total",
+		3:  "net_receive_drop_total",
+		8:  "net_transmit_bytes_total",
+		9:  "net_transmit_packets_total",
+		10: "net_transmit_errors_total",
+		11: "net_transmit_drop_total",
+	}
+
+	now := time.Now()
+	var output []Sample
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), ":", 2)
+		if len(parts) != 2 {
+			continue // header lines
+		}
+		name := strings.TrimSpace(parts[0])
+		fields := strings.Fields(parts[1])
+		if name == "lo" || len(fields) < 16 {
+			continue
+		}
+
+		labels := map[string]string{"interface": name}
+		for i := 0; i < len(fields); i++ {
+			metric, ok := counters[i]
+			if !ok {
+				continue
+			}
+			value, _ := strconv.ParseFloat(fields[i], 64)
+			output = append(output, Sample{Name: metric, Labels: labels, Value: value, Timestamp: now})
+		}
+	}
+
+	return output, scanner.Err()
+}
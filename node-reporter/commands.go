@@ -0,0 +1,207 @@
+// commands the backend asks the device to perform, delivered in check-in responses
+// only command types in the allowed_commands list of the local configuration are ever executed
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Command is an action requested by the backend
+type Command struct {
+	ID      int64             `json:"id"`
+	Type    string            `json:"type"`
+	Args    map[string]string `json:"args,omitempty"`
+	Timeout int               `json:"timeout"` // seconds
+}
+
+// CommandResult is what is reported back to the backend once a command is done
+type CommandResult struct {
+	ID       int64  `json:"id"`
+	Status   string `json:"status"` // succeeded, failed, timed_out or rejected
+	ExitCode *int   `json:"exit_code,omitempty"`
+	Output   string `json:"output,omitempty"`
+}
+
+// command types node-reporter knows how to execute
+var commandHandlers = map[string]func(ctx context.Context, cmd Command, clientObj *http.Client) CommandResult{
+	"run_check":           runCheckCommand,
+	"collect_diagnostics": collectDiagnosticsCommand,
+	"restart_service":     restartServiceCommand,
+}
+
+// commands run by collect_diagnostics, their output is concatenated
+var diagnosticCommands = [][]string{
+	{"uname", "-a"},
+	{"uptime"},
+	{"df", "-h"},
+	{"free", "-m"},
+	{"ps", "-eo", "pid,user,pcpu,pmem,rss,etime,comm", "--sort=-pcpu"},
+}
+
+const maxCommandOutput = 64 * 1024 // bytes of output sent back for each command
+const defaultCommandTimeout = 60   // seconds, when the backend does not specify a timeout
+const maxCommandTimeout = 60 * 60  // seconds, longer timeouts requested by the backend are capped
+
+var executedCommands = make(map[int64]bool) // commands already started, the backend may deliver one twice
+var executedCommandsMutex sync.Mutex
+
+func executeCommands(ctx context.Context, commands []Command, clientObj *http.Client) {
+	// run each command in its own goroutine, so a slow one does not delay check-ins, and report its result
+	for _, cmd := range commands {
+		executedCommandsMutex.Lock()
+		seen := executedCommands[cmd.ID]
+		executedCommands[cmd.ID] = true
+		executedCommandsMutex.Unlock()
+		if seen {
+			continue
+		}
+
+		go func(cmd Command) {
+			result := executeCommand(ctx, cmd, clientObj)
+			logInfof("Command %d (%s) finished, %s\n", cmd.ID, cmd.Type, result.Status)
+
+			err := sendCommandResult(ctx, result, clientObj)
+			if err != nil {
+				log.Printf("Failed to send result of command %d, %v\n", cmd.ID, err)
+			}
+		}(cmd)
+	}
+}
+
+func executeCommand(ctx context.Context, cmd Command, clientObj *http.Client) CommandResult {
+	// run a command if its type is allowed, rejecting it otherwise
+	allowed := false
+	for _, t := range getConf().AllowedCommands {
+		allowed = allowed || t == cmd.Type
+	}
+	handler, known := commandHandlers[cmd.Type]
+	if !allowed || !known {
+		logWarnf("Rejecting command %d, type %q is not allowed\n", cmd.ID, cmd.Type)
+		return CommandResult{ID: cmd.ID, Status: "rejected", Output: fmt.Sprintf("command type %q is not allowed on this device", cmd.Type)}
+	}
+
+	if cmd.Timeout <= 0 {
+		cmd.Timeout = defaultCommandTimeout
+	}
+	if cmd.Timeout > maxCommandTimeout {
+		cmd.Timeout = maxCommandTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(cmd.Timeout)*time.Second)
+	defer cancel()
+
+	logInfof("Running command %d (%s)\n", cmd.ID, cmd.Type)
+	result := handler(ctx, cmd, clientObj)
+	result.ID = cmd.ID
+	if len(result.Output) > maxCommandOutput {
+		result.Output = result.Output[:maxCommandOutput]
+	}
+	return result
+}
+
+func runCheckCommand(ctx context.Context, cmd Command, clientObj *http.Client) CommandResult {
+	// run one of the configured checks now, the result is also sent like a scheduled one
+	for _, def := range getConf().Checks {
+		if def.Name != cmd.Args["check"] {
+			continue
+		}
+
+		result := runCheck(ctx, def)
+		err := sendCheckResults(ctx, []CheckResult{result}, clientObj)
+		if err != nil {
+			log.Println(err)
+		}
+		return CommandResult{Status: "succeeded", ExitCode: &result.Status, Output: result.StatusText + ": " + result.Output}
+	}
+
+	return CommandResult{Status: "rejected", Output: fmt.Sprintf("no check named %q is configured", cmd.Args["check"])}
+}
+
+func collectDiagnosticsCommand(ctx context.Context, cmd Command, clientObj *http.Client) CommandResult {
+	// run a fixed set of commands, a failing one does not stop the others
+	var output bytes.Buffer
+	status := "succeeded"
+	for _, argv := range diagnosticCommands {
+		fmt.Fprintf(&output, "$ %s\n", strings.Join(argv, " "))
+		out, _, s := runCommand(ctx, argv)
+		output.WriteString(out)
+		output.WriteString("\n")
+		if s == "timed_out" {
+			return CommandResult{Status: s, Output: output.String()}
+		}
+		if s != "succeeded" {
+			status = "failed"
+		}
+	}
+
+	return CommandResult{Status: status, Output: output.String()}
+}
+
+func restartServiceCommand(ctx context.Context, cmd Command, clientObj *http.Client) CommandResult {
+	// restart a service, only the ones listed in restartable_services
+	service := cmd.Args["service"]
+	allowed := false
+	for _, s := range getConf().RestartableServices {
+		allowed = allowed || s == service
+	}
+	if !allowed {
+		return CommandResult{Status: "rejected", Output: fmt.Sprintf("service %q is not in restartable_services", service)}
+	}
+
+	output, exitCode, status := runCommand(ctx, []string{"systemctl", "restart", service})
+	return CommandResult{Status: status, ExitCode: exitCode, Output: output}
+}
+
+func runCommand(ctx context.Context, argv []string) (string, *int, string) {
+	// run argv until ctx is done, returning its combined output, exit code (if it exited) and status
+	var output bytes.Buffer
+	c := exec.CommandContext(ctx, argv[0], argv[1:]...)
+	c.Stdout = &output
+	c.Stderr = &output
+	err := c.Run()
+
+	if ctx.Err() == context.DeadlineExceeded {
+		return output.String(), nil, "timed_out"
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		code := exitErr.ExitCode()
+		return output.String(), &code, "failed"
+	}
+	if err != nil {
+		return output.String() + err.Error(), nil, "failed"
+	}
+
+	code := 0
+	return output.String(), &code, "succeeded"
+}
+
+func sendCommandResult(ctx context.Context, result CommandResult, clientObj *http.Client) error {
+	// report the outcome of a command to the backend
+	reqBody := map[string]interface{}{"key": getKey(), "id": result.ID, "status": result.Status, "exit_code": result.ExitCode, "output": result.Output}
+	requestJson, _ := json.Marshal(reqBody)
+	resp, err := endpoints.Post(ctx, clientObj, "/command-result", requestJson)
+	if err != nil {
+		return err
+	}
+
+	return processDataResponse(resp)
+}
+
+func validateAllowedCommands(allowed []string) error {
+	// only command types node-reporter knows about can be allowed
+	for _, t := range allowed {
+		if _, ok := commandHandlers[t]; !ok {
+			return fmt.Errorf("unknown command type %q in allowed_commands", t)
+		}
+	}
+	return nil
+}
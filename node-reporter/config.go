@@ -0,0 +1,412 @@
+// configuration of the node reporter, read from a JSON file, environment variables and command line flags
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds everything the node reporter can be configured with
+// precedence, from lowest to highest, is: defaults, config file, environment variables, command line flags
+type Config struct {
+	Servers             []string          `json:"servers"`               // backend URLs, in order of preference
+	SRV                 string            `json:"srv"`                   // DNS SRV name to discover backend URLs from, overrides servers
+	Transport           string            `json:"transport"`             // http or grpc, for registration, check-ins, check-outs and samples
+	GRPCServers         []string          `json:"grpc_servers"`          // host:port of the gRPC API of each backend, in order of preference
+	GRPCTLS             bool              `json:"grpc_tls"`              // connect to the gRPC API with TLS
+	FailbackProbe       Duration          `json:"failback_probe"`        // how often to probe the primary backend while failed over
+	CheckinInterval     Duration          `json:"checkin_interval"`      // time between check-ins
+	ClientTimeout       Duration          `json:"client_timeout"`        // timeout for every HTTP request to the backend
+	Jitter              Duration          `json:"jitter"`                // every scheduled run is delayed by a random amount up to this
+	ShutdownTimeout     Duration          `json:"shutdown_timeout"`      // how long to wait for running jobs when stopping
+	Session             bool              `json:"session"`               // keep a WebSocket session open so the backend can push commands and configuration immediately
+	Collectors          []string          `json:"collectors"`            // collectors to enable
+	CollectInterval     Duration          `json:"collect_interval"`      // time between runs of the collectors
+	BatchWindow         Duration          `json:"batch_window"`          // samples are collected for this long and sent together, 0 sends them right away
+	BatchMaxSamples     int               `json:"batch_max_samples"`     // a batch is sent early once it holds this many samples
+	Compression         string            `json:"compression"`           // none, gzip or zstd, for the samples sent over HTTP
+	ProcessWatches      []ProcessWatch    `json:"process_watches"`       // processes watched by the process collector
+	Checks              []CheckDefinition `json:"checks"`                // Nagios-compatible check commands
+	Tags                []string          `json:"tags"`                  // tags sent at registration, the backend applies the configuration of the matching groups
+	AllowedCommands     []string          `json:"allowed_commands"`      // command types the backend may ask this device to run, none by default
+	RestartableServices []string          `json:"restartable_services"`  // services the restart_service command may restart
+	RemoteCheckCommands []string          `json:"remote_check_commands"` // executables the checks set by the backend may run, none by default
+	Interface           string            `json:"interface"`             // interface the device identifies itself by, first physical one if empty
+	StateFile           string            `json:"state_file"`            // where the key obtained from the backend is kept across restarts
+	BufferDir           string            `json:"buffer_dir"`            // where samples the backend could not take are kept until they are sent, buffering is disabled if empty, the user cache directory is used if it cannot be written
+	BufferMaxBytes      int64             `json:"buffer_max_bytes"`      // size the buffer may take up on disk
+	BufferPolicy        string            `json:"buffer_policy"`         // what to drop when the buffer is full, drop_oldest or drop_newest
+	LogLevel            string            `json:"log_level"`             // one of debug, info, warn, error
+}
+
+// Duration is a time.Duration read from and written to JSON as a string, e.g. "10s"
+type Duration struct {
+	time.Duration
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	err := json.Unmarshal(data, &s)
+	if err != nil {
+		return fmt.Errorf("duration must be a string such as \"10s\", got %s", string(data))
+	}
+
+	d.Duration, err = time.ParseDuration(s)
+	return err
+}
+
+// names of the collectors node-reporter knows about, used to validate the configuration
+var availableCollectors = map[string]bool{}
+
+func defaultConfig() Config {
+	return Config{
+		Servers:         []string{"http://localhost:80"},
+		Transport:       "http",
+		FailbackProbe:   Duration{60 * time.Second},
+		CheckinInterval: Duration{10 * time.Second},
+		ClientTimeout:   Duration{5 * time.Second},
+		Jitter:          Duration{2 * time.Second},
+		ShutdownTimeout: Duration{10 * time.Second},
+		Collectors:      []string{"cpu", "load", "memory", "filesystem", "diskio", "netdev"},
+		CollectInterval: Duration{30 * time.Second},
+		BatchMaxSamples: 5000,
+		Compression:     "none",
+		StateFile:       "/var/lib/remotemonitor/node-reporter-state.json",
+		BufferDir:       "/var/lib/remotemonitor/buffer",
+		BufferMaxBytes:  64 * 1024 * 1024,
+		BufferPolicy:    "drop_oldest",
+		LogLevel:        "info",
+	}
+}
+
+func loadConfig(args []string) (Config, bool, error) {
+	// build the effective configuration from args (without the program name)
+	// also return whether the configuration should only be printed
+	conf := defaultConfig()
+
+	fs := flag.NewFlagSet("node-reporter", flag.ContinueOnError)
+	configFile := fs.String("config", os.Getenv("RM_CONFIG"), "path to JSON configuration file")
+	printConfig := fs.Bool("print-config", false, "print the effective configuration and exit")
+	servers := fs.String("servers", "", "comma-separated list of backend URLs, in order of preference")
+	srv := fs.String("srv", "", "DNS SRV name to discover backend URLs from, overrides -servers")
+	transport := fs.String("transport", "", "http or grpc, for registration, check-ins, check-outs and samples")
+	grpcServers := fs.String("grpc-servers", "", "comma-separated list of host:port of the gRPC API of each backend")
+	failbackProbe := fs.Duration("failback-probe", 0, "how often to probe the primary backend while failed over")
+	checkinInterval := fs.Duration("checkin-interval", 0, "time between check-ins")
+	clientTimeout := fs.Duration("timeout", 0, "timeout for HTTP requests to the backend")
+	jitter := fs.Duration("jitter", 0, "maximum random delay added to every scheduled run")
+	session := fs.Bool("session", false, "keep a WebSocket session open with the backend")
+	collectors := fs.String("collectors", "", "comma-separated list of collectors to enable")
+	collectInterval := fs.Duration("collect-interval", 0, "time between runs of the collectors")
+	batchWindow := fs.Duration("batch-window", 0, "time samples are collected for before being sent together")
+	compression := fs.String("compression", "", "compression of the samples sent over HTTP, one of none, gzip, zstd")
+	tags := fs.String("tags", "", "comma-separated list of tags to register with")
+	allowedCommands := fs.String("allowed-commands", "", "comma-separated list of command types the backend may run")
+	iface := fs.String("interface", "", "interface the device identifies itself by")
+	stateFile := fs.String("state-file", "", "file where the device key is kept across restarts")
+	bufferDir := fs.String("buffer-dir", "", "directory where unsent samples are kept, empty to disable buffering")
+	logLevel := fs.String("log-level", "", "log level, one of debug, info, warn, error")
+
+	err := fs.Parse(args)
+	if err != nil {
+		return conf, false, err
+	}
+
+	// config file
+	if *configFile != "" {
+		byteData, err := ioutil.ReadFile(*configFile)
+		if err != nil {
+			return conf, false, err
+		}
+		// unknown keys are rejected, so a typo does not silently leave a setting to its default
+		decoder := json.NewDecoder(bytes.NewReader(byteData))
+		decoder.DisallowUnknownFields()
+		err = decoder.Decode(&conf)
+		if err != nil {
+			return conf, false, fmt.Errorf("failed to parse %s, %v", *configFile, err)
+		}
+	}
+
+	// environment variables
+	err = applyEnvironment(&conf)
+	if err != nil {
+		return conf, false, err
+	}
+
+	// flags, only the ones explicitly set override what was loaded so far
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "servers":
+			conf.Servers = splitList(*servers)
+		case "srv":
+			conf.SRV = *srv
+		case "transport":
+			conf.Transport = *transport
+		case "grpc-servers":
+			conf.GRPCServers = splitList(*grpcServers)
+		case "failback-probe":
+			conf.FailbackProbe.Duration = *failbackProbe
+		case "checkin-interval":
+			conf.CheckinInterval.Duration = *checkinInterval
+		case "timeout":
+			conf.ClientTimeout.Duration = *clientTimeout
+		case "jitter":
+			conf.Jitter.Duration = *jitter
+		case "session":
+			conf.Session = *session
+		case "collectors":
+			conf.Collectors = splitList(*collectors)
+		case "collect-interval":
+			conf.CollectInterval.Duration = *collectInterval
+		case "batch-window":
+			conf.BatchWindow.Duration = *batchWindow
+		case "compression":
+			conf.Compression = *compression
+		case "tags":
+			conf.Tags = splitList(*tags)
+		case "allowed-commands":
+			conf.AllowedCommands = splitList(*allowedCommands)
+		case "interface":
+			conf.Interface = *iface
+		case "state-file":
+			conf.StateFile = *stateFile
+		case "buffer-dir":
+			conf.BufferDir = *bufferDir
+		case "log-level":
+			conf.LogLevel = *logLevel
+		}
+	})
+
+	return conf, *printConfig, validateConfig(conf)
+}
+
+func applyEnvironment(conf *Config) error {
+	// override configuration with RM_* environment variables, when set
+	var err error
+	if v := os.Getenv("RM_SERVERS"); v != "" {
+		conf.Servers = splitList(v)
+	}
+	if v := os.Getenv("RM_SRV"); v != "" {
+		conf.SRV = v
+	}
+	if v := os.Getenv("RM_TRANSPORT"); v != "" {
+		conf.Transport = v
+	}
+	if v := os.Getenv("RM_GRPC_SERVERS"); v != "" {
+		conf.GRPCServers = splitList(v)
+	}
+	if v := os.Getenv("RM_FAILBACK_PROBE"); v != "" {
+		if conf.FailbackProbe.Duration, err = time.ParseDuration(v); err != nil {
+			return fmt.Errorf("RM_FAILBACK_PROBE: %v", err)
+		}
+	}
+	if v := os.Getenv("RM_CHECKIN_INTERVAL"); v != "" {
+		if conf.CheckinInterval.Duration, err = time.ParseDuration(v); err != nil {
+			return fmt.Errorf("RM_CHECKIN_INTERVAL: %v", err)
+		}
+	}
+	if v := os.Getenv("RM_CLIENT_TIMEOUT"); v != "" {
+		if conf.ClientTimeout.Duration, err = time.ParseDuration(v); err != nil {
+			return fmt.Errorf("RM_CLIENT_TIMEOUT: %v", err)
+		}
+	}
+	if v := os.Getenv("RM_JITTER"); v != "" {
+		if conf.Jitter.Duration, err = time.ParseDuration(v); err != nil {
+			return fmt.Errorf("RM_JITTER: %v", err)
+		}
+	}
+	if v := os.Getenv("RM_SESSION"); v != "" {
+		if conf.Session, err = strconv.ParseBool(v); err != nil {
+			return fmt.Errorf("RM_SESSION: %v", err)
+		}
+	}
+	if v := os.Getenv("RM_COLLECTORS"); v != "" {
+		conf.Collectors = splitList(v)
+	}
+	if v := os.Getenv("RM_COLLECT_INTERVAL"); v != "" {
+		if conf.CollectInterval.Duration, err = time.ParseDuration(v); err != nil {
+			return fmt.Errorf("RM_COLLECT_INTERVAL: %v", err)
+		}
+	}
+	if v := os.Getenv("RM_BATCH_WINDOW"); v != "" {
+		if conf.BatchWindow.Duration, err = time.ParseDuration(v); err != nil {
+			return fmt.Errorf("RM_BATCH_WINDOW: %v", err)
+		}
+	}
+	if v := os.Getenv("RM_COMPRESSION"); v != "" {
+		conf.Compression = v
+	}
+	if v := os.Getenv("RM_TAGS"); v != "" {
+		conf.Tags = splitList(v)
+	}
+	if v := os.Getenv("RM_ALLOWED_COMMANDS"); v != "" {
+		conf.AllowedCommands = splitList(v)
+	}
+	if v := os.Getenv("RM_INTERFACE"); v != "" {
+		conf.Interface = v
+	}
+	if v := os.Getenv("RM_STATE_FILE"); v != "" {
+		conf.StateFile = v
+	}
+	if v, ok := os.LookupEnv("RM_BUFFER_DIR"); ok { // set but empty disables buffering
+		conf.BufferDir = v
+	}
+	if v := os.Getenv("RM_LOG_LEVEL"); v != "" {
+		conf.LogLevel = v
+	}
+
+	return nil
+}
+
+func validateConfig(conf Config) error {
+	// check the configuration makes sense before anything is started
+	if len(conf.Servers) == 0 && conf.SRV == "" {
+		return fmt.Errorf("at least one server URL or an SRV name is required")
+	}
+	for _, s := range conf.Servers {
+		u, err := url.Parse(s)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid server URL %q", s)
+		}
+	}
+
+	if conf.Transport != "http" && conf.Transport != "grpc" {
+		return fmt.Errorf("transport must be http or grpc")
+	}
+	if conf.Transport == "grpc" && len(conf.GRPCServers) == 0 {
+		return fmt.Errorf("the grpc transport needs at least one address in grpc_servers")
+	}
+
+	if conf.CheckinInterval.Duration <= 0 {
+		return fmt.Errorf("checkin_interval must be positive")
+	}
+	if conf.ClientTimeout.Duration <= 0 {
+		return fmt.Errorf("client_timeout must be positive")
+	}
+	if conf.CollectInterval.Duration <= 0 {
+		return fmt.Errorf("collect_interval must be positive")
+	}
+	if conf.Jitter.Duration < 0 || conf.Jitter.Duration >= conf.CheckinInterval.Duration {
+		return fmt.Errorf("jitter must not be negative and must be shorter than checkin_interval")
+	}
+	if conf.ShutdownTimeout.Duration <= 0 {
+		return fmt.Errorf("shutdown_timeout must be positive")
+	}
+	if conf.FailbackProbe.Duration <= 0 {
+		return fmt.Errorf("failback_probe must be positive")
+	}
+
+	for _, c := range conf.Collectors {
+		if !availableCollectors[c] {
+			return fmt.Errorf("unknown collector %q", c)
+		}
+	}
+
+	processEnabled := false
+	for _, c := range conf.Collectors {
+		processEnabled = processEnabled || c == "process"
+	}
+	if len(conf.ProcessWatches) > 0 && !processEnabled {
+		return fmt.Errorf("process_watches are configured but the process collector is not enabled")
+	}
+	err := validateProcessWatches(conf.ProcessWatches)
+	if err != nil {
+		return err
+	}
+	err = validateChecks(conf.Checks)
+	if err != nil {
+		return err
+	}
+	err = validateAllowedCommands(conf.AllowedCommands)
+	if err != nil {
+		return err
+	}
+
+	if conf.BatchWindow.Duration < 0 {
+		return fmt.Errorf("batch_window must not be negative")
+	}
+	if conf.BatchWindow.Duration > 0 && conf.BatchMaxSamples <= 0 {
+		return fmt.Errorf("batch_max_samples must be positive")
+	}
+	if !compressions[conf.Compression] {
+		return fmt.Errorf("compression must be none, gzip or zstd")
+	}
+
+	if conf.BufferDir != "" && conf.BufferMaxBytes <= 0 {
+		return fmt.Errorf("buffer_max_bytes must be positive")
+	}
+	if conf.BufferDir != "" && !bufferPolicies[conf.BufferPolicy] {
+		return fmt.Errorf("buffer_policy must be drop_oldest or drop_newest")
+	}
+
+	if _, ok := logLevels[conf.LogLevel]; !ok {
+		return fmt.Errorf("invalid log_level %q", conf.LogLevel)
+	}
+
+	return nil
+}
+
+func printConfig(conf Config) {
+	// print the effective configuration in the same format as the config file
+	jsonData, err := json.MarshalIndent(conf, "", "    ")
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println(string(jsonData))
+}
+
+func splitList(s string) []string {
+	// split a comma-separated list, ignoring empty elements
+	var output []string
+	for _, element := range strings.Split(s, ",") {
+		element = strings.TrimSpace(element)
+		if element != "" {
+			output = append(output, element)
+		}
+	}
+	return output
+}
+
+/////////////
+// logging
+var logLevels = map[string]int{"debug": 0, "info": 1, "warn": 2, "error": 3}
+var logLevel = logLevels["info"]
+
+func setLogLevel(level string) {
+	logLevel = logLevels[level]
+}
+
+func logDebugf(format string, v ...interface{}) {
+	// log only if the log level is debug
+	if logLevel <= logLevels["debug"] {
+		log.Printf(format, v...)
+	}
+}
+
+func logInfof(format string, v ...interface{}) {
+	// log unless the log level is warn or error
+	if logLevel <= logLevels["info"] {
+		log.Printf(format, v...)
+	}
+}
+
+func logWarnf(format string, v ...interface{}) {
+	// log unless only errors are wanted
+	if logLevel <= logLevels["warn"] {
+		log.Printf(format, v...)
+	}
+}
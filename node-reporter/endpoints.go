@@ -0,0 +1,183 @@
+// keeps track of the backend endpoints the node reporter talks to, failing over between them when one is unhealthy
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+var lookupSRV = net.LookupSRV // replaced in tests
+
+// endpointList is an ordered list of backend URLs, the first one is the primary
+type endpointList struct {
+	mutex         sync.Mutex
+	urls          []string      // backend URLs, in order of preference
+	srvName       string        // DNS SRV name the URLs were discovered from, empty if they were configured
+	current       int           // index of the endpoint currently in use
+	probeInterval time.Duration // how often the primary is probed while failed over to another endpoint
+	lastProbe     time.Time     // last time the primary was probed
+}
+
+func newEndpointList(urls []string, srvName string, probeInterval time.Duration) (*endpointList, error) {
+	// build the list of endpoints, if srvName is provided the URLs are discovered through DNS instead
+	e := &endpointList{srvName: srvName, probeInterval: probeInterval}
+
+	if srvName != "" {
+		var err error
+		urls, err = lookupSRVEndpoints(srvName)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, u := range urls {
+		u = strings.TrimRight(strings.TrimSpace(u), "/")
+		if u != "" {
+			e.urls = append(e.urls, u)
+		}
+	}
+	if len(e.urls) == 0 {
+		return nil, fmt.Errorf("no backend endpoints configured")
+	}
+
+	return e, nil
+}
+
+func lookupSRVEndpoints(name string) ([]string, error) {
+	// resolve a DNS SRV name (e.g. _remotemonitor._tcp.example.com) into backend URLs
+	// net.LookupSRV already sorts the records by priority and randomizes them by weight
+	_, addrs, err := lookupSRV("", "", name)
+	if err != nil {
+		return nil, err
+	}
+
+	var urls []string
+	for _, addr := range addrs {
+		host := strings.TrimSuffix(addr.Target, ".")
+		urls = append(urls, fmt.Sprintf("http://%s", net.JoinHostPort(host, fmt.Sprint(addr.Port))))
+	}
+	if len(urls) == 0 {
+		return nil, fmt.Errorf("SRV record %s has no targets", name)
+	}
+
+	return urls, nil
+}
+
+func (e *endpointList) Current() string {
+	// URL of the endpoint currently in use
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return e.urls[e.current]
+}
+
+func (e *endpointList) Post(ctx context.Context, clientObj *http.Client, path string, body []byte) (*http.Response, error) {
+	// POST body to path on the endpoint currently in use, failing over to the next endpoint in the list if it is unhealthy
+	// the endpoint that works is kept for the following requests, while the primary is probed every probeInterval to fail back
+	return e.PostEncoded(ctx, clientObj, path, body, "")
+}
+
+func (e *endpointList) PostEncoded(ctx context.Context, clientObj *http.Client, path string, body []byte, contentEncoding string) (*http.Response, error) {
+	// same as Post, for a body already compressed with contentEncoding
+	e.mutex.Lock()
+	urls := e.urls
+	current := e.current
+	probePrimary := current != 0 && time.Since(e.lastProbe) >= e.probeInterval
+	if probePrimary {
+		e.lastProbe = time.Now()
+	}
+	e.mutex.Unlock()
+
+	if probePrimary {
+		resp, err := postToEndpoint(ctx, clientObj, urls[0]+path, body, contentEncoding)
+		if err == nil {
+			log.Printf("Primary endpoint %s is healthy again, failing back\n", urls[0])
+			e.setCurrent(0)
+			return resp, nil
+		}
+		log.Printf("Primary endpoint %s is still unhealthy, %v\n", urls[0], err)
+	}
+
+	for i := 0; i < len(urls); i++ {
+		index := (current + i) % len(urls)
+		if probePrimary && index == 0 {
+			continue // already tried above
+		}
+
+		if ctx.Err() != nil {
+			return nil, ctx.Err() // cancelled, the remaining endpoints are not to blame
+		}
+
+		resp, err := postToEndpoint(ctx, clientObj, urls[index]+path, body, contentEncoding)
+		if err != nil {
+			log.Printf("Endpoint %s is unhealthy, %v\n", urls[index], err)
+			continue
+		}
+
+		if index != current {
+			log.Printf("Failing over from %s to %s\n", urls[current], urls[index])
+			e.setCurrent(index)
+		}
+		return resp, nil
+	}
+
+	// every endpoint failed, SRV records may have changed in the meantime
+	if e.srvName != "" {
+		e.refreshSRV()
+	}
+
+	return nil, fmt.Errorf("all %d backend endpoints are unhealthy", len(urls))
+}
+
+func (e *endpointList) setCurrent(index int) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.current = index
+	e.lastProbe = time.Now()
+}
+
+func (e *endpointList) refreshSRV() {
+	// resolve the SRV name again, keeping the old list if that fails
+	urls, err := lookupSRVEndpoints(e.srvName)
+	if err != nil {
+		log.Printf("Failed to refresh SRV record %s, %v\n", e.srvName, err)
+		return
+	}
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.urls = urls
+	e.current = 0
+}
+
+func postToEndpoint(ctx context.Context, clientObj *http.Client, url string, body []byte, contentEncoding string) (*http.Response, error) {
+	// send a POST request to a single endpoint
+	// transport errors and 5xx responses mean the endpoint is unhealthy, anything else is a valid response from the backend
+	request, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(body))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-type", "application/json")
+	if contentEncoding != "" {
+		request.Header.Set("Content-Encoding", contentEncoding)
+	}
+
+	resp, err := clientObj.Do(request)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode >= 500 {
+		resp.Body.Close()
+		return nil, fmt.Errorf("received HTTP %d", resp.StatusCode)
+	}
+
+	return resp, nil
+}
@@ -0,0 +1,219 @@
+// gRPC transport for registration, check-ins, check-outs and samples, selected with "transport": "grpc"
+// everything else is still sent over HTTP to the servers in the configuration
+// the service is defined in proto/remotemonitor.proto, responses are turned back into the JSON bodies of the HTTP API
+// so they are parsed the same way
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	pb "github.com/DPinato/RemoteMonitor/proto"
+)
+
+const maxSamplesPerMessage = 500 // samples sent in each message of the SendData stream
+
+// grpcClient talks to the backends in grpc_servers, failing over like endpointList does for HTTP
+type grpcClient struct {
+	mutex   sync.Mutex
+	addrs   []string           // host:port of every backend, in order of preference
+	conns   []*grpc.ClientConn // one connection per backend, they connect lazily
+	clients []pb.BackendClient // stubs over conns
+	current int                // index of the backend in use
+}
+
+var grpcBackend *grpcClient // set when the gRPC transport is selected
+
+func newGRPCClient(addrs []string, useTLS bool) (*grpcClient, error) {
+	// prepare connections to every backend, nothing is dialled until the first call
+	creds := insecure.NewCredentials()
+	if useTLS {
+		creds = credentials.NewTLS(&tls.Config{})
+	}
+
+	g := &grpcClient{addrs: addrs}
+	for _, addr := range addrs {
+		conn, err := grpc.NewClient(addr, grpc.WithTransportCredentials(creds))
+		if err != nil {
+			return nil, err
+		}
+		g.conns = append(g.conns, conn)
+		g.clients = append(g.clients, pb.NewBackendClient(conn))
+	}
+	return g, nil
+}
+
+func (g *grpcClient) call(ctx context.Context, fn func(ctx context.Context, client pb.BackendClient) (interface{}, error)) ([]byte, error) {
+	// make a call on the backend in use, moving to the next one if it is unreachable
+	// return codes the backend sent as status details are turned back into a response body, so callers handle
+	// them the same way as HTTP responses
+	g.mutex.Lock()
+	start := g.current
+	g.mutex.Unlock()
+
+	var err error
+	for i := 0; i < len(g.conns); i++ {
+		index := (start + i) % len(g.conns)
+		callCtx, cancel := context.WithTimeout(ctx, getConf().ClientTimeout.Duration)
+		var resp interface{}
+		resp, err = fn(callCtx, g.clients[index])
+		cancel()
+
+		code := status.Code(err)
+		if err == nil || (code != codes.Unavailable && code != codes.DeadlineExceeded) {
+			if index != start {
+				logWarnf("Failed over to gRPC backend %s\n", g.addrs[index])
+				g.mutex.Lock()
+				g.current = index
+				g.mutex.Unlock()
+			}
+			if err != nil {
+				return returnCodeBody(err)
+			}
+			return json.Marshal(resp)
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		logWarnf("gRPC backend %s is unavailable, %v\n", g.addrs[index], err)
+	}
+
+	return nil, fmt.Errorf("no gRPC backend available, %v", err)
+}
+
+func (g *grpcClient) Current() string {
+	// address of the backend in use
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	return g.addrs[g.current]
+}
+
+func currentBackend() string {
+	// backend registrations and check-ins go to, for log messages
+	if grpcBackend != nil {
+		return grpcBackend.Current()
+	}
+	return endpoints.Current()
+}
+
+func returnCodeBody(err error) ([]byte, error) {
+	// rebuild the body of an HTTP error response from the return code in the details of a gRPC status
+	st := status.Convert(err)
+	for _, detail := range st.Details() {
+		if info, ok := detail.(*errdetails.ErrorInfo); ok && info.Domain == "remotemonitor" {
+			return []byte(fmt.Sprintf(`{"code": %s, "code_string": %q, "comment": %q}`, info.Metadata["code"], info.Reason, st.Message())), nil
+		}
+	}
+	return nil, err
+}
+
+func (g *grpcClient) Register(ctx context.Context, tags []string, inv Inventory) ([]byte, error) {
+	req := &pb.RegisterRequest{
+		Name:       myInfo.Name,
+		Mac:        myInfo.Mac,
+		MachineId:  myInfo.MachineID,
+		Interfaces: interfacesToPB(myInfo.Interfaces),
+		Tags:       tags,
+		Os:         inv.OS,
+		Inventory: &pb.Inventory{
+			Os:              inv.OS,
+			OsId:            inv.OSID,
+			OsVersion:       inv.OSVersion,
+			Kernel:          inv.Kernel,
+			Arch:            inv.Arch,
+			CpuModel:        inv.CPUModel,
+			CpuCount:        int32(inv.CPUCount),
+			MemoryTotal:     inv.MemoryTotal,
+			BootTime:        timestamppb.New(inv.BootTime),
+			Interfaces:      interfacesToPB(inv.Interfaces),
+			ReporterVersion: inv.ReporterVersion,
+		},
+	}
+	return g.call(ctx, func(ctx context.Context, client pb.BackendClient) (interface{}, error) {
+		resp, err := client.Register(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"code": resp.Code, "code_string": resp.CodeString, "comment": resp.Comment, "key": resp.Key, "mac": resp.Mac}, nil
+	})
+}
+
+func (g *grpcClient) Checkin(ctx context.Context) ([]byte, error) {
+	return g.call(ctx, func(ctx context.Context, client pb.BackendClient) (interface{}, error) {
+		resp, err := client.Checkin(ctx, &pb.KeyRequest{Key: getKey()})
+		if err != nil {
+			return nil, err
+		}
+		respMap := map[string]interface{}{"code": resp.Code, "last_checkin": resp.LastCheckin, "config_version": resp.ConfigVersion}
+		if len(resp.Commands) > 0 {
+			var commands []Command
+			for _, cmd := range resp.Commands {
+				commands = append(commands, Command{ID: cmd.Id, Type: cmd.Type, Args: cmd.Args, Timeout: int(cmd.Timeout)})
+			}
+			respMap["commands"] = commands
+		}
+		return respMap, nil
+	})
+}
+
+func (g *grpcClient) Checkout(ctx context.Context) ([]byte, error) {
+	return g.call(ctx, func(ctx context.Context, client pb.BackendClient) (interface{}, error) {
+		resp, err := client.Checkout(ctx, &pb.KeyRequest{Key: getKey()})
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"code": resp.Code, "code_string": resp.CodeString, "last_checkout": resp.LastCheckout}, nil
+	})
+}
+
+func (g *grpcClient) SendData(ctx context.Context, samples []Sample, replay bool) ([]byte, error) {
+	// stream the samples in batches, the backend replies once all of them were received
+	return g.call(ctx, func(ctx context.Context, client pb.BackendClient) (interface{}, error) {
+		stream, err := client.SendData(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		key := getKey()
+		for start := 0; start < len(samples); start += maxSamplesPerMessage {
+			end := start + maxSamplesPerMessage
+			if end > len(samples) {
+				end = len(samples)
+			}
+			req := &pb.DataRequest{Key: key, Replay: replay}
+			for _, sample := range samples[start:end] {
+				req.Samples = append(req.Samples, &pb.Sample{Name: sample.Name, Labels: sample.Labels, Value: sample.Value, Timestamp: timestamppb.New(sample.Timestamp)})
+			}
+			err = stream.Send(req)
+			if err != nil {
+				break // the reason is returned by CloseAndRecv
+			}
+		}
+
+		resp, err := stream.CloseAndRecv()
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"code": resp.Code, "code_string": resp.CodeString, "accepted": resp.Accepted, "rejected": resp.Rejected}, nil
+	})
+}
+
+func interfacesToPB(list []NetInterface) []*pb.NetInterface {
+	var output []*pb.NetInterface
+	for _, iface := range list {
+		output = append(output, &pb.NetInterface{Name: iface.Name, Mac: iface.Mac, Ips: iface.IPs})
+	}
+	return output
+}
@@ -0,0 +1,89 @@
+// works out a stable identity for the device, so it is recognised by the backend across reboots
+
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// NetInterface describes a physical network interface of the device
+type NetInterface struct {
+	Name string   `json:"name"` // interface name, e.g. eth0
+	Mac  string   `json:"mac"`  // MAC address of the interface
+	IPs  []string `json:"ips"`  // addresses configured on the interface, in CIDR notation
+}
+
+// files a stable machine identifier can be read from, in order of preference
+var machineIDFiles = []string{
+	"/etc/machine-id",
+	"/var/lib/dbus/machine-id",
+	"/sys/class/dmi/id/product_uuid",
+}
+
+// name prefixes of interfaces that are virtual, used when /sys/class/net is not available
+var virtualInterfacePrefixes = []string{"docker", "veth", "br-", "virbr", "vnet", "tun", "tap", "cni", "flannel", "cali", "kube", "lxc", "vmnet", "zt", "wg"}
+
+func getMachineID() string {
+	// read the first machine identifier available, empty if there is none
+	for _, fileLoc := range machineIDFiles {
+		byteData, err := ioutil.ReadFile(fileLoc)
+		if err != nil {
+			continue
+		}
+
+		id := strings.ToLower(strings.TrimSpace(string(byteData)))
+		if id != "" {
+			return id
+		}
+	}
+
+	return ""
+}
+
+func getPhysicalInterfaces() ([]NetInterface, error) {
+	// list interfaces that are up, have a MAC address and are neither loopback nor virtual
+	ifas, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+
+	var output []NetInterface
+	for _, ifa := range ifas {
+		if ifa.Flags&net.FlagLoopback != 0 || ifa.Flags&net.FlagUp == 0 {
+			continue
+		}
+		if ifa.HardwareAddr.String() == "" || isVirtualInterface(ifa.Name) {
+			continue
+		}
+
+		tmpIfa := NetInterface{Name: ifa.Name, Mac: ifa.HardwareAddr.String()}
+		addrs, err := ifa.Addrs()
+		if err == nil {
+			for _, addr := range addrs {
+				tmpIfa.IPs = append(tmpIfa.IPs, addr.String())
+			}
+		}
+		output = append(output, tmpIfa)
+	}
+
+	return output, nil
+}
+
+func isVirtualInterface(name string) bool {
+	// on Linux physical interfaces have a device link in sysfs, virtual ones (bridges, veth, tunnels) do not
+	if _, err := os.Stat("/sys/class/net"); err == nil {
+		_, err = os.Stat(filepath.Join("/sys/class/net", name, "device"))
+		return err != nil
+	}
+
+	for _, prefix := range virtualInterfacePrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
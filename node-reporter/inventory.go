@@ -0,0 +1,154 @@
+// collects an inventory of the device: operating system, kernel, hardware and network details
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// reporterVersion can be set at build time with -ldflags "-X main.reporterVersion=..."
+var reporterVersion = "0.1.0"
+
+// Inventory describes the device, it is sent at registration and whenever it changes
+type Inventory struct {
+	OS              string         `json:"os"`               // distribution, PRETTY_NAME from /etc/os-release
+	OSID            string         `json:"os_id"`            // distribution identifier, e.g. debian
+	OSVersion       string         `json:"os_version"`       // distribution version, e.g. 12
+	Kernel          string         `json:"kernel"`           // kernel release
+	Arch            string         `json:"arch"`             // CPU architecture
+	CPUModel        string         `json:"cpu_model"`        // model name of the first CPU
+	CPUCount        int            `json:"cpu_count"`        // number of logical CPUs
+	MemoryTotal     uint64         `json:"memory_total"`     // total memory, in bytes
+	BootTime        time.Time      `json:"boot_time"`        // time the device booted
+	Interfaces      []NetInterface `json:"interfaces"`       // physical interfaces and their addresses
+	ReporterVersion string         `json:"reporter_version"` // version of node-reporter
+}
+
+func collectInventory() Inventory {
+	// gather the inventory, anything that cannot be read is left empty
+	inv := Inventory{
+		Arch:            runtime.GOARCH,
+		CPUCount:        runtime.NumCPU(),
+		ReporterVersion: reporterVersion,
+	}
+
+	osRelease := readKeyValueFile("/etc/os-release")
+	inv.OS = osRelease["PRETTY_NAME"]
+	inv.OSID = osRelease["ID"]
+	inv.OSVersion = osRelease["VERSION_ID"]
+	if inv.OS == "" {
+		inv.OS = runtime.GOOS
+	}
+
+	if byteData, err := ioutil.ReadFile("/proc/sys/kernel/osrelease"); err == nil {
+		inv.Kernel = strings.TrimSpace(string(byteData))
+	}
+
+	inv.CPUModel = readCPUModel("/proc/cpuinfo")
+	inv.MemoryTotal = readMemoryTotal("/proc/meminfo")
+	inv.BootTime = readBootTime("/proc/stat")
+
+	if ifas, err := getPhysicalInterfaces(); err == nil {
+		inv.Interfaces = ifas
+	}
+
+	return inv
+}
+
+func inventoryChanged(old, new Inventory) bool {
+	// compare two inventories through their JSON representation
+	oldJson, _ := json.Marshal(old)
+	newJson, _ := json.Marshal(new)
+	return string(oldJson) != string(newJson)
+}
+
+func readKeyValueFile(fileLoc string) map[string]string {
+	// read a file of KEY=value lines, such as /etc/os-release, values may be quoted
+	output := make(map[string]string)
+	f, err := os.Open(fileLoc)
+	if err != nil {
+		return output
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		output[parts[0]] = strings.Trim(parts[1], "\"'")
+	}
+
+	return output
+}
+
+func readCPUModel(fileLoc string) string {
+	// model name of the first CPU listed in /proc/cpuinfo
+	f, err := os.Open(fileLoc)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), ":", 2)
+		if len(parts) == 2 && strings.TrimSpace(parts[0]) == "model name" {
+			return strings.TrimSpace(parts[1])
+		}
+	}
+
+	return ""
+}
+
+func readMemoryTotal(fileLoc string) uint64 {
+	// MemTotal from /proc/meminfo, converted to bytes
+	f, err := os.Open(fileLoc)
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "MemTotal:" {
+			kb, _ := strconv.ParseUint(fields[1], 10, 64)
+			return kb * 1024
+		}
+	}
+
+	return 0
+}
+
+func readBootTime(fileLoc string) time.Time {
+	// btime from /proc/stat, seconds since the epoch
+	f, err := os.Open(fileLoc)
+	if err != nil {
+		return time.Time{}
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[0] == "btime" {
+			seconds, _ := strconv.ParseInt(fields[1], 10, 64)
+			return time.Unix(seconds, 0).UTC()
+		}
+	}
+
+	return time.Time{}
+}
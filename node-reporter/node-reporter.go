@@ -3,143 +3,596 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"sync"
+	"syscall"
 	"time"
 )
 
 type Device struct {
-	Name        string    `json:"name"`         // name a device identified itself with
-	Key         string    `json:"key"`          // key the device will use to authenticate itself with backend-api
-	Mac         string    `json:"mac"`          // MAC address of any interface provided by the device
-	LastCheckin time.Time `json:"last_checkin"` // time when the device last checked in
+	Name        string         `json:"name"`         // name a device identified itself with
+	Key         string         `json:"key"`          // key the device will use to authenticate itself with backend-api
+	Mac         string         `json:"mac"`          // MAC address of the interface the device identifies itself by
+	MachineID   string         `json:"machine_id"`   // stable machine identifier, from /etc/machine-id or the DMI product UUID
+	Interfaces  []NetInterface `json:"interfaces"`   // physical interfaces of the device
+	LastCheckin time.Time      `json:"last_checkin"` // time when the device last checked in
 }
 
-var myInfo Device // information device uses to identify itself
+var myInfo Device            // information device uses to identify itself
+var myInfoMutex sync.RWMutex // protects the key in myInfo, which changes if the device registers again
+var conf Config              // effective configuration, read it with getConf once jobs are running
+var confMutex sync.RWMutex   // protects conf, which changes when the backend pushes a configuration
+var endpoints *endpointList  // backends the device reports to, in order of preference
+var scheduler *Scheduler     // runs check-ins, collectors and checks
+var lastInventory Inventory  // inventory last accepted by the backend
+var checkinMutex sync.Mutex  // check-in responses are handled one at a time, they come from the check-in job and the session
+var errBadKey = errors.New("backend does not know the key of this device")
+var errAlreadyRegistered = errors.New("backend has this device registered under a key we do not have")
 
 func main() {
-	serverURL := "http://localhost:80"
+	var err error
+	var onlyPrint bool
+	conf, onlyPrint, err = loadConfig(os.Args[1:])
+	if err != nil {
+		log.Fatalf("Invalid configuration, %v\n", err)
+	}
+	localConf = conf
+	if onlyPrint {
+		printConfig(conf)
+		return
+	}
+	setLogLevel(conf.LogLevel)
+
+	// stop cleanly on SIGINT and SIGTERM
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
 	client := &http.Client{
-		Timeout: 5 * time.Second,
+		Timeout: conf.ClientTimeout.Duration,
+	}
+
+	endpoints, err = newEndpointList(conf.Servers, conf.SRV, conf.FailbackProbe.Duration)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if conf.BatchWindow.Duration > 0 {
+		batcher = newBatcher(conf.BatchMaxSamples)
+	}
+	if conf.BufferDir != "" {
+		buffer, eventBuffer = openBuffers(conf.BufferDir, conf.BufferMaxBytes, conf.BufferPolicy)
+	}
+	if conf.Transport == "grpc" {
+		grpcBackend, err = newGRPCClient(conf.GRPCServers, conf.GRPCTLS)
+		if err != nil {
+			log.Fatal(err)
+		}
 	}
 
-	myInfo = getMyInfo()
-	log.Printf("myInfo: %v\n", myInfo)
+	myInfo, err = getMyInfo(conf.Interface)
+	if err != nil {
+		log.Fatal(err)
+	}
+	logInfof("myInfo: %v\n", myInfo)
+
+	// reuse the key from a previous run, as long as it was obtained with the same identity
+	state, err := loadState(conf.StateFile)
+	if err != nil {
+		logWarnf("Failed to read state from %s, %v\n", conf.StateFile, err)
+	} else if state.Key != "" && state.Name == myInfo.Name && state.Mac == myInfo.Mac && state.MachineID == myInfo.MachineID {
+		logInfof("Using key from %s\n", conf.StateFile)
+		myInfo.Key = state.Key
+	}
 
 	// start by registering with the backend
+	// a device the backend still sees as up keeps its old key, so keep trying until it gives us a new one
+	for myInfo.Key == "" {
+		err = registerWithBackend(ctx, client)
+		if err == nil {
+			break
+		}
+		logWarnf("Failed to register with the backend, %v\n", err)
+		select {
+		case <-ctx.Done():
+			log.Fatalf("I don't have a key, exiting ...")
+		case <-time.After(conf.CheckinInterval.Duration):
+		}
+	}
+
+	// check-ins, collectors and every check run on their own schedule
+	scheduler = newScheduler(conf.Jitter.Duration)
+	scheduleJobs(Config{}, client)
+	scheduler.Start(ctx)
+	if getConf().Session {
+		go sessionLoop(ctx, client)
+	}
+	<-ctx.Done()
+	logInfof("Shutting down ...\n")
+	scheduler.Wait(getConf().ShutdownTimeout.Duration)
+
+	// samples still waiting for the batch window are sent, or buffered, before leaving
+	if batcher != nil {
+		flushCtx, cancel := context.WithTimeout(context.Background(), getConf().ClientTimeout.Duration)
+		err = flushBatch(flushCtx, client)
+		cancel()
+		if err != nil {
+			logWarnf("Failed to send the last batch, %v\n", err)
+		}
+	}
+
+	// let the backend know the device stopped reporting on purpose
+	err = checkoutFromBackend(client)
+	if err != nil {
+		logWarnf("Failed to check out, %v\n", err)
+	}
+
+}
+
+func checkinJob(ctx context.Context, clientObj *http.Client) error {
+	// check in with the backend, registering again if it does not know this device
+	// an open session already keeps the backend informed, only the inventory is checked then
+	if !sessionActive.Load() {
+		var configVersion string
+		var commands []Command
+		var err error
+		if grpcBackend != nil {
+			var body []byte
+			body, err = grpcBackend.Checkin(ctx)
+			if err == nil {
+				configVersion, commands, err = parseCheckinResponse(body)
+			}
+		} else {
+			var resp *http.Response
+			resp, err = checkin(ctx, "/checkin", clientObj)
+			if err == nil {
+				configVersion, commands, err = processCheckinResponse(resp)
+			}
+		}
+		if err == errBadKey {
+			// the endpoint in use does not share the device store of the one the key came from, register again with it
+			logWarnf("%s does not know this device, registering again\n", currentBackend())
+			err = registerWithBackend(ctx, clientObj)
+		}
+		if err != nil {
+			return err
+		}
+		handleCheckinResponse(ctx, configVersion, commands, clientObj)
+	}
+
+	// let the backend know if anything in the inventory changed since it was last sent
+	inv := collectInventory()
+	if inventoryChanged(lastInventory, inv) {
+		return sendInventory(ctx, inv, clientObj)
+	}
+	return nil
+}
+
+func handleCheckinResponse(ctx context.Context, configVersion string, commands []Command, clientObj *http.Client) {
+	// act on a check-in response, received from an HTTP check-in or pushed through the session
+	checkinMutex.Lock()
+	defer checkinMutex.Unlock()
+
+	// the backend has a different configuration for this device
+	if configVersion != "" && configVersion != appliedConfigVersion {
+		logInfof("Backend has configuration version %s, fetching it\n", configVersion)
+		err := applyRemoteConfig(ctx, configVersion, clientObj)
+		if err != nil {
+			log.Println(err)
+		}
+	}
+
+	// commands run on their own, they report back to the backend when done
+	if len(commands) > 0 {
+		executeCommands(scheduler.ctx, commands, clientObj)
+	}
+}
+
+func collectorsJob(ctx context.Context, collectors []Collector, clientObj *http.Client) error {
+	// run the collectors and send what they produce to the backend
+	// a failure to send events does not hold back the samples, both are kept to be sent later
+	samples, events := collectAll(collectors)
+	var eventsErr error
+	if len(events) > 0 {
+		eventsErr = sendEvents(ctx, events, clientObj)
+	}
+	if len(samples) > 0 {
+		err := queueSamples(ctx, samples, clientObj)
+		if err != nil {
+			return err
+		}
+	}
+	return eventsErr
+}
+
+func checkJob(ctx context.Context, def CheckDefinition, clientObj *http.Client) error {
+	// run a check and send its result, and the metrics derived from it, to the backend
+	result := runCheck(ctx, def)
+	logDebugf("Check %s: %s, %s\n", def.Name, result.StatusText, result.Output)
+
+	err := sendCheckResults(ctx, []CheckResult{result}, clientObj)
+	if err != nil {
+		return err
+	}
+	return queueSamples(ctx, checkResultSamples(result), clientObj)
+}
+
+func registerWithBackend(ctx context.Context, clientObj *http.Client) error {
+	// register with the backend and process its response
 	registerReq := make(map[string]interface{})
 	registerReq["name"] = myInfo.Name
 	registerReq["mac"] = myInfo.Mac
+	registerReq["machine_id"] = myInfo.MachineID
+	registerReq["interfaces"] = myInfo.Interfaces
+	registerReq["tags"] = getConf().Tags
+	inv := collectInventory()
+	registerReq["os"] = inv.OS
+	registerReq["inventory"] = inv
+
+	if grpcBackend != nil {
+		body, err := grpcBackend.Register(ctx, getConf().Tags, inv)
+		if err != nil {
+			return err
+		}
+		err = parseRegisterResponse(body)
+		if err != nil {
+			return err
+		}
+	} else {
+		resp, err := register(ctx, "/register", registerReq, clientObj)
+		if err != nil {
+			return err
+		}
+		err = processRegisterResponse(resp)
+		if err != nil {
+			return err
+		}
+	}
+	lastInventory = inv
 
-	var err error
-	var resp *http.Response
-	resp, err = register(serverURL+"/register", registerReq, client)
+	// keep the key for the next run
+	key := getKey()
+	if key != "" {
+		err := saveState(getConf().StateFile, State{Key: key, Name: myInfo.Name, Mac: myInfo.Mac, MachineID: myInfo.MachineID})
+		if err != nil {
+			logWarnf("Failed to save state to %s, %v\n", getConf().StateFile, err)
+		}
+	}
+
+	return nil
+}
+
+func register(ctx context.Context, path string, reqBody map[string]interface{}, clientObj *http.Client) (*http.Response, error) {
+	// register with the server and obtain key required for any other API call
+	requestJson, _ := json.Marshal(reqBody)
+	return endpoints.Post(ctx, clientObj, path, requestJson)
+}
+
+func sendInventory(ctx context.Context, inv Inventory, clientObj *http.Client) error {
+	// send the inventory to the backend, which keeps a history of its changes
+	reqBody := map[string]interface{}{"key": getKey(), "inventory": inv}
+	requestJson, _ := json.Marshal(reqBody)
+	resp, err := endpoints.Post(ctx, clientObj, "/inventory", requestJson)
 	if err != nil {
-		log.Println(err)
+		return err
 	}
 
-	// process register response
-	err = processRegisterResponse(resp)
+	err = processDataResponse(resp)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 
-	// no point in continuing if the key was not obtained, registration should probably be attempted again
-	if myInfo.Key == "" {
-		log.Fatalf("I don't have a key, exiting ...")
+	logInfof("Sent updated inventory to %s\n", endpoints.Current())
+	lastInventory = inv
+	return nil
+}
+
+func sendCheckResults(ctx context.Context, results []CheckResult, clientObj *http.Client) error {
+	// send check results to the backend
+	reqBody := map[string]interface{}{"key": getKey(), "results": results}
+	requestJson, _ := json.Marshal(reqBody)
+	resp, err := endpoints.Post(ctx, clientObj, "/check-results", requestJson)
+	if err != nil {
+		return err
 	}
 
-	// start checkin goroutine
-	for {
-		resp, err = checkin(serverURL+"/checkin", client)
-		if err != nil {
-			log.Println(err)
+	return processDataResponse(resp)
+}
+
+func sendSamples(ctx context.Context, samples []Sample, clientObj *http.Client) error {
+	// send samples to the data endpoint of the backend, keeping them in the buffer if the backend cannot take them now
+	// while the buffer holds older samples, new ones are queued behind them so the backend receives them in order
+	if buffer == nil {
+		_, err := postSamples(ctx, samples, false, clientObj)
+		return err
+	}
+
+	if buffer.Len() == 0 {
+		retry, err := postSamples(ctx, samples, false, clientObj)
+		if shouldBuffer(err) {
+			logWarnf("Keeping %d samples to send later, %v\n", len(samples), err)
+			retry = samples
+		}
+		if len(retry) > 0 {
+			pushErr := buffer.Push(retry)
+			if pushErr != nil {
+				log.Println(pushErr)
+			}
+		}
+		return err
+	}
+
+	err := buffer.Push(samples)
+	if err != nil {
+		log.Println(err)
+	}
+
+	// samples the backend asks to resend are queued again once the replay is over, the buffer is busy until then
+	var retry []Sample
+	err = buffer.Replay(ctx, func(ctx context.Context, samples []Sample) error {
+		r, err := postSamples(ctx, samples, true, clientObj)
+		retry = append(retry, r...)
+		return err
+	})
+	if len(retry) > 0 {
+		pushErr := buffer.Push(retry)
+		if pushErr != nil {
+			log.Println(pushErr)
 		}
+	}
+	return err
+}
 
-		err = processCheckinResponse(resp)
+func postSamples(ctx context.Context, samples []Sample, replay bool, clientObj *http.Client) ([]Sample, error) {
+	// send samples once, replayed samples are tagged so the backend accepts their older timestamps
+	// return the samples the backend did not accept but asked to send again
+	var body []byte
+	if grpcBackend != nil {
+		var err error
+		body, err = grpcBackend.SendData(ctx, samples, replay)
 		if err != nil {
-			log.Println(err)
+			return nil, fmt.Errorf("%w, %v", errBackendUnavailable, err)
+		}
+	} else {
+		reqBody := map[string]interface{}{"key": getKey(), "samples": samples, "replay": replay}
+		requestJson, _ := json.Marshal(reqBody)
+		requestJson, contentEncoding, err := compressBody(requestJson, getConf().Compression)
+		if err != nil {
+			return nil, err
 		}
-		time.Sleep(10 * time.Second)
+		resp, err := endpoints.PostEncoded(ctx, clientObj, "/data", requestJson, contentEncoding)
+		if err != nil {
+			return nil, fmt.Errorf("%w, %v", errBackendUnavailable, err)
+		}
+		defer resp.Body.Close()
+		body, err = ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return nil, fmt.Errorf("%w, %v", errBackendUnavailable, err)
+		}
+	}
+
+	return parseSamplesResponse(body, samples)
+}
 
+func parseSamplesResponse(body []byte, samples []Sample) ([]Sample, error) {
+	// parse the response to samples, the backend may accept only some of them and list the others by index
+	err := parseDataResponse(body)
+	if err != nil {
+		return nil, err
+	}
+
+	var resp struct {
+		Accepted int `json:"accepted"`
+		Rejected []struct {
+			Index int `json:"index"`
+			Code  int `json:"code"`
+		} `json:"rejected"`
 	}
+	json.Unmarshal(body, &resp)
 
+	var retry []Sample
+	dropped := 0
+	for _, r := range resp.Rejected {
+		if r.Index < 0 || r.Index >= len(samples) {
+			continue
+		}
+		if r.Code == 3004 || r.Code == 3005 {
+			retry = append(retry, samples[r.Index])
+		} else {
+			dropped++
+		}
+	}
+	if dropped > 0 {
+		logWarnf("Backend rejected %d of %d samples\n", dropped, len(samples))
+	}
+
+	logDebugf("Backend accepted %d of %d samples\n", resp.Accepted, len(samples))
+	return retry, nil
 }
 
-func register(url string, reqBody map[string]interface{}, clientObj *http.Client) (*http.Response, error) {
-	// register with the server and obtain key required for any other API call
+func sendEvents(ctx context.Context, events []Event, clientObj *http.Client) error {
+	// send events to the backend as soon as they are produced, keeping them in the buffer if the backend cannot take them now
+	// like samples, new events are queued behind older ones so the backend receives them in order
+	if eventBuffer == nil {
+		return postEvents(ctx, events, clientObj)
+	}
+
+	if eventBuffer.Len() == 0 {
+		err := postEvents(ctx, events, clientObj)
+		if shouldBuffer(err) {
+			logWarnf("Keeping %d events to send later, %v\n", len(events), err)
+			pushErr := eventBuffer.Push(events)
+			if pushErr != nil {
+				log.Println(pushErr)
+			}
+		}
+		return err
+	}
+
+	err := eventBuffer.Push(events)
+	if err != nil {
+		log.Println(err)
+	}
+	return eventBuffer.Replay(ctx, func(ctx context.Context, events []Event) error {
+		return postEvents(ctx, events, clientObj)
+	})
+}
+
+func postEvents(ctx context.Context, events []Event, clientObj *http.Client) error {
+	// send events once
+	reqBody := map[string]interface{}{"key": getKey(), "events": events}
 	requestJson, _ := json.Marshal(reqBody)
-	request, _ := http.NewRequest("POST", url, bytes.NewBuffer(requestJson))
-	request.Header.Set("Content-type", "application/json")
+	resp, err := endpoints.Post(ctx, clientObj, "/events", requestJson)
+	if err != nil {
+		return fmt.Errorf("%w, %v", errBackendUnavailable, err)
+	}
 
-	resp, err := clientObj.Do(request)
+	err = processDataResponse(resp)
 	if err != nil {
-		log.Fatalln(err)
+		return err
 	}
-	// defer resp.Body.Close()
-	return resp, err
+
+	logInfof("Sent %d events to %s\n", len(events), endpoints.Current())
+	return nil
 }
 
-func checkin(url string, clientObj *http.Client) (*http.Response, error) {
+func checkin(ctx context.Context, path string, clientObj *http.Client) (*http.Response, error) {
 	// check in with the backend
-	// only parameter required is the key obtained during registration
-	reqBody := map[string]string{"key": myInfo.Key}
+	// only parameter required is the key obtained during registration, it is the same for every endpoint sharing a device store
+	reqBody := map[string]string{"key": getKey()}
 	requestJson, _ := json.Marshal(reqBody)
-	request, _ := http.NewRequest("POST", url, bytes.NewBuffer(requestJson))
-	request.Header.Set("Content-type", "application/json")
+	return endpoints.Post(ctx, clientObj, path, requestJson)
+}
 
-	resp, err := clientObj.Do(request)
-	if err != nil {
-		log.Fatalln(err)
+func checkoutFromBackend(clientObj *http.Client) error {
+	// check out from the backend, the context of the device is already done by the time this runs
+	ctx, cancel := context.WithTimeout(context.Background(), getConf().ClientTimeout.Duration)
+	defer cancel()
+
+	var body []byte
+	if grpcBackend != nil {
+		var err error
+		body, err = grpcBackend.Checkout(ctx)
+		if err != nil {
+			return err
+		}
+	} else {
+		requestJson, _ := json.Marshal(map[string]string{"key": getKey()})
+		resp, err := endpoints.Post(ctx, clientObj, "/checkout", requestJson)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		body, err = ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return err
+		}
+	}
+
+	var respMap map[string]interface{}
+	err := json.Unmarshal(body, &respMap)
+	if err != nil || respMap["code"] == nil {
+		return fmt.Errorf("checkoutFromBackend did not receive a code")
 	}
-	// defer resp.Body.Close()
-	return resp, err
+	if code := int(respMap["code"].(float64)); code != 2002 {
+		return fmt.Errorf("checkoutFromBackend received code %d, %v", code, respMap["comment"])
+	}
+
+	logInfof("Checked out from the backend\n")
+	return nil
+}
+
+func getKey() string {
+	myInfoMutex.RLock()
+	defer myInfoMutex.RUnlock()
+	return myInfo.Key
+}
+
+func setKey(key string) {
+	myInfoMutex.Lock()
+	defer myInfoMutex.Unlock()
+	myInfo.Key = key
+}
+
+func getConf() Config {
+	// copy of the effective configuration, jobs use the one they got even if it is replaced meanwhile
+	confMutex.RLock()
+	defer confMutex.RUnlock()
+	return conf
+}
+
+func setConf(newConf Config) {
+	confMutex.Lock()
+	defer confMutex.Unlock()
+	conf = newConf
 }
 
 ///////////////////////
 // helper functions
-func getMyInfo() Device {
-	// collect device name and mac address
+func getMyInfo(ifaceName string) (Device, error) {
+	// collect device name, machine identifier and physical interfaces
+	// the primary MAC address is taken from ifaceName if provided, otherwise from the first physical interface
 	tmpDevice := Device{}
 	name, err := os.Hostname()
 	if err != nil {
-		log.Panic(err)
+		return tmpDevice, err
 	}
 
-	ifas, err := net.Interfaces()
-	tmpMac := ""
+	ifas, err := getPhysicalInterfaces()
 	if err != nil {
-		log.Panic(err)
+		return tmpDevice, err
 	}
+
+	tmpMac := ""
 	for _, ifa := range ifas {
-		tmpMac = ifa.HardwareAddr.String()
-		if tmpMac != "" {
+		if ifaceName == "" || ifa.Name == ifaceName {
+			tmpMac = ifa.Mac
 			break
 		}
 	}
+	if tmpMac == "" && ifaceName != "" {
+		// the configured interface may be virtual, it was asked for explicitly so use it anyway
+		ifa, err := net.InterfaceByName(ifaceName)
+		if err != nil || ifa.HardwareAddr.String() == "" {
+			return tmpDevice, fmt.Errorf("interface %s not found or has no MAC address", ifaceName)
+		}
+		tmpMac = ifa.HardwareAddr.String()
+	}
 
-	tmpDevice.Mac = tmpMac // just take the MAC address of the first interface in the list
+	tmpDevice.Mac = tmpMac
 	tmpDevice.Name = name
-	return tmpDevice
+	tmpDevice.MachineID = getMachineID()
+	tmpDevice.Interfaces = ifas
+	if tmpDevice.Mac == "" && tmpDevice.MachineID == "" {
+		return tmpDevice, fmt.Errorf("no physical interface with a MAC address and no machine identifier found")
+	}
+	return tmpDevice, nil
 }
 
 func processRegisterResponse(resp *http.Response) error {
+	defer resp.Body.Close()
 
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		log.Println("processRegisterResponse failed to process response")
 		return err
 	}
-	log.Println("Response body: " + string(body))
+	logDebugf("Response body: %s\n", string(body))
+
+	return parseRegisterResponse(body)
+}
 
+func parseRegisterResponse(body []byte) error {
+	// parse a register response, keeping the key it carries
 	var respMap map[string]interface{}
-	err = json.Unmarshal([]byte(body), &respMap)
+	json.Unmarshal(body, &respMap)
 
 	// check the code received in the response
 	if respMap["code"] == nil {
@@ -148,9 +601,13 @@ func processRegisterResponse(resp *http.Response) error {
 	}
 
 	code := int(respMap["code"].(float64))
-	if code == 100 {
-		myInfo.Key = respMap["key"].(string)
-	} else if code == 101 {
+	if code == 1000 {
+		setKey(respMap["key"].(string))
+	} else if code == 1001 {
+		// already registered, keep using the key we have, if we have one
+		if getKey() == "" {
+			return errAlreadyRegistered
+		}
 	} else {
 		log.Printf("processRegisterResponse does not know about this response code, %d\n", respMap["code"])
 		return fmt.Errorf("processRegisterResponse does not know about this response code, %d\n", respMap["code"])
@@ -159,24 +616,87 @@ func processRegisterResponse(resp *http.Response) error {
 	return nil // everything went well
 }
 
-func processCheckinResponse(resp *http.Response) error {
+func processCheckinResponse(resp *http.Response) (string, []Command, error) {
+	// process a check-in response, returning the configuration version the backend has for the device
+	// and the commands it queued for it
+	defer resp.Body.Close()
 
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		log.Println("processCheckinResponse failed to process response")
-		return err
+		return "", nil, err
 	}
-	log.Println("Response body: " + string(body))
+	logDebugf("Response body: %s\n", string(body))
 
+	return parseCheckinResponse(body)
+}
+
+func parseCheckinResponse(body []byte) (string, []Command, error) {
+	// parse a check-in response, sessions push the same messages
 	var respMap map[string]interface{}
-	err = json.Unmarshal([]byte(body), &respMap)
+	err := json.Unmarshal(body, &respMap)
 
 	// check the code received in the response
+	if respMap["code"] == nil {
+		return "", nil, fmt.Errorf("parseCheckinResponse did not receive a code\n")
+	}
+
+	code := int(respMap["code"].(float64))
+	if code == 2000 {
+	} else if code == 3001 {
+		return "", nil, errBadKey
+	} else {
+		log.Printf("parseCheckinResponse does not know about this response code, %d\n", respMap["code"])
+		return "", nil, fmt.Errorf("parseCheckinResponse does not know about this response code, %d\n", respMap["code"])
+	}
+
+	configVersion, _ := respMap["config_version"].(string)
+
+	var commands []Command
+	if respMap["commands"] != nil {
+		var cmdResp struct {
+			Commands []Command `json:"commands"`
+		}
+		err = json.Unmarshal(body, &cmdResp)
+		if err != nil {
+			return configVersion, nil, err
+		}
+		commands = cmdResp.Commands
+	}
+	return configVersion, commands, nil
+}
+
+func processDataResponse(resp *http.Response) error {
+	// process the response to data sent to the backend
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		log.Println("processDataResponse failed to process response")
+		return err
+	}
+	logDebugf("Response body: %s\n", string(body))
+
+	return parseDataResponse(body)
+}
+
+func parseDataResponse(body []byte) error {
+	// parse the response to data sent to the backend
+	var respMap map[string]interface{}
+	err := json.Unmarshal(body, &respMap)
+	if err != nil || respMap["code"] == nil {
+		return fmt.Errorf("parseDataResponse did not receive a code\n")
+	}
+
 	code := int(respMap["code"].(float64))
-	if code == 200 {
+	if code == 3000 {
+	} else if code == 3001 {
+		return errBadKey
+	} else if code == 3004 || code == 3005 {
+		// the backend is busy, Wait and WaitAndResend
+		return fmt.Errorf("%w, code %d", errBackendUnavailable, code)
 	} else {
-		log.Printf("processCheckinResponse does not know about this response code, %d\n", respMap["code"])
-		return fmt.Errorf("processCheckinResponse does not know about this response code, %d\n", respMap["code"])
+		return fmt.Errorf("parseDataResponse received code %d, %v\n", code, respMap["comment"])
 	}
 
 	return nil
@@ -0,0 +1,620 @@
+// tests of the node reporter, run without a backend
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func Test_newEndpointList(t *testing.T) {
+	defer func(old func(string, string, string) (string, []*net.SRV, error)) { lookupSRV = old }(lookupSRV)
+	lookupSRV = func(service, proto, name string) (string, []*net.SRV, error) {
+		// already sorted by priority and weight, as net.LookupSRV returns them
+		return "", []*net.SRV{
+			{Target: "backend-1.example.com.", Port: 8000, Priority: 10},
+			{Target: "backend-2.example.com.", Port: 8001, Priority: 20},
+		}, nil
+	}
+
+	for _, tt := range []struct {
+		name    string
+		urls    []string
+		srvName string
+		want    []string
+	}{
+		{"Configured", []string{"http://a:8000/", " http://b:8000 ", ""}, "", []string{"http://a:8000", "http://b:8000"}},
+		{"SRV", []string{"http://ignored:8000"}, "_remotemonitor._tcp.example.com", []string{"http://backend-1.example.com:8000", "http://backend-2.example.com:8001"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			e, err := newEndpointList(tt.urls, tt.srvName, time.Minute)
+			if err != nil {
+				t.Fatalf("Got %v, want no error", err)
+			}
+			if strings.Join(e.urls, ",") != strings.Join(tt.want, ",") || e.Current() != tt.want[0] {
+				t.Errorf("Got %v, want %v", e.urls, tt.want)
+			}
+		})
+	}
+
+	t.Run("Empty", func(t *testing.T) {
+		if _, err := newEndpointList([]string{" ", ""}, "", time.Minute); err == nil {
+			t.Errorf("Got nil, want an error")
+		}
+	})
+}
+
+func Test_endpointFailover(t *testing.T) {
+	// the primary fails until it is marked healthy, the secondary always answers
+	primaryHealthy := false
+	var primaryCalls, secondaryCalls int
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		primaryCalls++
+		if !primaryHealthy {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer primary.Close()
+	secondary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		secondaryCalls++
+	}))
+	defer secondary.Close()
+
+	e, err := newEndpointList([]string{primary.URL, secondary.URL}, "", time.Hour)
+	if err != nil {
+		t.Fatalf("Got %v, want no error", err)
+	}
+	post := func() error {
+		resp, err := e.Post(context.Background(), http.DefaultClient, "/checkin", []byte("{}"))
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+
+	t.Run("Failover", func(t *testing.T) {
+		if err := post(); err != nil || e.Current() != secondary.URL {
+			t.Errorf("Got %v on %v, want %v", err, e.Current(), secondary.URL)
+		}
+	})
+
+	t.Run("Sticky", func(t *testing.T) {
+		// the primary is not probed again before probeInterval
+		calls := primaryCalls
+		if err := post(); err != nil || primaryCalls != calls || e.Current() != secondary.URL {
+			t.Errorf("Got %v primary calls, want %v", primaryCalls, calls)
+		}
+	})
+
+	t.Run("StillUnhealthy", func(t *testing.T) {
+		e.probeInterval = 0
+		calls := secondaryCalls
+		if err := post(); err != nil || e.Current() != secondary.URL || secondaryCalls != calls+1 {
+			t.Errorf("Got %v on %v, want %v", err, e.Current(), secondary.URL)
+		}
+	})
+
+	t.Run("Failback", func(t *testing.T) {
+		primaryHealthy = true
+		calls := secondaryCalls
+		if err := post(); err != nil || e.Current() != primary.URL || secondaryCalls != calls {
+			t.Errorf("Got %v on %v, want %v", err, e.Current(), primary.URL)
+		}
+	})
+
+	t.Run("AllUnhealthy", func(t *testing.T) {
+		primaryHealthy = false
+		secondary.Close()
+		if err := post(); err == nil {
+			t.Errorf("Got nil, want an error")
+		}
+	})
+}
+
+func Test_loadConfig(t *testing.T) {
+	dir := t.TempDir()
+	writeConfig := func(content string) string {
+		path := filepath.Join(dir, "node-reporter.json")
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatalf("Failed to write configuration, %v", err)
+		}
+		return path
+	}
+	for _, name := range []string{"RM_CONFIG", "RM_SERVERS", "RM_CHECKIN_INTERVAL", "RM_COLLECT_INTERVAL", "RM_JITTER"} {
+		t.Setenv(name, "")
+	}
+
+	t.Run("Example", func(t *testing.T) {
+		if _, _, err := loadConfig([]string{"-config", "node-reporter.example.json"}); err != nil {
+			t.Errorf("Got %v, want the example configuration to be valid", err)
+		}
+	})
+
+	t.Run("Precedence", func(t *testing.T) {
+		// defaults < file < environment < flags
+		path := writeConfig(`{"servers": ["http://file:8000"], "checkin_interval": "20s", "collect_interval": "40s", "jitter": "3s"}`)
+		t.Setenv("RM_CHECKIN_INTERVAL", "30s")
+		t.Setenv("RM_JITTER", "4s")
+		conf, _, err := loadConfig([]string{"-config", path, "-checkin-interval", "45s"})
+		if err != nil {
+			t.Fatalf("Got %v, want no error", err)
+		}
+		for _, tt := range []struct {
+			name      string
+			got, want time.Duration
+		}{
+			{"default", conf.ClientTimeout.Duration, 5 * time.Second},
+			{"file", conf.CollectInterval.Duration, 40 * time.Second},
+			{"environment", conf.Jitter.Duration, 4 * time.Second},
+			{"flag", conf.CheckinInterval.Duration, 45 * time.Second},
+		} {
+			if tt.got != tt.want {
+				t.Errorf("Got %v, want %v from the %s", tt.got, tt.want, tt.name)
+			}
+		}
+		if strings.Join(conf.Servers, ",") != "http://file:8000" {
+			t.Errorf("Got %v, want the servers of the file", conf.Servers)
+		}
+	})
+
+	t.Run("UnknownKey", func(t *testing.T) {
+		path := writeConfig(`{"checkin_intervall": "20s"}`)
+		if _, _, err := loadConfig([]string{"-config", path}); err == nil || !strings.Contains(err.Error(), "checkin_intervall") {
+			t.Errorf("Got %v, want an error naming the unknown key", err)
+		}
+	})
+}
+
+func Test_validateConfig(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		change func(conf *Config)
+		valid  bool
+	}{
+		{"Defaults", func(conf *Config) {}, true},
+		{"NoServers", func(conf *Config) { conf.Servers = nil }, false},
+		{"SRVOnly", func(conf *Config) { conf.Servers = nil; conf.SRV = "_rm._tcp.example.com" }, true},
+		{"BadServer", func(conf *Config) { conf.Servers = []string{"ftp://backend"} }, false},
+		{"BadTransport", func(conf *Config) { conf.Transport = "udp" }, false},
+		{"GRPCWithoutServers", func(conf *Config) { conf.Transport = "grpc" }, false},
+		{"ZeroCheckin", func(conf *Config) { conf.CheckinInterval.Duration = 0 }, false},
+		{"JitterTooLong", func(conf *Config) { conf.Jitter = conf.CheckinInterval }, false},
+		{"UnknownCollector", func(conf *Config) { conf.Collectors = []string{"gpu"} }, false},
+		{"WatchesWithoutCollector", func(conf *Config) { conf.ProcessWatches = []ProcessWatch{{Name: "sshd", Process: "sshd"}} }, false},
+		{"BadCompression", func(conf *Config) { conf.Compression = "lz4" }, false},
+		{"BadBufferPolicy", func(conf *Config) { conf.BufferPolicy = "keep_all" }, false},
+		{"NoBuffer", func(conf *Config) { conf.BufferDir = ""; conf.BufferPolicy = "" }, true},
+		{"BadLogLevel", func(conf *Config) { conf.LogLevel = "trace" }, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := defaultConfig()
+			tt.change(&conf)
+			if err := validateConfig(conf); (err == nil) != tt.valid {
+				t.Errorf("Got %v, want valid %v", err, tt.valid)
+			}
+		})
+	}
+}
+
+func Test_parseRegisterResponse(t *testing.T) {
+	defer setKey(getKey())
+
+	t.Run("Registered", func(t *testing.T) {
+		setKey("")
+		err := parseRegisterResponse([]byte(`{"code": 1000, "key": "abc"}`))
+		if err != nil || getKey() != "abc" {
+			t.Errorf("Got %v %q, want nil %q", err, getKey(), "abc")
+		}
+	})
+
+	t.Run("AlreadyRegisteredWithKey", func(t *testing.T) {
+		setKey("abc")
+		err := parseRegisterResponse([]byte(`{"code": 1001}`))
+		if err != nil || getKey() != "abc" {
+			t.Errorf("Got %v %q, want nil %q", err, getKey(), "abc")
+		}
+	})
+
+	t.Run("AlreadyRegisteredWithoutKey", func(t *testing.T) {
+		setKey("")
+		err := parseRegisterResponse([]byte(`{"code": 1001}`))
+		if err != errAlreadyRegistered {
+			t.Errorf("Got %v, want %v", err, errAlreadyRegistered)
+		}
+	})
+}
+
+func Test_diskIOCollector(t *testing.T) {
+	dir := t.TempDir()
+	diskstats := filepath.Join(dir, "diskstats")
+	ioutil.WriteFile(diskstats, []byte(`   8       0 sda 100 0 2000 50 200 0 4000 80 0 120 130 0 0 0 0
+   8       1 sda1 60 0 1200 30 150 0 3000 60 0 90 90 0 0 0 0
+   7       0 loop0 10 0 20 1 0 0 0 0 0 1 1 0 0 0 0
+`), 0644)
+	os.MkdirAll(filepath.Join(dir, "block", "sda"), 0755)
+	os.MkdirAll(filepath.Join(dir, "block", "sda1"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "block", "sda1", "partition"), []byte("1\n"), 0644)
+
+	c := &diskIOCollector{diskstatsFile: diskstats, sysBlockDir: filepath.Join(dir, "block")}
+	samples, err := c.Collect()
+	if err != nil {
+		t.Fatalf("Collect failed, %v", err)
+	}
+	if len(samples) != 5 {
+		t.Fatalf("Got %v samples, want %v", len(samples), 5)
+	}
+	for _, sample := range samples {
+		if sample.Labels["device"] != "sda" {
+			t.Errorf("Got %v, want only sda", sample.Labels["device"])
+		}
+	}
+}
+
+func Test_sendEvents(t *testing.T) {
+	// the backend is busy for the first request, events it could not take are sent with the next ones, in order
+	busy := true
+	var received []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Events []Event `json:"events"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		if busy {
+			w.Write([]byte(`{"code": 3004}`))
+			return
+		}
+		for _, event := range req.Events {
+			received = append(received, event.Message)
+		}
+		w.Write([]byte(`{"code": 3000}`))
+	}))
+	defer server.Close()
+
+	defer func(oldEndpoints *endpointList, oldBuffer *Buffer[Event]) {
+		endpoints, eventBuffer = oldEndpoints, oldBuffer
+	}(endpoints, eventBuffer)
+	var err error
+	endpoints, err = newEndpointList([]string{server.URL}, "", time.Hour)
+	if err != nil {
+		t.Fatalf("Got %v, want no error", err)
+	}
+	eventBuffer, err = openBuffer[Event]("events", t.TempDir(), 1<<20, "drop_oldest")
+	if err != nil {
+		t.Fatalf("Got %v, want no error", err)
+	}
+
+	err = sendEvents(context.Background(), []Event{{Type: "process_disappeared", Message: "first"}}, http.DefaultClient)
+	if !shouldBuffer(err) || eventBuffer.Len() != 1 {
+		t.Fatalf("Got %v and %d entries, want a busy backend and 1 entry", err, eventBuffer.Len())
+	}
+
+	busy = false
+	err = sendEvents(context.Background(), []Event{{Type: "process_restarted", Message: "second"}}, http.DefaultClient)
+	if err != nil || eventBuffer.Len() != 0 {
+		t.Fatalf("Got %v and %d entries, want no error and an empty buffer", err, eventBuffer.Len())
+	}
+	if strings.Join(received, ",") != "first,second" {
+		t.Errorf("Got %v, want %v", received, "first,second")
+	}
+}
+
+func Test_openBuffers(t *testing.T) {
+	// a regular file cannot hold a buffer directory, whoever runs the test
+	blocked := filepath.Join(t.TempDir(), "file")
+	err := ioutil.WriteFile(blocked, nil, 0600)
+	if err != nil {
+		t.Fatalf("Failed to create file, %v", err)
+	}
+
+	t.Run("Configured directory", func(t *testing.T) {
+		dir := t.TempDir()
+		samples, events := openBuffers(dir, 1<<20, "drop_oldest")
+		if samples == nil || events == nil || samples.dir != dir {
+			t.Errorf("Got %v, want buffers in %s", samples, dir)
+		}
+	})
+
+	t.Run("User cache directory", func(t *testing.T) {
+		cacheDir := t.TempDir()
+		t.Setenv("XDG_CACHE_HOME", cacheDir)
+		samples, events := openBuffers(filepath.Join(blocked, "buffer"), 1<<20, "drop_oldest")
+		want := filepath.Join(cacheDir, "remotemonitor", "buffer")
+		if samples == nil || events == nil || samples.dir != want {
+			t.Errorf("Got %v, want buffers in %s", samples, want)
+		}
+	})
+
+	t.Run("No usable directory", func(t *testing.T) {
+		t.Setenv("XDG_CACHE_HOME", blocked)
+		samples, events := openBuffers(filepath.Join(blocked, "buffer"), 1<<20, "drop_oldest")
+		if samples != nil || events != nil {
+			t.Errorf("Got %v %v, want no buffers", samples, events)
+		}
+	})
+}
+
+func Test_parseProcStat(t *testing.T) {
+	// the process name may contain spaces and parentheses
+	stat := "1234 (my (odd) proc) S 1 1234 1234 0 -1 4194560 100 0 0 0 150 50 0 0 20 0 1 0 100 1000000 250 18446744073709551615"
+	p, err := parseProcStat(stat, 4096)
+	if err != nil {
+		t.Fatalf("Got %v, want no error", err)
+	}
+	if p.comm != "my (odd) proc" || p.cpuTicks != 200 || p.rssBytes != 250*4096 {
+		t.Errorf("Got %+v, want my (odd) proc, 200 ticks and %d bytes", p, 250*4096)
+	}
+
+	if _, err := parseProcStat("1234 no parentheses", 4096); err == nil {
+		t.Errorf("Got nil, want an error")
+	}
+}
+
+func Test_validateProcessWatches(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		watches []ProcessWatch
+		valid   bool
+	}{
+		{"Valid", []ProcessWatch{{Name: "nginx", Process: "nginx"}, {Name: "app", Cmdline: "^java .*app.jar"}}, true},
+		{"NoName", []ProcessWatch{{Process: "nginx"}}, false},
+		{"Duplicate", []ProcessWatch{{Name: "nginx", Process: "nginx"}, {Name: "nginx", Process: "nginx"}}, false},
+		{"NoMatcher", []ProcessWatch{{Name: "nginx"}}, false},
+		{"BadRegexp", []ProcessWatch{{Name: "app", Cmdline: "("}}, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateProcessWatches(tt.watches)
+			if (err == nil) != tt.valid {
+				t.Errorf("Got %v, want valid %v", err, tt.valid)
+			}
+		})
+	}
+}
+
+func Test_processCollector(t *testing.T) {
+	procDir := t.TempDir()
+	writeProcess := func(pid int, comm string) {
+		dir := filepath.Join(procDir, strconv.Itoa(pid))
+		os.MkdirAll(dir, 0755)
+		stat := fmt.Sprintf("%d (%s) S 1 1 1 0 -1 0 0 0 0 0 10 10 0 0 20 0 1 0 100 1000 50 0", pid, comm)
+		ioutil.WriteFile(filepath.Join(dir, "stat"), []byte(stat), 0644)
+		ioutil.WriteFile(filepath.Join(dir, "cmdline"), []byte("/usr/sbin/"+comm+"\x00-g\x00daemon off;"), 0644)
+	}
+	value := func(samples []Sample, name string) float64 {
+		for _, sample := range samples {
+			if sample.Name == name {
+				return sample.Value
+			}
+		}
+		return -1
+	}
+
+	c := newProcessCollector([]ProcessWatch{{Name: "nginx", Process: "nginx", Cmdline: "daemon off"}})
+	c.procDir = procDir
+	writeProcess(100, "nginx")
+	writeProcess(200, "sshd")
+
+	t.Run("Running", func(t *testing.T) {
+		samples, err := c.Collect()
+		if err != nil {
+			t.Fatalf("Got %v, want no error", err)
+		}
+		if value(samples, "process_up") != 1 || value(samples, "process_count") != 1 || len(c.Events()) != 0 {
+			t.Errorf("Got %v, want a single process and no events", samples)
+		}
+	})
+
+	t.Run("Restarted", func(t *testing.T) {
+		os.RemoveAll(filepath.Join(procDir, "100"))
+		writeProcess(101, "nginx")
+		samples, _ := c.Collect()
+		events := c.Events()
+		if len(events) != 1 || events[0].Type != "process_restarted" {
+			t.Errorf("Got %v, want a process_restarted event", events)
+		}
+		if value(samples, "process_restarts_total") != 1 {
+			t.Errorf("Got %v, want %v", value(samples, "process_restarts_total"), 1)
+		}
+	})
+
+	t.Run("Disappeared", func(t *testing.T) {
+		os.RemoveAll(filepath.Join(procDir, "101"))
+		samples, _ := c.Collect()
+		events := c.Events()
+		if len(events) != 1 || events[0].Type != "process_disappeared" {
+			t.Errorf("Got %v, want a process_disappeared event", events)
+		}
+		if value(samples, "process_up") != 0 {
+			t.Errorf("Got %v, want %v", value(samples, "process_up"), 0)
+		}
+	})
+}
+
+func Test_Scheduler(t *testing.T) {
+	stats := func(s *Scheduler, name string) jobState {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		return *s.jobs[name]
+	}
+
+	t.Run("Invalid", func(t *testing.T) {
+		s := newScheduler(0)
+		if err := s.Add(Job{Name: "job", Interval: 0}); err == nil {
+			t.Errorf("Got nil, want an error for a zero interval")
+		}
+		if err := s.Add(Job{Name: "job", Interval: time.Second, Timeout: -time.Second}); err == nil {
+			t.Errorf("Got nil, want an error for a negative timeout")
+		}
+		s.Add(Job{Name: "job", Interval: time.Second})
+		if err := s.Add(Job{Name: "job", Interval: time.Second}); err == nil {
+			t.Errorf("Got nil, want an error for a duplicate job")
+		}
+	})
+
+	t.Run("Timeout", func(t *testing.T) {
+		// the timeout is kept even when it is longer than the interval, and defaults to the interval
+		s := newScheduler(0)
+		s.Add(Job{Name: "long", Interval: time.Second, Timeout: 3 * time.Second})
+		s.Add(Job{Name: "default", Interval: time.Second})
+		if got := stats(s, "long").job.Timeout; got != 3*time.Second {
+			t.Errorf("Got %v, want %v", got, 3*time.Second)
+		}
+		if got := stats(s, "default").job.Timeout; got != time.Second {
+			t.Errorf("Got %v, want %v", got, time.Second)
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		deadlines := make(chan time.Duration, 1)
+		s = newScheduler(0)
+		s.Add(Job{Name: "job", Interval: time.Hour, Timeout: 2 * time.Hour, Run: func(ctx context.Context) error {
+			deadline, _ := ctx.Deadline()
+			deadlines <- time.Until(deadline)
+			return nil
+		}})
+		s.Start(ctx)
+		if got := <-deadlines; got <= time.Hour {
+			t.Errorf("Got %v, want more than an hour", got)
+		}
+	})
+
+	t.Run("Overlap", func(t *testing.T) {
+		// a run that takes several intervals makes the runs due meanwhile skipped, never concurrent
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		s := newScheduler(0)
+		release := make(chan struct{})
+		var mutex sync.Mutex
+		running, maxRunning := 0, 0
+		s.Add(Job{Name: "slow", Interval: 10 * time.Millisecond, Timeout: time.Second, Run: func(ctx context.Context) error {
+			mutex.Lock()
+			running++
+			if running > maxRunning {
+				maxRunning = running
+			}
+			mutex.Unlock()
+			<-release
+			mutex.Lock()
+			running--
+			mutex.Unlock()
+			return nil
+		}})
+		s.Start(ctx)
+		time.Sleep(55 * time.Millisecond)
+		close(release)
+		cancel()
+		s.Wait(time.Second)
+
+		state := stats(s, "slow")
+		if maxRunning != 1 || state.runs != 1 || state.skipped < 3 {
+			t.Errorf("Got %d concurrent, %d runs and %d skipped, want 1 concurrent, 1 run and some skipped", maxRunning, state.runs, state.skipped)
+		}
+	})
+
+	t.Run("Jitter", func(t *testing.T) {
+		s := newScheduler(50 * time.Millisecond)
+		for i := 0; i < 100; i++ {
+			if j := s.randomJitter(); j < 0 || j >= 50*time.Millisecond {
+				t.Fatalf("Got %v, want a jitter in [0, 50ms)", j)
+			}
+		}
+		if j := newScheduler(0).randomJitter(); j != 0 {
+			t.Errorf("Got %v, want no jitter", j)
+		}
+
+		// the first run is delayed by at most the jitter
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		started := make(chan time.Time, 1)
+		s.Add(Job{Name: "job", Interval: time.Hour, Run: func(ctx context.Context) error {
+			started <- time.Now()
+			return nil
+		}})
+		start := time.Now()
+		s.Start(ctx)
+		select {
+		case at := <-started:
+			if at.Sub(start) >= 50*time.Millisecond+20*time.Millisecond {
+				t.Errorf("Got a first run after %v, want at most the jitter", at.Sub(start))
+			}
+		case <-time.After(time.Second):
+			t.Errorf("Job did not run")
+		}
+	})
+
+	t.Run("Replace", func(t *testing.T) {
+		// the old definition stops running, the new one takes its place and keeps its position
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		s := newScheduler(0)
+		runs := make(chan string, 100)
+		s.Add(Job{Name: "first", Interval: time.Hour, Run: func(ctx context.Context) error { return nil }})
+		s.Add(Job{Name: "job", Interval: 10 * time.Millisecond, Run: func(ctx context.Context) error {
+			runs <- "old"
+			return nil
+		}})
+		s.Start(ctx)
+		<-runs
+
+		err := s.Replace(Job{Name: "job", Interval: 10 * time.Millisecond, Run: func(ctx context.Context) error {
+			runs <- "new"
+			return nil
+		}})
+		if err != nil {
+			t.Fatalf("Got %v, want no error", err)
+		}
+		// an old run may have been started right before the replacement and finish after the first new one
+		deadline := time.After(time.Second)
+		for newRuns := 0; newRuns < 3; {
+			select {
+			case run := <-runs:
+				if run == "new" {
+					newRuns++
+				} else if newRuns > 1 {
+					t.Fatalf("Got a run of the old definition after the new one started")
+				}
+			case <-deadline:
+				t.Fatalf("New definition did not run")
+			}
+		}
+		if names := s.Names(); strings.Join(names, ",") != "first,job" {
+			t.Errorf("Got %v, want %v", names, "first,job")
+		}
+	})
+}
+
+func Test_mergeRemoteConfig(t *testing.T) {
+	base := defaultConfig()
+	check := CheckDefinition{Name: "load", Command: []string{"/usr/lib/nagios/plugins/check_load", "-w", "5", "-c", "10"},
+		Interval: Duration{time.Minute}, Timeout: Duration{10 * time.Second}}
+
+	t.Run("NotAllowed", func(t *testing.T) {
+		_, err := mergeRemoteConfig(base, RemoteConfig{Checks: []CheckDefinition{check}})
+		if err == nil {
+			t.Errorf("Got nil, want an error for a command outside remote_check_commands")
+		}
+	})
+
+	t.Run("Allowed", func(t *testing.T) {
+		allowed := base
+		allowed.RemoteCheckCommands = []string{"/usr/lib/nagios/plugins/check_load"}
+		got, err := mergeRemoteConfig(allowed, RemoteConfig{CheckinInterval: "30s", Checks: []CheckDefinition{check}})
+		if err != nil {
+			t.Fatalf("Got %v, want no error", err)
+		}
+		if got.CheckinInterval.Duration != 30*time.Second || len(got.Checks) != len(base.Checks)+1 {
+			t.Errorf("Got %v and %d checks, want 30s and %d checks", got.CheckinInterval.Duration, len(got.Checks), len(base.Checks)+1)
+		}
+	})
+}
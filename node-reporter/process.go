@@ -0,0 +1,283 @@
+// process watcher, scans /proc for configured processes and reports whether they are running
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ProcessWatch describes a process to watch, at least one of Process, Cmdline or PIDFile has to be set
+type ProcessWatch struct {
+	Name    string `json:"name"`    // name the watch is reported as
+	Process string `json:"process"` // exact process name, as found in /proc/<pid>/comm
+	Cmdline string `json:"cmdline"` // regular expression matched against the full command line
+	PIDFile string `json:"pidfile"` // file containing the PID of the process
+}
+
+// Event is something that happened on the device, sent to the backend as it happens
+type Event struct {
+	Type      string            `json:"type"`             // event type, e.g. process_disappeared
+	Labels    map[string]string `json:"labels,omitempty"` // labels identifying what the event is about
+	Message   string            `json:"message"`          // human readable description
+	Timestamp time.Time         `json:"timestamp"`        // when the event happened
+}
+
+// EventSource is implemented by collectors that also produce events
+type EventSource interface {
+	Events() []Event
+}
+
+// clock ticks per second used in /proc/<pid>/stat, USER_HZ is 100 on every mainstream Linux architecture
+const clockTicks = 100
+
+// processInfo is what is read from /proc for a single process
+type processInfo struct {
+	pid      int
+	comm     string
+	cmdline  string
+	cpuTicks uint64 // user + system time, in clock ticks
+	rssBytes uint64
+}
+
+type processCollector struct {
+	procDir   string
+	watches   []ProcessWatch
+	cmdlineRe []*regexp.Regexp
+	lastPIDs  map[string][]int  // PIDs found by each watch in the previous scan
+	lastTicks map[int]uint64    // CPU ticks of each process in the previous scan
+	lastScan  time.Time         // time of the previous scan
+	restarts  map[string]uint64 // PID changes seen for each watch since startup
+	events    []Event           // events not yet collected with Events
+}
+
+func newProcessCollector(watches []ProcessWatch) *processCollector {
+	// regular expressions have already been checked when the configuration was validated
+	c := &processCollector{
+		procDir:   "/proc",
+		watches:   watches,
+		lastPIDs:  make(map[string][]int),
+		lastTicks: make(map[int]uint64),
+		restarts:  make(map[string]uint64),
+	}
+	for _, w := range watches {
+		var re *regexp.Regexp
+		if w.Cmdline != "" {
+			re = regexp.MustCompile(w.Cmdline)
+		}
+		c.cmdlineRe = append(c.cmdlineRe, re)
+	}
+	return c
+}
+
+func validateProcessWatches(watches []ProcessWatch) error {
+	// every watch needs a unique name, at least one way to match processes and a valid regular expression
+	names := make(map[string]bool)
+	for _, w := range watches {
+		if w.Name == "" {
+			return fmt.Errorf("process watch without a name")
+		}
+		if names[w.Name] {
+			return fmt.Errorf("duplicate process watch %q", w.Name)
+		}
+		names[w.Name] = true
+
+		if w.Process == "" && w.Cmdline == "" && w.PIDFile == "" {
+			return fmt.Errorf("process watch %q needs process, cmdline or pidfile", w.Name)
+		}
+		if w.Cmdline != "" {
+			if _, err := regexp.Compile(w.Cmdline); err != nil {
+				return fmt.Errorf("process watch %q has an invalid cmdline regular expression, %v", w.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (c *processCollector) Name() string { return "process" }
+
+func (c *processCollector) Events() []Event {
+	// return and forget the events produced since the last call
+	output := c.events
+	c.events = nil
+	return output
+}
+
+func (c *processCollector) Collect() ([]Sample, error) {
+	processes, err := readProcesses(c.procDir)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	elapsed := now.Sub(c.lastScan).Seconds()
+	currentTicks := make(map[int]uint64)
+	var output []Sample
+
+	for i, w := range c.watches {
+		matched := c.match(i, processes)
+
+		var pids []int
+		var cpuPercent float64
+		var rss uint64
+		for _, p := range matched {
+			pids = append(pids, p.pid)
+			rss += p.rssBytes
+			currentTicks[p.pid] = p.cpuTicks
+			if last, ok := c.lastTicks[p.pid]; ok && !c.lastScan.IsZero() && p.cpuTicks >= last && elapsed > 0 {
+				cpuPercent += 100 * float64(p.cpuTicks-last) / clockTicks / elapsed
+			}
+		}
+		sort.Ints(pids)
+
+		c.checkTransitions(w.Name, c.lastPIDs[w.Name], pids, now)
+		c.lastPIDs[w.Name] = pids
+
+		up := 0.0
+		if len(pids) > 0 {
+			up = 1
+		}
+		labels := map[string]string{"watch": w.Name}
+		output = append(output,
+			Sample{Name: "process_up", Labels: labels, Value: up, Timestamp: now},
+			Sample{Name: "process_count", Labels: labels, Value: float64(len(pids)), Timestamp: now},
+			Sample{Name: "process_cpu_percent", Labels: labels, Value: cpuPercent, Timestamp: now},
+			Sample{Name: "process_rss_bytes", Labels: labels, Value: float64(rss), Timestamp: now},
+			Sample{Name: "process_restarts_total", Labels: labels, Value: float64(c.restarts[w.Name]), Timestamp: now})
+	}
+
+	c.lastTicks = currentTicks
+	c.lastScan = now
+	return output, nil
+}
+
+func (c *processCollector) match(index int, processes []processInfo) []processInfo {
+	// processes matching the watch at index, a process has to satisfy every matcher the watch has
+	w := c.watches[index]
+
+	pidFromFile := -1
+	if w.PIDFile != "" {
+		byteData, err := ioutil.ReadFile(w.PIDFile)
+		if err != nil {
+			return nil
+		}
+		pidFromFile, err = strconv.Atoi(strings.TrimSpace(string(byteData)))
+		if err != nil {
+			return nil
+		}
+	}
+
+	var output []processInfo
+	for _, p := range processes {
+		if pidFromFile != -1 && p.pid != pidFromFile {
+			continue
+		}
+		if w.Process != "" && p.comm != w.Process {
+			continue
+		}
+		if c.cmdlineRe[index] != nil && !c.cmdlineRe[index].MatchString(p.cmdline) {
+			continue
+		}
+		output = append(output, p)
+	}
+	return output
+}
+
+func (c *processCollector) checkTransitions(name string, oldPIDs, newPIDs []int, now time.Time) {
+	// count restarts and produce events when a watched process disappears or is replaced by a new PID
+	labels := map[string]string{"watch": name}
+
+	if len(oldPIDs) > 0 && len(newPIDs) == 0 {
+		c.events = append(c.events, Event{Type: "process_disappeared", Labels: labels, Timestamp: now,
+			Message: fmt.Sprintf("watched process %s is no longer running (last PIDs %v)", name, oldPIDs)})
+		return
+	}
+
+	if len(oldPIDs) == 0 {
+		return // first scan, or the process was not running before
+	}
+
+	// any PID that was not there before, while one of the old ones went away, is a restart
+	oldSet := make(map[int]bool)
+	for _, pid := range oldPIDs {
+		oldSet[pid] = true
+	}
+	var added []int
+	for _, pid := range newPIDs {
+		if !oldSet[pid] {
+			added = append(added, pid)
+		}
+		delete(oldSet, pid)
+	}
+	if len(added) > 0 && len(oldSet) > 0 {
+		c.restarts[name]++
+		c.events = append(c.events, Event{Type: "process_restarted", Labels: labels, Timestamp: now,
+			Message: fmt.Sprintf("watched process %s restarted, now running as PIDs %v", name, newPIDs)})
+	}
+}
+
+func readProcesses(procDir string) ([]processInfo, error) {
+	// read every process in procDir, processes exiting while being read are skipped
+	entries, err := ioutil.ReadDir(procDir)
+	if err != nil {
+		return nil, err
+	}
+
+	pageSize := uint64(os.Getpagesize())
+	var output []processInfo
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil || !entry.IsDir() {
+			continue
+		}
+		dir := filepath.Join(procDir, entry.Name())
+
+		stat, err := ioutil.ReadFile(filepath.Join(dir, "stat"))
+		if err != nil {
+			continue
+		}
+		p, err := parseProcStat(string(stat), pageSize)
+		if err != nil {
+			continue
+		}
+		p.pid = pid
+
+		// the command line is NUL separated, and empty for kernel threads
+		cmdline, _ := ioutil.ReadFile(filepath.Join(dir, "cmdline"))
+		p.cmdline = strings.TrimSpace(strings.ReplaceAll(string(cmdline), "\x00", " "))
+		output = append(output, p)
+	}
+
+	return output, nil
+}
+
+func parseProcStat(stat string, pageSize uint64) (processInfo, error) {
+	// parse /proc/<pid>/stat, the process name is in parentheses and may contain spaces
+	var p processInfo
+	open := strings.IndexByte(stat, '(')
+	close := strings.LastIndexByte(stat, ')')
+	if open == -1 || close < open {
+		return p, fmt.Errorf("unexpected format of stat")
+	}
+	p.comm = stat[open+1 : close]
+
+	// fields after the name start from the 3rd one (state), utime and stime are the 14th and 15th, rss the 24th
+	fields := strings.Fields(stat[close+1:])
+	if len(fields) < 22 {
+		return p, fmt.Errorf("unexpected number of fields in stat")
+	}
+	utime, _ := strconv.ParseUint(fields[11], 10, 64)
+	stime, _ := strconv.ParseUint(fields[12], 10, 64)
+	rss, _ := strconv.ParseUint(fields[21], 10, 64)
+	p.cpuTicks = utime + stime
+	p.rssBytes = rss * pageSize
+
+	return p, nil
+}
@@ -0,0 +1,179 @@
+// configuration pushed by the backend, applied on top of the local configuration while the reporter runs
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"time"
+)
+
+// RemoteConfig is the part of the configuration the backend can set, empty fields keep the local value
+type RemoteConfig struct {
+	CheckinInterval string            `json:"checkin_interval,omitempty"`
+	CollectInterval string            `json:"collect_interval,omitempty"`
+	Collectors      []string          `json:"collectors,omitempty"`
+	Checks          []CheckDefinition `json:"checks,omitempty"` // added to the local checks, replacing the ones with the same name
+}
+
+var localConf Config            // configuration as loaded at startup, remote configuration is always applied on top of it
+var appliedConfigVersion string // last configuration version received from the backend
+
+func mergeRemoteConfig(base Config, rc RemoteConfig) (Config, error) {
+	// apply the remote configuration on top of base
+	var err error
+	if rc.CheckinInterval != "" {
+		if base.CheckinInterval.Duration, err = time.ParseDuration(rc.CheckinInterval); err != nil {
+			return base, fmt.Errorf("checkin_interval: %v", err)
+		}
+	}
+	if rc.CollectInterval != "" {
+		if base.CollectInterval.Duration, err = time.ParseDuration(rc.CollectInterval); err != nil {
+			return base, fmt.Errorf("collect_interval: %v", err)
+		}
+	}
+	if rc.Collectors != nil {
+		base.Collectors = rc.Collectors
+	}
+
+	// the backend only picks among the executables the local configuration allows, it cannot run anything else on the device
+	for _, c := range rc.Checks {
+		if len(c.Command) == 0 {
+			continue // validateConfig reports it
+		}
+		allowed := false
+		for _, path := range base.RemoteCheckCommands {
+			allowed = allowed || path == c.Command[0]
+		}
+		if !allowed {
+			return base, fmt.Errorf("check %q runs %q, which is not in remote_check_commands", c.Name, c.Command[0])
+		}
+	}
+	if rc.Checks != nil {
+		replaced := make(map[string]bool)
+		for _, c := range rc.Checks {
+			replaced[c.Name] = true
+		}
+		var checks []CheckDefinition
+		for _, c := range base.Checks {
+			if !replaced[c.Name] {
+				checks = append(checks, c)
+			}
+		}
+		base.Checks = append(checks, rc.Checks...)
+	}
+
+	return base, validateConfig(base)
+}
+
+func applyRemoteConfig(ctx context.Context, version string, clientObj *http.Client) error {
+	// fetch the configuration from the backend, apply it to the running jobs and acknowledge it
+	reqBody := map[string]string{"key": getKey()}
+	requestJson, _ := json.Marshal(reqBody)
+	resp, err := endpoints.Post(ctx, clientObj, "/config", requestJson)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	var respBody struct {
+		Code          int          `json:"code"`
+		ConfigVersion string       `json:"config_version"`
+		Config        RemoteConfig `json:"config"`
+	}
+	err = json.Unmarshal(body, &respBody)
+	if err != nil || respBody.Code != 3000 {
+		return fmt.Errorf("failed to fetch configuration version %s, %s", version, string(body))
+	}
+
+	// a configuration that cannot be applied is reported, and not fetched again until its version changes
+	appliedConfigVersion = respBody.ConfigVersion
+	newConf, err := mergeRemoteConfig(localConf, respBody.Config)
+	if err != nil {
+		ackErr := ackRemoteConfig(ctx, respBody.ConfigVersion, err.Error(), clientObj)
+		if ackErr != nil {
+			logWarnf("Failed to report configuration error, %v\n", ackErr)
+		}
+		return fmt.Errorf("rejected configuration version %s, %v", respBody.ConfigVersion, err)
+	}
+
+	oldConf := getConf()
+	setConf(newConf)
+	scheduleJobs(oldConf, clientObj)
+	logInfof("Applied configuration version %s\n", respBody.ConfigVersion)
+
+	return ackRemoteConfig(ctx, respBody.ConfigVersion, "", clientObj)
+}
+
+func ackRemoteConfig(ctx context.Context, version, errorText string, clientObj *http.Client) error {
+	// let the backend know which configuration version is in use, or why it could not be used
+	reqBody := map[string]string{"key": getKey(), "config_version": version, "error": errorText}
+	requestJson, _ := json.Marshal(reqBody)
+	resp, err := endpoints.Post(ctx, clientObj, "/config/ack", requestJson)
+	if err != nil {
+		return err
+	}
+	return processDataResponse(resp)
+}
+
+func scheduleJobs(oldConf Config, clientObj *http.Client) {
+	// (re)schedule the jobs whose configuration differs from oldConf, and remove the checks that are gone
+	// jobs that did not change keep their schedule
+	conf := getConf()
+	if !scheduler.Has("checkin") || oldConf.CheckinInterval != conf.CheckinInterval {
+		scheduler.Replace(Job{Name: "checkin", Interval: conf.CheckinInterval.Duration, Run: func(ctx context.Context) error {
+			return checkinJob(ctx, clientObj)
+		}})
+	}
+
+	if batcher != nil && !scheduler.Has("batch") {
+		scheduler.Replace(Job{Name: "batch", Interval: conf.BatchWindow.Duration, Run: func(ctx context.Context) error {
+			return flushBatch(ctx, clientObj)
+		}})
+	}
+
+	collectorsChanged := oldConf.CollectInterval != conf.CollectInterval || !reflect.DeepEqual(oldConf.Collectors, conf.Collectors) ||
+		!reflect.DeepEqual(oldConf.ProcessWatches, conf.ProcessWatches)
+	if len(conf.Collectors) == 0 {
+		scheduler.Remove("collectors")
+	} else if !scheduler.Has("collectors") || collectorsChanged {
+		collectors := append(newCollectors(conf.Collectors), scheduler)
+		if buffer != nil {
+			collectors = append(collectors, buffer)
+		}
+		scheduler.Replace(Job{Name: "collectors", Interval: conf.CollectInterval.Duration, Run: func(ctx context.Context) error {
+			return collectorsJob(ctx, collectors, clientObj)
+		}})
+	}
+
+	oldChecks := make(map[string]CheckDefinition)
+	for _, def := range oldConf.Checks {
+		oldChecks[def.Name] = def
+	}
+	wanted := make(map[string]bool)
+	for _, def := range conf.Checks {
+		def := def
+		name := "check:" + def.Name
+		wanted[name] = true
+		if old, ok := oldChecks[def.Name]; ok && scheduler.Has(name) && reflect.DeepEqual(old, def) {
+			continue
+		}
+		scheduler.Replace(Job{Name: name, Interval: def.Interval.Duration, Timeout: def.Timeout.Duration + conf.ClientTimeout.Duration,
+			Run: func(ctx context.Context) error {
+				return checkJob(ctx, def, clientObj)
+			}})
+	}
+	for _, name := range scheduler.Names() {
+		if len(name) > 6 && name[:6] == "check:" && !wanted[name] {
+			scheduler.Remove(name)
+		}
+	}
+}
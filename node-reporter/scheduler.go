@@ -0,0 +1,245 @@
+// runs check-ins, collectors and checks, each on its own interval
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Job is something the scheduler runs periodically
+type Job struct {
+	Name     string                          // unique name of the job
+	Interval time.Duration                   // time between the start of two runs
+	Timeout  time.Duration                   // the context passed to Run is cancelled after this long, the interval if zero
+	Run      func(ctx context.Context) error // work to do, it should return once its context is cancelled
+}
+
+// jobState keeps track of the runs of a job
+type jobState struct {
+	job      Job
+	running  bool               // whether a run is in progress, a job never runs twice at the same time
+	runs     uint64             // runs started
+	failures uint64             // runs that returned an error
+	skipped  uint64             // runs not started because the previous one was still in progress
+	missed   uint64             // runs not started because the scheduler itself was late, e.g. after a suspend
+	lastRun  time.Time          // start of the last run
+	cancel   context.CancelFunc // stops the schedule of the job
+}
+
+// Scheduler runs jobs on their intervals, with jitter, until its context is cancelled
+type Scheduler struct {
+	mutex  sync.Mutex
+	ctx    context.Context // set once started, jobs added afterwards start right away
+	jitter time.Duration   // every run is delayed by a random amount up to this
+	jobs   map[string]*jobState
+	order  []string       // job names, in the order they were added
+	loops  sync.WaitGroup // one per job, running its schedule
+	runs   sync.WaitGroup // one per run in progress
+}
+
+func newScheduler(jitter time.Duration) *Scheduler {
+	return &Scheduler{jitter: jitter, jobs: make(map[string]*jobState)}
+}
+
+func (s *Scheduler) Add(job Job) error {
+	// add a job, it starts running once the scheduler is started, or right away if it already is
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, ok := s.jobs[job.Name]; ok {
+		return fmt.Errorf("job %s already scheduled", job.Name)
+	}
+	if job.Interval <= 0 {
+		return fmt.Errorf("job %s needs a positive interval", job.Name)
+	}
+	// a timeout may be longer than the interval, e.g. a check timeout plus the time to send its result,
+	// runs never overlap anyway, the ones due while the job is still running are skipped
+	if job.Timeout < 0 {
+		return fmt.Errorf("job %s has a negative timeout", job.Name)
+	}
+	if job.Timeout == 0 {
+		job.Timeout = job.Interval
+	}
+
+	s.jobs[job.Name] = &jobState{job: job}
+	s.order = append(s.order, job.Name)
+	if s.ctx != nil {
+		s.startLoop(s.jobs[job.Name])
+	}
+	return nil
+}
+
+func (s *Scheduler) Remove(name string) {
+	// stop scheduling a job, a run in progress is left to finish
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	state, ok := s.jobs[name]
+	if !ok {
+		return
+	}
+	if state.cancel != nil {
+		state.cancel()
+	}
+	delete(s.jobs, name)
+	for i, n := range s.order {
+		if n == name {
+			s.order = append(s.order[:i], s.order[i+1:]...)
+			break
+		}
+	}
+}
+
+func (s *Scheduler) Replace(job Job) error {
+	// replace a job with a new definition, or add it if there was none with its name
+	s.Remove(job.Name)
+	return s.Add(job)
+}
+
+func (s *Scheduler) Has(name string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	_, ok := s.jobs[name]
+	return ok
+}
+
+func (s *Scheduler) Names() []string {
+	// names of the scheduled jobs, in the order they were added
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]string{}, s.order...)
+}
+
+func (s *Scheduler) Start(ctx context.Context) {
+	// start every job, the first run of each one happens after a random delay up to the jitter
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.ctx = ctx
+	for _, name := range s.order {
+		s.startLoop(s.jobs[name])
+	}
+}
+
+func (s *Scheduler) startLoop(state *jobState) {
+	// start the schedule of a job, the caller holds the mutex
+	var loopCtx context.Context
+	loopCtx, state.cancel = context.WithCancel(s.ctx)
+	s.loops.Add(1)
+	go s.loop(loopCtx, state)
+}
+
+func (s *Scheduler) Wait(timeout time.Duration) {
+	// wait for the schedules to stop and the runs in progress to finish, for at most timeout
+	done := make(chan struct{})
+	go func() {
+		s.loops.Wait()
+		s.runs.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		log.Printf("Jobs still running after %v, not waiting for them any longer\n", timeout)
+	}
+}
+
+func (s *Scheduler) loop(ctx context.Context, state *jobState) {
+	// run a job every interval, starting from now plus some jitter
+	defer s.loops.Done()
+	interval := state.job.Interval
+	next := time.Now().Add(s.randomJitter())
+
+	for {
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		// if the scheduler woke up more than an interval late, those runs were missed, they are not made up for
+		now := time.Now()
+		if late := now.Sub(next); late >= interval {
+			missed := uint64(late / interval)
+			s.mutex.Lock()
+			state.missed += missed
+			s.mutex.Unlock()
+			logWarnf("Job %s missed %d runs\n", state.job.Name, missed)
+			next = next.Add(time.Duration(missed) * interval)
+		}
+
+		s.start(state)
+		next = next.Add(interval)
+	}
+}
+
+func (s *Scheduler) start(state *jobState) {
+	// start a run of the job, unless the previous one is still in progress
+	// runs are tied to the scheduler rather than to the schedule of the job, so a job can replace itself
+	s.mutex.Lock()
+	if state.running {
+		state.skipped++
+		s.mutex.Unlock()
+		logWarnf("Job %s is still running, skipping this run\n", state.job.Name)
+		return
+	}
+	state.running = true
+	state.runs++
+	state.lastRun = time.Now()
+	s.mutex.Unlock()
+
+	s.runs.Add(1)
+	go func() {
+		defer s.runs.Done()
+		runCtx, cancel := context.WithTimeout(s.ctx, state.job.Timeout)
+		err := state.job.Run(runCtx)
+		cancel()
+
+		s.mutex.Lock()
+		state.running = false
+		if err != nil {
+			state.failures++
+		}
+		s.mutex.Unlock()
+
+		if err != nil {
+			log.Printf("Job %s failed, %v\n", state.job.Name, err)
+		}
+	}()
+}
+
+func (s *Scheduler) randomJitter() time.Duration {
+	if s.jitter <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(s.jitter)))
+}
+
+// the scheduler is also a collector, reporting how its jobs are doing
+func (s *Scheduler) Name() string { return "scheduler" }
+
+func (s *Scheduler) Collect() ([]Sample, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now()
+	var output []Sample
+	for _, name := range s.order {
+		state := s.jobs[name]
+		labels := map[string]string{"job": name}
+		output = append(output,
+			Sample{Name: "scheduler_runs_total", Labels: labels, Value: float64(state.runs), Timestamp: now},
+			Sample{Name: "scheduler_failures_total", Labels: labels, Value: float64(state.failures), Timestamp: now},
+			Sample{Name: "scheduler_skipped_total", Labels: labels, Value: float64(state.skipped), Timestamp: now},
+			Sample{Name: "scheduler_missed_total", Labels: labels, Value: float64(state.missed), Timestamp: now})
+	}
+	return output, nil
+}
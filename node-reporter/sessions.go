@@ -0,0 +1,113 @@
+// persistent session with the backend over WebSocket
+// while it is open the backend pushes commands and configuration changes through it and HTTP check-ins are skipped
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+var sessionActive atomic.Bool // whether a session with the backend is open
+
+const sessionReadTimeout = 60 * time.Second // the backend pings every 20s, a silent session is considered dropped
+const sessionRetryMin = 1 * time.Second     // delay before reconnecting after a session drops, doubled every failure
+const sessionRetryMax = 1 * time.Minute
+
+func sessionLoop(ctx context.Context, clientObj *http.Client) {
+	// keep a session open with the backend until ctx is done, reconnecting when it drops
+	delay := sessionRetryMin
+	for {
+		connected, err := runSession(ctx, clientObj)
+		sessionActive.Store(false)
+		if ctx.Err() != nil {
+			return
+		}
+		if connected {
+			delay = sessionRetryMin
+		}
+		logWarnf("Session with %s is not open, %v, using HTTP check-ins\n", endpoints.Current(), err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		delay *= 2
+		if delay > sessionRetryMax {
+			delay = sessionRetryMax
+		}
+	}
+}
+
+func runSession(ctx context.Context, clientObj *http.Client) (bool, error) {
+	// open a session with the endpoint in use and process what the backend pushes until it drops
+	// return whether the session was opened at all
+	u, err := url.Parse(endpoints.Current())
+	if err != nil {
+		return false, err
+	}
+	if u.Scheme == "https" {
+		u.Scheme = "wss"
+	} else {
+		u.Scheme = "ws"
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/session"
+
+	dialer := websocket.Dialer{Proxy: http.ProxyFromEnvironment, HandshakeTimeout: getConf().ClientTimeout.Duration}
+	if transport, ok := clientObj.Transport.(*http.Transport); ok {
+		dialer.TLSClientConfig = transport.TLSClientConfig
+	}
+	header := http.Header{"Authorization": []string{"Bearer " + getKey()}}
+	conn, resp, err := dialer.DialContext(ctx, u.String(), header)
+	if err != nil {
+		if resp != nil {
+			resp.Body.Close()
+			return false, fmt.Errorf("%v, HTTP %d", err, resp.StatusCode)
+		}
+		return false, err
+	}
+	defer conn.Close()
+
+	// closing the connection is the only way to interrupt a read in progress
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	sessionActive.Store(true)
+	logInfof("Session open with %s\n", u.String())
+	conn.SetReadDeadline(time.Now().Add(sessionReadTimeout))
+	conn.SetPingHandler(func(data string) error {
+		conn.SetReadDeadline(time.Now().Add(sessionReadTimeout))
+		return conn.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(getConf().ClientTimeout.Duration))
+	})
+
+	for {
+		_, body, err := conn.ReadMessage()
+		if err != nil {
+			return true, err
+		}
+		conn.SetReadDeadline(time.Now().Add(sessionReadTimeout))
+		logDebugf("Session message: %s\n", string(body))
+
+		// messages are check-in responses, a bad key ends the session and the HTTP check-in registers again
+		configVersion, commands, err := parseCheckinResponse(body)
+		if err != nil {
+			return true, err
+		}
+		handleCheckinResponse(ctx, configVersion, commands, clientObj)
+	}
+}
@@ -0,0 +1,53 @@
+// keeps what the node reporter obtained from the backend across restarts
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// State is persisted to the state file after registration
+type State struct {
+	Key       string `json:"key"`        // key obtained from the backend
+	Name      string `json:"name"`       // name the key was obtained with
+	Mac       string `json:"mac"`        // MAC address the key was obtained with
+	MachineID string `json:"machine_id"` // machine identifier the key was obtained with
+}
+
+func loadState(fileLoc string) (State, error) {
+	// read state from fileLoc, a missing file is not an error and results in an empty state
+	var state State
+	byteData, err := ioutil.ReadFile(fileLoc)
+	if os.IsNotExist(err) {
+		return state, nil
+	} else if err != nil {
+		return state, err
+	}
+
+	err = json.Unmarshal(byteData, &state)
+	return state, err
+}
+
+func saveState(fileLoc string, state State) error {
+	// write state to fileLoc, going through a temporary file so a crash cannot leave it half written
+	jsonData, err := json.MarshalIndent(state, "", "    ")
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(fileLoc), 0700)
+	if err != nil {
+		return err
+	}
+
+	tmpFile := fileLoc + ".tmp"
+	err = ioutil.WriteFile(tmpFile, jsonData, 0600)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmpFile, fileLoc)
+}
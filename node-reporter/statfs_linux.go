@@ -0,0 +1,15 @@
+package main
+
+import "syscall"
+
+func statFilesystem(path string) (total, free, avail, files, filesFree uint64, err error) {
+	// sizes of the filesystem mounted at path, in bytes
+	var st syscall.Statfs_t
+	err = syscall.Statfs(path, &st)
+	if err != nil {
+		return
+	}
+
+	blockSize := uint64(st.Bsize)
+	return st.Blocks * blockSize, st.Bfree * blockSize, st.Bavail * blockSize, st.Files, st.Ffree, nil
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+
+package main
+
+import "fmt"
+
+func statFilesystem(path string) (total, free, avail, files, filesFree uint64, err error) {
+	// the filesystem collector reads /proc/self/mounts, which only exists on Linux
+	err = fmt.Errorf("filesystem statistics are only supported on Linux")
+	return
+}